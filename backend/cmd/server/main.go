@@ -6,25 +6,30 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"agri-track/internal/db"
+	"agri-track/internal/dispatch"
+	"agri-track/internal/events"
+	"agri-track/internal/gazetteer"
 	"agri-track/internal/handlers"
 	"agri-track/internal/middleware"
+	"agri-track/internal/models"
+	"agri-track/internal/notify"
+	"agri-track/internal/pickupcode"
+	"agri-track/internal/ratelimit"
+	"agri-track/internal/roads"
+	"agri-track/internal/sms"
+	"agri-track/internal/webhook"
 
 	// "agri-track/internal/simulator"
 
-	"math/rand"
-
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
 func main() {
 	// Load .env file
 	if err := godotenv.Load(); err != nil {
@@ -41,44 +46,241 @@ func main() {
 		log.Fatalf("Failed to initialize database schema: %v", err)
 	}
 
+	// Bootstrap the first admin account
+	if email := os.Getenv("ADMIN_EMAIL"); email != "" {
+		if err := db.SeedAdmin(db.Pool, email, os.Getenv("ADMIN_PASSWORD")); err != nil {
+			log.Fatalf("Failed to seed admin: %v", err)
+		}
+	}
+
+	// Without an OpenStreetMap extract, routes are estimated from straight lines
+	roadNetwork, err := roads.FromEnv(context.Background())
+	if err != nil {
+		log.Fatalf("Invalid road network: %v", err)
+	}
+
+	// Without GAZETTEER_DIR, places are named from the bundled gazetteer
+	places, err := gazetteer.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid gazetteer: %v", err)
+	}
+
 	// Initialize Handlers
-	telemetryHandler := handlers.NewTelemetryHandler()
-	queryHandler := handlers.NewQueryHandler()
-	authHandler := handlers.NewAuthHandler()
-	shipmentHandler := handlers.NewShipmentHandler()
+	telemetryHandler := handlers.NewTelemetryHandler(roadNetwork, places)
+	queryHandler := handlers.NewQueryHandler(places)
+	// Without SMS_API_KEY, only SMS_FAKE lets the server start, keeping texts in memory
+	smsSender, err := sms.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid SMS gateway: %v", err)
+	}
+
+	// Rate limiter state is kept in memory, limits are per instance
+	limiterStore := ratelimit.NewMemoryStore()
+	loginLockout := ratelimit.NewLockout(limiterStore, 5, 15*time.Minute, 15*time.Minute)
+	accountLockout := ratelimit.NewLockout(limiterStore, 20, time.Hour, 15*time.Minute)
+	pickupLockout := ratelimit.NewLockout(limiterStore, 5, 15*time.Minute, 30*time.Minute)
+
+	pickupCodes, err := pickupcode.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid pickup code config: %v", err)
+	}
+
+	authHandler := handlers.NewAuthHandler(smsSender, loginLockout, accountLockout)
+	dispatchHandler := handlers.NewDispatchHandler(dispatch.DefaultConfig)
+	shipmentHandler := handlers.NewShipmentHandler(pickupLockout, pickupCodes, dispatchHandler, roadNetwork, places)
+	routeHandler := handlers.NewRouteHandler(shipmentHandler, roadNetwork)
+	ussdHandler := handlers.NewUSSDHandler(shipmentHandler, os.Getenv("USSD_CALLBACK_TOKEN"))
+	smsCommandHandler := handlers.NewSMSCommandHandler(shipmentHandler, telemetryHandler, smsSender, os.Getenv("SMS_CALLBACK_TOKEN"))
 	dashboardHandler := handlers.NewDashboardHandler()
+	metricsHandler := handlers.NewMetricsHandler(telemetryHandler, os.Getenv("METRICS_TOKEN"))
+	analyticsHandler := handlers.NewAnalyticsHandler()
+	slaHandler := handlers.NewSLAHandler(roadNetwork)
+	reportHandler := handlers.NewReportHandler()
+	adminHandler := handlers.NewAdminHandler()
+	orgHandler := handlers.NewOrgHandler()
+	fleetHandler := handlers.NewFleetHandler()
+	loadBoardHandler := handlers.NewLoadBoardHandler(roadNetwork)
+	bidHandler := handlers.NewBidHandler()
+	// Without SMTP_ADDR, email is written to the log
+	notificationHandler := handlers.NewNotificationHandler(notify.Drivers{
+		notify.SMS:   notify.SMSDriver{Sender: smsSender},
+		notify.Email: notify.EmailFromEnv(),
+		notify.InApp: handlers.Inbox{},
+	})
+	webhookHandler := handlers.NewWebhookHandler(webhook.DefaultConfig)
+
+	// Side effects of domain events, handed over from the outbox once committed
+	eventBus := events.NewBus(db.Pool)
+	eventBus.Subscribe("webhooks", webhookHandler.QueueDeliveries, webhook.EventTypes...)
+	eventBus.Subscribe("notifications", notificationHandler.NotifyShipper, notify.Kinds()...)
+	eventBus.Subscribe("sla", slaHandler.TrackShipment, events.ShipmentPickedUp, events.ShipmentDelivered)
 
 	// Start Batch Processor
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	go telemetryHandler.StartBatchProcessor(ctx)
+	go limiterStore.StartCleanup(ctx, time.Minute)
+	go bidHandler.StartExpirySweeper(ctx, time.Minute)
+	go dispatchHandler.StartOfferSweeper(ctx, 15*time.Second)
+	go eventBus.Run(ctx, time.Second)
+	go webhookHandler.StartDeliveryWorker(ctx, 5*time.Second)
+	go notificationHandler.StartSender(ctx, 5*time.Second)
+	go reportHandler.StartScheduler(ctx, time.Minute)
+	go slaHandler.StartMonitor(ctx, time.Minute)
 
 	// Setup Router
-	r := gin.Default()
+	// gin.Default, without the callback tokens in the log
+	r := gin.New()
+	r.Use(middleware.Logger("token"), gin.Recovery())
+	// Only trust X-Forwarded-For from known proxies, otherwise clients could pick their own IP
+	var trustedProxies []string
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		trustedProxies = strings.Split(proxies, ",")
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	r.Use(middleware.Metrics())
 	r.Use(middleware.CORSMiddleware())
+	r.Use(middleware.RateLimit(limiterStore, ratelimit.Every(50*time.Millisecond, 100), middleware.ByIP("global")))
 
 	// Public Routes
-	r.POST("/login", authHandler.Login)
-	r.POST("/register", authHandler.Register)
-	r.GET("/status", queryHandler.GetTruckStatus)
-	r.GET("/api/simulate/demo", telemetryHandler.SimulateDemo) // Added Demo Trigger
+	authLimit := middleware.RateLimit(limiterStore, ratelimit.Every(6*time.Second, 10), middleware.ByIP("auth"))
+	r.POST("/login", authLimit, authHandler.Login)
+	r.POST("/register", authLimit, authHandler.Register)
+	r.POST("/otp/request", authLimit, authHandler.RequestOTP)
+	r.POST("/otp/verify", authLimit, authHandler.VerifyOTP)
+	// Called by the USSD and SMS gateways, which authenticate with a token in the URL the logger leaves out
+	r.POST("/ussd", ussdHandler.Callback)
+	r.POST("/sms/inbound", smsCommandHandler.Inbound)
+	// Scraped by Prometheus with METRICS_TOKEN as a bearer token, not found without it
+	r.GET("/metrics", metricsHandler.Serve)
 
 	// Protected Routes
+	// Owners and dispatchers manage the fleet and decide who carries shipments,
+	// everyone in the organization can view
+	fleetRole := middleware.RequireOrgRole(models.OrgRoleOwner, models.OrgRoleDispatcher)
+
 	api := r.Group("/api")
 	api.Use(middleware.AuthMiddleware())
+	api.Use(middleware.OrgMiddleware())
+	api.Use(middleware.RateLimit(limiterStore, ratelimit.Every(100*time.Millisecond, 50), middleware.ByUser("api")))
 	{
+		api.GET("/status", queryHandler.GetTruckStatus)
+		api.GET("/simulate/demo", telemetryHandler.SimulateDemo) // Added Demo Trigger
+		api.GET("/orgs", orgHandler.ListMyOrgs)
+		api.PUT("/org", middleware.RequireOrgRole(models.OrgRoleOwner), orgHandler.UpdateSettings)
+		api.POST("/orgs", orgHandler.CreateOrg)
+		api.GET("/org/members", orgHandler.ListMembers)
+		api.POST("/org/members", middleware.RequireOrgRole(models.OrgRoleOwner), orgHandler.AddMember)
+		api.PUT("/org/members/:user_id", middleware.RequireOrgRole(models.OrgRoleOwner), orgHandler.UpdateMember)
+		api.PUT("/org/members/:user_id/account-role", middleware.RequireOrgRole(models.OrgRoleOwner), orgHandler.UpdateAccountRole)
+		api.DELETE("/org/members/:user_id", middleware.RequireOrgRole(models.OrgRoleOwner), orgHandler.RemoveMember)
+		api.GET("/invitations", orgHandler.ListInvitations)
+		api.POST("/invitations/:id/accept", orgHandler.AcceptInvitation)
+		api.POST("/invitations/:id/decline", orgHandler.DeclineInvitation)
+		api.GET("/locations", orgHandler.ListLocations)
+		api.POST("/locations", orgHandler.CreateLocation)
+		api.DELETE("/locations/:id", middleware.RequireOrgRole(models.OrgRoleOwner, models.OrgRoleDispatcher), orgHandler.DeleteLocation)
+		api.GET("/fleet/trucks", fleetHandler.ListTrucks)
+		api.GET("/fleet/trucks/:id", fleetHandler.GetTruck)
+		api.GET("/fleet/trucks/:id/assignments", fleetHandler.TruckAssignments)
+		api.GET("/fleet/trucks/:id/capacity", fleetHandler.TruckCapacity)
+		api.POST("/fleet/trucks", fleetRole, fleetHandler.CreateTruck)
+		api.PUT("/fleet/trucks/:id", fleetRole, fleetHandler.UpdateTruck)
+		api.DELETE("/fleet/trucks/:id", fleetRole, fleetHandler.RetireTruck)
+		api.POST("/fleet/trucks/:id/assign", fleetRole, fleetHandler.AssignDriver)
+		api.POST("/fleet/trucks/:id/unassign", fleetRole, fleetHandler.UnassignTruck)
+		api.GET("/fleet/drivers", fleetHandler.ListDrivers)
+		api.GET("/fleet/drivers/:id/assignments", fleetHandler.DriverAssignments)
+		api.POST("/fleet/drivers", fleetRole, fleetHandler.CreateDriver)
+		api.PUT("/fleet/drivers/:id", fleetRole, fleetHandler.UpdateDriver)
+		api.GET("/fleet/me", fleetHandler.MyTruck)
+		api.GET("/loadboard", loadBoardHandler.ListOpenShipments)
+		api.POST("/loadboard/:id/claim", loadBoardHandler.ClaimShipment)
+		api.GET("/loadboard/claims", loadBoardHandler.MyClaims)
+		api.DELETE("/loadboard/claims/:id", loadBoardHandler.WithdrawClaim)
+		api.GET("/shipments/:id/claims", loadBoardHandler.ListClaims)
+		api.POST("/shipments/:id/claims/:claim_id/accept", fleetRole, loadBoardHandler.AcceptClaim)
+		api.POST("/shipments/:id/claims/:claim_id/reject", fleetRole, loadBoardHandler.RejectClaim)
+
+		api.POST("/shipments/:id/bids", bidHandler.PlaceBid)
+		api.GET("/shipments/:id/bids", bidHandler.ListShipmentBids)
+		api.GET("/bids", bidHandler.MyBids)
+		api.POST("/bids/:id/counter", bidHandler.CounterBid)
+		api.POST("/bids/:id/accept", bidHandler.AcceptBid)
+		api.POST("/bids/:id/reject", bidHandler.RejectBid)
+		api.POST("/bids/:id/withdraw", bidHandler.WithdrawBid)
+
+		api.POST("/shipments/:id/dispatch", fleetRole, dispatchHandler.StartDispatch)
+		api.GET("/dispatch/offers", dispatchHandler.MyOffers)
+		api.POST("/dispatch/offers/:id/accept", dispatchHandler.AcceptOffer)
+		api.POST("/dispatch/offers/:id/decline", dispatchHandler.DeclineOffer)
+
+		api.GET("/routes/directions", routeHandler.Directions)
+		api.GET("/geocode/reverse", queryHandler.ReverseGeocode)
+		api.POST("/routes/plan", fleetRole, routeHandler.PlanRoutes)
+		api.POST("/routes/commit", fleetRole, routeHandler.CommitRoutes)
+
+		api.GET("/notifications", notificationHandler.ListNotifications)
+		api.POST("/notifications/read", notificationHandler.MarkRead)
+		api.GET("/notifications/preferences", notificationHandler.GetPreferences)
+		api.PUT("/notifications/preferences", notificationHandler.UpdatePreferences)
+		api.POST("/notifications/:id/read", notificationHandler.MarkRead)
+
+		ownerRole := middleware.RequireOrgRole(models.OrgRoleOwner)
+		api.GET("/webhooks", ownerRole, webhookHandler.ListSubscriptions)
+		api.POST("/webhooks", ownerRole, webhookHandler.CreateSubscription)
+		api.DELETE("/webhooks/:id", ownerRole, webhookHandler.DeleteSubscription)
+		api.GET("/webhooks/:id/deliveries", ownerRole, webhookHandler.ListDeliveries)
+		api.GET("/webhooks/:id/deliveries/:delivery_id", ownerRole, webhookHandler.GetDelivery)
+		api.POST("/webhooks/:id/deliveries/:delivery_id/redeliver", ownerRole, webhookHandler.Redeliver)
+		api.POST("/account/phone", authHandler.AttachPhone)
+		api.POST("/account/email", authHandler.AttachEmail)
 		api.POST("/shipments", shipmentHandler.CreateShipment)
-		api.POST("/shipments/pickup", shipmentHandler.PickupShipment)
+		api.POST("/shipments/pickup", middleware.RateLimit(limiterStore, ratelimit.Every(10*time.Second, 5), middleware.ByUser("pickup")), shipmentHandler.PickupShipment)
 		api.POST("/shipments/start", shipmentHandler.StartShipment)
+		api.POST("/shipments/:id/pickup-code", shipmentHandler.RegeneratePickupCode)
 		api.POST("/handshake", shipmentHandler.Handshake)
 		api.POST("/shipments/complete", shipmentHandler.CompleteShipment)
 		api.POST("/shipments/verify", shipmentHandler.VerifyArrival) // Added
+		api.GET("/shipments/:id/stops", shipmentHandler.ListStops)
+		api.POST("/shipments/:id/stops/:seq/complete", shipmentHandler.CompleteStop)
+		api.GET("/shipments/:id/track", telemetryHandler.GetTrack)
+		api.POST("/shipments/:id/track/match", fleetRole, telemetryHandler.MatchTrack)
 		api.POST("/telemetry", telemetryHandler.ReceiveTelemetry)
 		api.POST("/telemetry/incident", telemetryHandler.ReportIncident)
 		api.GET("/incidents", telemetryHandler.GetRecentIncidents)
 		api.GET("/incidents/all", telemetryHandler.GetAllIncidents) // Added for Heatmap
 		api.GET("/shipments/active", shipmentHandler.GetActiveShipments)
 		api.GET("/dashboard/summary", dashboardHandler.GetSummary)
+		api.GET("/dashboard/late-risk", slaHandler.LateRisk)
+		api.GET("/analytics/deliveries", analyticsHandler.Deliveries)
+		api.GET("/analytics/active-trucks", analyticsHandler.ActiveTrucks)
+		api.GET("/analytics/incidents", analyticsHandler.Incidents)
+		api.GET("/analytics/corridors", analyticsHandler.CorridorSpeeds)
+		api.GET("/reports/fleet", reportHandler.GetFleetReport)
+		api.GET("/shipments/:id/report", reportHandler.GetTripReport)
+		api.GET("/reports/schedules", reportHandler.ListSchedules)
+		api.POST("/reports/schedules", fleetRole, reportHandler.CreateSchedule)
+		api.DELETE("/reports/schedules/:id", fleetRole, reportHandler.DeleteSchedule)
+		api.GET("/reports/archive", reportHandler.ListArchive)
+		api.GET("/reports/archive/:id", reportHandler.GetArchived)
+		api.GET("/sla/policies", slaHandler.ListPolicies)
+		api.POST("/sla/policies", fleetRole, slaHandler.CreatePolicy)
+		api.DELETE("/sla/policies/:id", fleetRole, slaHandler.DeletePolicy)
+	}
+
+	// Admin Routes
+	admin := api.Group("/admin")
+	admin.Use(middleware.RequireRole(models.RoleAdmin))
+	{
+		admin.GET("/users", adminHandler.ListUsers)
+		admin.POST("/users/:id/suspend", adminHandler.SuspendUser)
+		admin.POST("/users/:id/reactivate", adminHandler.ReactivateUser)
+		admin.PUT("/users/:id/role", adminHandler.ChangeRole)
+		admin.DELETE("/users/:id", adminHandler.DeleteUser)
+		admin.GET("/audit", adminHandler.GetAuditLog)
 	}
 
 	// Server Setup
@@ -2,10 +2,15 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"time"
 
+	"agri-track/internal/utils"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -44,6 +49,17 @@ func ConnectDB() error {
 	return nil
 }
 
+// personalOrgBackfill gives every user without an organization a personal one
+const personalOrgBackfill = `
+	WITH missing AS (
+		SELECT u.id AS user_id, gen_random_uuid()::text AS org_id, COALESCE(u.name, u.email, u.phone, 'Personal') AS name
+		FROM users u
+		WHERE NOT EXISTS (SELECT 1 FROM org_members m WHERE m.user_id = u.id)
+	), orgs AS (
+		INSERT INTO organizations (id, name, kind) SELECT org_id, name, 'individual' FROM missing
+	)
+	INSERT INTO org_members (org_id, user_id, role) SELECT org_id, user_id, 'owner' FROM missing;`
+
 func InitDB(pool *pgxpool.Pool) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -107,6 +123,303 @@ func InitDB(pool *pgxpool.Pool) error {
 			description TEXT,
 			severity INT CHECK (severity >= 1 AND severity <= 5)
 		);`,
+		// One-time login codes sent by SMS
+		`CREATE TABLE IF NOT EXISTS otp_codes (
+			id SERIAL PRIMARY KEY,
+			phone TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			consumed_at TIMESTAMPTZ
+		);`,
+		`CREATE INDEX IF NOT EXISTS otp_codes_phone_idx ON otp_codes (phone, created_at DESC);`,
+		// Admin actions on user accounts
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id SERIAL PRIMARY KEY,
+			time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			actor_id TEXT NOT NULL,
+			action TEXT NOT NULL, -- 'user.suspend', 'user.reactivate', 'user.role_change', 'user.delete'
+			target_id TEXT NOT NULL,
+			details JSONB
+		);`,
+		// Organizations: cooperatives, haulage companies, and a personal one per user
+		`CREATE TABLE IF NOT EXISTS organizations (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL DEFAULT 'individual' CHECK (kind IN ('individual', 'cooperative', 'haulage')),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE TABLE IF NOT EXISTS org_members (
+			org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			role TEXT NOT NULL CHECK (role IN ('owner', 'dispatcher', 'member')),
+			joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (org_id, user_id)
+		);`,
+		`CREATE INDEX IF NOT EXISTS org_members_user_idx ON org_members (user_id);`,
+		// Accounts are only added to an organization once they accept
+		`CREATE TABLE IF NOT EXISTS org_invitations (
+			id SERIAL PRIMARY KEY,
+			org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			role TEXT NOT NULL CHECK (role IN ('owner', 'dispatcher', 'member')),
+			invited_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+			status TEXT NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'ACCEPTED', 'DECLINED')),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			decided_at TIMESTAMPTZ
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS org_invitations_pending_idx ON org_invitations (org_id, user_id) WHERE status = 'PENDING';`,
+		`CREATE INDEX IF NOT EXISTS org_invitations_user_idx ON org_invitations (user_id);`,
+		// Saved pickup and drop-off points
+		`CREATE TABLE IF NOT EXISTS locations (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			latitude DOUBLE PRECISION NOT NULL,
+			longitude DOUBLE PRECISION NOT NULL,
+			created_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		// Driver profiles, separate from accounts and from trucks
+		`CREATE TABLE IF NOT EXISTS drivers (
+			user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			full_name TEXT NOT NULL,
+			license_number TEXT,
+			phone TEXT,
+			status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'inactive')),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE INDEX IF NOT EXISTS drivers_org_idx ON drivers (org_id);`,
+		// Which driver drove which truck, and when. Open rows have no unassigned_at.
+		`CREATE TABLE IF NOT EXISTS truck_assignments (
+			id SERIAL PRIMARY KEY,
+			truck_id TEXT NOT NULL REFERENCES trucks(id) ON DELETE CASCADE,
+			driver_id TEXT NOT NULL REFERENCES drivers(user_id) ON DELETE CASCADE,
+			assigned_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+			assigned_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			unassigned_at TIMESTAMPTZ
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS truck_assignments_open_truck_idx ON truck_assignments (truck_id) WHERE unassigned_at IS NULL;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS truck_assignments_open_driver_idx ON truck_assignments (driver_id) WHERE unassigned_at IS NULL;`,
+		// Drivers asking for open shipments from the load board
+		`CREATE TABLE IF NOT EXISTS shipment_claims (
+			id SERIAL PRIMARY KEY,
+			shipment_id TEXT NOT NULL REFERENCES shipments(id) ON DELETE CASCADE,
+			driver_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			truck_id TEXT NOT NULL REFERENCES trucks(id),
+			message TEXT,
+			status TEXT NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'ACCEPTED', 'REJECTED', 'WITHDRAWN')),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			decided_at TIMESTAMPTZ
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS shipment_claims_pending_idx ON shipment_claims (shipment_id, driver_id) WHERE status = 'PENDING';`,
+		`CREATE INDEX IF NOT EXISTS shipment_claims_driver_idx ON shipment_claims (driver_id, created_at DESC);`,
+		// Freight bids. A counter-offer is a new bid pointing at the one it answers.
+		`CREATE TABLE IF NOT EXISTS bids (
+			id SERIAL PRIMARY KEY,
+			shipment_id TEXT NOT NULL REFERENCES shipments(id) ON DELETE CASCADE,
+			parent_bid_id INT REFERENCES bids(id),
+			bidder_org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE, -- The carrier
+			truck_id TEXT NOT NULL REFERENCES trucks(id),
+			created_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+			side TEXT NOT NULL CHECK (side IN ('carrier', 'shipper')), -- Who made this offer
+			price DOUBLE PRECISION NOT NULL CHECK (price > 0),
+			eta_minutes INT, -- Time for the truck to reach the pickup
+			note TEXT,
+			status TEXT NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'COUNTERED', 'ACCEPTED', 'REJECTED', 'EXPIRED', 'WITHDRAWN')),
+			expires_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			decided_at TIMESTAMPTZ
+		);`,
+		`CREATE INDEX IF NOT EXISTS bids_shipment_idx ON bids (shipment_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS bids_pending_idx ON bids (expires_at) WHERE status = 'PENDING';`,
+		// In-app notification inbox
+		`CREATE TABLE IF NOT EXISTS user_notifications (
+			id SERIAL PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			kind TEXT NOT NULL, -- e.g. 'bid.received', 'bid.accepted'
+			title TEXT NOT NULL,
+			body TEXT NOT NULL,
+			data JSONB,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			read_at TIMESTAMPTZ
+		);`,
+		`CREATE INDEX IF NOT EXISTS user_notifications_user_idx ON user_notifications (user_id, created_at DESC);`,
+		// Jobs offered to drivers by automatic dispatch, one open offer per shipment at a time
+		`CREATE TABLE IF NOT EXISTS dispatch_offers (
+			id SERIAL PRIMARY KEY,
+			shipment_id TEXT NOT NULL REFERENCES shipments(id) ON DELETE CASCADE,
+			truck_id TEXT NOT NULL REFERENCES trucks(id),
+			driver_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			pickup_km DOUBLE PRECISION NOT NULL,
+			status TEXT NOT NULL DEFAULT 'OFFERED' CHECK (status IN ('OFFERED', 'ACCEPTED', 'DECLINED', 'EXPIRED', 'CANCELLED')),
+			offered_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			responded_at TIMESTAMPTZ
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS dispatch_offers_open_idx ON dispatch_offers (shipment_id) WHERE status = 'OFFERED';`,
+		`CREATE INDEX IF NOT EXISTS dispatch_offers_driver_idx ON dispatch_offers (driver_id, offered_at DESC);`,
+		// Ordered stops of multi-stop shipments. The first is a pickup and the last a drop-off,
+		// shipments.origin and dest mirror them for code that only knows two points.
+		`CREATE TABLE IF NOT EXISTS shipment_stops (
+			shipment_id TEXT NOT NULL REFERENCES shipments(id) ON DELETE CASCADE,
+			seq INT NOT NULL,
+			kind TEXT NOT NULL CHECK (kind IN ('pickup', 'dropoff')),
+			lat DOUBLE PRECISION NOT NULL,
+			lon DOUBLE PRECISION NOT NULL,
+			name TEXT,
+			contact_phone TEXT,
+			quantity_kg DOUBLE PRECISION, -- Planned, replaced by the actual quantity on completion
+			window_start TIMESTAMPTZ,
+			window_end TIMESTAMPTZ,
+			status TEXT NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'ARRIVED', 'COMPLETED', 'SKIPPED')),
+			arrived_at TIMESTAMPTZ,
+			completed_at TIMESTAMPTZ,
+			PRIMARY KEY (shipment_id, seq)
+		);`,
+		// A shipment's GPS track matched to the roads, the snapped fixes are in logistics_events
+		`CREATE TABLE IF NOT EXISTS shipment_tracks (
+			shipment_id TEXT PRIMARY KEY REFERENCES shipments(id) ON DELETE CASCADE,
+			path JSONB NOT NULL, -- Road geometry, [{"lat": .., "lon": ..}, ...]
+			distance_m DOUBLE PRECISION NOT NULL,
+			raw_distance_m DOUBLE PRECISION NOT NULL, -- Summed between raw fixes
+			fixes INT NOT NULL,
+			matched_fixes INT NOT NULL,
+			matched_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		// Domain events, written in the same transaction as the change they
+		// describe and handed to in-process subscribers once committed
+		`CREATE TABLE IF NOT EXISTS outbox_events (
+			id BIGSERIAL PRIMARY KEY,
+			type TEXT NOT NULL,
+			shipment_id TEXT NOT NULL,
+			data JSONB NOT NULL,
+			occurred_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			attempts INT NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			pending_subscribers TEXT[], -- Those still to handle it after a failure, NULL before the first attempt
+			last_error TEXT,
+			dispatched_at TIMESTAMPTZ
+		);`,
+		`CREATE INDEX IF NOT EXISTS outbox_events_due_idx ON outbox_events (next_attempt_at) WHERE dispatched_at IS NULL;`,
+		// Outbound webhooks, a delivery per event and matching subscription
+		`CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			event_types TEXT[] NOT NULL,
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE INDEX IF NOT EXISTS webhook_subscriptions_org_idx ON webhook_subscriptions (org_id) WHERE active;`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id TEXT PRIMARY KEY,
+			subscription_id TEXT NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+			event_type TEXT NOT NULL,
+			payload JSONB NOT NULL,
+			-- 'dead' deliveries ran out of attempts and wait in the dead-letter queue for a manual redelivery
+			status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+			attempts INT NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			last_status_code INT,
+			last_error TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			delivered_at TIMESTAMPTZ
+		);`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, created_at DESC);`,
+		`CREATE TABLE IF NOT EXISTS webhook_attempts (
+			id SERIAL PRIMARY KEY,
+			delivery_id TEXT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+			status_code INT,
+			error TEXT,
+			duration_ms INT NOT NULL,
+			attempted_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE INDEX IF NOT EXISTS webhook_attempts_delivery_idx ON webhook_attempts (delivery_id, attempted_at);`,
+		// How each user wants to hear about their shipments, defaults apply without a row
+		`CREATE TABLE IF NOT EXISTS notification_preferences (
+			user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			channels TEXT[] NOT NULL,
+			quiet_start INT, -- Minutes after midnight, both or neither set
+			quiet_end INT,
+			time_zone TEXT NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		// Messages on their way out, one per user, channel and thing it is about
+		`CREATE TABLE IF NOT EXISTS notification_messages (
+			id SERIAL PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			channel TEXT NOT NULL CHECK (channel IN ('sms', 'email', 'in_app')),
+			recipient TEXT NOT NULL, -- Phone number, email address or user ID
+			kind TEXT NOT NULL,
+			dedup_key TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			body TEXT NOT NULL,
+			data JSONB,
+			status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'failed')),
+			attempts INT NOT NULL DEFAULT 0,
+			send_after TIMESTAMPTZ NOT NULL DEFAULT NOW(), -- Later than created during quiet hours
+			last_error TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			sent_at TIMESTAMPTZ,
+			UNIQUE (user_id, channel, dedup_key)
+		);`,
+		`CREATE INDEX IF NOT EXISTS notification_messages_due_idx ON notification_messages (send_after) WHERE status = 'pending';`,
+		// Text messages from drivers, keyed by the gateway's ID so retried callbacks are dropped
+		`CREATE TABLE IF NOT EXISTS inbound_sms (
+			id TEXT PRIMARY KEY,
+			phone TEXT NOT NULL,
+			body TEXT NOT NULL,
+			reply TEXT,
+			received_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		// Reports generated on a schedule, in the organization's time zone
+		`CREATE TABLE IF NOT EXISTS report_schedules (
+			id SERIAL PRIMARY KEY,
+			org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			kind TEXT NOT NULL CHECK (kind IN ('fleet', 'trips')),
+			cron TEXT NOT NULL,
+			period TEXT NOT NULL DEFAULT '24h', -- Covered by fleet reports
+			channels TEXT[] NOT NULL,
+			created_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+			next_run_at TIMESTAMPTZ NOT NULL,
+			last_run_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE INDEX IF NOT EXISTS report_schedules_due_idx ON report_schedules (next_run_at);`,
+		// Every scheduled report, kept for download
+		`CREATE TABLE IF NOT EXISTS report_archive (
+			id SERIAL PRIMARY KEY,
+			org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			schedule_id INT REFERENCES report_schedules(id) ON DELETE SET NULL,
+			kind TEXT NOT NULL CHECK (kind IN ('fleet', 'trip')),
+			shipment_id TEXT REFERENCES shipments(id) ON DELETE SET NULL,
+			title TEXT NOT NULL,
+			period_from TIMESTAMPTZ,
+			period_to TIMESTAMPTZ,
+			data JSONB NOT NULL,
+			markdown TEXT NOT NULL,
+			pdf BYTEA NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE INDEX IF NOT EXISTS report_archive_org_idx ON report_archive (org_id, created_at DESC);`,
+		`CREATE INDEX IF NOT EXISTS report_archive_schedule_idx ON report_archive (schedule_id, shipment_id);`,
+		// Delivery promised by an organization, on a route or, without places, anywhere
+		`CREATE TABLE IF NOT EXISTS sla_policies (
+			id SERIAL PRIMARY KEY,
+			org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			origin_place TEXT,
+			dest_place TEXT,
+			transit_hours DOUBLE PRECISION NOT NULL CHECK (transit_hours > 0),
+			window_hours DOUBLE PRECISION NOT NULL DEFAULT 0 CHECK (window_hours >= 0),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS sla_policies_route_idx ON sla_policies (org_id, COALESCE(origin_place, ''), COALESCE(dest_place, ''));`,
 	}
 
 	for _, query := range queries {
@@ -133,6 +446,131 @@ func InitDB(pool *pgxpool.Pool) error {
 		return fmt.Errorf("failed to add started_at column: %v", err)
 	}
 
+	// Accounts can be identified by phone, email or both
+	migrations := []string{
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS phone TEXT UNIQUE;",
+		"ALTER TABLE users ALTER COLUMN email DROP NOT NULL;",
+		"ALTER TABLE users ALTER COLUMN password DROP NOT NULL;", // Phone-only accounts have no password
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ DEFAULT NOW();",
+		// Pickup codes: expiry, owner, and at most one open shipment per code
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS pickup_code_expires_at TIMESTAMPTZ;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS created_by TEXT REFERENCES users(id) ON DELETE SET NULL;",
+		`UPDATE shipments s SET pickup_code = NULL
+		WHERE s.status = 'CREATED' AND s.pickup_code IS NOT NULL AND EXISTS (
+			SELECT 1 FROM shipments o
+			WHERE o.pickup_code = s.pickup_code AND o.status = 'CREATED'
+			AND (COALESCE(o.created_at, 'epoch'), o.id) < (COALESCE(s.created_at, 'epoch'), s.id)
+		);`,
+		"CREATE UNIQUE INDEX IF NOT EXISTS shipments_active_pickup_code_idx ON shipments (pickup_code) WHERE status = 'CREATED';",
+		// Tenancy: shipments and trucks belong to an organization
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS org_id TEXT REFERENCES organizations(id);",
+		"ALTER TABLE trucks ADD COLUMN IF NOT EXISTS org_id TEXT REFERENCES organizations(id);",
+		"CREATE INDEX IF NOT EXISTS shipments_org_idx ON shipments (org_id);",
+		"CREATE INDEX IF NOT EXISTS trucks_org_idx ON trucks (org_id);",
+		personalOrgBackfill,
+		`UPDATE shipments s SET org_id = m.org_id
+		FROM org_members m JOIN organizations o ON o.id = m.org_id
+		WHERE s.org_id IS NULL AND s.created_by = m.user_id AND o.kind = 'individual';`,
+		// Roles used to be free text ('DRIVER', anything the client sent)
+		"UPDATE users SET role = LOWER(role) WHERE role <> LOWER(role);",
+		"UPDATE users SET role = 'farmer' WHERE role NOT IN ('farmer', 'driver', 'depot_manager', 'admin');",
+		// Fleet: trucks are managed through the API instead of being created on pickup
+		"ALTER TABLE trucks ALTER COLUMN driver_name DROP NOT NULL;", // Drivers now come from truck_assignments
+		"ALTER TABLE trucks ADD COLUMN IF NOT EXISTS make TEXT;",
+		"ALTER TABLE trucks ADD COLUMN IF NOT EXISTS capacity_kg DOUBLE PRECISION;",
+		"ALTER TABLE trucks ADD COLUMN IF NOT EXISTS capacity_m3 DOUBLE PRECISION;",
+		"ALTER TABLE trucks ADD COLUMN IF NOT EXISTS refrigerated BOOLEAN NOT NULL DEFAULT FALSE;",
+		"ALTER TABLE trucks ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';",
+		"ALTER TABLE trucks ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ DEFAULT NOW();",
+		// Trucks auto-registered on pickup used the driver's user ID, keep them driving it
+		`INSERT INTO drivers (user_id, org_id, full_name)
+		SELECT u.id, t.org_id, COALESCE(u.name, t.driver_name, u.email, u.phone, 'Driver')
+		FROM trucks t JOIN users u ON u.id = t.id
+		WHERE t.org_id IS NOT NULL
+		ON CONFLICT (user_id) DO NOTHING;`,
+		`INSERT INTO truck_assignments (truck_id, driver_id)
+		SELECT d.user_id, d.user_id FROM drivers d JOIN trucks t ON t.id = d.user_id
+		WHERE NOT EXISTS (SELECT 1 FROM truck_assignments a WHERE a.driver_id = d.user_id OR a.truck_id = t.id);`,
+		// Cargo: what a shipment is and what a truck can carry
+		"ALTER TABLE trucks ADD COLUMN IF NOT EXISTS covered BOOLEAN NOT NULL DEFAULT FALSE;",
+		"ALTER TABLE trucks ADD COLUMN IF NOT EXISTS livestock BOOLEAN NOT NULL DEFAULT FALSE;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS weight_kg DOUBLE PRECISION;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS volume_m3 DOUBLE PRECISION;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS commodity TEXT;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS cargo_type TEXT NOT NULL DEFAULT 'general';",
+		// Load board: what the farmer pays and when the load can be collected
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS payout DOUBLE PRECISION;",
+		// Scheduled reports run and are dated in the organization's time zone
+		"ALTER TABLE organizations ADD COLUMN IF NOT EXISTS time_zone TEXT NOT NULL DEFAULT 'Africa/Lagos';",
+		// What the cargo is worth, for the spoilage exposure in fleet reports
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS cargo_value DOUBLE PRECISION;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS pickup_from TIMESTAMPTZ;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS pickup_until TIMESTAMPTZ;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS bid_deadline TIMESTAMPTZ;",
+		// Automatic dispatch: 'searching' while offers go out, 'assigned' or 'failed' when done
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS dispatch_status TEXT;",
+		// Multi-stop: the stop the truck is heading to or at
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS current_stop_seq INT;",
+		// Delivery window promised to the buyer, given or from the organization's SLA policy at pickup
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS deliver_from TIMESTAMPTZ;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS deliver_by TIMESTAMPTZ;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS sla_policy_id INT REFERENCES sla_policies(id) ON DELETE SET NULL;",
+		// Latest arrival estimate on the road, and when it was first past the window
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS eta TIMESTAMPTZ;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS eta_breached_at TIMESTAMPTZ;",
+		// How the delivery went against the window, and what made it late
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS sla_status TEXT CHECK (sla_status IN ('early', 'on_time', 'late'));",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS delay_minutes DOUBLE PRECISION;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS delay_reason TEXT;",
+		// Where each fix lies on the road, once the track is map-matched
+		"ALTER TABLE logistics_events ADD COLUMN IF NOT EXISTS matched_lat DOUBLE PRECISION;",
+		"ALTER TABLE logistics_events ADD COLUMN IF NOT EXISTS matched_lon DOUBLE PRECISION;",
+		// A shipment's latest fix, read for every shipment on the road by the ETA monitor
+		"CREATE INDEX IF NOT EXISTS logistics_events_shipment_idx ON logistics_events (shipment_id, time DESC);",
+		// Place names from the gazetteer, given when the row is written
+		"ALTER TABLE logistics_incidents ADD COLUMN IF NOT EXISTS place TEXT;",
+		"ALTER TABLE shipment_stops ADD COLUMN IF NOT EXISTS place TEXT;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS origin_place TEXT;",
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS dest_place TEXT;",
+		// Set the first time the truck enters the destination geofence
+		"ALTER TABLE shipments ADD COLUMN IF NOT EXISTS near_destination_at TIMESTAMPTZ;",
+		// Webhook deliveries come from outbox events, at most one per subscription
+		"ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS event_id BIGINT;",
+		"CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_event_idx ON webhook_deliveries (subscription_id, event_id);",
+		"CREATE INDEX IF NOT EXISTS shipments_open_idx ON shipments (origin_lat, origin_lon) WHERE status = 'CREATED' AND truck_id IS NULL;",
+		`DO $$ BEGIN
+			ALTER TABLE shipments ADD CONSTRAINT shipments_cargo_type_check CHECK (cargo_type IN ('general', 'dry', 'chilled', 'livestock'));
+		EXCEPTION WHEN duplicate_object THEN NULL;
+		END $$;`,
+		`DO $$ BEGIN
+			ALTER TABLE trucks ADD CONSTRAINT trucks_status_check CHECK (status IN ('active', 'maintenance', 'retired'));
+		EXCEPTION WHEN duplicate_object THEN NULL;
+		END $$;`,
+		`DO $$ BEGIN
+			ALTER TABLE users ADD CONSTRAINT users_status_check CHECK (status IN ('active', 'suspended'));
+		EXCEPTION WHEN duplicate_object THEN NULL;
+		END $$;`,
+		// Replaces the check from before depot managers had a role of their own
+		`DO $$ BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM pg_constraint WHERE conname = 'users_role_check' AND pg_get_constraintdef(oid) LIKE '%depot_manager%'
+			) THEN
+				ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+				ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('farmer', 'driver', 'depot_manager', 'admin'));
+			END IF;
+		END $$;`,
+		// Fleets invite drivers too, the profile is created when they accept
+		"ALTER TABLE org_invitations ADD COLUMN IF NOT EXISTS driver_full_name TEXT;",
+		"ALTER TABLE org_invitations ADD COLUMN IF NOT EXISTS driver_license_number TEXT;",
+		"ALTER TABLE org_invitations ADD COLUMN IF NOT EXISTS driver_status TEXT;",
+	}
+	for _, query := range migrations {
+		if _, err := pool.Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to run migration %q: %v", query, err)
+		}
+	}
+
 	// 3. Convert to Hypertable (Conditional)
 	// Check if hypertable exists to avoid error
 	var exists bool
@@ -172,6 +610,37 @@ func InitDB(pool *pgxpool.Pool) error {
 		return fmt.Errorf("failed to create materialized view: %v", err)
 	}
 
+	// Fixes per truck and shipment each hour, for the dashboard series. Hours
+	// the policy hasn't materialized yet are read from logistics_events.
+	analytics := []string{
+		`CREATE MATERIALIZED VIEW IF NOT EXISTS fleet_activity_hourly
+		WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+		SELECT
+			time_bucket('1 hour', time) AS bucket,
+			truck_id,
+			shipment_id,
+			COUNT(*) AS fixes,
+			SUM(speed) AS speed_sum,
+			COUNT(speed) AS speed_fixes
+		FROM
+			logistics_events
+		GROUP BY
+			bucket,
+			truck_id,
+			shipment_id
+		WITH NO DATA;`,
+		`SELECT add_continuous_aggregate_policy('fleet_activity_hourly',
+			start_offset => INTERVAL '3 days',
+			end_offset => INTERVAL '1 hour',
+			schedule_interval => INTERVAL '30 minutes',
+			if_not_exists => true);`,
+	}
+	for _, query := range analytics {
+		if _, err := pool.Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to create continuous aggregate: %v", err)
+		}
+	}
+
 	// 5. Seed Data (For Demo/Simulator)
 	seedQueries := []string{
 		`INSERT INTO trucks (id, driver_name, plate_number) VALUES ('TRUCK-001', 'Driver 1', 'LAG-001') ON CONFLICT (id) DO NOTHING;`,
@@ -190,6 +659,37 @@ func InitDB(pool *pgxpool.Pool) error {
 	return nil
 }
 
+// SeedAdmin creates an admin account with the given credentials, or promotes
+// the existing account with that email. It is the only way to get the first admin.
+func SeedAdmin(pool *pgxpool.Pool, email, password string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash admin password: %v", err)
+	}
+
+	_, err = pool.Exec(ctx, `
+		INSERT INTO users (id, email, password, role) VALUES ($1, $2, $3, 'admin')
+		ON CONFLICT (email) DO UPDATE SET role = 'admin', status = 'active'
+	`, uuid.New().String(), email, hashedPassword)
+	if err != nil {
+		return fmt.Errorf("failed to seed admin: %v", err)
+	}
+
+	if _, err := pool.Exec(ctx, personalOrgBackfill); err != nil {
+		return fmt.Errorf("failed to create admin organization: %v", err)
+	}
+	return nil
+}
+
+// IsUniqueViolation reports whether err is a unique constraint violation on the named constraint or index.
+func IsUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == constraint
+}
+
 func CloseDB() {
 	if Pool != nil {
 		Pool.Close()
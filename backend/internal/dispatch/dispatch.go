@@ -0,0 +1,101 @@
+package dispatch
+
+import (
+	"sort"
+	"time"
+
+	"agri-track/internal/fleet"
+	"agri-track/internal/geo"
+)
+
+// Config tunes how candidates are filtered and ranked.
+type Config struct {
+	MaxPickupKm       float64       // Trucks further than this from the pickup aren't considered
+	DailyDrivingHours float64       // Driving allowed per driver in any 24 hours
+	AverageSpeedKmh   float64       // Used to turn distances into driving time
+	EmptyTruckBonusKm float64       // How much nearer a fully loaded truck must be to win over an empty one
+	OfferTimeout      time.Duration // How long a driver has to answer an offer
+}
+
+var DefaultConfig = Config{
+	MaxPickupKm:       150,
+	DailyDrivingHours: 11,
+	AverageSpeedKmh:   50,
+	EmptyTruckBonusKm: 20,
+	OfferTimeout:      2 * time.Minute,
+}
+
+// Job is the shipment to dispatch.
+type Job struct {
+	Origin      geo.Point
+	Destination geo.Point
+	Load        fleet.Load
+}
+
+// Candidate is an available truck with its current driver.
+type Candidate struct {
+	TruckID     string
+	DriverID    string
+	Position    *geo.Point // Last known, nil if the truck never reported
+	Truck       fleet.Truck
+	Carried     fleet.Carried
+	DrivenHours float64 // Driving in the last 24 hours
+}
+
+// Ranked is a candidate that can take the job, with its score. Lower scores are better.
+type Ranked struct {
+	Candidate
+	PickupKm float64
+	JobHours float64 // Driving to the pickup and then to the destination
+	Score    float64
+}
+
+// Rank returns the candidates that can take job, best first. A candidate is
+// left out when its position is unknown, it's too far from the pickup, the
+// load doesn't fit, or the driver doesn't have the hours left to finish.
+func Rank(job Job, candidates []Candidate, cfg Config) []Ranked {
+	tripKm := geo.Haversine(job.Origin, job.Destination) / 1000
+
+	ranked := []Ranked{}
+	for _, cand := range candidates {
+		if cand.Position == nil {
+			continue
+		}
+		pickupKm := geo.Haversine(*cand.Position, job.Origin) / 1000
+		if pickupKm > cfg.MaxPickupKm {
+			continue
+		}
+		if fleet.CheckFit(cand.Truck, job.Load, cand.Carried) != nil {
+			continue
+		}
+		jobHours := (pickupKm + tripKm) / cfg.AverageSpeedKmh
+		if cand.DrivenHours+jobHours > cfg.DailyDrivingHours {
+			continue
+		}
+
+		ranked = append(ranked, Ranked{
+			Candidate: cand,
+			PickupKm:  pickupKm,
+			JobHours:  jobHours,
+			Score:     pickupKm + utilization(cand.Truck, cand.Carried)*cfg.EmptyTruckBonusKm,
+		})
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score < ranked[j].Score
+	})
+	return ranked
+}
+
+// utilization returns how full a truck is, from 0 for empty to 1 for full,
+// by weight or volume, whichever is higher. Unknown capacity counts as empty.
+func utilization(truck fleet.Truck, carried fleet.Carried) float64 {
+	used := 0.0
+	if truck.CapacityKg != nil && *truck.CapacityKg > 0 {
+		used = max(used, carried.WeightKg / *truck.CapacityKg)
+	}
+	if truck.CapacityM3 != nil && *truck.CapacityM3 > 0 {
+		used = max(used, carried.VolumeM3 / *truck.CapacityM3)
+	}
+	return min(used, 1)
+}
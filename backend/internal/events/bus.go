@@ -0,0 +1,170 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	dispatchBatch = 100
+	maxRetryDelay = 10 * time.Minute
+	retention     = 7 * 24 * time.Hour // Dispatched events are kept this long for inspection
+)
+
+// Handler reacts to an event. Returning an error has the event handed to it
+// again later.
+type Handler func(ctx context.Context, e Event) error
+
+type subscriber struct {
+	name    string
+	types   []string
+	handler Handler
+}
+
+// Bus hands events from the outbox to subscribers. Subscribe everything
+// before starting it.
+type Bus struct {
+	pool        *pgxpool.Pool
+	subscribers []subscriber
+}
+
+func NewBus(pool *pgxpool.Pool) *Bus {
+	return &Bus{pool: pool}
+}
+
+// Subscribe has handler called with events of the given types, or all
+// events when none are given. The name identifies the subscriber across
+// restarts, for retrying only the subscribers an event failed for.
+func (b *Bus) Subscribe(name string, handler Handler, types ...string) {
+	b.subscribers = append(b.subscribers, subscriber{name: name, types: types, handler: handler})
+}
+
+// Run dispatches events as they are published until ctx is cancelled.
+func (b *Bus) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastCleanup := time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Drain a backlog without waiting for the next tick
+			for {
+				n, err := b.DispatchDue(ctx)
+				if err != nil {
+					log.Printf("Event dispatch failed: %v", err)
+				}
+				if err != nil || n < dispatchBatch {
+					break
+				}
+			}
+			if time.Since(lastCleanup) > time.Hour {
+				lastCleanup = time.Now()
+				if _, err := b.pool.Exec(ctx, "DELETE FROM outbox_events WHERE dispatched_at < $1", time.Now().Add(-retention)); err != nil {
+					log.Printf("Failed to clean up outbox: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// DispatchDue hands every event that is due to its subscribers, oldest
+// first and up to a batch, and returns how many events it went through. The
+// events stay locked while their subscribers run, so several buses never
+// dispatch the same event at once.
+func (b *Bus) DispatchDue(ctx context.Context) (int, error) {
+	tx, err := b.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, type, shipment_id, data, occurred_at, pending_subscribers, attempts FROM outbox_events
+		WHERE dispatched_at IS NULL AND next_attempt_at <= NOW()
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, dispatchBatch)
+	if err != nil {
+		return 0, err
+	}
+	type due struct {
+		Event
+		pending  []string // Nil before the first attempt
+		attempts int
+	}
+	var batch []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.ID, &d.Type, &d.ShipmentID, &d.Data, &d.OccurredAt, &d.pending, &d.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, d := range batch {
+		failed, errs := b.deliver(ctx, d.Event, d.pending)
+		if err := b.record(ctx, tx, d.ID, d.attempts+1, failed, errs); err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), tx.Commit(ctx)
+}
+
+// deliver hands an event to its subscribers, only the named ones if any are,
+// and returns those that failed.
+func (b *Bus) deliver(ctx context.Context, e Event, only []string) ([]string, []string) {
+	failed, errs := []string{}, []string{}
+	for _, s := range b.subscribers {
+		if only != nil && !slices.Contains(only, s.name) {
+			continue
+		}
+		if len(s.types) > 0 && !slices.Contains(s.types, e.Type) {
+			continue
+		}
+		if err := s.call(ctx, e); err != nil {
+			log.Printf("Subscriber %s failed on %s event %d: %v", s.name, e.Type, e.ID, err)
+			failed = append(failed, s.name)
+			errs = append(errs, s.name+": "+err.Error())
+		}
+	}
+	return failed, errs
+}
+
+func (s subscriber) call(ctx context.Context, e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.handler(ctx, e)
+}
+
+// record marks an event dispatched, or keeps the subscribers it failed for
+// to try again after a backoff.
+func (b *Bus) record(ctx context.Context, tx pgx.Tx, id int64, attempts int, failed, errs []string) error {
+	if len(failed) == 0 {
+		_, err := tx.Exec(ctx, "UPDATE outbox_events SET dispatched_at=NOW(), attempts=$2, pending_subscribers='{}' WHERE id=$1", id, attempts)
+		return err
+	}
+	delay := min(time.Duration(1<<min(attempts, 20))*time.Second, maxRetryDelay)
+	_, err := tx.Exec(ctx, `
+		UPDATE outbox_events SET attempts=$2, pending_subscribers=$3, last_error=$4, next_attempt_at=$5 WHERE id=$1
+	`, id, attempts, failed, strings.Join(errs, "; "), time.Now().Add(delay))
+	return err
+}
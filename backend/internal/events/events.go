@@ -0,0 +1,112 @@
+// Package events is the outbox of domain events. Handlers publish an event
+// in the same transaction as the change it describes, and a Bus hands the
+// committed events to in-process subscribers, at least once: a subscriber
+// that fails gets the event again later, so it must tolerate duplicates.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Event types
+const (
+	ShipmentCreated         = "shipment.created"
+	ShipmentPickedUp        = "shipment.picked_up"
+	ShipmentNearDestination = "shipment.near_destination"
+	ShipmentDelivered       = "shipment.delivered"
+	TelemetryAccepted       = "telemetry.accepted"
+	IncidentReported        = "incident.reported"
+	ShipmentETABreach       = "shipment.eta_breach"
+)
+
+// Event is a published event. Every event is about a shipment.
+type Event struct {
+	ID         int64
+	Type       string
+	ShipmentID string
+	Data       json.RawMessage // One of the *Data types below, by Type
+	OccurredAt time.Time
+}
+
+// Decode unmarshals the event data into v.
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+type ShipmentCreatedData struct {
+	OrgID     string  `json:"org_id"`
+	CreatedBy string  `json:"created_by"`
+	TruckID   *string `json:"truck_id"`
+	OriginLat float64 `json:"origin_lat"`
+	OriginLon float64 `json:"origin_lon"`
+	DestLat   float64 `json:"dest_lat"`
+	DestLon   float64 `json:"dest_lon"`
+	Commodity string  `json:"commodity,omitempty"`
+}
+
+type ShipmentPickedUpData struct {
+	TruckID   string  `json:"truck_id"`
+	OriginLat float64 `json:"origin_lat"`
+	OriginLon float64 `json:"origin_lon"`
+}
+
+type ShipmentNearDestinationData struct {
+	TruckID   string  `json:"truck_id"`
+	Lat       float64 `json:"lat"`
+	Lon       float64 `json:"lon"`
+	DistanceM float64 `json:"distance_m"`
+}
+
+type ShipmentDeliveredData struct {
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+// TelemetryAcceptedData is published once per shipment for each batch of
+// fixes written, with the latest fix of the batch.
+type TelemetryAcceptedData struct {
+	TruckID   string    `json:"truck_id"`
+	Fixes     int       `json:"fixes"`
+	From      time.Time `json:"from"`
+	Time      time.Time `json:"time"`
+	Lat       float64   `json:"lat"`
+	Lon       float64   `json:"lon"`
+	Speed     float64   `json:"speed"`
+	EventType string    `json:"event_type"`
+}
+
+type IncidentReportedData struct {
+	TruckID      string  `json:"truck_id"`
+	IncidentType string  `json:"incident_type"`
+	Description  string  `json:"description"`
+	Severity     int     `json:"severity"`
+	Lat          float64 `json:"lat"`
+	Lon          float64 `json:"lon"`
+	Place        *string `json:"place"`
+}
+
+// ShipmentETABreachData is published once, when a shipment on the road is
+// first expected to miss its delivery window.
+type ShipmentETABreachData struct {
+	ETA       time.Time `json:"eta"`
+	DeliverBy time.Time `json:"deliver_by"`
+}
+
+// Execer is satisfied by both the pool and a transaction. Publish with the
+// transaction making the change, so the event exists only if it commits.
+type Execer interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+}
+
+// Publish writes an event to the outbox.
+func Publish(ctx context.Context, q Execer, eventType, shipmentID string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(ctx, "INSERT INTO outbox_events (type, shipment_id, data) VALUES ($1, $2, $3)", eventType, shipmentID, raw)
+	return err
+}
@@ -0,0 +1,133 @@
+package fleet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cargo types. Each one needs a truck with the matching capability.
+const (
+	CargoGeneral   = "general"
+	CargoDry       = "dry"     // Grain, flour, fertilizer: must stay out of the rain
+	CargoChilled   = "chilled" // Fresh produce, fish, dairy
+	CargoLivestock = "livestock"
+)
+
+var CargoTypes = []string{CargoGeneral, CargoDry, CargoChilled, CargoLivestock}
+
+// Common commodities and the cargo type they default to
+var commodityCargo = map[string]string{
+	"maize":      CargoDry,
+	"rice":       CargoDry,
+	"sorghum":    CargoDry,
+	"millet":     CargoDry,
+	"beans":      CargoDry,
+	"soybeans":   CargoDry,
+	"garri":      CargoDry,
+	"flour":      CargoDry,
+	"fertilizer": CargoDry,
+	"tomatoes":   CargoChilled,
+	"pepper":     CargoChilled,
+	"fish":       CargoChilled,
+	"milk":       CargoChilled,
+	"vegetables": CargoChilled,
+	"cattle":     CargoLivestock,
+	"goats":      CargoLivestock,
+	"sheep":      CargoLivestock,
+	"poultry":    CargoLivestock,
+}
+
+// CargoTypeFor returns the cargo type a commodity needs, general if unknown.
+func CargoTypeFor(commodity string) string {
+	if t, ok := commodityCargo[strings.ToLower(strings.TrimSpace(commodity))]; ok {
+		return t
+	}
+	return CargoGeneral
+}
+
+// Truck is what a truck can carry. A nil capacity is unknown and not checked.
+type Truck struct {
+	CapacityKg   *float64
+	CapacityM3   *float64
+	Refrigerated bool
+	Covered      bool
+	Livestock    bool
+}
+
+// Load is one shipment. A nil weight or volume is unknown and not checked.
+type Load struct {
+	WeightKg  *float64
+	VolumeM3  *float64
+	CargoType string
+}
+
+// Carried is what a truck already has on board or reserved.
+type Carried struct {
+	WeightKg   float64
+	VolumeM3   float64
+	CargoTypes []string
+}
+
+// MismatchError explains why a load doesn't fit a truck.
+type MismatchError struct {
+	Reason string
+}
+
+func (e *MismatchError) Error() string {
+	return e.Reason
+}
+
+func mismatch(format string, args ...interface{}) error {
+	return &MismatchError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// CheckFit reports whether load can go on truck on top of what it already carries.
+// It returns a *MismatchError with the reason when it can't.
+func CheckFit(truck Truck, load Load, carried Carried) error {
+	switch load.CargoType {
+	case CargoChilled:
+		if !truck.Refrigerated {
+			return mismatch("chilled cargo needs a refrigerated truck")
+		}
+	case CargoDry:
+		if !truck.Covered && !truck.Refrigerated {
+			return mismatch("dry cargo needs a covered truck")
+		}
+	case CargoLivestock:
+		if !truck.Livestock {
+			return mismatch("livestock needs a truck fitted for animals")
+		}
+	}
+
+	// Animals don't share a truck with goods
+	for _, t := range carried.CargoTypes {
+		if (t == CargoLivestock) != (load.CargoType == CargoLivestock) {
+			return mismatch("truck is carrying %s cargo, which can't be mixed with %s cargo", t, load.CargoType)
+		}
+	}
+
+	if truck.CapacityKg != nil && load.WeightKg != nil {
+		if left := *truck.CapacityKg - carried.WeightKg; *load.WeightKg > left {
+			return mismatch("load of %.0f kg exceeds the truck's remaining capacity of %.0f kg", *load.WeightKg, max(left, 0))
+		}
+	}
+	if truck.CapacityM3 != nil && load.VolumeM3 != nil {
+		if left := *truck.CapacityM3 - carried.VolumeM3; *load.VolumeM3 > left {
+			return mismatch("load of %.1f m³ exceeds the truck's remaining space of %.1f m³", *load.VolumeM3, max(left, 0))
+		}
+	}
+	return nil
+}
+
+// Remaining returns the weight and volume a truck can still take, nil when its capacity is unknown.
+func Remaining(truck Truck, carried Carried) (kg, m3 *float64) {
+	if truck.CapacityKg != nil {
+		v := max(*truck.CapacityKg-carried.WeightKg, 0)
+		kg = &v
+	}
+	if truck.CapacityM3 != nil {
+		v := max(*truck.CapacityM3-carried.VolumeM3, 0)
+		m3 = &v
+	}
+	return kg, m3
+}
@@ -0,0 +1,314 @@
+// Package gazetteer names the place at a point, like "near Oja Oba, Ilorin"
+// or "Ilorin–Jebba Rd, km 42", from a list of towns, LGAs, landmarks and
+// roads. A small list covering the regions we operate in is bundled; a
+// fuller one can be imported from a directory of the same CSV files.
+package gazetteer
+
+import (
+	"embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"strconv"
+
+	"agri-track/internal/geo"
+)
+
+//go:embed data/*.csv
+var bundled embed.FS
+
+// How close a point has to be to be described by each kind of place
+const (
+	landmarkRadius = 1500.0
+	townRadius     = 5000.0
+	roadRadius     = 500.0
+	directionRange = 25000.0  // "12 km N of Offa"
+	lgaRadius      = 100000.0 // Farther than this from any LGA, we don't know the area
+)
+
+// Kind of place.
+type Kind string
+
+const (
+	Town     Kind = "town"
+	LGA      Kind = "lga" // Located at its headquarters
+	Landmark Kind = "landmark"
+)
+
+// Place is a named point.
+type Place struct {
+	Kind  Kind
+	Name  string
+	Point geo.Point
+	Town  string // Landmarks only
+	LGA   string
+	State string
+}
+
+// Road is a named polyline. Kilometers are counted from its first point.
+type Road struct {
+	Name   string
+	Points []geo.Point
+}
+
+// Description is what is known about the place at a point.
+type Description struct {
+	Text   string  `json:"text"`
+	Place  string  `json:"place,omitempty"` // Nearest landmark or town
+	Town   string  `json:"town,omitempty"`
+	LGA    string  `json:"lga,omitempty"`
+	State  string  `json:"state,omitempty"`
+	Road   string  `json:"road,omitempty"`
+	RoadKm float64 `json:"road_km,omitempty"`
+}
+
+// Gazetteer looks places up by location. It is safe for concurrent use.
+type Gazetteer struct {
+	places []Place
+	roads  []Road
+	grid   map[cell][]int32 // Places by cell
+	lines  map[cell][]int32 // Roads by the cells their segments cross
+}
+
+// New indexes places and roads.
+func New(places []Place, roads []Road) *Gazetteer {
+	g := &Gazetteer{places: places, roads: roads, grid: make(map[cell][]int32), lines: make(map[cell][]int32)}
+	for i, p := range places {
+		c := cellOf(p.Point)
+		g.grid[c] = append(g.grid[c], int32(i))
+	}
+	for i, r := range roads {
+		seen := make(map[cell]bool)
+		for j := 1; j < len(r.Points); j++ {
+			a, b := cellOf(r.Points[j-1]), cellOf(r.Points[j])
+			for lat := min(a.lat, b.lat); lat <= max(a.lat, b.lat); lat++ {
+				for lon := min(a.lon, b.lon); lon <= max(a.lon, b.lon); lon++ {
+					if c := (cell{lat, lon}); !seen[c] {
+						seen[c] = true
+						g.lines[c] = append(g.lines[c], int32(i))
+					}
+				}
+			}
+		}
+	}
+	return g
+}
+
+// Describe names the place at p. The text is empty when p is far from
+// everything in the gazetteer.
+func (g *Gazetteer) Describe(p geo.Point) Description {
+	var d Description
+	if lga, _, ok := g.nearest(p, lgaRadius, LGA); ok {
+		d.LGA, d.State = lga.LGA, lga.State
+	}
+	town, townDist, nearTown := g.nearest(p, directionRange, Town)
+	if nearTown {
+		d.Town, d.LGA, d.State = town.Name, town.LGA, town.State
+	}
+
+	if lm, _, ok := g.nearest(p, landmarkRadius, Landmark); ok {
+		d.Place, d.Town, d.LGA, d.State = lm.Name, lm.Town, lm.LGA, lm.State
+		d.Text = "near " + lm.Name
+		if lm.Town != "" {
+			d.Text += ", " + lm.Town
+		}
+		return d
+	}
+	if nearTown && townDist <= townRadius {
+		d.Place = town.Name
+		d.Text = "near " + town.Name
+		return d
+	}
+	if road, km, ok := g.nearestRoad(p); ok {
+		d.Road, d.RoadKm = road.Name, km
+		d.Text = fmt.Sprintf("%s, km %.0f", road.Name, km)
+		return d
+	}
+	if nearTown {
+		d.Place = town.Name
+		d.Text = fmt.Sprintf("%.0f km %s of %s", townDist/1000, direction(town.Point, p), town.Name)
+		return d
+	}
+	if d.LGA != "" {
+		d.Text = d.LGA + " LGA, " + d.State
+	}
+	return d
+}
+
+// nearest returns the closest place of a kind within radius meters of p.
+func (g *Gazetteer) nearest(p geo.Point, radius float64, kind Kind) (Place, float64, bool) {
+	best, bestDist := -1, radius
+	g.within(g.grid, p, radius, func(i int32) {
+		if g.places[i].Kind != kind {
+			return
+		}
+		if d := geo.Haversine(p, g.places[i].Point); d <= bestDist {
+			best, bestDist = int(i), d
+		}
+	})
+	if best < 0 {
+		return Place{}, 0, false
+	}
+	return g.places[best], bestDist, true
+}
+
+// nearestRoad returns the closest road within roadRadius of p and how many
+// kilometers along it p is.
+func (g *Gazetteer) nearestRoad(p geo.Point) (Road, float64, bool) {
+	best, bestOff, bestAlong := -1, roadRadius, 0.0
+	seen := make(map[int32]bool)
+	g.within(g.lines, p, roadRadius, func(i int32) {
+		if seen[i] {
+			return
+		}
+		seen[i] = true
+		along, off := geo.ProjectLine(p, g.roads[i].Points)
+		if off <= bestOff {
+			best, bestOff, bestAlong = int(i), off, along
+		}
+	})
+	if best < 0 {
+		return Road{}, 0, false
+	}
+	return g.roads[best], bestAlong / 1000, true
+}
+
+// within calls fn with everything indexed in the cells within radius of p.
+func (g *Gazetteer) within(index map[cell][]int32, p geo.Point, radius float64, fn func(int32)) {
+	minLat, maxLat, minLon, maxLon := geo.BoundingBox(p, radius)
+	lo, hi := cellOf(geo.Point{Lat: minLat, Lon: minLon}), cellOf(geo.Point{Lat: maxLat, Lon: maxLon})
+	for lat := lo.lat; lat <= hi.lat; lat++ {
+		for lon := lo.lon; lon <= hi.lon; lon++ {
+			for _, i := range index[cell{lat, lon}] {
+				fn(i)
+			}
+		}
+	}
+}
+
+var compass = []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}
+
+// direction returns the compass point of to as seen from from.
+func direction(from, to geo.Point) string {
+	dy := to.Lat - from.Lat
+	dx := (to.Lon - from.Lon) * math.Cos(from.Lat*math.Pi/180)
+	bearing := math.Atan2(dx, dy) * 180 / math.Pi
+	return compass[int(math.Round((bearing+360)/45))%8]
+}
+
+// Grid cells are this many degrees on a side
+const cellDeg = 0.25
+
+type cell struct{ lat, lon int32 }
+
+func cellOf(p geo.Point) cell {
+	return cell{int32(math.Floor(p.Lat / cellDeg)), int32(math.Floor(p.Lon / cellDeg))}
+}
+
+// Bundled returns the gazetteer shipped with the service.
+func Bundled() *Gazetteer {
+	data, _ := fs.Sub(bundled, "data")
+	g, err := Load(data)
+	if err != nil {
+		panic(err) // The bundled files are checked by the tests
+	}
+	return g
+}
+
+// FromEnv loads the gazetteer in the directory at GAZETTEER_DIR, or the
+// bundled one when it isn't set.
+func FromEnv() (*Gazetteer, error) {
+	dir := os.Getenv("GAZETTEER_DIR")
+	if dir == "" {
+		return Bundled(), nil
+	}
+	g, err := Load(os.DirFS(dir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load gazetteer from %s: %v", dir, err)
+	}
+	log.Printf("Loaded gazetteer from %s: %d places, %d roads", dir, len(g.places), len(g.roads))
+	return g, nil
+}
+
+// Load reads places.csv, with columns kind, name, lat, lon, town, lga and
+// state, and roads.csv, with a row of name, lat and lon for each point of
+// each road in order.
+func Load(fsys fs.FS) (*Gazetteer, error) {
+	var places []Place
+	err := readCSV(fsys, "places.csv", 7, func(row []string) error {
+		kind := Kind(row[0])
+		if kind != Town && kind != LGA && kind != Landmark {
+			return fmt.Errorf("unknown kind %q", row[0])
+		}
+		p, err := parsePoint(row[2], row[3])
+		if err != nil {
+			return err
+		}
+		places = append(places, Place{Kind: kind, Name: row[1], Point: p, Town: row[4], LGA: row[5], State: row[6]})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var roads []Road
+	err = readCSV(fsys, "roads.csv", 3, func(row []string) error {
+		p, err := parsePoint(row[1], row[2])
+		if err != nil {
+			return err
+		}
+		if len(roads) == 0 || roads[len(roads)-1].Name != row[0] {
+			roads = append(roads, Road{Name: row[0]})
+		}
+		last := &roads[len(roads)-1]
+		last.Points = append(last.Points, p)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return New(places, roads), nil
+}
+
+// readCSV calls fn with each row of a CSV file after the header.
+func readCSV(fsys fs.FS, name string, columns int, fn func([]string) error) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = columns
+	if _, err := r.Read(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := fn(row); err != nil {
+			line, _ := r.FieldPos(0)
+			return fmt.Errorf("%s line %d: %v", name, line, err)
+		}
+	}
+}
+
+func parsePoint(lat, lon string) (geo.Point, error) {
+	var p geo.Point
+	var err error
+	if p.Lat, err = strconv.ParseFloat(lat, 64); err != nil {
+		return p, err
+	}
+	p.Lon, err = strconv.ParseFloat(lon, 64)
+	return p, err
+}
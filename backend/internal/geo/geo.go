@@ -0,0 +1,100 @@
+package geo
+
+import "math"
+
+// EarthRadius in meters
+const EarthRadius = 6371000
+
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Haversine returns the great-circle distance between two points in meters.
+func Haversine(a, b Point) float64 {
+	phi1 := a.Lat * (math.Pi / 180)
+	phi2 := b.Lat * (math.Pi / 180)
+	deltaPhi := (b.Lat - a.Lat) * (math.Pi / 180)
+	deltaLambda := (b.Lon - a.Lon) * (math.Pi / 180)
+
+	h := math.Sin(deltaPhi/2)*math.Sin(deltaPhi/2) +
+		math.Cos(phi1)*math.Cos(phi2)*
+			math.Sin(deltaLambda/2)*math.Sin(deltaLambda/2)
+	return EarthRadius * 2 * math.Atan2(math.Sqrt(h), math.Sqrt(1-h))
+}
+
+// Project locates p against the segment from a to b. It returns how far
+// along the segment the closest point is (0 at a, 1 at b) and the distance
+// from p to that point in meters. Uses a flat projection, which is accurate
+// enough for the few hundred kilometers of a truck route.
+func Project(p, a, b Point) (float64, float64) {
+	cosLat := math.Cos(p.Lat * math.Pi / 180)
+	toXY := func(q Point) (float64, float64) {
+		return (q.Lon - p.Lon) * cosLat, q.Lat - p.Lat
+	}
+	ax, ay := toXY(a)
+	bx, by := toXY(b)
+
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if lenSq := dx*dx + dy*dy; lenSq > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lenSq))
+	}
+	closest := Point{Lat: p.Lat + ay + t*dy, Lon: p.Lon + (ax+t*dx)/cosLat}
+	return t, Haversine(p, closest)
+}
+
+// BoundingBox returns the latitude and longitude ranges within radius meters of p,
+// for a cheap prefilter before computing exact distances.
+func BoundingBox(p Point, radius float64) (minLat, maxLat, minLon, maxLon float64) {
+	dLat := radius / EarthRadius * 180 / math.Pi
+	dLon := dLat / math.Max(math.Cos(p.Lat*math.Pi/180), 0.01)
+	return p.Lat - dLat, p.Lat + dLat, p.Lon - dLon, p.Lon + dLon
+}
+
+// Length returns the length of a polyline in meters.
+func Length(line []Point) float64 {
+	total := 0.0
+	for i := 1; i < len(line); i++ {
+		total += Haversine(line[i-1], line[i])
+	}
+	return total
+}
+
+// Interpolate returns the point the given number of meters along a polyline,
+// clamped to its ends.
+func Interpolate(line []Point, meters float64) Point {
+	if len(line) == 0 {
+		return Point{}
+	}
+	for i := 1; i < len(line); i++ {
+		seg := Haversine(line[i-1], line[i])
+		if meters <= seg && seg > 0 {
+			t := meters / seg
+			return Point{
+				Lat: line[i-1].Lat + (line[i].Lat-line[i-1].Lat)*t,
+				Lon: line[i-1].Lon + (line[i].Lon-line[i-1].Lon)*t,
+			}
+		}
+		meters -= seg
+	}
+	return line[len(line)-1]
+}
+
+// ProjectLine locates p against a polyline. It returns how far along the
+// line the closest point is and the distance from p to it, both in meters.
+func ProjectLine(p Point, line []Point) (float64, float64) {
+	if len(line) == 1 {
+		return 0, Haversine(p, line[0])
+	}
+	bestAlong, bestOff, walked := 0.0, math.Inf(1), 0.0
+	for i := 1; i < len(line); i++ {
+		seg := Haversine(line[i-1], line[i])
+		t, off := Project(p, line[i-1], line[i])
+		if off < bestOff {
+			bestAlong, bestOff = walked+t*seg, off
+		}
+		walked += seg
+	}
+	return bestAlong, bestOff
+}
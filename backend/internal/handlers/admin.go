@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+type AdminHandler struct{}
+
+func NewAdminHandler() *AdminHandler {
+	return &AdminHandler{}
+}
+
+// ListUsers returns accounts filtered by ?q= (email, phone or name), ?role= and ?status=.
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	var conds []string
+	var args []interface{}
+
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		args = append(args, "%"+q+"%")
+		conds = append(conds, fmt.Sprintf("(email ILIKE $%d OR phone ILIKE $%d OR name ILIKE $%d)", len(args), len(args), len(args)))
+	}
+	if role := c.Query("role"); role != "" {
+		args = append(args, role)
+		conds = append(conds, fmt.Sprintf("role = $%d", len(args)))
+	}
+	if status := c.Query("status"); status != "" {
+		args = append(args, status)
+		conds = append(conds, fmt.Sprintf("status = $%d", len(args)))
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	query := "SELECT id, email, phone, name, role, status, COALESCE(created_at, NOW()) FROM users"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, limit, offset)
+	query += fmt.Sprintf(" ORDER BY created_at DESC NULLS LAST LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := db.Pool.Query(c.Request.Context(), query, args...)
+	if err != nil {
+		log.Printf("Failed to list users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Phone, &u.Name, &u.Role, &u.Status, &u.CreatedAt); err != nil {
+			continue
+		}
+		users = append(users, u)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users, "limit": limit, "offset": offset})
+}
+
+func (h *AdminHandler) SuspendUser(c *gin.Context) {
+	var req models.SuspendRequest
+	// Reason is optional, an empty body is fine
+	_ = c.ShouldBindJSON(&req)
+
+	h.setStatus(c, models.UserSuspended, "user.suspend", gin.H{"reason": req.Reason})
+}
+
+func (h *AdminHandler) ReactivateUser(c *gin.Context) {
+	h.setStatus(c, models.UserActive, "user.reactivate", nil)
+}
+
+func (h *AdminHandler) setStatus(c *gin.Context, status, action string, details gin.H) {
+	targetID := c.Param("id")
+	if targetID == c.GetString("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change the status of your own account"})
+		return
+	}
+
+	err := h.audited(c.Request.Context(), c.GetString("user_id"), action, targetID, details, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(c.Request.Context(), "UPDATE users SET status=$1 WHERE id=$2", status, targetID)
+		if err == nil && tag.RowsAffected() == 0 {
+			return errUserNotFound
+		}
+		return err
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": targetID, "status": status})
+}
+
+func (h *AdminHandler) ChangeRole(c *gin.Context) {
+	var req models.RoleChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	targetID := c.Param("id")
+	if targetID == c.GetString("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
+	}
+
+	details := gin.H{"role": req.Role}
+	err := h.audited(c.Request.Context(), c.GetString("user_id"), "user.role_change", targetID, details, func(tx pgx.Tx) error {
+		var previous string
+		err := tx.QueryRow(c.Request.Context(), "SELECT role FROM users WHERE id=$1 FOR UPDATE", targetID).Scan(&previous)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		details["previous_role"] = previous
+		_, err = tx.Exec(c.Request.Context(), "UPDATE users SET role=$1 WHERE id=$2", req.Role, targetID)
+		return err
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": targetID, "role": req.Role})
+}
+
+func (h *AdminHandler) DeleteUser(c *gin.Context) {
+	targetID := c.Param("id")
+	if targetID == c.GetString("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot delete your own account"})
+		return
+	}
+
+	// Keep the identities in the audit trail since the row itself is gone
+	details := gin.H{}
+	err := h.audited(c.Request.Context(), c.GetString("user_id"), "user.delete", targetID, details, func(tx pgx.Tx) error {
+		var email, phone *string
+		err := tx.QueryRow(c.Request.Context(), "DELETE FROM users WHERE id=$1 RETURNING email, phone", targetID).Scan(&email, &phone)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errUserNotFound
+		}
+		details["email"] = email
+		details["phone"] = phone
+		return err
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": targetID, "deleted": true})
+}
+
+// GetAuditLog returns the most recent admin actions, optionally for one ?target_id=.
+func (h *AdminHandler) GetAuditLog(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT id, time, actor_id, action, target_id, details
+		FROM audit_log
+		WHERE $1 = '' OR target_id = $1
+		ORDER BY time DESC
+		LIMIT 200
+	`, c.Query("target_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit log"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []gin.H{}
+	for rows.Next() {
+		var id int
+		var actorID, action, targetID string
+		var details map[string]interface{}
+		var t time.Time
+		if err := rows.Scan(&id, &t, &actorID, &action, &targetID, &details); err != nil {
+			continue
+		}
+		entries = append(entries, gin.H{
+			"id":        id,
+			"time":      t,
+			"actor_id":  actorID,
+			"action":    action,
+			"target_id": targetID,
+			"details":   details,
+		})
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// audited runs fn and records the action in audit_log within the same transaction.
+// fn may add to details before they are written.
+func (h *AdminHandler) audited(ctx context.Context, actorID, action, targetID string, details gin.H, fn func(tx pgx.Tx) error) error {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO audit_log (actor_id, action, target_id, details) VALUES ($1, $2, $3, $4)
+	`, actorID, action, targetID, details)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// respond writes the error response for a failed admin action and reports whether it succeeded.
+func (h *AdminHandler) respond(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	default:
+		log.Printf("Admin action failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+	}
+	return false
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"agri-track/internal/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Periods a series can cover, up to now, unless given from and to
+var seriesRanges = map[string]time.Duration{
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+	"90d": 90 * 24 * time.Hour,
+}
+
+// Longest period a series can cover, and most buckets it can have
+const (
+	maxSeriesSpan    = 366 * 24 * time.Hour
+	maxSeriesBuckets = 1000
+)
+
+// Corridors in the speed series, the busiest first
+const maxCorridors = 10
+
+// bucketSize is a size a series can be cut into. Buckets are cut the way
+// time_bucket cuts wall-clock time in a zone: hours from local midnight,
+// days at local midnight and weeks from Monday.
+type bucketSize struct {
+	interval string // As PostgreSQL reads it
+	hours    int
+	days     int
+}
+
+var seriesBuckets = map[string]bucketSize{
+	"1h": {interval: "1 hour", hours: 1},
+	"6h": {interval: "6 hours", hours: 6},
+	"1d": {interval: "1 day", days: 1},
+	"7d": {interval: "7 days", days: 7},
+}
+
+// start returns the start of the bucket t falls in.
+func (b bucketSize) start(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	if b.hours > 0 {
+		return time.Date(y, m, d, t.Hour()/b.hours*b.hours, 0, 0, 0, loc)
+	}
+	day := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	if b.days == 7 {
+		day = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+	return day
+}
+
+// next returns the start of the bucket after the one starting at t.
+func (b bucketSize) next(t time.Time) time.Time {
+	if b.hours == 0 {
+		return t.AddDate(0, 0, b.days)
+	}
+	// Stepping in real time gets past the hour clocks skip going forward,
+	// and the hour they repeat going back is one bucket
+	step := time.Duration(b.hours) * time.Hour
+	for n := t.Add(step); ; n = n.Add(step) {
+		if s := b.start(n, t.Location()); s.After(t) {
+			return s
+		}
+	}
+}
+
+// seriesQuery is the period and bucket size a series was asked for.
+type seriesQuery struct {
+	orgID  string
+	from   time.Time // The start of the first bucket
+	to     time.Time
+	bucket string
+	size   bucketSize
+	loc    *time.Location
+	axis   []time.Time // Every bucket from from to to
+}
+
+// SeriesPoint is the value of a series in the bucket starting at Bucket.
+// Value is null where there was nothing to average.
+type SeriesPoint struct {
+	Bucket time.Time `json:"bucket"`
+	Value  *float64  `json:"value"`
+}
+
+type Series struct {
+	Name   string        `json:"name"`
+	Points []SeriesPoint `json:"points"`
+}
+
+type seriesResponse struct {
+	Metric   string    `json:"metric"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Bucket   string    `json:"bucket"`
+	TimeZone string    `json:"time_zone"`
+	Series   []Series  `json:"series"`
+}
+
+// AnalyticsHandler serves the dashboard's time series, cut into buckets in
+// the organization's time zone, with a point for every bucket.
+type AnalyticsHandler struct{}
+
+func NewAnalyticsHandler() *AnalyticsHandler {
+	return &AnalyticsHandler{}
+}
+
+// parseSeriesQuery reads ?range= (7 days by default), or ?from= and ?to=,
+// and ?bucket=, falling back to bucket.
+func parseSeriesQuery(c *gin.Context, bucket string) (seriesQuery, error) {
+	q := seriesQuery{orgID: c.GetString("org_id"), bucket: c.DefaultQuery("bucket", bucket)}
+	var ok bool
+	if q.size, ok = seriesBuckets[q.bucket]; !ok {
+		return q, fmt.Errorf("bucket must be one of 1h, 6h, 1d or 7d")
+	}
+
+	now := time.Now()
+	q.to = now
+	from, to := c.Query("from"), c.Query("to")
+	switch {
+	case from == "" && to != "":
+		return q, fmt.Errorf("from is required with to")
+	case from != "":
+		var err error
+		if q.from, err = time.Parse(time.RFC3339, from); err != nil {
+			return q, fmt.Errorf("from must be an RFC 3339 time")
+		}
+		if to != "" {
+			if q.to, err = time.Parse(time.RFC3339, to); err != nil {
+				return q, fmt.Errorf("to must be an RFC 3339 time")
+			}
+		}
+		if !q.from.Before(q.to) {
+			return q, fmt.Errorf("from must be before to")
+		}
+		if q.to.Sub(q.from) > maxSeriesSpan {
+			return q, fmt.Errorf("a series covers at most 366 days")
+		}
+	default:
+		period, ok := seriesRanges[c.DefaultQuery("range", "7d")]
+		if !ok {
+			return q, fmt.Errorf("range must be one of 24h, 7d, 30d or 90d")
+		}
+		q.from = now.Add(-period)
+	}
+
+	_, loc, err := orgSettings(c.Request.Context(), q.orgID)
+	if err != nil {
+		return q, err
+	}
+	q.loc = loc
+	q.from = q.size.start(q.from, loc)
+	for t := q.from; t.Before(q.to); t = q.size.next(t) {
+		if len(q.axis) == maxSeriesBuckets {
+			return q, fmt.Errorf("too many buckets, ask for a larger bucket or a shorter period")
+		}
+		q.axis = append(q.axis, t)
+	}
+	return q, nil
+}
+
+// fill lays values out on the query's buckets. Buckets without a value are
+// zero, or null if empty is.
+func (q seriesQuery) fill(name string, values map[int64]float64, empty *float64) Series {
+	s := Series{Name: name, Points: make([]SeriesPoint, len(q.axis))}
+	for i, t := range q.axis {
+		s.Points[i] = SeriesPoint{Bucket: t, Value: empty}
+		if v, ok := values[t.Unix()]; ok {
+			s.Points[i].Value = &v
+		}
+	}
+	return s
+}
+
+var zeroValue = new(float64)
+
+// serveSeries answers with the series load reads for the query.
+func serveSeries(c *gin.Context, metric, bucket string, load func(ctx context.Context, q seriesQuery) ([]Series, error)) {
+	q, err := parseSeriesQuery(c, bucket)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	series, err := load(c.Request.Context(), q)
+	if err != nil {
+		log.Printf("Failed to load %s series: %v", metric, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch analytics"})
+		return
+	}
+	c.JSON(http.StatusOK, seriesResponse{
+		Metric: metric, From: q.from, To: q.to, Bucket: q.bucket, TimeZone: q.loc.String(), Series: series,
+	})
+}
+
+// scanBuckets reads rows of a bucket, a series name and a value.
+func scanBuckets(rows pgx.Rows) (map[string]map[int64]float64, error) {
+	defer rows.Close()
+	values := map[string]map[int64]float64{}
+	for rows.Next() {
+		var bucket time.Time
+		var name string
+		var value float64
+		if err := rows.Scan(&bucket, &name, &value); err != nil {
+			return nil, err
+		}
+		if values[name] == nil {
+			values[name] = map[int64]float64{}
+		}
+		values[name][bucket.Unix()] = value
+	}
+	return values, rows.Err()
+}
+
+// Deliveries counts the organization's deliveries in each bucket, a day by
+// default.
+func (h *AnalyticsHandler) Deliveries(c *gin.Context) {
+	serveSeries(c, "deliveries", "1d", func(ctx context.Context, q seriesQuery) ([]Series, error) {
+		rows, err := db.Pool.Query(ctx, `
+			SELECT time_bucket($2::text::interval, completed_at, $3::text) AS bucket, 'deliveries', COUNT(*)::float8
+			FROM shipments
+			WHERE status = 'DELIVERED' AND completed_at >= $4 AND completed_at < $5
+			AND (org_id = $1 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $1))
+			GROUP BY bucket
+		`, q.orgID, q.size.interval, q.loc.String(), q.from, q.to)
+		if err != nil {
+			return nil, err
+		}
+		values, err := scanBuckets(rows)
+		if err != nil {
+			return nil, err
+		}
+		return []Series{q.fill("deliveries", values["deliveries"], zeroValue)}, nil
+	})
+}
+
+// ActiveTrucks counts the trucks that sent a fix for the organization in
+// each bucket, an hour by default: its own trucks, and any truck carrying
+// its shipments.
+func (h *AnalyticsHandler) ActiveTrucks(c *gin.Context) {
+	serveSeries(c, "active_trucks", "1h", func(ctx context.Context, q seriesQuery) ([]Series, error) {
+		rows, err := db.Pool.Query(ctx, `
+			SELECT time_bucket($2::text::interval, a.bucket, $3::text) AS b, 'active_trucks', COUNT(DISTINCT a.truck_id)::float8
+			FROM fleet_activity_hourly a
+			WHERE a.bucket >= $4 AND a.bucket < $5
+			AND (a.truck_id IN (SELECT id FROM trucks WHERE org_id = $1)
+				OR a.shipment_id IN (SELECT id FROM shipments WHERE org_id = $1))
+			GROUP BY b
+		`, q.orgID, q.size.interval, q.loc.String(), q.from, q.to)
+		if err != nil {
+			return nil, err
+		}
+		values, err := scanBuckets(rows)
+		if err != nil {
+			return nil, err
+		}
+		return []Series{q.fill("active_trucks", values["active_trucks"], zeroValue)}, nil
+	})
+}
+
+// Incidents counts incidents on the organization's shipments in each
+// bucket, a day by default, with a series per incident type.
+func (h *AnalyticsHandler) Incidents(c *gin.Context) {
+	serveSeries(c, "incidents", "1d", func(ctx context.Context, q seriesQuery) ([]Series, error) {
+		rows, err := db.Pool.Query(ctx, `
+			SELECT time_bucket($2::text::interval, i.time, $3::text) AS bucket, i.incident_type, COUNT(*)::float8
+			FROM logistics_incidents i
+			LEFT JOIN shipments s ON s.id = i.shipment_id
+			WHERE i.time >= $4 AND i.time < $5
+			AND (i.truck_id IN (SELECT id FROM trucks WHERE org_id = $1) OR s.org_id = $1)
+			GROUP BY bucket, i.incident_type
+		`, q.orgID, q.size.interval, q.loc.String(), q.from, q.to)
+		if err != nil {
+			return nil, err
+		}
+		values, err := scanBuckets(rows)
+		if err != nil {
+			return nil, err
+		}
+		series := []Series{}
+		for _, kind := range sortedNames(values) {
+			series = append(series, q.fill(kind, values[kind], zeroValue))
+		}
+		return series, nil
+	})
+}
+
+func sortedNames(values map[string]map[int64]float64) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CorridorSpeeds averages the speed of the organization's shipments in
+// each bucket, a day by default, with a series per corridor: the places a
+// shipment goes from and to, or their coordinates where they have no name.
+// Only the busiest corridors are returned, the busiest first.
+func (h *AnalyticsHandler) CorridorSpeeds(c *gin.Context) {
+	serveSeries(c, "corridor_speed", "1d", func(ctx context.Context, q seriesQuery) ([]Series, error) {
+		rows, err := db.Pool.Query(ctx, `
+			SELECT time_bucket($2::text::interval, a.bucket, $3::text) AS b,
+				COALESCE(s.origin_place, ROUND(s.origin_lat::numeric, 2) || ', ' || ROUND(s.origin_lon::numeric, 2))
+					|| ' → ' || COALESCE(s.dest_place, ROUND(s.dest_lat::numeric, 2) || ', ' || ROUND(s.dest_lon::numeric, 2)) AS corridor,
+				SUM(a.speed_sum), SUM(a.speed_fixes)::bigint
+			FROM fleet_activity_hourly a
+			JOIN shipments s ON s.id = a.shipment_id
+			WHERE a.bucket >= $4 AND a.bucket < $5 AND a.speed_fixes > 0
+			AND (s.org_id = $1 OR s.truck_id IN (SELECT id FROM trucks WHERE org_id = $1))
+			GROUP BY b, corridor
+		`, q.orgID, q.size.interval, q.loc.String(), q.from, q.to)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		speeds := map[string]map[int64]float64{}
+		fixes := map[string]int64{}
+		for rows.Next() {
+			var bucket time.Time
+			var corridor string
+			var sum float64
+			var n int64
+			if err := rows.Scan(&bucket, &corridor, &sum, &n); err != nil {
+				return nil, err
+			}
+			if speeds[corridor] == nil {
+				speeds[corridor] = map[int64]float64{}
+			}
+			speeds[corridor][bucket.Unix()] = sum / float64(n)
+			fixes[corridor] += n
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		corridors := sortedNames(speeds)
+		sort.SliceStable(corridors, func(i, j int) bool { return fixes[corridors[i]] > fixes[corridors[j]] })
+		series := []Series{}
+		for _, corridor := range corridors[:min(len(corridors), maxCorridors)] {
+			series = append(series, q.fill(corridor, speeds[corridor], nil))
+		}
+		return series, nil
+	})
+}
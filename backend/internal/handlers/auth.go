@@ -3,20 +3,33 @@ package handlers
 import (
 	"agri-track/internal/db"
 	"agri-track/internal/models"
+	"agri-track/internal/otp"
+	"agri-track/internal/ratelimit"
+	"agri-track/internal/sms"
 	"agri-track/internal/utils"
+	"context"
+	"errors"
+	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
-type AuthHandler struct{}
+type AuthHandler struct {
+	otp    *otp.Service
+	logins *ratelimit.Lockout
+	// accounts counts failures per account from any IP, with a higher limit
+	accounts *ratelimit.Lockout
+}
 
-func NewAuthHandler() *AuthHandler {
-	return &AuthHandler{}
+func NewAuthHandler(sender sms.Sender, logins, accounts *ratelimit.Lockout) *AuthHandler {
+	return &AuthHandler{otp: otp.NewService(sender), logins: logins, accounts: accounts}
 }
 
 func (h *AuthHandler) Login(c *gin.Context) {
@@ -26,27 +39,40 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
+	// Refuse early while the account is locked, before spending time on bcrypt.
+	// The lock is per account and client IP, so someone guessing a password
+	// can't lock its owner out from elsewhere. The rate limit on /login caps
+	// how many accounts one IP can try, and the per account lock how many
+	// guesses many IPs together get at one account.
+	accountKey := "login:" + strings.ToLower(req.Email)
+	lockKey := accountKey + ":ip:" + c.ClientIP()
+	locked, retryAfter := h.logins.Locked(lockKey)
+	if !locked {
+		locked, retryAfter = h.accounts.Locked(accountKey)
+	}
+	if locked {
+		abortLocked(c, retryAfter, "Too many failed login attempts, try again later")
+		return
+	}
+
 	// Verify password
 	var user models.User
-	err := db.Pool.QueryRow(c.Request.Context(), "SELECT id, email, password, role FROM users WHERE email=$1", req.Email).Scan(&user.ID, &user.Email, &user.Password, &user.Role)
-	if err != nil {
+	err := db.Pool.QueryRow(c.Request.Context(), "SELECT id, email, COALESCE(password, ''), role, status FROM users WHERE email=$1", req.Email).Scan(&user.ID, &user.Email, &user.Password, &user.Role, &user.Status)
+	if err != nil || !utils.CheckPasswordHash(req.Password, user.Password) {
+		h.logins.Fail(lockKey)
+		h.accounts.Fail(accountKey)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+	h.logins.Reset(lockKey)
+	h.accounts.Reset(accountKey)
 
-	if !utils.CheckPasswordHash(req.Password, user.Password) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	if user.Status == models.UserSuspended {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account suspended"})
 		return
 	}
 
-	// Generate JWT
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"role":    user.Role,
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-	})
-
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	tokenString, err := issueToken(user.ID, user.Role)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
 		return
@@ -60,7 +86,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 }
 
 func (h *AuthHandler) Register(c *gin.Context) {
-	var req models.LoginRequest
+	var req models.RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, formatValidationError(err))
 		return
@@ -72,17 +98,16 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	// Default to farmer if not specified, or validate allowed roles
+	// Self-registration can't make admins, the binding tag leaves them out
 	role := req.Role
 	if role == "" {
-		role = "farmer"
+		role = models.RoleFarmer
 	}
-	// Basic validation could be added here
-	
+
 	// Generate UUID
 	id := uuid.New().String()
 	
-	_, err = db.Pool.Exec(c.Request.Context(), "INSERT INTO users (id, email, password, role) VALUES ($1, $2, $3, $4)", id, req.Email, hashedPassword, role)
+	err = createUser(c.Request.Context(), "INSERT INTO users (id, email, password, role) VALUES ($1, $2, $3, $4)", id, req.Email, req.Email, hashedPassword, role)
 
 	if err != nil {
 		c.JSON(http.StatusConflict, gin.H{"error": "User already exists or database error"})
@@ -91,3 +116,201 @@ func (h *AuthHandler) Register(c *gin.Context) {
 
 	c.JSON(http.StatusCreated, gin.H{"id": id, "email": req.Email, "role": role})
 }
+
+// RequestOTP sends a one-time login code to a phone number.
+func (h *AuthHandler) RequestOTP(c *gin.Context) {
+	var req models.OTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	phone, err := utils.NormalizePhone(req.Phone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = h.otp.Request(c.Request.Context(), phone)
+	switch {
+	case errors.Is(err, otp.ErrRateLimited), errors.Is(err, otp.ErrCooldown):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("Failed to send otp: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not send code"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "sent", "phone": phone, "expires_in": int(h.otp.TTL.Seconds())})
+}
+
+// VerifyOTP logs a user in with a code sent to their phone. Numbers that
+// don't belong to an account yet are registered on the spot.
+func (h *AuthHandler) VerifyOTP(c *gin.Context) {
+	var req models.OTPVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	phone, err := utils.NormalizePhone(req.Phone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !h.checkOTP(c, phone, req.Code) {
+		return
+	}
+
+	created := false
+	var userID, role string
+	status := models.UserActive
+	err = db.Pool.QueryRow(c.Request.Context(), "SELECT id, role, status FROM users WHERE phone=$1", phone).Scan(&userID, &role, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		role = req.Role
+		if role == "" {
+			role = models.RoleFarmer
+		}
+		userID = uuid.New().String()
+		name := req.Name
+		if name == "" {
+			name = phone
+		}
+		err = createUser(c.Request.Context(), "INSERT INTO users (id, phone, name, role) VALUES ($1, $2, NULLIF($3, ''), $4)", userID, name, phone, req.Name, role)
+		created = true
+	}
+	if err != nil {
+		log.Printf("Failed to load or create phone user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not sign in"})
+		return
+	}
+
+	if status == models.UserSuspended {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account suspended"})
+		return
+	}
+
+	tokenString, err := issueToken(userID, role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":   tokenString,
+		"user_id": userID,
+		"role":    role,
+		"created": created,
+	})
+}
+
+// AttachPhone adds a verified phone number to the signed-in account.
+func (h *AuthHandler) AttachPhone(c *gin.Context) {
+	var req models.OTPVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	phone, err := utils.NormalizePhone(req.Phone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !h.checkOTP(c, phone, req.Code) {
+		return
+	}
+
+	_, err = db.Pool.Exec(c.Request.Context(), "UPDATE users SET phone=$1 WHERE id=$2", phone, c.GetString("user_id"))
+	if db.IsUniqueViolation(err, "users_phone_key") {
+		c.JSON(http.StatusConflict, gin.H{"error": "Phone number already linked to another account"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link phone number"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "phone": phone})
+}
+
+// AttachEmail lets a phone-only account add an email and password login.
+func (h *AuthHandler) AttachEmail(c *gin.Context) {
+	var req models.AttachEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not hash password"})
+		return
+	}
+
+	tag, err := db.Pool.Exec(c.Request.Context(), `
+		UPDATE users SET email=$1, password=$2 WHERE id=$3 AND email IS NULL
+	`, req.Email, hashedPassword, c.GetString("user_id"))
+	if db.IsUniqueViolation(err, "users_email_key") {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already linked to another account"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to link email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link email"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Account already has an email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "email": req.Email})
+}
+
+// checkOTP verifies the code and writes the error response if it fails.
+func (h *AuthHandler) checkOTP(c *gin.Context, phone, code string) bool {
+	err := h.otp.Verify(c.Request.Context(), phone, code)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, otp.ErrTooManyAttempts):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	case errors.Is(err, otp.ErrInvalidCode), errors.Is(err, otp.ErrExpired):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Failed to verify otp: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify code"})
+	}
+	return false
+}
+
+// createUser runs the INSERT for a new account together with its personal
+// organization. The first argument after the query must be the user ID.
+func createUser(ctx context.Context, query string, userID, orgName string, args ...interface{}) error {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, query, append([]interface{}{userID}, args...)...); err != nil {
+		return err
+	}
+	if err := createPersonalOrg(ctx, tx, userID, orgName); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func issueToken(userID, role string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userID,
+		"role":    role,
+		"exp":     time.Now().Add(24 * time.Hour).Unix(),
+	})
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+}
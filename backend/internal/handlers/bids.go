@@ -0,0 +1,579 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	errBidNotFound    = errors.New("bid not found")
+	errBidClosed      = errors.New("bid is no longer open")
+	errBidExpired     = errors.New("bid has expired")
+	errBiddingClosed  = errors.New("bidding on this shipment has closed")
+	errNotYourTurn    = errors.New("only the other party can answer this offer")
+	errNotYourOffer   = errors.New("only the party that made this offer can withdraw it")
+	errNotYourTruck   = errors.New("you can't bid with this truck")
+	errOwnShipment    = errors.New("you can't bid on your own shipment")
+	errNoShipperOwner = errors.New("shipment has no owning organization")
+)
+
+// How long a bid stays open when the bidder doesn't say
+const defaultBidTTL = 24 * time.Hour
+
+type BidHandler struct{}
+
+func NewBidHandler() *BidHandler {
+	return &BidHandler{}
+}
+
+// lockedBid is a bid row together with the organization that owns the shipment.
+type lockedBid struct {
+	ID           int
+	ShipmentID   string
+	BidderOrgID  string
+	TruckID      string
+	Side         string
+	Status       string
+	Price        float64
+	ExpiresAt    time.Time
+	ShipperOrgID string
+}
+
+// PlaceBid offers to carry an open shipment with one of the caller's trucks.
+// A new bid replaces the organization's earlier pending offers on the shipment.
+func (h *BidHandler) PlaceBid(c *gin.Context) {
+	var req models.BidRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	ctx := c.Request.Context()
+	orgID := c.GetString("org_id")
+	shipmentID := c.Param("id")
+	var bidID int
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		load, err := lockOpenShipment(ctx, tx, shipmentID, "")
+		if err != nil {
+			return err
+		}
+
+		var shipperOrgID *string
+		var deadline *time.Time
+		if err := tx.QueryRow(ctx, "SELECT org_id, bid_deadline FROM shipments WHERE id=$1", shipmentID).Scan(&shipperOrgID, &deadline); err != nil {
+			return err
+		}
+		if shipperOrgID == nil {
+			return errNoShipperOwner
+		}
+		if *shipperOrgID == orgID {
+			return errOwnShipment
+		}
+		if deadline != nil && deadline.Before(time.Now()) {
+			return errBiddingClosed
+		}
+
+		var truckOrgID *string
+		err = tx.QueryRow(ctx, "SELECT org_id FROM trucks WHERE id=$1", req.TruckID).Scan(&truckOrgID)
+		if errors.Is(err, pgx.ErrNoRows) || truckOrgID == nil || *truckOrgID != orgID {
+			return errNotYourTruck
+		}
+		if err != nil {
+			return err
+		}
+		if ok, err := actsFor(ctx, c, orgID, req.TruckID); err != nil || !ok {
+			return errNotYourTruck
+		}
+
+		if err := checkTruckFit(ctx, tx, req.TruckID, shipmentID, load); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+			UPDATE bids SET status='WITHDRAWN', decided_at=NOW()
+			WHERE shipment_id=$1 AND bidder_org_id=$2 AND status='PENDING'
+		`, shipmentID, orgID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRow(ctx, `
+			INSERT INTO bids (shipment_id, bidder_org_id, truck_id, created_by, side, price, eta_minutes, note, expires_at)
+			VALUES ($1, $2, $3, $4, 'carrier', $5, $6, NULLIF($7, ''), $8)
+			RETURNING id
+		`, shipmentID, orgID, req.TruckID, c.GetString("user_id"), req.Price, req.EtaMinutes, req.Note,
+			bidExpiry(req.ExpiresInMinutes, deadline)).Scan(&bidID)
+		if err != nil {
+			return err
+		}
+
+		return notifyOrg(ctx, tx, *shipperOrgID, "bid.received", "New bid on your shipment",
+			fmt.Sprintf("A carrier offered ₦%.0f to move your shipment.", req.Price),
+			gin.H{"shipment_id": shipmentID, "bid_id": bidID})
+	})
+	if fitError(c, err) || !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": bidID, "shipment_id": shipmentID, "status": models.BidPending})
+}
+
+// CounterBid answers a pending offer with a different price. The original
+// offer is closed and the other party can accept, reject or counter again.
+func (h *BidHandler) CounterBid(c *gin.Context) {
+	var req models.CounterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	ctx := c.Request.Context()
+	var counterID int
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		bid, err := h.lockForAnswer(ctx, c, tx)
+		if err != nil {
+			return err
+		}
+
+		var deadline *time.Time
+		if err := tx.QueryRow(ctx, "SELECT bid_deadline FROM shipments WHERE id=$1", bid.ShipmentID).Scan(&deadline); err != nil {
+			return err
+		}
+		if deadline != nil && deadline.Before(time.Now()) {
+			return errBiddingClosed
+		}
+
+		if _, err := tx.Exec(ctx, "UPDATE bids SET status='COUNTERED', decided_at=NOW() WHERE id=$1", bid.ID); err != nil {
+			return err
+		}
+
+		side := models.BidSideShipper
+		if bid.Side == models.BidSideShipper {
+			side = models.BidSideCarrier
+		}
+		err = tx.QueryRow(ctx, `
+			INSERT INTO bids (shipment_id, parent_bid_id, bidder_org_id, truck_id, created_by, side, price, eta_minutes, note, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10)
+			RETURNING id
+		`, bid.ShipmentID, bid.ID, bid.BidderOrgID, bid.TruckID, c.GetString("user_id"), side, req.Price, req.EtaMinutes, req.Note,
+			bidExpiry(req.ExpiresInMinutes, deadline)).Scan(&counterID)
+		if err != nil {
+			return err
+		}
+
+		return notifyOrg(ctx, tx, bid.maker(), "bid.countered", "Counter-offer received",
+			fmt.Sprintf("Your offer of ₦%.0f was countered with ₦%.0f.", bid.Price, req.Price),
+			gin.H{"shipment_id": bid.ShipmentID, "bid_id": counterID})
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": counterID, "parent_bid_id": c.Param("id"), "status": models.BidPending})
+}
+
+// AcceptBid settles the shipment on an offer: its truck is assigned, the
+// agreed price becomes the payout, and every other pending offer and load
+// board claim on the shipment is turned down.
+func (h *BidHandler) AcceptBid(c *gin.Context) {
+	ctx := c.Request.Context()
+	var bid lockedBid
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		bid, err = h.lockForAnswer(ctx, c, tx)
+		if err != nil {
+			return err
+		}
+		load, err := lockOpenShipment(ctx, tx, bid.ShipmentID, "")
+		if err != nil {
+			return err
+		}
+		if err := checkTruckFit(ctx, tx, bid.TruckID, bid.ShipmentID, load); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, "UPDATE shipments SET truck_id=$1, payout=$2 WHERE id=$3", bid.TruckID, bid.Price, bid.ShipmentID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE bids SET status = CASE WHEN id = $1 THEN 'ACCEPTED' ELSE 'REJECTED' END, decided_at = NOW()
+			WHERE shipment_id = $2 AND status = 'PENDING'
+		`, bid.ID, bid.ShipmentID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE shipment_claims SET status='REJECTED', decided_at=NOW() WHERE shipment_id=$1 AND status='PENDING'
+		`, bid.ShipmentID)
+		if err != nil {
+			return err
+		}
+
+		return h.notifyAccepted(ctx, tx, bid)
+	})
+	if fitError(c, err) || !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": bid.ID, "shipment_id": bid.ShipmentID, "truck_id": bid.TruckID, "price": bid.Price, "status": models.BidAccepted})
+}
+
+// notifyAccepted tells both parties and the truck's driver that the deal is
+// done, and every other bidder that the shipment is gone.
+func (h *BidHandler) notifyAccepted(ctx context.Context, tx pgx.Tx, bid lockedBid) error {
+	data := gin.H{"shipment_id": bid.ShipmentID, "bid_id": bid.ID}
+	body := fmt.Sprintf("The shipment was agreed at ₦%.0f.", bid.Price)
+	if err := notifyOrg(ctx, tx, bid.maker(), "bid.accepted", "Offer accepted", body, data); err != nil {
+		return err
+	}
+
+	// The board never shows pickup codes, the driver gets this one to collect the load with
+	var pickupCode *string
+	var expiresAt *time.Time
+	err := tx.QueryRow(ctx, "SELECT pickup_code, pickup_code_expires_at FROM shipments WHERE id=$1", bid.ShipmentID).Scan(&pickupCode, &expiresAt)
+	if err != nil {
+		return err
+	}
+	driverBody := body
+	if pickupCode != nil {
+		driverBody += " Pickup code: " + *pickupCode
+	}
+	driverData := gin.H{"shipment_id": bid.ShipmentID, "bid_id": bid.ID, "pickup_code": pickupCode, "pickup_code_expires_at": expiresAt}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO user_notifications (user_id, kind, title, body, data)
+		SELECT driver_id, 'shipment.assigned', 'New job for your truck', $2, $3
+		FROM truck_assignments WHERE truck_id = $1 AND unassigned_at IS NULL
+	`, bid.TruckID, driverBody, driverData)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT DISTINCT bidder_org_id FROM bids WHERE shipment_id=$1 AND bidder_org_id <> $2
+	`, bid.ShipmentID, bid.BidderOrgID)
+	if err != nil {
+		return err
+	}
+	var losers []string
+	for rows.Next() {
+		var orgID string
+		if err := rows.Scan(&orgID); err == nil {
+			losers = append(losers, orgID)
+		}
+	}
+	rows.Close()
+
+	for _, orgID := range losers {
+		err := notifyOrg(ctx, tx, orgID, "bid.lost", "Shipment awarded to another carrier",
+			"The shipment you bid on went to another offer.", gin.H{"shipment_id": bid.ShipmentID})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RejectBid turns down a pending offer.
+func (h *BidHandler) RejectBid(c *gin.Context) {
+	ctx := c.Request.Context()
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		bid, err := h.lockForAnswer(ctx, c, tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "UPDATE bids SET status='REJECTED', decided_at=NOW() WHERE id=$1", bid.ID); err != nil {
+			return err
+		}
+		return notifyOrg(ctx, tx, bid.maker(), "bid.rejected", "Offer rejected",
+			fmt.Sprintf("Your offer of ₦%.0f was rejected.", bid.Price), gin.H{"shipment_id": bid.ShipmentID, "bid_id": bid.ID})
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "status": models.BidRejected})
+}
+
+// WithdrawBid takes back a pending offer the caller's side made.
+func (h *BidHandler) WithdrawBid(c *gin.Context) {
+	ctx := c.Request.Context()
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		bid, err := lockBid(ctx, tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if ok, err := actsFor(ctx, c, bid.maker(), bid.truckFor(bid.Side)); err != nil || !ok {
+			return errNotYourOffer
+		}
+		if bid.Status != models.BidPending {
+			return errBidClosed
+		}
+		_, err = tx.Exec(ctx, "UPDATE bids SET status='WITHDRAWN', decided_at=NOW() WHERE id=$1", bid.ID)
+		return err
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "status": models.BidWithdrawn})
+}
+
+// ListShipmentBids returns the bidding history of a shipment. The shipper
+// sees every offer, a carrier only its own negotiation.
+func (h *BidHandler) ListShipmentBids(c *gin.Context) {
+	h.listBids(c, "b.shipment_id = $1 AND (s.org_id = $2 OR b.bidder_org_id = $2)", "b.created_at", c.Param("id"), c.GetString("org_id"))
+}
+
+// MyBids returns the latest offers made by or to the current organization as a carrier.
+func (h *BidHandler) MyBids(c *gin.Context) {
+	h.listBids(c, "b.bidder_org_id = $1", "b.created_at DESC", c.GetString("org_id"))
+}
+
+func (h *BidHandler) listBids(c *gin.Context, cond, order string, args ...interface{}) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT b.id, b.shipment_id, b.parent_bid_id, b.bidder_org_id, o.name, b.truck_id, t.plate_number,
+		       b.side, b.price, b.eta_minutes, b.note, b.status, b.expires_at, b.created_at, b.decided_at
+		FROM bids b
+		JOIN shipments s ON s.id = b.shipment_id
+		JOIN organizations o ON o.id = b.bidder_org_id
+		JOIN trucks t ON t.id = b.truck_id
+		WHERE `+cond+`
+		ORDER BY `+order+`
+		LIMIT 200
+	`, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch bids"})
+		return
+	}
+	defer rows.Close()
+
+	bids := []models.Bid{}
+	for rows.Next() {
+		var b models.Bid
+		err := rows.Scan(&b.ID, &b.ShipmentID, &b.ParentBidID, &b.BidderOrgID, &b.BidderName, &b.TruckID, &b.PlateNumber,
+			&b.Side, &b.Price, &b.EtaMinutes, &b.Note, &b.Status, &b.ExpiresAt, &b.CreatedAt, &b.DecidedAt)
+		if err != nil {
+			continue
+		}
+		bids = append(bids, b)
+	}
+
+	c.JSON(http.StatusOK, bids)
+}
+
+// StartExpirySweeper expires offers past their deadline and closes offers on
+// shipments that were taken some other way, until ctx is cancelled.
+func (h *BidHandler) StartExpirySweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.sweep(ctx); err != nil {
+				log.Printf("Bid expiry sweep failed: %v", err)
+			}
+		}
+	}
+}
+
+func (h *BidHandler) sweep(ctx context.Context) error {
+	return inTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			WITH expired AS (
+				UPDATE bids SET status='EXPIRED', decided_at=NOW()
+				WHERE status='PENDING' AND expires_at <= NOW()
+				RETURNING id, shipment_id, bidder_org_id, side, price
+			)
+			SELECT e.id, e.shipment_id, CASE WHEN e.side = 'carrier' THEN e.bidder_org_id ELSE s.org_id END, e.price
+			FROM expired e JOIN shipments s ON s.id = e.shipment_id
+		`)
+		if err != nil {
+			return err
+		}
+		type expiredBid struct {
+			id         int
+			shipmentID string
+			makerOrgID *string
+			price      float64
+		}
+		var expired []expiredBid
+		for rows.Next() {
+			var e expiredBid
+			if err := rows.Scan(&e.id, &e.shipmentID, &e.makerOrgID, &e.price); err == nil {
+				expired = append(expired, e)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, e := range expired {
+			if e.makerOrgID == nil {
+				continue
+			}
+			err := notifyOrg(ctx, tx, *e.makerOrgID, "bid.expired", "Offer expired",
+				fmt.Sprintf("Your offer of ₦%.0f expired without an answer.", e.price), gin.H{"shipment_id": e.shipmentID, "bid_id": e.id})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(ctx, `
+			UPDATE bids b SET status='REJECTED', decided_at=NOW()
+			FROM shipments s
+			WHERE b.shipment_id = s.id AND b.status = 'PENDING'
+			AND (s.status <> 'CREATED' OR s.truck_id IS NOT NULL)
+		`)
+		return err
+	})
+}
+
+// lockForAnswer locks the shipment and then the bid in the URL, in the same
+// order as AcceptBid, and checks the caller is the party that can answer it.
+func (h *BidHandler) lockForAnswer(ctx context.Context, c *gin.Context, tx pgx.Tx) (lockedBid, error) {
+	var shipmentID string
+	err := tx.QueryRow(ctx, "SELECT shipment_id FROM bids WHERE id::text=$1", c.Param("id")).Scan(&shipmentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return lockedBid{}, errBidNotFound
+	}
+	if err != nil {
+		return lockedBid{}, err
+	}
+	if _, err := lockOpenShipment(ctx, tx, shipmentID, ""); err != nil {
+		return lockedBid{}, err
+	}
+
+	bid, err := lockBid(ctx, tx, c.Param("id"))
+	if err != nil {
+		return bid, err
+	}
+	answerer := models.BidSideCarrier
+	if bid.Side == models.BidSideCarrier {
+		answerer = models.BidSideShipper
+	}
+	if ok, err := actsFor(ctx, c, bid.orgFor(answerer), bid.truckFor(answerer)); err != nil || !ok {
+		// Don't reveal offers to outsiders
+		if c.GetString("org_id") != bid.BidderOrgID && c.GetString("org_id") != bid.ShipperOrgID {
+			return bid, errBidNotFound
+		}
+		return bid, errNotYourTurn
+	}
+	if bid.Status != models.BidPending {
+		return bid, errBidClosed
+	}
+	if bid.ExpiresAt.Before(time.Now()) {
+		return bid, errBidExpired
+	}
+	return bid, nil
+}
+
+func lockBid(ctx context.Context, tx pgx.Tx, id string) (lockedBid, error) {
+	var bid lockedBid
+	var shipperOrgID *string
+	err := tx.QueryRow(ctx, `
+		SELECT b.id, b.shipment_id, b.bidder_org_id, b.truck_id, b.side, b.status, b.price, b.expires_at, s.org_id
+		FROM bids b JOIN shipments s ON s.id = b.shipment_id
+		WHERE b.id::text = $1
+		FOR UPDATE OF b
+	`, id).Scan(&bid.ID, &bid.ShipmentID, &bid.BidderOrgID, &bid.TruckID, &bid.Side, &bid.Status, &bid.Price, &bid.ExpiresAt, &shipperOrgID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return bid, errBidNotFound
+	}
+	if shipperOrgID != nil {
+		bid.ShipperOrgID = *shipperOrgID
+	}
+	return bid, err
+}
+
+// orgFor returns the organization acting for a side of the negotiation.
+func (b lockedBid) orgFor(side string) string {
+	if side == models.BidSideCarrier {
+		return b.BidderOrgID
+	}
+	return b.ShipperOrgID
+}
+
+// truckFor returns the truck whose driver can act for a side, if any.
+func (b lockedBid) truckFor(side string) string {
+	if side == models.BidSideCarrier {
+		return b.TruckID
+	}
+	return ""
+}
+
+// maker returns the organization that made the offer.
+func (b lockedBid) maker() string {
+	return b.orgFor(b.Side)
+}
+
+// actsFor reports whether the caller can make or answer offers for an
+// organization: its owners and dispatchers can, and so can the driver
+// currently on truckID.
+func actsFor(ctx context.Context, c *gin.Context, orgID, truckID string) (bool, error) {
+	if orgID == "" || c.GetString("org_id") != orgID {
+		return false, nil
+	}
+	switch c.GetString("org_role") {
+	case models.OrgRoleOwner, models.OrgRoleDispatcher:
+		return true, nil
+	}
+	if truckID == "" {
+		return false, nil
+	}
+	current, err := assignedTruck(ctx, db.Pool, c.GetString("user_id"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return current == truckID, err
+}
+
+// bidExpiry returns when a new offer expires: after the requested minutes or
+// a day, and never after the shipment's bidding deadline.
+func bidExpiry(minutes int, deadline *time.Time) time.Time {
+	ttl := defaultBidTTL
+	if minutes > 0 {
+		ttl = time.Duration(minutes) * time.Minute
+	}
+	expires := time.Now().Add(ttl)
+	if deadline != nil && deadline.Before(expires) {
+		expires = *deadline
+	}
+	return expires
+}
+
+func (h *BidHandler) respond(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, pgx.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+	case errors.Is(err, errBidNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bid not found"})
+	case errors.Is(err, errNotYourTurn), errors.Is(err, errNotYourOffer), errors.Is(err, errNotYourTruck):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, errOwnShipment), errors.Is(err, errNoShipperOwner):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errShipmentNotOpen), errors.Is(err, errPickupClosed), errors.Is(err, errBidClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errBidExpired), errors.Is(err, errBiddingClosed):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Bid action failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update bid"})
+	}
+	return false
+}
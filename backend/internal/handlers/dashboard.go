@@ -1,8 +1,9 @@
 package handlers
 
 import (
-	"fmt"
+	"log"
 	"net/http"
+	"time"
 
 	"agri-track/internal/db"
 
@@ -20,47 +21,53 @@ func (h *DashboardHandler) GetSummary(c *gin.Context) {
 	var totalCompleted int
 	var alertsCount int
 
-	// 1. Dynamic Time Filtering
+	// 1. Time Filtering
 	timeRange := c.DefaultQuery("range", "24h")
-	var startTime string
-
-	switch timeRange {
-	case "24h":
-		startTime = "NOW() - INTERVAL '24 hours'"
-	case "7d":
-		startTime = "NOW() - INTERVAL '7 days'"
-	case "30d":
-		startTime = "NOW() - INTERVAL '30 days'"
-	case "all":
-		startTime = "'1970-01-01'" // Effectively all time
-	default:
-		startTime = "NOW() - INTERVAL '24 hours'"
+	since := time.Unix(0, 0) // "all" counts everything
+	if period, ok := reportPeriods[timeRange]; ok {
+		since = time.Now().Add(-period)
+	} else if timeRange != "all" {
 		timeRange = "24h"
+		since = time.Now().Add(-reportPeriods[timeRange])
 	}
 
 	// Active Trucks (Unique trucks in IN_TRANSIT shipments)
 	// This metric is usually real-time, so time range might not apply directly,
 	// but let's keep it as is for "current active trucks".
-	err := db.Pool.QueryRow(c.Request.Context(), "SELECT COUNT(DISTINCT truck_id) FROM shipments WHERE status='IN_TRANSIT'").Scan(&totalActive)
+	// Everything below only counts shipments owned or carried by the caller's organization
+	orgID := c.GetString("org_id")
+
+	err := db.Pool.QueryRow(c.Request.Context(), `
+		SELECT COUNT(DISTINCT truck_id) FROM shipments
+		WHERE status='IN_TRANSIT'
+		AND (org_id = $1 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $1))
+	`, orgID).Scan(&totalActive)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch active trucks"})
 		return
 	}
 
 	// Completed (Filtered by time range)
-	// We use the calculated startTime here.
-	queryCompleted := fmt.Sprintf("SELECT COUNT(*) FROM shipments WHERE status='DELIVERED' AND completed_at > %s", startTime)
-	err = db.Pool.QueryRow(c.Request.Context(), queryCompleted).Scan(&totalCompleted)
+	err = db.Pool.QueryRow(c.Request.Context(), `
+		SELECT COUNT(*) FROM shipments
+		WHERE status='DELIVERED' AND completed_at > $2
+		AND (org_id = $1 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $1))
+	`, orgID, since).Scan(&totalCompleted)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch completed shipments"})
 		return
 	}
 
 	// 2. Simplified Incident Count (Last 24h)
-	err = db.Pool.QueryRow(c.Request.Context(), "SELECT COUNT(*) FROM logistics_incidents WHERE time > NOW() - INTERVAL '24 hours'").Scan(&alertsCount)
+	err = db.Pool.QueryRow(c.Request.Context(), `
+		SELECT COUNT(*) FROM logistics_incidents i
+		LEFT JOIN shipments s ON s.id = i.shipment_id
+		WHERE i.time > NOW() - INTERVAL '24 hours'
+		AND (i.truck_id IN (SELECT id FROM trucks WHERE org_id = $1) OR s.org_id = $1)
+	`, orgID).Scan(&alertsCount)
 	if err != nil {
 		alertsCount = 0
-		fmt.Printf("Error counting incidents: %v\n", err)
+		log.Printf("Error counting incidents: %v", err)
 	}
 
 	// 3. Average Speed (Last 24h)
@@ -73,21 +80,40 @@ func (h *DashboardHandler) GetSummary(c *gin.Context) {
 		// 4. Avg Speed (Real-time: Last 5 minutes only)
 		// COALESCE(..., 0) ensures we get 0 instead of NULL if no data exists
 		err = db.Pool.QueryRow(c.Request.Context(), `
-			SELECT COALESCE(AVG(speed), 0) 
-			FROM logistics_events 
-			WHERE time > NOW() - INTERVAL '5 minutes'
-		`).Scan(&avgSpeed)
+			SELECT COALESCE(AVG(e.speed), 0) 
+			FROM logistics_events e
+			JOIN shipments s ON s.id = e.shipment_id
+			WHERE e.time > NOW() - INTERVAL '5 minutes'
+			AND (s.org_id = $1 OR s.truck_id IN (SELECT id FROM trucks WHERE org_id = $1))
+		`, orgID).Scan(&avgSpeed)
 
 		if err != nil {
 			avgSpeed = 0
 		}
 	}
 
+	// 5. On-time rate of the deliveries in the time range that had a window,
+	// and shipments on the road expected to miss theirs
+	var onTimeRate *float64
+	var lateRisk int
+	err = db.Pool.QueryRow(c.Request.Context(), `
+		SELECT
+			(AVG(CASE WHEN sla_status = 'late' THEN 0 ELSE 1 END) FILTER (WHERE sla_status IS NOT NULL AND completed_at > $2))::float8,
+			COUNT(*) FILTER (WHERE status = 'IN_TRANSIT' AND eta > deliver_by)
+		FROM shipments
+		WHERE (org_id = $1 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $1))
+	`, orgID, since).Scan(&onTimeRate, &lateRisk)
+	if err != nil {
+		log.Printf("Error computing on-time rate: %v", err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"total_active_trucks":   totalActive,
 		"total_completed_today": totalCompleted,
 		"alerts_count":          alertsCount,
 		"avg_speed":             int(avgSpeed), // Return as integer
+		"on_time_rate":          onTimeRate, // null with no windowed deliveries
+		"late_risk_count":       lateRisk,
 		"time_range":            timeRange,
 	})
 }
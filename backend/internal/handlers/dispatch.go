@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/dispatch"
+	"agri-track/internal/fleet"
+	"agri-track/internal/geo"
+	"agri-track/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	errOfferNotFound = errors.New("offer not found")
+	errOfferClosed   = errors.New("offer is no longer open")
+)
+
+// DispatchHandler offers new shipments to an organization's own drivers, one
+// at a time and nearest suitable truck first, until one of them takes it.
+type DispatchHandler struct {
+	cfg dispatch.Config
+}
+
+func NewDispatchHandler(cfg dispatch.Config) *DispatchHandler {
+	return &DispatchHandler{cfg: cfg}
+}
+
+// Dispatch offers a shipment that is searching for a truck to the best
+// candidate that hasn't been asked yet. It does nothing while an offer is
+// open, and marks the shipment failed and tells the dispatchers when no
+// candidate is left. Returns the shipment's dispatch status.
+func (h *DispatchHandler) Dispatch(ctx context.Context, shipmentID string) (string, error) {
+	status := models.DispatchSearching
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		var job dispatch.Job
+		var orgID *string
+		var truckID, dispatchStatus *string
+		var shipmentStatus string
+		err := tx.QueryRow(ctx, `
+			SELECT origin_lat, origin_lon, dest_lat, dest_lon, weight_kg, volume_m3, cargo_type, org_id, truck_id, status, dispatch_status
+			FROM shipments WHERE id=$1 FOR UPDATE
+		`, shipmentID).Scan(&job.Origin.Lat, &job.Origin.Lon, &job.Destination.Lat, &job.Destination.Lon,
+			&job.Load.WeightKg, &job.Load.VolumeM3, &job.Load.CargoType, &orgID, &truckID, &shipmentStatus, &dispatchStatus)
+		if err != nil {
+			return err
+		}
+		if dispatchStatus == nil {
+			status = ""
+			return nil
+		}
+		if *dispatchStatus != models.DispatchSearching {
+			status = *dispatchStatus
+			return nil
+		}
+		// Taken through the load board, a bid or a pickup code
+		if truckID != nil || shipmentStatus != "CREATED" || orgID == nil {
+			status = models.DispatchAssigned
+			_, err := tx.Exec(ctx, "UPDATE shipments SET dispatch_status=$1 WHERE id=$2", status, shipmentID)
+			return err
+		}
+
+		var open bool
+		if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM dispatch_offers WHERE shipment_id=$1 AND status='OFFERED')", shipmentID).Scan(&open); err != nil || open {
+			return err
+		}
+
+		candidates, busy, err := dispatchCandidates(ctx, tx, *orgID, shipmentID)
+		if err != nil {
+			return err
+		}
+		ranked := dispatch.Rank(job, candidates, h.cfg)
+		if len(ranked) == 0 && len(dispatch.Rank(job, busy, h.cfg)) > 0 {
+			return nil // Still searching, the sweep tries again once those drivers answer
+		}
+		if len(ranked) == 0 {
+			status = models.DispatchFailed
+			if _, err := tx.Exec(ctx, "UPDATE shipments SET dispatch_status=$1 WHERE id=$2", status, shipmentID); err != nil {
+				return err
+			}
+			return notifyOrg(ctx, tx, *orgID, "dispatch.failed", "No truck for shipment",
+				"None of your available trucks took the shipment. Assign one yourself.", gin.H{"shipment_id": shipmentID})
+		}
+
+		best := ranked[0]
+		var offerID int
+		err = tx.QueryRow(ctx, `
+			INSERT INTO dispatch_offers (shipment_id, truck_id, driver_id, pickup_km, expires_at)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id
+		`, shipmentID, best.TruckID, best.DriverID, best.PickupKm, time.Now().Add(h.cfg.OfferTimeout)).Scan(&offerID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO user_notifications (user_id, kind, title, body, data)
+			VALUES ($1, 'dispatch.offer', 'New job offer', $2, $3)
+		`, best.DriverID, fmt.Sprintf("A load %.0f km from you. Answer within %s.", best.PickupKm, h.cfg.OfferTimeout),
+			gin.H{"shipment_id": shipmentID, "offer_id": offerID})
+		return err
+	})
+	return status, err
+}
+
+// dispatchCandidates returns the organization's active trucks with an active
+// driver, their last reported position, what they carry and how long their
+// driver has driven in the last 24 hours. Trucks already offered the
+// shipment are left out, those whose driver has another open offer are
+// returned apart as busy.
+func dispatchCandidates(ctx context.Context, tx pgx.Tx, orgID, shipmentID string) (free, busy []dispatch.Candidate, err error) {
+	rows, err := tx.Query(ctx, `
+		SELECT t.id, a.driver_id, t.capacity_kg, t.capacity_m3, t.refrigerated, t.covered, t.livestock,
+		       pos.latitude, pos.longitude,
+		       COALESCE(onboard.weight, 0), COALESCE(onboard.volume, 0), COALESCE(onboard.types, '{}'),
+		       COALESCE(driving.hours, 0),
+		       EXISTS (SELECT 1 FROM dispatch_offers o WHERE o.driver_id = a.driver_id AND o.status = $3)
+		FROM trucks t
+		JOIN truck_assignments a ON a.truck_id = t.id AND a.unassigned_at IS NULL
+		JOIN drivers d ON d.user_id = a.driver_id AND d.status = 'active'
+		LEFT JOIN LATERAL (
+			SELECT latitude, longitude FROM logistics_events e
+			WHERE e.truck_id = t.id ORDER BY e.time DESC LIMIT 1
+		) pos ON true
+		LEFT JOIN LATERAL (
+			SELECT SUM(weight_kg) AS weight, SUM(volume_m3) AS volume, ARRAY_AGG(DISTINCT cargo_type) AS types
+			FROM shipments s WHERE s.truck_id = t.id AND s.status IN ('CREATED', 'IN_TRANSIT')
+		) onboard ON true
+		LEFT JOIN LATERAL (
+			-- Time between consecutive reports while moving, in whichever truck the driver was assigned
+			SELECT SUM(LEAST(g.gap, 600)) / 3600.0 AS hours FROM (
+				SELECT EXTRACT(EPOCH FROM e.time - LAG(e.time) OVER (PARTITION BY e.truck_id ORDER BY e.time)) AS gap, e.speed
+				FROM logistics_events e
+				JOIN truck_assignments h ON h.truck_id = e.truck_id AND h.driver_id = a.driver_id
+					AND e.time >= h.assigned_at AND (h.unassigned_at IS NULL OR e.time < h.unassigned_at)
+				WHERE e.time > NOW() - INTERVAL '24 hours'
+			) g WHERE g.speed > 5
+		) driving ON true
+		WHERE t.org_id = $1 AND t.status = 'active'
+		AND NOT EXISTS (SELECT 1 FROM dispatch_offers o WHERE o.shipment_id = $2 AND o.truck_id = t.id)
+	`, orgID, shipmentID, models.OfferOpen)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cand dispatch.Candidate
+		var lat, lon *float64
+		var offered bool
+		err := rows.Scan(&cand.TruckID, &cand.DriverID, &cand.Truck.CapacityKg, &cand.Truck.CapacityM3,
+			&cand.Truck.Refrigerated, &cand.Truck.Covered, &cand.Truck.Livestock, &lat, &lon,
+			&cand.Carried.WeightKg, &cand.Carried.VolumeM3, &cand.Carried.CargoTypes, &cand.DrivenHours, &offered)
+		if err != nil {
+			return nil, nil, err
+		}
+		if lat != nil && lon != nil {
+			cand.Position = &geo.Point{Lat: *lat, Lon: *lon}
+		}
+		if offered {
+			busy = append(busy, cand)
+		} else {
+			free = append(free, cand)
+		}
+	}
+	return free, busy, rows.Err()
+}
+
+// StartOfferSweeper expires unanswered offers, cancels offers on shipments
+// that were taken some other way, and moves every shipment still searching
+// on to its next candidate, until ctx is cancelled.
+func (h *DispatchHandler) StartOfferSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.sweep(ctx); err != nil {
+				log.Printf("Dispatch sweep failed: %v", err)
+			}
+		}
+	}
+}
+
+func (h *DispatchHandler) sweep(ctx context.Context) error {
+	_, err := db.Pool.Exec(ctx, `
+		UPDATE dispatch_offers o SET
+			status = CASE WHEN s.status = 'CREATED' AND s.truck_id IS NULL THEN $2 ELSE $3 END,
+			responded_at = NOW()
+		FROM shipments s
+		WHERE o.shipment_id = s.id AND o.status = $1
+		AND (o.expires_at <= NOW() OR s.status <> 'CREATED' OR s.truck_id IS NOT NULL)
+	`, models.OfferOpen, models.OfferExpired, models.OfferCancelled)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id FROM shipments s
+		WHERE dispatch_status = $1
+		AND NOT EXISTS (SELECT 1 FROM dispatch_offers o WHERE o.shipment_id = s.id AND o.status = $2)
+	`, models.DispatchSearching, models.OfferOpen)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := h.Dispatch(ctx, id); err != nil {
+			log.Printf("Failed to dispatch shipment %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// StartDispatch starts, or restarts after it failed, automatic dispatch of an
+// unassigned shipment of the organization.
+func (h *DispatchHandler) StartDispatch(c *gin.Context) {
+	ctx := c.Request.Context()
+	shipmentID := c.Param("id")
+	tag, err := db.Pool.Exec(ctx, `
+		UPDATE shipments SET dispatch_status='searching'
+		WHERE id=$1 AND org_id=$2 AND status='CREATED' AND truck_id IS NULL
+	`, shipmentID, c.GetString("org_id"))
+	if err != nil {
+		log.Printf("Failed to start dispatch: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start dispatch"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No unassigned shipment in your organization with that ID"})
+		return
+	}
+
+	// A restart gives every truck another chance
+	_, err = db.Pool.Exec(ctx, "DELETE FROM dispatch_offers WHERE shipment_id=$1 AND status IN ('DECLINED', 'EXPIRED')", shipmentID)
+	if err == nil {
+		var status string
+		status, err = h.Dispatch(ctx, shipmentID)
+		if err == nil {
+			c.JSON(http.StatusOK, gin.H{"id": shipmentID, "dispatch_status": status})
+			return
+		}
+	}
+	log.Printf("Failed to dispatch shipment: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start dispatch"})
+}
+
+// MyOffers returns the latest job offers made to the current driver.
+func (h *DispatchHandler) MyOffers(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT o.id, o.shipment_id, o.truck_id, o.driver_id, o.pickup_km, o.status, o.offered_at, o.expires_at, o.responded_at,
+		       s.origin_lat, s.origin_lon, s.dest_lat, s.dest_lon, s.commodity, s.weight_kg, s.payout
+		FROM dispatch_offers o JOIN shipments s ON s.id = o.shipment_id
+		WHERE o.driver_id = $1
+		ORDER BY o.offered_at DESC
+		LIMIT 50
+	`, c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch offers"})
+		return
+	}
+	defer rows.Close()
+
+	offers := []models.DispatchOffer{}
+	for rows.Next() {
+		var o models.DispatchOffer
+		err := rows.Scan(&o.ID, &o.ShipmentID, &o.TruckID, &o.DriverID, &o.PickupKm, &o.Status, &o.OfferedAt, &o.ExpiresAt, &o.RespondedAt,
+			&o.OriginLat, &o.OriginLon, &o.DestLat, &o.DestLon, &o.Commodity, &o.WeightKg, &o.Payout)
+		if err != nil {
+			continue
+		}
+		offers = append(offers, o)
+	}
+
+	c.JSON(http.StatusOK, offers)
+}
+
+// AcceptOffer assigns the shipment to the truck it was offered to.
+func (h *DispatchHandler) AcceptOffer(c *gin.Context) {
+	ctx := c.Request.Context()
+	var offer models.DispatchOffer
+	var pickupCode *string
+	var expiresAt *time.Time
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		var load fleet.Load
+		offer, load, err = h.lockOffer(ctx, c, tx)
+		if err != nil {
+			return err
+		}
+		if current, err := assignedTruck(ctx, tx, offer.DriverID); err != nil || current != offer.TruckID {
+			return errDriverMoved
+		}
+		if err := checkTruckFit(ctx, tx, offer.TruckID, offer.ShipmentID, load); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE shipments SET truck_id=$1, dispatch_status='assigned' WHERE id=$2", offer.TruckID, offer.ShipmentID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "UPDATE dispatch_offers SET status='ACCEPTED', responded_at=NOW() WHERE id=$1", offer.ID); err != nil {
+			return err
+		}
+
+		var orgID string
+		err = tx.QueryRow(ctx, "SELECT org_id, pickup_code, pickup_code_expires_at FROM shipments WHERE id=$1", offer.ShipmentID).
+			Scan(&orgID, &pickupCode, &expiresAt)
+		if err != nil {
+			return err
+		}
+		err = notifyOrg(ctx, tx, orgID, "dispatch.assigned", "Shipment dispatched",
+			fmt.Sprintf("A driver %.0f km away accepted the shipment.", offer.PickupKm),
+			gin.H{"shipment_id": offer.ShipmentID, "truck_id": offer.TruckID})
+		if err != nil {
+			return err
+		}
+
+		// Offers never show pickup codes, the driver gets this one to collect the load with
+		body := "You accepted the job."
+		if pickupCode != nil {
+			body += " Pickup code: " + *pickupCode
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO user_notifications (user_id, kind, title, body, data) VALUES ($1, 'shipment.assigned', 'New job for your truck', $2, $3)
+		`, offer.DriverID, body, gin.H{"shipment_id": offer.ShipmentID, "offer_id": offer.ID, "pickup_code": pickupCode, "pickup_code_expires_at": expiresAt})
+		return err
+	})
+	if fitError(c, err) || !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": offer.ID, "shipment_id": offer.ShipmentID, "truck_id": offer.TruckID, "status": models.OfferAccepted,
+		"pickup_code": pickupCode, "pickup_code_expires_at": expiresAt})
+}
+
+// DeclineOffer turns a job down and passes it on to the next candidate.
+func (h *DispatchHandler) DeclineOffer(c *gin.Context) {
+	ctx := c.Request.Context()
+	var offer models.DispatchOffer
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		offer, _, err = h.lockOffer(ctx, c, tx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "UPDATE dispatch_offers SET status='DECLINED', responded_at=NOW() WHERE id=$1", offer.ID)
+		return err
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	if _, err := h.Dispatch(ctx, offer.ShipmentID); err != nil {
+		log.Printf("Failed to dispatch shipment %s: %v", offer.ShipmentID, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"id": offer.ID, "status": models.OfferDeclined})
+}
+
+// lockOffer locks the shipment and then the open offer in the URL, which
+// must have been made to the caller.
+func (h *DispatchHandler) lockOffer(ctx context.Context, c *gin.Context, tx pgx.Tx) (models.DispatchOffer, fleet.Load, error) {
+	var offer models.DispatchOffer
+	err := tx.QueryRow(ctx, "SELECT shipment_id FROM dispatch_offers WHERE id::text=$1 AND driver_id=$2", c.Param("id"), c.GetString("user_id")).Scan(&offer.ShipmentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return offer, fleet.Load{}, errOfferNotFound
+	}
+	if err != nil {
+		return offer, fleet.Load{}, err
+	}
+	load, err := lockOpenShipment(ctx, tx, offer.ShipmentID, "")
+	if errors.Is(err, errShipmentNotOpen) || errors.Is(err, errPickupClosed) {
+		return offer, load, errOfferClosed
+	}
+	if err != nil {
+		return offer, load, err
+	}
+
+	err = tx.QueryRow(ctx, `
+		SELECT id, truck_id, driver_id, pickup_km, status, expires_at FROM dispatch_offers WHERE id::text=$1 FOR UPDATE
+	`, c.Param("id")).Scan(&offer.ID, &offer.TruckID, &offer.DriverID, &offer.PickupKm, &offer.Status, &offer.ExpiresAt)
+	if err != nil {
+		return offer, load, err
+	}
+	if offer.Status != models.OfferOpen || offer.ExpiresAt.Before(time.Now()) {
+		return offer, load, errOfferClosed
+	}
+	return offer, load, nil
+}
+
+func (h *DispatchHandler) respond(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errOfferNotFound), errors.Is(err, pgx.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Offer not found"})
+	case errors.Is(err, errOfferClosed), errors.Is(err, errDriverMoved):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Dispatch action failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update offer"})
+	}
+	return false
+}
@@ -0,0 +1,634 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"agri-track/internal/db"
+	"agri-track/internal/fleet"
+	"agri-track/internal/models"
+	"agri-track/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	errTruckNotFound    = errors.New("truck not found")
+	errDriverNotFound   = errors.New("driver not found")
+	errTruckUnavailable = errors.New("truck is not in service")
+	errDriverInactive   = errors.New("driver is inactive")
+	errTruckInTransit   = errors.New("truck is carrying a shipment")
+	errPlateTaken       = errors.New("another truck in your organization has this plate number")
+	errPersonalOrg      = errors.New("personal organizations can only have the owner as driver")
+)
+
+type FleetHandler struct{}
+
+func NewFleetHandler() *FleetHandler {
+	return &FleetHandler{}
+}
+
+const truckColumns = `
+	t.id, t.plate_number, t.make, t.capacity_kg, t.capacity_m3, t.refrigerated, t.covered, t.livestock, t.status,
+	a.driver_id, d.full_name, COALESCE(t.created_at, NOW())`
+
+// Trucks with their current driver, if any
+const truckFrom = `
+	FROM trucks t
+	LEFT JOIN truck_assignments a ON a.truck_id = t.id AND a.unassigned_at IS NULL
+	LEFT JOIN drivers d ON d.user_id = a.driver_id`
+
+func scanTruck(row pgx.Row) (models.Truck, error) {
+	var t models.Truck
+	err := row.Scan(&t.ID, &t.PlateNumber, &t.Make, &t.CapacityKg, &t.CapacityM3, &t.Refrigerated, &t.Covered, &t.Livestock, &t.Status, &t.DriverID, &t.DriverName, &t.CreatedAt)
+	return t, err
+}
+
+// ListTrucks returns the trucks of the current organization, optionally filtered by ?status=.
+func (h *FleetHandler) ListTrucks(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `SELECT `+truckColumns+truckFrom+`
+		WHERE t.org_id = $1 AND ($2 = '' OR t.status = $2)
+		ORDER BY t.plate_number
+	`, c.GetString("org_id"), c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch trucks"})
+		return
+	}
+	defer rows.Close()
+
+	trucks := []models.Truck{}
+	for rows.Next() {
+		t, err := scanTruck(rows)
+		if err != nil {
+			continue
+		}
+		trucks = append(trucks, t)
+	}
+
+	c.JSON(http.StatusOK, trucks)
+}
+
+func (h *FleetHandler) GetTruck(c *gin.Context) {
+	t, err := scanTruck(db.Pool.QueryRow(c.Request.Context(), `SELECT `+truckColumns+truckFrom+`
+		WHERE t.id = $1 AND t.org_id = $2
+	`, c.Param("id"), c.GetString("org_id")))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Truck not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch truck"})
+		return
+	}
+
+	c.JSON(http.StatusOK, t)
+}
+
+func (h *FleetHandler) CreateTruck(c *gin.Context) {
+	var req models.TruckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+	normalizeTruckRequest(&req)
+
+	ctx := c.Request.Context()
+	orgID := c.GetString("org_id")
+	id := uuid.New().String()
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		if err := checkPlate(ctx, tx, orgID, id, req); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `
+			INSERT INTO trucks (id, plate_number, make, capacity_kg, capacity_m3, refrigerated, covered, livestock, status, org_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		`, id, req.PlateNumber, req.Make, req.CapacityKg, req.CapacityM3, req.Refrigerated, req.Covered, req.Livestock, req.Status, orgID)
+		return err
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": id, "plate_number": req.PlateNumber, "status": req.Status})
+}
+
+// UpdateTruck replaces a truck's details. Taking a truck out of service ends its current assignment.
+func (h *FleetHandler) UpdateTruck(c *gin.Context) {
+	var req models.TruckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+	normalizeTruckRequest(&req)
+
+	ctx := c.Request.Context()
+	orgID := c.GetString("org_id")
+	truckID := c.Param("id")
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		if _, err := lockTruck(ctx, tx, truckID, orgID); err != nil {
+			return err
+		}
+		if err := checkPlate(ctx, tx, orgID, truckID, req); err != nil {
+			return err
+		}
+		if req.Status != models.TruckActive {
+			if err := endAssignments(ctx, tx, truckID, ""); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, `
+			UPDATE trucks SET plate_number=$1, make=$2, capacity_kg=$3, capacity_m3=$4, refrigerated=$5, covered=$6, livestock=$7, status=$8
+			WHERE id=$9
+		`, req.PlateNumber, req.Make, req.CapacityKg, req.CapacityM3, req.Refrigerated, req.Covered, req.Livestock, req.Status, truckID)
+		return err
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": truckID, "plate_number": req.PlateNumber, "status": req.Status})
+}
+
+// RetireTruck takes a truck out of the fleet. The row stays so past
+// shipments and assignments still point at it.
+func (h *FleetHandler) RetireTruck(c *gin.Context) {
+	ctx := c.Request.Context()
+	truckID := c.Param("id")
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		if _, err := lockTruck(ctx, tx, truckID, c.GetString("org_id")); err != nil {
+			return err
+		}
+		if err := endAssignments(ctx, tx, truckID, ""); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, "UPDATE trucks SET status='retired' WHERE id=$1", truckID)
+		return err
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": truckID, "status": models.TruckRetired})
+}
+
+// TruckCapacity returns how much a truck can still take on top of the
+// shipments it carries or has reserved.
+func (h *FleetHandler) TruckCapacity(c *gin.Context) {
+	ctx := c.Request.Context()
+	var capacity models.TruckCapacity
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		var orgID *string
+		if err := tx.QueryRow(ctx, "SELECT org_id FROM trucks WHERE id=$1", c.Param("id")).Scan(&orgID); err != nil || orgID == nil || *orgID != c.GetString("org_id") {
+			return errTruckNotFound
+		}
+		truck, carried, _, err := truckLoad(ctx, tx, c.Param("id"), "")
+		if err != nil {
+			return err
+		}
+		remainingKg, remainingM3 := fleet.Remaining(truck, carried)
+		capacity = models.TruckCapacity{
+			TruckID:     c.Param("id"),
+			CapacityKg:  truck.CapacityKg,
+			CapacityM3:  truck.CapacityM3,
+			LoadKg:      carried.WeightKg,
+			LoadM3:      carried.VolumeM3,
+			RemainingKg: remainingKg,
+			RemainingM3: remainingM3,
+			CargoTypes:  carried.CargoTypes,
+		}
+		return nil
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, capacity)
+}
+
+// truckLoad locks a truck and returns what it can carry, its status, and the
+// load of the shipments it is carrying or has been given but not picked up yet,
+// leaving out excludeShipmentID.
+func truckLoad(ctx context.Context, tx pgx.Tx, truckID, excludeShipmentID string) (fleet.Truck, fleet.Carried, string, error) {
+	var truck fleet.Truck
+	var carried fleet.Carried
+	var status string
+	err := tx.QueryRow(ctx, `
+		SELECT capacity_kg, capacity_m3, refrigerated, covered, livestock, status
+		FROM trucks WHERE id=$1 FOR UPDATE
+	`, truckID).Scan(&truck.CapacityKg, &truck.CapacityM3, &truck.Refrigerated, &truck.Covered, &truck.Livestock, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return truck, carried, "", errTruckNotFound
+	}
+	if err != nil {
+		return truck, carried, "", err
+	}
+
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(SUM(weight_kg), 0), COALESCE(SUM(volume_m3), 0), COALESCE(ARRAY_AGG(DISTINCT cargo_type), '{}')
+		FROM shipments WHERE truck_id=$1 AND status IN ('CREATED', 'IN_TRANSIT') AND id <> $2
+	`, truckID, excludeShipmentID).Scan(&carried.WeightKg, &carried.VolumeM3, &carried.CargoTypes)
+	return truck, carried, status, err
+}
+
+func normalizeTruckRequest(req *models.TruckRequest) {
+	req.PlateNumber = strings.ToUpper(strings.TrimSpace(req.PlateNumber))
+	if req.Status == "" {
+		req.Status = models.TruckActive
+	}
+}
+
+// checkPlate rejects a plate number already used by another truck of the organization still in service.
+func checkPlate(ctx context.Context, tx pgx.Tx, orgID, truckID string, req models.TruckRequest) error {
+	if req.Status == models.TruckRetired {
+		return nil
+	}
+	var taken bool
+	err := tx.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM trucks
+			WHERE org_id=$1 AND id<>$2 AND UPPER(plate_number)=$3 AND status<>'retired'
+		)
+	`, orgID, truckID, req.PlateNumber).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errPlateTaken
+	}
+	return nil
+}
+
+// lockTruck locks a truck of the organization and returns its status.
+func lockTruck(ctx context.Context, tx pgx.Tx, truckID, orgID string) (string, error) {
+	var status string
+	err := tx.QueryRow(ctx, "SELECT status FROM trucks WHERE id=$1 AND org_id=$2 FOR UPDATE", truckID, orgID).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errTruckNotFound
+	}
+	return status, err
+}
+
+// endAssignments closes the open assignments of a truck and/or a driver.
+// It refuses while the truck involved is carrying a shipment.
+func endAssignments(ctx context.Context, tx pgx.Tx, truckID, driverID string) error {
+	var inTransit bool
+	err := tx.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM shipments s
+			WHERE s.status = 'IN_TRANSIT' AND (s.truck_id = $1 OR s.truck_id IN (
+				SELECT truck_id FROM truck_assignments WHERE driver_id = $2 AND unassigned_at IS NULL
+			))
+		)
+	`, truckID, driverID).Scan(&inTransit)
+	if err != nil {
+		return err
+	}
+	if inTransit {
+		return errTruckInTransit
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE truck_assignments SET unassigned_at = NOW()
+		WHERE unassigned_at IS NULL AND (truck_id = $1 OR driver_id = $2)
+	`, truckID, driverID)
+	return err
+}
+
+// ListDrivers returns the driver profiles of the current organization.
+func (h *FleetHandler) ListDrivers(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT d.user_id, d.full_name, d.license_number, d.phone, d.status, a.truck_id, d.created_at
+		FROM drivers d
+		LEFT JOIN truck_assignments a ON a.driver_id = d.user_id AND a.unassigned_at IS NULL
+		WHERE d.org_id = $1 AND ($2 = '' OR d.status = $2)
+		ORDER BY d.full_name
+	`, c.GetString("org_id"), c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch drivers"})
+		return
+	}
+	defer rows.Close()
+
+	drivers := []models.Driver{}
+	for rows.Next() {
+		var d models.Driver
+		if err := rows.Scan(&d.UserID, &d.FullName, &d.LicenseNumber, &d.Phone, &d.Status, &d.TruckID, &d.CreatedAt); err != nil {
+			continue
+		}
+		drivers = append(drivers, d)
+	}
+
+	c.JSON(http.StatusOK, drivers)
+}
+
+// CreateDriver invites a driver account to drive for the organization. The
+// driver profile is created when the driver accepts, see AcceptInvitation.
+// Like AddMember, the answer doesn't tell whether the account exists. A
+// driver can give their own personal organization a profile directly.
+func (h *FleetHandler) CreateDriver(c *gin.Context) {
+	var req models.DriverRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+	if req.Status == "" {
+		req.Status = models.DriverActive
+	}
+
+	ctx := c.Request.Context()
+	var userID, role string
+	var phone *string
+	var err error
+	switch {
+	case req.UserID != "":
+		err = db.Pool.QueryRow(ctx, "SELECT id, role, phone FROM users WHERE id=$1", req.UserID).Scan(&userID, &role, &phone)
+	case req.Email != "":
+		err = db.Pool.QueryRow(ctx, "SELECT id, role, phone FROM users WHERE email=$1", req.Email).Scan(&userID, &role, &phone)
+	case req.Phone != "":
+		normalized, perr := utils.NormalizePhone(req.Phone)
+		if perr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": perr.Error()})
+			return
+		}
+		err = db.Pool.QueryRow(ctx, "SELECT id, role, phone FROM users WHERE phone=$1", normalized).Scan(&userID, &role, &phone)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id, email or phone is required"})
+		return
+	}
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Printf("Failed to look up driver account: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update fleet"})
+		return
+	}
+
+	orgID := c.GetString("org_id")
+	self := err == nil && userID == c.GetString("user_id")
+	if self && role != models.RoleDriver {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only driver accounts can have a driver profile"})
+		return
+	}
+	var kind string
+	if err := db.Pool.QueryRow(ctx, "SELECT kind FROM organizations WHERE id=$1", orgID).Scan(&kind); err != nil {
+		h.respond(c, err)
+		return
+	}
+	if kind == models.OrgIndividual && !self {
+		h.respond(c, errPersonalOrg)
+		return
+	}
+
+	if self {
+		_, err = db.Pool.Exec(ctx, `
+			INSERT INTO drivers (user_id, org_id, full_name, license_number, phone, status)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, userID, orgID, req.FullName, req.LicenseNumber, phone, req.Status)
+		if db.IsUniqueViolation(err, "drivers_pkey") {
+			c.JSON(http.StatusConflict, gin.H{"error": "This driver already has a profile"})
+			return
+		}
+		if !h.respond(c, err) {
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"user_id": userID, "full_name": req.FullName, "status": req.Status})
+		return
+	}
+
+	// Only driver accounts get an invitation, anything else is quietly left out
+	if err == nil && role == models.RoleDriver {
+		err = inTx(ctx, func(tx pgx.Tx) error {
+			return inviteDriver(ctx, tx, orgID, userID, c.GetString("user_id"), req)
+		})
+	} else {
+		err = nil
+	}
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": models.InvitationPending, "full_name": req.FullName})
+}
+
+// inviteDriver invites a driver account to drive for an organization, as a
+// member if it isn't one yet. A membership invitation already waiting gets
+// the driver profile added.
+func inviteDriver(ctx context.Context, tx pgx.Tx, orgID, userID, invitedBy string, req models.DriverRequest) error {
+	var id int
+	err := tx.QueryRow(ctx, `
+		INSERT INTO org_invitations (org_id, user_id, role, invited_by, driver_full_name, driver_license_number, driver_status)
+		VALUES ($1, $2, 'member', $3, $4, $5, $6)
+		ON CONFLICT (org_id, user_id) WHERE status = 'PENDING' DO UPDATE
+		SET driver_full_name = EXCLUDED.driver_full_name, driver_license_number = EXCLUDED.driver_license_number,
+			driver_status = EXCLUDED.driver_status
+		RETURNING id
+	`, orgID, userID, invitedBy, req.FullName, req.LicenseNumber, req.Status).Scan(&id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO user_notifications (user_id, kind, title, body, data)
+		SELECT $1, 'driver.invited', 'Invitation to drive for ' || name, name || ' wants you to drive for them.',
+			jsonb_build_object('invitation_id', $2::int, 'org_id', id)
+		FROM organizations WHERE id = $3
+	`, userID, id, orgID)
+	return err
+}
+
+// UpdateDriver changes a driver's name, license and status. Deactivating a
+// driver ends their current assignment.
+func (h *FleetHandler) UpdateDriver(c *gin.Context) {
+	var req models.DriverRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+	if req.Status == "" {
+		req.Status = models.DriverActive
+	}
+
+	ctx := c.Request.Context()
+	driverID := c.Param("id")
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		if _, err := lockDriver(ctx, tx, driverID, c.GetString("org_id")); err != nil {
+			return err
+		}
+		if req.Status != models.DriverActive {
+			if err := endAssignments(ctx, tx, "", driverID); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, `
+			UPDATE drivers SET full_name=$1, license_number=$2, status=$3 WHERE user_id=$4
+		`, req.FullName, req.LicenseNumber, req.Status, driverID)
+		return err
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": driverID, "full_name": req.FullName, "status": req.Status})
+}
+
+func lockDriver(ctx context.Context, tx pgx.Tx, driverID, orgID string) (string, error) {
+	var status string
+	err := tx.QueryRow(ctx, "SELECT status FROM drivers WHERE user_id=$1 AND org_id=$2 FOR UPDATE", driverID, orgID).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errDriverNotFound
+	}
+	return status, err
+}
+
+// AssignDriver puts a driver on a truck, ending whatever the truck and the
+// driver were assigned to before.
+func (h *FleetHandler) AssignDriver(c *gin.Context) {
+	var req models.AssignRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	ctx := c.Request.Context()
+	orgID := c.GetString("org_id")
+	truckID := c.Param("id")
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		truckStatus, err := lockTruck(ctx, tx, truckID, orgID)
+		if err != nil {
+			return err
+		}
+		if truckStatus != models.TruckActive {
+			return errTruckUnavailable
+		}
+		driverStatus, err := lockDriver(ctx, tx, req.DriverID, orgID)
+		if err != nil {
+			return err
+		}
+		if driverStatus != models.DriverActive {
+			return errDriverInactive
+		}
+
+		if err := endAssignments(ctx, tx, truckID, req.DriverID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO truck_assignments (truck_id, driver_id, assigned_by) VALUES ($1, $2, $3)
+		`, truckID, req.DriverID, c.GetString("user_id"))
+		return err
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"truck_id": truckID, "driver_id": req.DriverID})
+}
+
+// UnassignTruck takes the current driver off a truck.
+func (h *FleetHandler) UnassignTruck(c *gin.Context) {
+	ctx := c.Request.Context()
+	truckID := c.Param("id")
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		if _, err := lockTruck(ctx, tx, truckID, c.GetString("org_id")); err != nil {
+			return err
+		}
+		return endAssignments(ctx, tx, truckID, "")
+	})
+	if !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"truck_id": truckID, "driver_id": nil})
+}
+
+// TruckAssignments returns every driver who has driven a truck, latest first.
+func (h *FleetHandler) TruckAssignments(c *gin.Context) {
+	h.assignments(c, "a.truck_id = $1")
+}
+
+// DriverAssignments returns every truck a driver has driven, latest first.
+func (h *FleetHandler) DriverAssignments(c *gin.Context) {
+	h.assignments(c, "a.driver_id = $1")
+}
+
+func (h *FleetHandler) assignments(c *gin.Context, cond string) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT a.id, a.truck_id, t.plate_number, a.driver_id, d.full_name, a.assigned_by, a.assigned_at, a.unassigned_at
+		FROM truck_assignments a
+		JOIN trucks t ON t.id = a.truck_id
+		JOIN drivers d ON d.user_id = a.driver_id
+		WHERE `+cond+` AND t.org_id = $2
+		ORDER BY a.assigned_at DESC
+	`, c.Param("id"), c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch assignments"})
+		return
+	}
+	defer rows.Close()
+
+	history := []models.TruckAssignment{}
+	for rows.Next() {
+		var a models.TruckAssignment
+		if err := rows.Scan(&a.ID, &a.TruckID, &a.PlateNumber, &a.DriverID, &a.DriverName, &a.AssignedBy, &a.AssignedAt, &a.UnassignedAt); err != nil {
+			continue
+		}
+		history = append(history, a)
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+// MyTruck returns the truck the calling driver is currently assigned to.
+func (h *FleetHandler) MyTruck(c *gin.Context) {
+	t, err := scanTruck(db.Pool.QueryRow(c.Request.Context(), `SELECT `+truckColumns+truckFrom+`
+		WHERE a.driver_id = $1
+	`, c.GetString("user_id")))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "You are not assigned to a truck"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch truck"})
+		return
+	}
+
+	c.JSON(http.StatusOK, t)
+}
+
+// inTx runs fn in a transaction and commits if it succeeds.
+func inTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// respond writes the error response for a failed fleet change and reports whether it succeeded.
+func (h *FleetHandler) respond(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errTruckNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Truck not found"})
+	case errors.Is(err, errDriverNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Driver not found"})
+	case errors.Is(err, errTruckUnavailable), errors.Is(err, errDriverInactive), errors.Is(err, errPersonalOrg):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errTruckInTransit), errors.Is(err, errPlateTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case db.IsUniqueViolation(err, "truck_assignments_open_truck_idx"), db.IsUniqueViolation(err, "truck_assignments_open_driver_idx"):
+		// Lost a race with a concurrent assignment
+		c.JSON(http.StatusConflict, gin.H{"error": "Assignment changed, try again"})
+	default:
+		log.Printf("Fleet update failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update fleet"})
+	}
+	return false
+}
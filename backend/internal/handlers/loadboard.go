@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"agri-track/internal/db"
+	"agri-track/internal/fleet"
+	"agri-track/internal/geo"
+	"agri-track/internal/models"
+	"agri-track/internal/roads"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	errShipmentNotOpen = errors.New("shipment is no longer open")
+	errPickupClosed    = errors.New("pickup window has passed")
+	errClaimNotFound   = errors.New("claim not found")
+	errClaimDecided    = errors.New("claim was already decided or withdrawn")
+	errDriverMoved     = errors.New("driver is no longer assigned to the claimed truck")
+)
+
+// Load board search defaults, in kilometers
+const (
+	defaultBoardRadiusKm   = 50
+	maxBoardRadiusKm       = 500
+	defaultBoardCorridorKm = 15
+	loadBoardLimit         = 100
+)
+
+type LoadBoardHandler struct {
+	// Lays out the driver's route for along-route search
+	router roads.Router
+}
+
+func NewLoadBoardHandler(router roads.Router) *LoadBoardHandler {
+	return &LoadBoardHandler{router: router}
+}
+
+// ListOpenShipments shows drivers the unassigned shipments near them.
+//
+// The driver's position is ?lat=&lon=, or the last position of their truck.
+// Without a destination, shipments within ?radius_km= of it are listed. With
+// ?dest_lat=&dest_lon=, shipments whose pickup and drop-off both lie within
+// ?corridor_km= of the driver's road route, in the driving direction, are listed.
+// ?sort= is distance (default), payout or pickup.
+func (h *LoadBoardHandler) ListOpenShipments(c *gin.Context) {
+	ctx := c.Request.Context()
+	driverID := c.GetString("user_id")
+
+	truckID, err := assignedTruck(ctx, db.Pool, driverID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load your truck"})
+		return
+	}
+
+	here, ok := queryPoint(c, "lat", "lon")
+	if !ok {
+		err := db.Pool.QueryRow(ctx, `
+			SELECT latitude, longitude FROM logistics_events WHERE truck_id=$1 ORDER BY time DESC LIMIT 1
+		`, truckID).Scan(&here.Lat, &here.Lon)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Your position is unknown, send lat and lon"})
+			return
+		}
+	}
+	dest, alongRoute := queryPoint(c, "dest_lat", "dest_lon")
+
+	radius := queryFloat(c, "radius_km", defaultBoardRadiusKm)
+	if radius <= 0 || radius > maxBoardRadiusKm {
+		radius = defaultBoardRadiusKm
+	}
+	corridor := queryFloat(c, "corridor_km", defaultBoardCorridorKm)
+	if corridor <= 0 || corridor > maxBoardRadiusKm {
+		corridor = defaultBoardCorridorKm
+	}
+
+	// Prefilter on the bounding box of the search area
+	minLat, maxLat, minLon, maxLon := geo.BoundingBox(here, radius*1000)
+	var line []geo.Point
+	if alongRoute {
+		line = []geo.Point{here, dest}
+		if path, err := h.router.Route(here, dest, roads.Fastest); err == nil {
+			line = path.Points
+		}
+		minLat, maxLat, minLon, maxLon = geo.BoundingBox(here, corridor*1000)
+		for _, p := range line {
+			pLat, pLatMax, pLon, pLonMax := geo.BoundingBox(p, corridor*1000)
+			minLat, maxLat = min(minLat, pLat), max(maxLat, pLatMax)
+			minLon, maxLon = min(minLon, pLon), max(maxLon, pLonMax)
+		}
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT s.id, s.origin_lat, s.origin_lon, s.dest_lat, s.dest_lon, s.commodity, s.cargo_type,
+		       s.weight_kg, s.volume_m3, s.payout, s.pickup_from, s.pickup_until, COALESCE(s.created_at, NOW()),
+		       (SELECT status FROM shipment_claims WHERE shipment_id = s.id AND driver_id = $1 ORDER BY created_at DESC LIMIT 1)
+		FROM shipments s
+		WHERE s.status = 'CREATED' AND s.truck_id IS NULL
+		AND (s.pickup_code_expires_at IS NULL OR s.pickup_code_expires_at > NOW())
+		AND (s.pickup_until IS NULL OR s.pickup_until > NOW())
+		AND s.origin_lat BETWEEN $2 AND $3 AND s.origin_lon BETWEEN $4 AND $5
+	`, driverID, minLat, maxLat, minLon, maxLon)
+	if err != nil {
+		log.Printf("Failed to fetch load board: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch load board"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.LoadBoardEntry{}
+	for rows.Next() {
+		var e models.LoadBoardEntry
+		err := rows.Scan(&e.ShipmentID, &e.OriginLat, &e.OriginLon, &e.DestLat, &e.DestLon, &e.Commodity, &e.CargoType,
+			&e.WeightKg, &e.VolumeM3, &e.Payout, &e.PickupFrom, &e.PickupUntil, &e.CreatedAt, &e.MyClaim)
+		if err != nil {
+			continue
+		}
+
+		origin := geo.Point{Lat: e.OriginLat, Lon: e.OriginLon}
+		destination := geo.Point{Lat: e.DestLat, Lon: e.DestLon}
+		if alongRoute {
+			pickupAt, pickupOff := geo.ProjectLine(origin, line)
+			dropAt, dropOff := geo.ProjectLine(destination, line)
+			if pickupOff > corridor*1000 || dropOff > corridor*1000 || dropAt < pickupAt {
+				continue
+			}
+		}
+		e.DistanceKm = geo.Haversine(here, origin) / 1000
+		if !alongRoute && e.DistanceKm > radius {
+			continue
+		}
+		e.TripKm = geo.Haversine(origin, destination) / 1000
+		entries = append(entries, e)
+	}
+	rows.Close()
+
+	sortLoadBoard(entries, c.DefaultQuery("sort", "distance"))
+	if len(entries) > loadBoardLimit {
+		entries = entries[:loadBoardLimit]
+	}
+
+	if err := h.markFit(ctx, truckID, entries); err != nil {
+		log.Printf("Failed to check load board fit: %v", err)
+	}
+
+	resp := gin.H{"position": here, "shipments": entries}
+	if alongRoute {
+		resp["route"] = line
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func sortLoadBoard(entries []models.LoadBoardEntry, by string) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch by {
+		case "payout":
+			// Highest first, unknown payouts last
+			if (a.Payout == nil) != (b.Payout == nil) {
+				return a.Payout != nil
+			}
+			if a.Payout != nil && *a.Payout != *b.Payout {
+				return *a.Payout > *b.Payout
+			}
+		case "pickup":
+			// Earliest pickup window first, open-ended last
+			if (a.PickupFrom == nil) != (b.PickupFrom == nil) {
+				return a.PickupFrom != nil
+			}
+			if a.PickupFrom != nil && !a.PickupFrom.Equal(*b.PickupFrom) {
+				return a.PickupFrom.Before(*b.PickupFrom)
+			}
+		}
+		return a.DistanceKm < b.DistanceKm
+	})
+}
+
+// markFit records on each entry whether the driver's truck can take it.
+func (h *LoadBoardHandler) markFit(ctx context.Context, truckID string, entries []models.LoadBoardEntry) error {
+	if truckID == "" {
+		for i := range entries {
+			entries[i].FitReason = "you are not assigned to a truck"
+		}
+		return nil
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	truck, carried, _, err := truckLoad(ctx, tx, truckID, "")
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		e := &entries[i]
+		err := fleet.CheckFit(truck, fleet.Load{WeightKg: e.WeightKg, VolumeM3: e.VolumeM3, CargoType: e.CargoType}, carried)
+		e.Fits = err == nil
+		if err != nil {
+			e.FitReason = err.Error()
+		}
+	}
+	return nil
+}
+
+// ClaimShipment asks the owner of an open shipment to give it to the driver's truck.
+func (h *LoadBoardHandler) ClaimShipment(c *gin.Context) {
+	var req models.ClaimRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	ctx := c.Request.Context()
+	driverID := c.GetString("user_id")
+	truckID, err := assignedTruck(ctx, db.Pool, driverID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusConflict, gin.H{"error": "You are not assigned to a truck, ask your dispatcher to assign one"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load your truck"})
+		return
+	}
+
+	shipmentID := c.Param("id")
+	var claimID int
+	err = inTx(ctx, func(tx pgx.Tx) error {
+		load, err := lockOpenShipment(ctx, tx, shipmentID, "")
+		if err != nil {
+			return err
+		}
+		if err := checkTruckFit(ctx, tx, truckID, shipmentID, load); err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, `
+			INSERT INTO shipment_claims (shipment_id, driver_id, truck_id, message)
+			VALUES ($1, $2, $3, NULLIF($4, ''))
+			RETURNING id
+		`, shipmentID, driverID, truckID, req.Message).Scan(&claimID)
+	})
+	if db.IsUniqueViolation(err, "shipment_claims_pending_idx") {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already have a pending claim on this shipment"})
+		return
+	}
+	if fitError(c, err) || !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": claimID, "shipment_id": shipmentID, "truck_id": truckID, "status": models.ClaimPending})
+}
+
+// MyClaims returns the calling driver's claims, latest first.
+func (h *LoadBoardHandler) MyClaims(c *gin.Context) {
+	h.listClaims(c, "c.driver_id = $1", c.GetString("user_id"))
+}
+
+// ListClaims returns the claims on a shipment of the current organization.
+func (h *LoadBoardHandler) ListClaims(c *gin.Context) {
+	h.listClaims(c, "c.shipment_id = $1 AND s.org_id = $2", c.Param("id"), c.GetString("org_id"))
+}
+
+func (h *LoadBoardHandler) listClaims(c *gin.Context, cond string, args ...interface{}) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT c.id, c.shipment_id, c.driver_id, d.full_name, c.truck_id, t.plate_number, c.message, c.status, c.created_at, c.decided_at
+		FROM shipment_claims c
+		JOIN shipments s ON s.id = c.shipment_id
+		JOIN trucks t ON t.id = c.truck_id
+		LEFT JOIN drivers d ON d.user_id = c.driver_id
+		WHERE `+cond+`
+		ORDER BY c.created_at DESC
+	`, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch claims"})
+		return
+	}
+	defer rows.Close()
+
+	claims := []models.ShipmentClaim{}
+	for rows.Next() {
+		var cl models.ShipmentClaim
+		err := rows.Scan(&cl.ID, &cl.ShipmentID, &cl.DriverID, &cl.DriverName, &cl.TruckID, &cl.PlateNumber, &cl.Message, &cl.Status, &cl.CreatedAt, &cl.DecidedAt)
+		if err != nil {
+			continue
+		}
+		claims = append(claims, cl)
+	}
+
+	c.JSON(http.StatusOK, claims)
+}
+
+// WithdrawClaim lets a driver take back a pending claim.
+func (h *LoadBoardHandler) WithdrawClaim(c *gin.Context) {
+	tag, err := db.Pool.Exec(c.Request.Context(), `
+		UPDATE shipment_claims SET status='WITHDRAWN', decided_at=NOW()
+		WHERE id=$1 AND driver_id=$2 AND status='PENDING'
+	`, c.Param("id"), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to withdraw claim"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No pending claim with that ID"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "status": models.ClaimWithdrawn})
+}
+
+// AcceptClaim gives the shipment to the claiming driver's truck and turns down
+// every other pending claim on it.
+func (h *LoadBoardHandler) AcceptClaim(c *gin.Context) {
+	ctx := c.Request.Context()
+	shipmentID := c.Param("id")
+	var truckID string
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		load, err := lockOpenShipment(ctx, tx, shipmentID, c.GetString("org_id"))
+		if err != nil {
+			return err
+		}
+
+		var driverID, status string
+		err = tx.QueryRow(ctx, `
+			SELECT driver_id, truck_id, status FROM shipment_claims WHERE id=$1 AND shipment_id=$2 FOR UPDATE
+		`, c.Param("claim_id"), shipmentID).Scan(&driverID, &truckID, &status)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errClaimNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if status != models.ClaimPending {
+			return errClaimDecided
+		}
+
+		// The driver may have moved to another truck since claiming
+		if current, err := assignedTruck(ctx, tx, driverID); err != nil || current != truckID {
+			return errDriverMoved
+		}
+		if err := checkTruckFit(ctx, tx, truckID, shipmentID, load); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, "UPDATE shipments SET truck_id=$1 WHERE id=$2", truckID, shipmentID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE shipment_claims
+			SET status = CASE WHEN id = $1 THEN 'ACCEPTED' ELSE 'REJECTED' END, decided_at = NOW()
+			WHERE shipment_id = $2 AND status = 'PENDING'
+		`, c.Param("claim_id"), shipmentID)
+		if err != nil {
+			return err
+		}
+
+		// The board never shows pickup codes, the driver gets this one to collect the load with
+		_, err = tx.Exec(ctx, `
+			INSERT INTO user_notifications (user_id, kind, title, body, data)
+			SELECT $1, 'claim.accepted', 'Claim accepted', 'Your claim was accepted. Pickup code: ' || pickup_code,
+				jsonb_build_object('shipment_id', id, 'claim_id', $3::int, 'pickup_code', pickup_code)
+			FROM shipments WHERE id = $2
+		`, driverID, shipmentID, c.Param("claim_id"))
+		return err
+	})
+	if fitError(c, err) || !h.respond(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": c.Param("claim_id"), "shipment_id": shipmentID, "truck_id": truckID, "status": models.ClaimAccepted})
+}
+
+// RejectClaim turns down one pending claim on a shipment of the current organization.
+func (h *LoadBoardHandler) RejectClaim(c *gin.Context) {
+	tag, err := db.Pool.Exec(c.Request.Context(), `
+		UPDATE shipment_claims c SET status='REJECTED', decided_at=NOW()
+		FROM shipments s
+		WHERE c.id=$1 AND c.shipment_id=$2 AND c.status='PENDING'
+		AND s.id = c.shipment_id AND s.org_id = $3
+	`, c.Param("claim_id"), c.Param("id"), c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reject claim"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No pending claim with that ID on this shipment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": c.Param("claim_id"), "status": models.ClaimRejected})
+}
+
+// lockOpenShipment locks an unassigned CREATED shipment whose pickup window
+// hasn't passed and returns its load.
+// An empty orgID skips the ownership check.
+func lockOpenShipment(ctx context.Context, tx pgx.Tx, shipmentID, orgID string) (fleet.Load, error) {
+	var load fleet.Load
+	var status string
+	var truckID *string
+	var pickupOpen bool
+	err := tx.QueryRow(ctx, `
+		SELECT status, truck_id, weight_kg, volume_m3, cargo_type, (pickup_until IS NULL OR pickup_until > NOW())
+		FROM shipments
+		WHERE id=$1 AND ($2 = '' OR org_id = $2)
+		FOR UPDATE
+	`, shipmentID, orgID).Scan(&status, &truckID, &load.WeightKg, &load.VolumeM3, &load.CargoType, &pickupOpen)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return load, pgx.ErrNoRows
+	}
+	if err != nil {
+		return load, err
+	}
+	if status != "CREATED" || truckID != nil {
+		return load, errShipmentNotOpen
+	}
+	if !pickupOpen {
+		return load, errPickupClosed
+	}
+	return load, nil
+}
+
+func (h *LoadBoardHandler) respond(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, pgx.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+	case errors.Is(err, errClaimNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Claim not found"})
+	case errors.Is(err, errShipmentNotOpen), errors.Is(err, errPickupClosed), errors.Is(err, errClaimDecided), errors.Is(err, errDriverMoved):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Load board action failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update claim"})
+	}
+	return false
+}
+
+// queryPoint reads a coordinate pair from the query string.
+func queryPoint(c *gin.Context, latKey, lonKey string) (geo.Point, bool) {
+	lat, err1 := strconv.ParseFloat(c.Query(latKey), 64)
+	lon, err2 := strconv.ParseFloat(c.Query(lonKey), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return geo.Point{}, false
+	}
+	return geo.Point{Lat: lat, Lon: lon}, true
+}
+
+func queryFloat(c *gin.Context, key string, fallback float64) float64 {
+	v, err := strconv.ParseFloat(c.Query(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return v
+}
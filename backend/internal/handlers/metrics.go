@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"agri-track/internal/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// domainMetricsTimeout bounds the queries behind the shipment and incident
+// counts, so a slow database can't hold up a scrape
+const domainMetricsTimeout = 5 * time.Second
+
+// MetricsHandler serves the metrics kept by the handlers and middleware to
+// Prometheus, along with what is only worth reading when scraped: the
+// telemetry queue, the database pool and counts from the database.
+type MetricsHandler struct {
+	// Scrapers send it as a bearer token, without one nobody may scrape
+	token   string
+	handler http.Handler
+}
+
+func NewMetricsHandler(telemetry *TelemetryHandler, token string) *MetricsHandler {
+	// What is read at scrape time goes in a registry of its own, so another
+	// handler (as the tests make) doesn't register it twice in the default one
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agritrack_telemetry_queue_depth",
+			Help: "Telemetry events waiting for the batch processor.",
+		}, func() float64 { return float64(len(telemetry.eventChan)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agritrack_telemetry_queue_capacity",
+			Help: "Telemetry events the queue holds before turning more away.",
+		}, func() float64 { return float64(cap(telemetry.eventChan)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agritrack_telemetry_shipment_cache_size",
+			Help: "Shipments on the road cached for incoming telemetry.",
+		}, func() float64 {
+			telemetry.cacheMutex.RLock()
+			defer telemetry.cacheMutex.RUnlock()
+			return float64(len(telemetry.shipmentCache))
+		}),
+		poolCollector{},
+		domainCollector{},
+	)
+
+	// The default registry carries the Go runtime and process collectors
+	// besides the handler and middleware metrics
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, reg}
+	return &MetricsHandler{
+		token:   token,
+		handler: promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{ErrorLog: log.Default()}),
+	}
+}
+
+func (h *MetricsHandler) Serve(c *gin.Context) {
+	if h.token == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(h.token)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid metrics token"})
+		return
+	}
+
+	h.handler.ServeHTTP(c.Writer, c.Request)
+}
+
+var (
+	poolAcquiredConns     = prometheus.NewDesc("agritrack_db_pool_acquired_conns", "Database connections in use.", nil, nil)
+	poolIdleConns         = prometheus.NewDesc("agritrack_db_pool_idle_conns", "Database connections open and idle.", nil, nil)
+	poolConstructingConns = prometheus.NewDesc("agritrack_db_pool_constructing_conns", "Database connections being opened.", nil, nil)
+	poolTotalConns        = prometheus.NewDesc("agritrack_db_pool_total_conns", "Database connections open or being opened.", nil, nil)
+	poolMaxConns          = prometheus.NewDesc("agritrack_db_pool_max_conns", "Most database connections the pool opens.", nil, nil)
+	poolAcquires          = prometheus.NewDesc("agritrack_db_pool_acquires_total", "Connections acquired from the pool.", nil, nil)
+	poolEmptyAcquires     = prometheus.NewDesc("agritrack_db_pool_empty_acquires_total", "Acquires that had to wait for a connection.", nil, nil)
+	poolCanceledAcquires  = prometheus.NewDesc("agritrack_db_pool_canceled_acquires_total", "Acquires given up before getting a connection.", nil, nil)
+	poolAcquireDuration   = prometheus.NewDesc("agritrack_db_pool_acquire_duration_seconds_total", "Time spent acquiring connections.", nil, nil)
+
+	shipmentsByStatus = prometheus.NewDesc("agritrack_shipments", "Shipments, by status.", []string{"status"}, nil)
+	recentIncidents   = prometheus.NewDesc("agritrack_incidents_last_24h", "Incidents in the last 24 hours, by type.", []string{"type"}, nil)
+)
+
+// poolCollector reads the database pool's stats when scraped.
+type poolCollector struct{}
+
+func (poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		poolAcquiredConns, poolIdleConns, poolConstructingConns, poolTotalConns, poolMaxConns,
+		poolAcquires, poolEmptyAcquires, poolCanceledAcquires, poolAcquireDuration,
+	} {
+		ch <- d
+	}
+}
+
+func (poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := db.Pool.Stat()
+	ch <- prometheus.MustNewConstMetric(poolAcquiredConns, prometheus.GaugeValue, float64(s.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdleConns, prometheus.GaugeValue, float64(s.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolConstructingConns, prometheus.GaugeValue, float64(s.ConstructingConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotalConns, prometheus.GaugeValue, float64(s.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMaxConns, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquires, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolEmptyAcquires, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolCanceledAcquires, prometheus.CounterValue, float64(s.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolAcquireDuration, prometheus.CounterValue, s.AcquireDuration().Seconds())
+}
+
+// domainCollector counts shipments by status and the last day's incidents
+// by type, across every organization.
+type domainCollector struct{}
+
+func (domainCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- shipmentsByStatus
+	ch <- recentIncidents
+}
+
+func (domainCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), domainMetricsTimeout)
+	defer cancel()
+
+	// Still worth serving the rest, the database may be why someone is looking
+	if err := collectCounts(ctx, ch, shipmentsByStatus, "SELECT status, COUNT(*) FROM shipments GROUP BY status"); err != nil {
+		log.Printf("Failed to read shipment metrics: %v", err)
+	}
+	if err := collectCounts(ctx, ch, recentIncidents, `
+		SELECT incident_type, COUNT(*) FROM logistics_incidents
+		WHERE time > NOW() - INTERVAL '24 hours'
+		GROUP BY incident_type
+	`); err != nil {
+		log.Printf("Failed to read incident metrics: %v", err)
+	}
+}
+
+// collectCounts sends a gauge per row of a query returning a label and a count.
+func collectCounts(ctx context.Context, ch chan<- prometheus.Metric, desc *prometheus.Desc, query string) error {
+	rows, err := db.Pool.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var label string
+		var n int
+		if err := rows.Scan(&label, &n); err != nil {
+			return err
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(n), label)
+	}
+	return rows.Err()
+}
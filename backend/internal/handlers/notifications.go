@@ -0,0 +1,394 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/events"
+	"agri-track/internal/models"
+	"agri-track/internal/notify"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	notificationBatch       = 50               // Messages sent per round of the sender
+	notificationAttempts    = 5                // Before a message is given up on
+	notificationLease       = 10 * time.Minute // A claimed batch stays out of the due window this long
+	notifyIncidentsSeverity = 3                // Minor incidents aren't worth a text
+)
+
+// NotificationHandler serves the in-app inbox and tells shippers what
+// happens to their shipments over the channels they prefer.
+type NotificationHandler struct {
+	drivers notify.Drivers
+}
+
+func NewNotificationHandler(drivers notify.Drivers) *NotificationHandler {
+	return &NotificationHandler{drivers: drivers}
+}
+
+// Inbox is the in-app channel: messages land among the user's notifications.
+type Inbox struct{}
+
+func (Inbox) Send(ctx context.Context, userID string, m notify.Message) error {
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO user_notifications (user_id, kind, title, body, data) VALUES ($1, $2, $3, $4, $5)
+	`, userID, m.Kind, m.Subject, m.Body, m.Data)
+	return err
+}
+
+// ListNotifications returns the caller's latest notifications, only unread ones with ?unread=true.
+func (h *NotificationHandler) ListNotifications(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT id, kind, title, body, data, created_at, read_at
+		FROM user_notifications
+		WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)
+		ORDER BY created_at DESC
+		LIMIT 100
+	`, c.GetString("user_id"), c.Query("unread") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+		return
+	}
+	defer rows.Close()
+
+	notifications := []models.Notification{}
+	for rows.Next() {
+		var n models.Notification
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Title, &n.Body, &n.Data, &n.CreatedAt, &n.ReadAt); err != nil {
+			continue
+		}
+		notifications = append(notifications, n)
+	}
+
+	c.JSON(http.StatusOK, notifications)
+}
+
+// MarkRead marks one notification, or all of them without an ID, as read.
+func (h *NotificationHandler) MarkRead(c *gin.Context) {
+	_, err := db.Pool.Exec(c.Request.Context(), `
+		UPDATE user_notifications SET read_at = NOW()
+		WHERE user_id = $1 AND read_at IS NULL AND ($2 = '' OR id::text = $2)
+	`, c.GetString("user_id"), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// notifyOrg notifies the owners and dispatchers of an organization, as part
+// of the change it is about when q is a transaction.
+func notifyOrg(ctx context.Context, q events.Execer, orgID, kind, title, body string, data gin.H) error {
+	_, err := q.Exec(ctx, `
+		INSERT INTO user_notifications (user_id, kind, title, body, data)
+		SELECT user_id, $2, $3, $4, $5 FROM org_members
+		WHERE org_id = $1 AND role IN ('owner', 'dispatcher')
+	`, orgID, kind, title, body, data)
+	return err
+}
+
+// GetPreferences returns the caller's notification preferences, the
+// defaults if they never set any.
+func (h *NotificationHandler) GetPreferences(c *gin.Context) {
+	prefs, _, err := loadPreferences(c.Request.Context(), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch preferences"})
+		return
+	}
+
+	c.JSON(http.StatusOK, prefs)
+}
+
+// UpdatePreferences replaces the caller's notification preferences. An
+// empty list of channels turns notifications off.
+func (h *NotificationHandler) UpdatePreferences(c *gin.Context) {
+	var req models.NotificationPreferences
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+	if req.TimeZone == "" {
+		req.TimeZone = notify.DefaultTimeZone
+	}
+	if _, err := time.LoadLocation(req.TimeZone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown time zone " + req.TimeZone})
+		return
+	}
+	var quietStart, quietEnd *int
+	if req.QuietHours != nil {
+		start, err := notify.ParseClock(req.QuietHours.Start)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		end, err := notify.ParseClock(req.QuietHours.End)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if start == end {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Quiet hours must start and end at different times"})
+			return
+		}
+		quietStart, quietEnd = (*int)(&start), (*int)(&end)
+		req.QuietHours = &models.QuietHours{Start: start.String(), End: end.String()}
+	}
+	slices.Sort(req.Channels)
+	req.Channels = slices.Compact(req.Channels)
+
+	_, err := db.Pool.Exec(c.Request.Context(), `
+		INSERT INTO notification_preferences (user_id, channels, quiet_start, quiet_end, time_zone) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET channels=$2, quiet_start=$3, quiet_end=$4, time_zone=$5, updated_at=NOW()
+	`, c.GetString("user_id"), req.Channels, quietStart, quietEnd, req.TimeZone)
+	if err != nil {
+		log.Printf("Failed to save notification preferences: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save preferences"})
+		return
+	}
+
+	c.JSON(http.StatusOK, req)
+}
+
+// loadPreferences returns a user's notification preferences along with
+// their quiet hours, empty ones in their time zone if they have none.
+func loadPreferences(ctx context.Context, userID string) (models.NotificationPreferences, *notify.QuietHours, error) {
+	prefs := models.NotificationPreferences{Channels: notify.DefaultChannels, TimeZone: notify.DefaultTimeZone}
+	var quietStart, quietEnd *int
+	err := db.Pool.QueryRow(ctx, `
+		SELECT channels, quiet_start, quiet_end, time_zone FROM notification_preferences WHERE user_id = $1
+	`, userID).Scan(&prefs.Channels, &quietStart, &quietEnd, &prefs.TimeZone)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return prefs, nil, err
+	}
+
+	loc, err := time.LoadLocation(prefs.TimeZone)
+	if err != nil {
+		loc, _ = time.LoadLocation(notify.DefaultTimeZone)
+	}
+	quiet := &notify.QuietHours{Location: loc}
+	if quietStart != nil && quietEnd != nil {
+		quiet.Start, quiet.End = notify.Clock(*quietStart), notify.Clock(*quietEnd)
+		prefs.QuietHours = &models.QuietHours{Start: quiet.Start.String(), End: quiet.End.String()}
+	}
+	return prefs, quiet, nil
+}
+
+// NotifyShipper subscribes notifications to the event bus: it queues a
+// message about the event to the person who created the shipment on each
+// of their channels. Every message has a key for what it is about, so
+// events handed over again, or repeated by several handlers, are only
+// told once.
+func (h *NotificationHandler) NotifyShipper(ctx context.Context, e events.Event) error {
+	var (
+		userID           string
+		commodity, plate string
+		phone, email     *string
+	)
+	err := db.Pool.QueryRow(ctx, `
+		SELECT s.created_by, COALESCE(s.commodity, ''), COALESCE(t.plate_number, ''), u.phone, u.email
+		FROM shipments s
+		JOIN users u ON u.id = s.created_by
+		LEFT JOIN trucks t ON t.id = s.truck_id
+		WHERE s.id = $1
+	`, e.ShipmentID).Scan(&userID, &commodity, &plate, &phone, &email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil // Gone, or nobody to tell
+	}
+	if err != nil {
+		return err
+	}
+	prefs, quiet, err := loadPreferences(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	data := notify.Data{
+		ShipmentID: e.ShipmentID,
+		Commodity:  commodity,
+		Plate:      plate,
+		Time:       e.OccurredAt.In(quiet.Location).Format("15:04"),
+	}
+	dedupKey := e.Type + ":" + e.ShipmentID
+	switch e.Type {
+	case events.ShipmentNearDestination:
+		var d events.ShipmentNearDestinationData
+		if err := e.Decode(&d); err != nil {
+			return err
+		}
+		data.DistanceKm = max(1, int(math.Round(d.DistanceM/1000)))
+	case events.IncidentReported:
+		var d events.IncidentReportedData
+		if err := e.Decode(&d); err != nil {
+			return err
+		}
+		if d.Severity < notifyIncidentsSeverity {
+			return nil
+		}
+		data.Incident = notify.IncidentText(d.IncidentType)
+		if d.Place != nil {
+			data.Place = *d.Place
+		}
+		// The same trouble reported again within the hour is old news
+		dedupKey += ":" + d.IncidentType + ":" + strconv.FormatInt(e.OccurredAt.Truncate(time.Hour).Unix(), 10)
+	case events.ShipmentETABreach:
+		var d events.ShipmentETABreachData
+		if err := e.Decode(&d); err != nil {
+			return err
+		}
+		data.Time = d.ETA.In(quiet.Location).Format("Mon 15:04")
+		data.Due = d.DeliverBy.In(quiet.Location).Format("Mon 15:04")
+	}
+	msg, err := notify.Render(e.Type, data)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, channel := range prefs.Channels {
+		var to *string
+		switch channel {
+		case notify.SMS:
+			to = phone
+		case notify.Email:
+			to = email
+		case notify.InApp:
+			to = &userID
+		}
+		if to == nil || *to == "" {
+			continue
+		}
+		sendAfter := now
+		if notify.Deferrable(channel) {
+			sendAfter = quiet.Until(now)
+		}
+		_, err := db.Pool.Exec(ctx, `
+			INSERT INTO notification_messages (user_id, channel, recipient, kind, dedup_key, subject, body, data, send_after)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (user_id, channel, dedup_key) DO NOTHING
+		`, userID, channel, *to, msg.Kind, dedupKey, msg.Subject, msg.Body, msg.Data, sendAfter)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartSender sends due messages until ctx is cancelled.
+func (h *NotificationHandler) StartSender(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := h.SendDue(ctx); err != nil {
+				log.Printf("Sending notifications failed: %v", err)
+			}
+		}
+	}
+}
+
+// SendDue sends every message that is due, oldest first and up to a batch,
+// and returns how many it tried. A failed message is tried again with
+// backoff until it runs out of attempts.
+//
+// The batch is claimed by moving it out of the due window for a lease, so
+// no transaction is held open while the gateways are called. Messages whose
+// sender died before recording a result come due again once the lease ends.
+func (h *NotificationHandler) SendDue(ctx context.Context) (int, error) {
+	rows, err := db.Pool.Query(ctx, `
+		UPDATE notification_messages SET send_after = $2
+		WHERE id IN (
+			SELECT id FROM notification_messages
+			WHERE status = 'pending' AND send_after <= NOW()
+			ORDER BY send_after
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, channel, recipient, kind, subject, body, data, attempts
+	`, notificationBatch, time.Now().Add(notificationLease))
+	if err != nil {
+		return 0, err
+	}
+	type due struct {
+		id       int
+		channel  string
+		to       string
+		msg      notify.Message
+		attempts int
+	}
+	var batch []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.channel, &d.to, &d.msg.Kind, &d.msg.Subject, &d.msg.Body, &d.msg.Data, &d.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Sending stops well inside the lease, so no message is still being sent
+	// when another sender may claim it again
+	sendCtx, cancel := context.WithTimeout(ctx, notificationLease/2)
+	defer cancel()
+
+	for i, d := range batch {
+		if sendCtx.Err() != nil {
+			var rest []int
+			for _, r := range batch[i:] {
+				rest = append(rest, r.id)
+			}
+			if _, err := db.Pool.Exec(ctx, "UPDATE notification_messages SET send_after=NOW() WHERE id = ANY($1)", rest); err != nil {
+				log.Printf("Failed to release notifications: %v", err)
+			}
+			return i, nil
+		}
+
+		err := fmt.Errorf("no driver for %s", d.channel)
+		if driver, ok := h.drivers[d.channel]; ok {
+			err = nil
+			// Emailed reports carry their PDF
+			if d.msg.Kind == notify.KindReport && d.channel == notify.Email {
+				err = attachReport(sendCtx, &d.msg)
+			}
+			if err == nil {
+				err = driver.Send(sendCtx, d.to, d.msg)
+			}
+		}
+		if err == nil {
+			_, err = db.Pool.Exec(ctx, "UPDATE notification_messages SET status='sent', attempts=$2, sent_at=NOW() WHERE id=$1", d.id, d.attempts+1)
+		} else {
+			log.Printf("Failed to send %s notification %d: %v", d.channel, d.id, err)
+			status := "pending"
+			if d.attempts+1 >= notificationAttempts {
+				status = "failed"
+			}
+			_, err = db.Pool.Exec(ctx, `
+				UPDATE notification_messages SET status=$2, attempts=$3, last_error=$4, send_after=$5 WHERE id=$1
+			`, d.id, status, d.attempts+1, err.Error(), time.Now().Add(time.Duration(1<<d.attempts)*time.Minute))
+		}
+		// Keep going: the rest of the batch is claimed and would otherwise wait out the lease
+		if err != nil {
+			log.Printf("Failed to record notification %d: %v", d.id, err)
+		}
+	}
+	return len(batch), nil
+}
@@ -0,0 +1,580 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/models"
+	"agri-track/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type OrgHandler struct{}
+
+func NewOrgHandler() *OrgHandler {
+	return &OrgHandler{}
+}
+
+// createPersonalOrg gives a new account its own organization, so individual
+// farmers and drivers are tenants like everybody else.
+func createPersonalOrg(ctx context.Context, tx pgx.Tx, userID, name string) error {
+	if name == "" {
+		name = "Personal"
+	}
+	orgID := uuid.New().String()
+	if _, err := tx.Exec(ctx, "INSERT INTO organizations (id, name, kind) VALUES ($1, $2, 'individual')", orgID, name); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, "INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, 'owner')", orgID, userID)
+	return err
+}
+
+// ListMyOrgs returns every organization the caller belongs to, their
+// personal one first.
+func (h *OrgHandler) ListMyOrgs(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT o.id, o.name, o.kind, m.role, o.time_zone, o.created_at
+		FROM organizations o
+		JOIN org_members m ON m.org_id = o.id
+		WHERE m.user_id = $1
+		ORDER BY o.kind <> 'individual', m.joined_at
+	`, c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organizations"})
+		return
+	}
+	defer rows.Close()
+
+	orgs := []models.Organization{}
+	for rows.Next() {
+		var o models.Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.Kind, &o.Role, &o.TimeZone, &o.CreatedAt); err != nil {
+			continue
+		}
+		orgs = append(orgs, o)
+	}
+
+	c.JSON(http.StatusOK, orgs)
+}
+
+// CreateOrg creates a cooperative or haulage company owned by the caller.
+func (h *OrgHandler) CreateOrg(c *gin.Context) {
+	var req models.OrgRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	ctx := c.Request.Context()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	id := uuid.New().String()
+	_, err = tx.Exec(ctx, "INSERT INTO organizations (id, name, kind) VALUES ($1, $2, $3)", id, req.Name, req.Kind)
+	if err == nil {
+		_, err = tx.Exec(ctx, "INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, 'owner')", id, c.GetString("user_id"))
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		log.Printf("Failed to create organization: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": id, "name": req.Name, "kind": req.Kind, "role": models.OrgRoleOwner})
+}
+
+// UpdateSettings changes the current organization's settings. Its report
+// schedules move with its time zone: 07:00 stays 07:00 where it now is.
+func (h *OrgHandler) UpdateSettings(c *gin.Context) {
+	var req models.OrgSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+	loc, err := time.LoadLocation(req.TimeZone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown time zone " + req.TimeZone})
+		return
+	}
+
+	ctx := c.Request.Context()
+	orgID := c.GetString("org_id")
+	err = inTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "UPDATE organizations SET time_zone=$2 WHERE id=$1", orgID, req.TimeZone); err != nil {
+			return err
+		}
+		return rescheduleReports(ctx, tx, orgID, loc)
+	})
+	if err != nil {
+		log.Printf("Failed to update organization settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update organization"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": orgID, "time_zone": req.TimeZone})
+}
+
+// ListMembers returns the members of the current organization.
+func (h *OrgHandler) ListMembers(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT u.id, u.email, u.phone, u.name, m.role, m.joined_at
+		FROM org_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = $1
+		ORDER BY m.joined_at
+	`, c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+	defer rows.Close()
+
+	members := []models.OrgMember{}
+	for rows.Next() {
+		var m models.OrgMember
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Phone, &m.Name, &m.Role, &m.JoinedAt); err != nil {
+			continue
+		}
+		members = append(members, m)
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// AddMember invites an account to the current organization. The account
+// only becomes a member once it accepts. The answer is the same whether or
+// not the email or phone belongs to an account, so nobody can use this to
+// find out who is registered.
+func (h *OrgHandler) AddMember(c *gin.Context) {
+	var req models.OrgMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	if !h.sharedOrg(c) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	var userID string
+	var err error
+	if req.Email != "" {
+		err = db.Pool.QueryRow(ctx, "SELECT id FROM users WHERE email=$1", req.Email).Scan(&userID)
+	} else {
+		phone, perr := utils.NormalizePhone(req.Phone)
+		if perr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": perr.Error()})
+			return
+		}
+		err = db.Pool.QueryRow(ctx, "SELECT id FROM users WHERE phone=$1", phone).Scan(&userID)
+	}
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Printf("Failed to look up account to invite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invite member"})
+		return
+	}
+	if err == nil {
+		err = inTx(ctx, func(tx pgx.Tx) error {
+			_, err := inviteMember(ctx, tx, c.GetString("org_id"), userID, req.Role, c.GetString("user_id"))
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to invite member: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invite member"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": models.InvitationPending, "role": req.Role})
+}
+
+// inviteMember invites an account to an organization and tells it so. It
+// returns the invitation, or 0 when the account is a member already or has
+// an invitation waiting.
+func inviteMember(ctx context.Context, tx pgx.Tx, orgID, userID, role, invitedBy string) (int, error) {
+	var id int
+	err := tx.QueryRow(ctx, `
+		INSERT INTO org_invitations (org_id, user_id, role, invited_by)
+		SELECT $1, $2, $3, $4
+		WHERE NOT EXISTS (SELECT 1 FROM org_members WHERE org_id = $1 AND user_id = $2)
+		ON CONFLICT (org_id, user_id) WHERE status = 'PENDING' DO NOTHING
+		RETURNING id
+	`, orgID, userID, role, invitedBy).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO user_notifications (user_id, kind, title, body, data)
+		SELECT $1, 'org.invited', 'Invitation to ' || name, 'You were invited to join ' || name || '.',
+			jsonb_build_object('invitation_id', $2::int, 'org_id', id)
+		FROM organizations WHERE id = $3
+	`, userID, id, orgID)
+	return id, err
+}
+
+// ListInvitations returns the caller's invitations waiting for an answer.
+func (h *OrgHandler) ListInvitations(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT i.id, i.org_id, o.name, i.role, i.status, i.created_at, i.driver_full_name, i.driver_license_number, i.driver_status
+		FROM org_invitations i
+		JOIN organizations o ON o.id = i.org_id
+		WHERE i.user_id = $1 AND i.status = 'PENDING'
+		ORDER BY i.created_at DESC
+	`, c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+		return
+	}
+	defer rows.Close()
+
+	invitations := []models.OrgInvitation{}
+	for rows.Next() {
+		var i models.OrgInvitation
+		if err := rows.Scan(&i.ID, &i.OrgID, &i.OrgName, &i.Role, &i.Status, &i.CreatedAt, &i.DriverFullName, &i.DriverLicenseNumber, &i.DriverStatus); err != nil {
+			continue
+		}
+		invitations = append(invitations, i)
+	}
+
+	c.JSON(http.StatusOK, invitations)
+}
+
+// AcceptInvitation makes the caller a member of the organization that
+// invited them, and its driver when invited to drive.
+func (h *OrgHandler) AcceptInvitation(c *gin.Context) {
+	ctx := c.Request.Context()
+	var invitation models.OrgInvitation
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		invitation, err = lockInvitation(ctx, c, tx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)
+			ON CONFLICT (org_id, user_id) DO NOTHING
+		`, invitation.OrgID, c.GetString("user_id"), invitation.Role)
+		if err != nil {
+			return err
+		}
+		if invitation.DriverFullName != nil {
+			_, err := tx.Exec(ctx, `
+				INSERT INTO drivers (user_id, org_id, full_name, license_number, phone, status)
+				SELECT id, $2, $3, $4, phone, $5 FROM users WHERE id = $1
+			`, c.GetString("user_id"), invitation.OrgID, invitation.DriverFullName, invitation.DriverLicenseNumber, invitation.DriverStatus)
+			if db.IsUniqueViolation(err, "drivers_pkey") {
+				return errHasDriverProfile
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := answerInvitation(ctx, tx, invitation.ID, models.InvitationAccepted); err != nil {
+			return err
+		}
+		return notifyOrg(ctx, tx, invitation.OrgID, "org.invitation_accepted", "Invitation accepted",
+			"A new member joined the organization.", gin.H{"invitation_id": invitation.ID, "user_id": c.GetString("user_id")})
+	})
+	if !respondInvitation(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": invitation.ID, "org_id": invitation.OrgID, "role": invitation.Role, "status": models.InvitationAccepted})
+}
+
+// DeclineInvitation turns an invitation down.
+func (h *OrgHandler) DeclineInvitation(c *gin.Context) {
+	ctx := c.Request.Context()
+	var invitation models.OrgInvitation
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		invitation, err = lockInvitation(ctx, c, tx)
+		if err != nil {
+			return err
+		}
+		return answerInvitation(ctx, tx, invitation.ID, models.InvitationDeclined)
+	})
+	if !respondInvitation(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": invitation.ID, "status": models.InvitationDeclined})
+}
+
+var (
+	errInvitationNotFound = errors.New("invitation not found")
+	errHasDriverProfile   = errors.New("you already drive for an organization")
+)
+
+// lockInvitation locks the caller's pending invitation in the URL.
+func lockInvitation(ctx context.Context, c *gin.Context, tx pgx.Tx) (models.OrgInvitation, error) {
+	var i models.OrgInvitation
+	err := tx.QueryRow(ctx, `
+		SELECT id, org_id, role, status, created_at, driver_full_name, driver_license_number, driver_status FROM org_invitations
+		WHERE id::text = $1 AND user_id = $2 AND status = 'PENDING'
+		FOR UPDATE
+	`, c.Param("id"), c.GetString("user_id")).Scan(&i.ID, &i.OrgID, &i.Role, &i.Status, &i.CreatedAt,
+		&i.DriverFullName, &i.DriverLicenseNumber, &i.DriverStatus)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return i, errInvitationNotFound
+	}
+	return i, err
+}
+
+func answerInvitation(ctx context.Context, tx pgx.Tx, id int, status string) error {
+	_, err := tx.Exec(ctx, "UPDATE org_invitations SET status=$2, decided_at=NOW() WHERE id=$1", id, status)
+	return err
+}
+
+func respondInvitation(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errInvitationNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+	case errors.Is(err, errHasDriverProfile):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Failed to answer invitation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to answer invitation"})
+	}
+	return false
+}
+
+// UpdateMember changes a member's role in the current organization.
+func (h *OrgHandler) UpdateMember(c *gin.Context) {
+	var req models.OrgRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	err := h.changeMembership(c.Request.Context(), c.GetString("org_id"), c.Param("user_id"), func(tx pgx.Tx) error {
+		_, err := tx.Exec(c.Request.Context(), "UPDATE org_members SET role=$1 WHERE org_id=$2 AND user_id=$3", req.Role, c.GetString("org_id"), c.Param("user_id"))
+		return err
+	})
+	if !h.respondMembership(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": c.Param("user_id"), "role": req.Role})
+}
+
+// RemoveMember removes someone from the current organization.
+func (h *OrgHandler) RemoveMember(c *gin.Context) {
+	err := h.changeMembership(c.Request.Context(), c.GetString("org_id"), c.Param("user_id"), func(tx pgx.Tx) error {
+		_, err := tx.Exec(c.Request.Context(), "DELETE FROM org_members WHERE org_id=$1 AND user_id=$2", c.GetString("org_id"), c.Param("user_id"))
+		return err
+	})
+	if !h.respondMembership(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": c.Param("user_id"), "removed": true})
+}
+
+// UpdateAccountRole makes a member of the current organization a depot
+// manager, or a farmer again. Sign-up can't pick that role; drivers and
+// admins keep theirs. The change is audited like an admin's.
+func (h *OrgHandler) UpdateAccountRole(c *gin.Context) {
+	var req models.AccountRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	if !h.sharedOrg(c) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	orgID, targetID := c.GetString("org_id"), c.Param("user_id")
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		var previous string
+		err := tx.QueryRow(ctx, `
+			SELECT u.role FROM users u
+			JOIN org_members m ON m.user_id = u.id AND m.org_id = $2
+			WHERE u.id = $1
+			FOR UPDATE OF u
+		`, targetID, orgID).Scan(&previous)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotMember
+		}
+		if err != nil {
+			return err
+		}
+		if previous != models.RoleFarmer && previous != models.RoleDepotManager {
+			return errAccountRole
+		}
+		if _, err := tx.Exec(ctx, "UPDATE users SET role=$1 WHERE id=$2", req.Role, targetID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO audit_log (actor_id, action, target_id, details) VALUES ($1, 'user.role_change', $2, $3)
+		`, c.GetString("user_id"), targetID, gin.H{"role": req.Role, "previous_role": previous, "org_id": orgID})
+		return err
+	})
+	switch {
+	case errors.Is(err, errAccountRole):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only farmers and depot managers can be changed here"})
+		return
+	case !h.respondMembership(c, err):
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": targetID, "role": req.Role})
+}
+
+var (
+	errNotMember   = errors.New("not a member")
+	errLastOwner   = errors.New("organization needs at least one owner")
+	errAccountRole = errors.New("account role can't be changed by the organization")
+)
+
+// changeMembership applies fn and rolls back if the organization would be left without an owner.
+func (h *OrgHandler) changeMembership(ctx context.Context, orgID, userID string, fn func(tx pgx.Tx) error) error {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the member rows so two owners can't demote each other at once
+	rows, err := tx.Query(ctx, "SELECT user_id FROM org_members WHERE org_id=$1 FOR UPDATE", orgID)
+	if err != nil {
+		return err
+	}
+	exists := false
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil && id == userID {
+			exists = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !exists {
+		return errNotMember
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	var owners int
+	if err := tx.QueryRow(ctx, "SELECT COUNT(*) FROM org_members WHERE org_id=$1 AND role='owner'", orgID).Scan(&owners); err != nil {
+		return err
+	}
+	if owners == 0 {
+		return errLastOwner
+	}
+	return tx.Commit(ctx)
+}
+
+func (h *OrgHandler) respondMembership(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errNotMember):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not a member of this organization"})
+	case errors.Is(err, errLastOwner):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Failed to change membership: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update membership"})
+	}
+	return false
+}
+
+// sharedOrg rejects membership changes on personal organizations.
+func (h *OrgHandler) sharedOrg(c *gin.Context) bool {
+	var kind string
+	err := db.Pool.QueryRow(c.Request.Context(), "SELECT kind FROM organizations WHERE id=$1", c.GetString("org_id")).Scan(&kind)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load organization"})
+		return false
+	}
+	if kind == models.OrgIndividual {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Personal organizations can't have other members"})
+		return false
+	}
+	return true
+}
+
+// ListLocations returns the saved locations of the current organization.
+func (h *OrgHandler) ListLocations(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT id, name, latitude, longitude, created_at
+		FROM locations WHERE org_id=$1
+		ORDER BY name
+	`, c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch locations"})
+		return
+	}
+	defer rows.Close()
+
+	locations := []models.Location{}
+	for rows.Next() {
+		var l models.Location
+		if err := rows.Scan(&l.ID, &l.Name, &l.Latitude, &l.Longitude, &l.CreatedAt); err != nil {
+			continue
+		}
+		locations = append(locations, l)
+	}
+
+	c.JSON(http.StatusOK, locations)
+}
+
+func (h *OrgHandler) CreateLocation(c *gin.Context) {
+	var req models.LocationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	id := uuid.New().String()
+	_, err := db.Pool.Exec(c.Request.Context(), `
+		INSERT INTO locations (id, org_id, name, latitude, longitude, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, id, c.GetString("org_id"), req.Name, req.Latitude, req.Longitude, c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save location"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": id, "name": req.Name, "latitude": req.Latitude, "longitude": req.Longitude})
+}
+
+func (h *OrgHandler) DeleteLocation(c *gin.Context) {
+	tag, err := db.Pool.Exec(c.Request.Context(), "DELETE FROM locations WHERE id=$1 AND org_id=$2", c.Param("id"), c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete location"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Location not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "deleted": true})
+}
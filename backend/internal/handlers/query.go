@@ -6,30 +6,37 @@ import (
 	"time"
 
 	"agri-track/internal/db"
+	"agri-track/internal/gazetteer"
+	"agri-track/internal/geo"
 	"agri-track/internal/models"
 
 	"github.com/gin-gonic/gin"
 )
 
-type QueryHandler struct{}
+type QueryHandler struct {
+	// Names the places trucks are at
+	places *gazetteer.Gazetteer
+}
 
-func NewQueryHandler() *QueryHandler {
-	return &QueryHandler{}
+func NewQueryHandler(places *gazetteer.Gazetteer) *QueryHandler {
+	return &QueryHandler{places: places}
 }
 
 func (h *QueryHandler) GetTruckStatus(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
-	// DISTINCT ON (truck_id) to get the latest event per truck
+	// DISTINCT ON (truck_id) to get the latest event per truck of the caller's organization
 	query := `
-		SELECT DISTINCT ON (truck_id)
-			truck_id, time, latitude, longitude, speed, event_type
-		FROM logistics_events
-		ORDER BY truck_id, time DESC
+		SELECT DISTINCT ON (e.truck_id)
+			e.truck_id, e.time, e.latitude, e.longitude, e.speed, e.event_type
+		FROM logistics_events e
+		JOIN trucks t ON t.id = e.truck_id
+		WHERE t.org_id = $1
+		ORDER BY e.truck_id, e.time DESC
 	`
 
-	rows, err := db.Pool.Query(ctx, query)
+	rows, err := db.Pool.Query(ctx, query, c.GetString("org_id"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch truck status"})
 		return
@@ -43,8 +50,29 @@ func (h *QueryHandler) GetTruckStatus(c *gin.Context) {
 		if err != nil {
 			continue
 		}
+		s.Place = h.places.Describe(geo.Point{Lat: s.Latitude, Lon: s.Longitude}).Text
 		statuses = append(statuses, s)
 	}
 
 	c.JSON(http.StatusOK, statuses)
 }
+
+// ReverseGeocode names the place at lat and lon, like "near Oja Oba, Ilorin".
+func (h *QueryHandler) ReverseGeocode(c *gin.Context) {
+	p, ok := queryPoint(c, "lat", "lon")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "lat and lon are required"})
+		return
+	}
+	c.JSON(http.StatusOK, h.places.Describe(p))
+}
+
+// placeName names the place at p for storing with a row, nil when the
+// gazetteer knows nothing near it.
+func placeName(places *gazetteer.Gazetteer, p geo.Point) *string {
+	text := places.Describe(p).Text
+	if text == "" {
+		return nil
+	}
+	return &text
+}
@@ -0,0 +1,721 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"agri-track/internal/cron"
+	"agri-track/internal/db"
+	"agri-track/internal/models"
+	"agri-track/internal/notify"
+	"agri-track/internal/pdf"
+	"agri-track/internal/report"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// Schedules run per round of the scheduler
+	reportScheduleBatch = 20
+	// Trip reports made per run, a schedule with more stays due for the rest
+	reportTripBatch = 50
+	// How long a schedule that failed waits before it is tried again
+	reportRetryDelay = 15 * time.Minute
+)
+
+// Periods a fleet report can cover, each compared with the one before
+var reportPeriods = map[string]time.Duration{
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// Scheduled reports go by email and to the inbox unless told otherwise
+var defaultReportChannels = []string{notify.Email, notify.InApp}
+
+// ReportHandler serves fleet and trip reports, and generates and delivers
+// them on the schedules organizations set.
+type ReportHandler struct{}
+
+func NewReportHandler() *ReportHandler {
+	return &ReportHandler{}
+}
+
+// fleetReportResponse is the report with its Markdown rendering.
+type fleetReportResponse struct {
+	report.Report
+	Markdown string `json:"markdown"`
+}
+
+type tripReportResponse struct {
+	report.Trip
+	Markdown string `json:"markdown"`
+}
+
+// GetFleetReport builds the fleet report of the caller's organization for
+// the period up to now.
+func (h *ReportHandler) GetFleetReport(c *gin.Context) {
+	period, ok := reportPeriods[c.DefaultQuery("range", "24h")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "range must be one of 24h, 7d or 30d"})
+		return
+	}
+	now := time.Now()
+	r, err := fleetReport(c.Request.Context(), c.GetString("org_id"), now.Add(-period), now)
+	if err != nil {
+		log.Printf("Failed to build fleet report: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build report"})
+		return
+	}
+	md := r.Markdown()
+	respondReport(c, fleetFilename(r), r.Title, md, nil, fleetReportResponse{Report: r, Markdown: md})
+}
+
+// GetTripReport builds the report of one shipment's journey.
+func (h *ReportHandler) GetTripReport(c *gin.Context) {
+	t, err := tripReport(c.Request.Context(), c.GetString("org_id"), c.Param("id"))
+	if errors.Is(err, errShipmentNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to build trip report: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build report"})
+		return
+	}
+	md := t.Markdown()
+	respondReport(c, tripFilename(t.ShipmentID), t.Title, md, nil, tripReportResponse{Trip: t, Markdown: md})
+}
+
+// respondReport writes a report in the ?format= asked for: json (the
+// default) writes body, markdown the briefing and pdf a download of it,
+// rendered from the Markdown unless given.
+func respondReport(c *gin.Context, filename, title, md string, document []byte, body interface{}) {
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, body)
+	case "markdown":
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(md))
+	case "pdf":
+		if document == nil {
+			document = pdf.FromMarkdown(title, md)
+		}
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Data(http.StatusOK, "application/pdf", document)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of json, markdown or pdf"})
+	}
+}
+
+func fleetFilename(r report.Report) string {
+	loc, err := time.LoadLocation(r.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return "fleet-report-" + r.To.In(loc).Format("2006-01-02") + ".pdf"
+}
+
+func tripFilename(shipmentID string) string {
+	return "trip-report-" + shortID(shipmentID) + ".pdf"
+}
+
+// orgSettings returns an organization's name and time zone.
+func orgSettings(ctx context.Context, orgID string) (string, *time.Location, error) {
+	var name, timeZone string
+	err := db.Pool.QueryRow(ctx, "SELECT name, time_zone FROM organizations WHERE id = $1", orgID).Scan(&name, &timeZone)
+	if err != nil {
+		return "", nil, err
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		loc, _ = time.LoadLocation(notify.DefaultTimeZone)
+	}
+	return name, loc, nil
+}
+
+// fleetReport builds the report of an organization's shipments and trucks
+// from from to to.
+func fleetReport(ctx context.Context, orgID string, from, to time.Time) (report.Report, error) {
+	name, loc, err := orgSettings(ctx, orgID)
+	if err != nil {
+		return report.Report{}, err
+	}
+	in := report.Input{Title: name + " Fleet Briefing", From: from, To: to, Location: loc}
+	// The previous period is loaded too, for the trends
+	since := from.Add(-to.Sub(from))
+
+	// Deliveries in either period, and shipments on the road at some point of them
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, COALESCE(commodity, ''), cargo_type, status, cargo_value,
+			origin_lat, origin_lon, dest_lat, dest_lon, started_at, completed_at, deliver_by
+		FROM shipments
+		WHERE (org_id = $1 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $1))
+		AND status <> 'CANCELLED'
+		AND ((completed_at >= $2 AND completed_at < $3)
+			OR (started_at < $3 AND (completed_at IS NULL OR completed_at >= $2)))
+	`, orgID, since, to)
+	if err != nil {
+		return report.Report{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s report.Shipment
+		err := rows.Scan(&s.ID, &s.Commodity, &s.CargoType, &s.Status, &s.CargoValue,
+			&s.Origin.Lat, &s.Origin.Lon, &s.Dest.Lat, &s.Dest.Lon, &s.StartedAt, &s.CompletedAt, &s.DeliverBy)
+		if err != nil {
+			return report.Report{}, err
+		}
+		in.Shipments = append(in.Shipments, s)
+	}
+	if err := rows.Err(); err != nil {
+		return report.Report{}, err
+	}
+
+	rows, err = db.Pool.Query(ctx, `
+		SELECT COALESCE(i.shipment_id, ''), i.time, i.incident_type, COALESCE(i.severity, 1), i.latitude, i.longitude, COALESCE(i.place, '')
+		FROM logistics_incidents i
+		LEFT JOIN shipments s ON s.id = i.shipment_id
+		WHERE i.time >= $2 AND i.time < $3
+		AND (i.truck_id IN (SELECT id FROM trucks WHERE org_id = $1) OR s.org_id = $1)
+	`, orgID, since, to)
+	if err != nil {
+		return report.Report{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i report.Incident
+		if err := rows.Scan(&i.ShipmentID, &i.Time, &i.Type, &i.Severity, &i.Point.Lat, &i.Point.Lon, &i.Place); err != nil {
+			return report.Report{}, err
+		}
+		in.Incidents = append(in.Incidents, i)
+	}
+	if err := rows.Err(); err != nil {
+		return report.Report{}, err
+	}
+
+	// Speeds are kept per truck, so only the organization's own trucks count
+	rows, err = db.Pool.Query(ctx, `
+		SELECT bucket, avg_speed FROM avg_speed_hourly
+		WHERE bucket >= $2 AND bucket < $3 AND avg_speed IS NOT NULL
+		AND truck_id IN (SELECT id FROM trucks WHERE org_id = $1)
+	`, orgID, since, to)
+	if err != nil {
+		return report.Report{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s report.Speed
+		if err := rows.Scan(&s.Bucket, &s.Kmh); err != nil {
+			return report.Report{}, err
+		}
+		in.Speeds = append(in.Speeds, s)
+	}
+	if err := rows.Err(); err != nil {
+		return report.Report{}, err
+	}
+
+	return report.Build(in, time.Now()), nil
+}
+
+// tripReport builds the trip report of a shipment the organization owns or
+// carries, with times in the organization's time zone. It returns
+// errShipmentNotFound for any other shipment.
+func tripReport(ctx context.Context, orgID, shipmentID string) (report.Trip, error) {
+	_, loc, err := orgSettings(ctx, orgID)
+	if err != nil {
+		return report.Trip{}, err
+	}
+	in := report.TripInput{Location: loc}
+	s := &in.Shipment
+	err = db.Pool.QueryRow(ctx, `
+		SELECT s.id, COALESCE(s.commodity, ''), s.cargo_type, s.status, s.cargo_value,
+			s.origin_lat, s.origin_lon, s.dest_lat, s.dest_lon, s.started_at, s.completed_at, s.deliver_by,
+			COALESCE(s.created_at, NOW()), s.near_destination_at, COALESCE(s.origin_place, ''), COALESCE(s.dest_place, ''),
+			COALESCE(t.plate_number, ''), s.weight_kg, tr.distance_m
+		FROM shipments s
+		LEFT JOIN trucks t ON t.id = s.truck_id
+		LEFT JOIN shipment_tracks tr ON tr.shipment_id = s.id
+		WHERE s.id = $1 AND (s.org_id = $2 OR s.truck_id IN (SELECT id FROM trucks WHERE org_id = $2))
+	`, shipmentID, orgID).Scan(&s.ID, &s.Commodity, &s.CargoType, &s.Status, &s.CargoValue,
+		&s.Origin.Lat, &s.Origin.Lon, &s.Dest.Lat, &s.Dest.Lon, &s.StartedAt, &s.CompletedAt, &s.DeliverBy,
+		&in.CreatedAt, &in.NearDestinationAt, &in.OriginPlace, &in.DestPlace,
+		&in.Plate, &in.WeightKg, &in.RoadDistanceM)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return report.Trip{}, errShipmentNotFound
+	}
+	if err != nil {
+		return report.Trip{}, err
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT time, latitude, longitude, COALESCE(speed, 0) FROM logistics_events WHERE shipment_id = $1 ORDER BY time
+	`, shipmentID)
+	if err != nil {
+		return report.Trip{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f report.Fix
+		if err := rows.Scan(&f.Time, &f.Point.Lat, &f.Point.Lon, &f.Speed); err != nil {
+			return report.Trip{}, err
+		}
+		in.Fixes = append(in.Fixes, f)
+	}
+	if err := rows.Err(); err != nil {
+		return report.Trip{}, err
+	}
+
+	rows, err = db.Pool.Query(ctx, `
+		SELECT time, incident_type, COALESCE(severity, 1), latitude, longitude, COALESCE(place, ''), COALESCE(description, '')
+		FROM logistics_incidents WHERE shipment_id = $1 ORDER BY time
+	`, shipmentID)
+	if err != nil {
+		return report.Trip{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		i := report.Incident{ShipmentID: shipmentID}
+		if err := rows.Scan(&i.Time, &i.Type, &i.Severity, &i.Point.Lat, &i.Point.Lon, &i.Place, &i.Description); err != nil {
+			return report.Trip{}, err
+		}
+		in.Incidents = append(in.Incidents, i)
+	}
+	if err := rows.Err(); err != nil {
+		return report.Trip{}, err
+	}
+
+	return report.BuildTrip(in, time.Now()), nil
+}
+
+// ListSchedules returns the organization's report schedules.
+func (h *ReportHandler) ListSchedules(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT s.id, s.kind, s.cron, s.period, s.channels, o.time_zone, s.next_run_at, s.last_run_at, s.created_at
+		FROM report_schedules s JOIN organizations o ON o.id = s.org_id
+		WHERE s.org_id = $1
+		ORDER BY s.id
+	`, c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch schedules"})
+		return
+	}
+	defer rows.Close()
+
+	schedules := []models.ReportSchedule{}
+	for rows.Next() {
+		var s models.ReportSchedule
+		if err := rows.Scan(&s.ID, &s.Kind, &s.Cron, &s.Range, &s.Channels, &s.TimeZone, &s.NextRunAt, &s.LastRunAt, &s.CreatedAt); err != nil {
+			continue
+		}
+		schedules = append(schedules, s)
+	}
+	c.JSON(http.StatusOK, schedules)
+}
+
+// CreateSchedule has a report generated when the cron expression fires in
+// the organization's time zone, and delivered to its owners and dispatchers.
+func (h *ReportHandler) CreateSchedule(c *gin.Context) {
+	var req models.ReportScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+	schedule, err := cron.Parse(req.Cron)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cron expression: " + err.Error()})
+		return
+	}
+	if req.Range == "" {
+		req.Range = "24h"
+	}
+	if len(req.Channels) == 0 {
+		req.Channels = defaultReportChannels
+	}
+	slices.Sort(req.Channels)
+	req.Channels = slices.Compact(req.Channels)
+
+	ctx := c.Request.Context()
+	orgID := c.GetString("org_id")
+	_, loc, err := orgSettings(ctx, orgID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create schedule"})
+		return
+	}
+	next := schedule.Next(time.Now().In(loc))
+	if next.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The cron expression never fires"})
+		return
+	}
+
+	s := models.ReportSchedule{Kind: req.Kind, Cron: req.Cron, Range: req.Range, Channels: req.Channels, TimeZone: loc.String(), NextRunAt: next}
+	err = db.Pool.QueryRow(ctx, `
+		INSERT INTO report_schedules (org_id, kind, cron, period, channels, created_by, next_run_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`, orgID, req.Kind, req.Cron, req.Range, req.Channels, c.GetString("user_id"), next).Scan(&s.ID, &s.CreatedAt)
+	if err != nil {
+		log.Printf("Failed to create report schedule: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create schedule"})
+		return
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+// DeleteSchedule stops a schedule. Reports it generated stay in the archive.
+func (h *ReportHandler) DeleteSchedule(c *gin.Context) {
+	tag, err := db.Pool.Exec(c.Request.Context(), "DELETE FROM report_schedules WHERE id=$1 AND org_id=$2", c.Param("id"), c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete schedule"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// rescheduleReports works out again when an organization's schedules next
+// fire, after its time zone changed.
+func rescheduleReports(ctx context.Context, tx pgx.Tx, orgID string, loc *time.Location) error {
+	rows, err := tx.Query(ctx, "SELECT id, cron FROM report_schedules WHERE org_id=$1 FOR UPDATE", orgID)
+	if err != nil {
+		return err
+	}
+	next := map[int]time.Time{}
+	now := time.Now().In(loc)
+	for rows.Next() {
+		var id int
+		var expr string
+		if err := rows.Scan(&id, &expr); err != nil {
+			rows.Close()
+			return err
+		}
+		schedule, err := cron.Parse(expr)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		next[id] = schedule.Next(now)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, at := range next {
+		if _, err := tx.Exec(ctx, "UPDATE report_schedules SET next_run_at=$2 WHERE id=$1", id, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListArchive returns the organization's latest scheduled reports, only
+// one kind of them with ?kind=.
+func (h *ReportHandler) ListArchive(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT id, kind, schedule_id, shipment_id, title, period_from, period_to, created_at
+		FROM report_archive
+		WHERE org_id = $1 AND ($2 = '' OR kind = $2)
+		ORDER BY created_at DESC, id DESC
+		LIMIT 100
+	`, c.GetString("org_id"), c.Query("kind"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reports"})
+		return
+	}
+	defer rows.Close()
+
+	reports := []models.ArchivedReport{}
+	for rows.Next() {
+		var r models.ArchivedReport
+		if err := rows.Scan(&r.ID, &r.Kind, &r.ScheduleID, &r.ShipmentID, &r.Title, &r.From, &r.To, &r.CreatedAt); err != nil {
+			continue
+		}
+		reports = append(reports, r)
+	}
+	c.JSON(http.StatusOK, reports)
+}
+
+// GetArchived returns a report from the archive, as generated, in the
+// ?format= asked for.
+func (h *ReportHandler) GetArchived(c *gin.Context) {
+	var r models.ArchivedReport
+	var data map[string]interface{}
+	var md string
+	var document []byte
+	err := db.Pool.QueryRow(c.Request.Context(), `
+		SELECT id, kind, schedule_id, shipment_id, title, period_from, period_to, created_at, data, markdown, pdf
+		FROM report_archive WHERE id = $1 AND org_id = $2
+	`, c.Param("id"), c.GetString("org_id")).Scan(&r.ID, &r.Kind, &r.ScheduleID, &r.ShipmentID, &r.Title, &r.From, &r.To, &r.CreatedAt,
+		&data, &md, &document)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch report"})
+		return
+	}
+	respondReport(c, archiveFilename(r), r.Title, md, document, gin.H{
+		"id":          r.ID,
+		"kind":        r.Kind,
+		"schedule_id": r.ScheduleID,
+		"shipment_id": r.ShipmentID,
+		"title":       r.Title,
+		"from":        r.From,
+		"to":          r.To,
+		"created_at":  r.CreatedAt,
+		"report":      data,
+		"markdown":    md,
+	})
+}
+
+func archiveFilename(r models.ArchivedReport) string {
+	if r.ShipmentID != nil {
+		return tripFilename(*r.ShipmentID)
+	}
+	return fmt.Sprintf("%s-report-%d.pdf", r.Kind, r.ID)
+}
+
+// StartScheduler generates the reports that are due until ctx is cancelled.
+func (h *ReportHandler) StartScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := h.RunDue(ctx); err != nil {
+				log.Printf("Running report schedules failed: %v", err)
+			}
+		}
+	}
+}
+
+type dueSchedule struct {
+	id       int
+	orgID    string
+	kind     string
+	cron     string
+	period   string
+	channels []string
+	due      time.Time
+	since    time.Time // The last run, or when the schedule was made
+	timeZone string
+}
+
+// RunDue runs every schedule that is due, up to a batch, and returns how
+// many runs it made. A schedule that was missed while the server was down
+// runs once, then carries on from now. Each run has its own transaction, a
+// schedule that fails is logged and tried again after reportRetryDelay
+// without holding up the others.
+func (h *ReportHandler) RunDue(ctx context.Context) (int, error) {
+	ran := 0
+	for i := 0; i < reportScheduleBatch; i++ {
+		id, err := h.runNext(ctx)
+		if errors.Is(err, pgx.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			if id == 0 {
+				return ran, err
+			}
+			log.Printf("Report schedule %d failed, retrying in %v: %v", id, reportRetryDelay, err)
+			if _, err := db.Pool.Exec(ctx, "UPDATE report_schedules SET next_run_at=$2 WHERE id=$1",
+				id, time.Now().Add(reportRetryDelay)); err != nil {
+				return ran, err
+			}
+			continue
+		}
+		ran++
+	}
+	return ran, nil
+}
+
+// runNext claims the schedule due longest and runs it, returning its ID.
+// Without a schedule due it returns pgx.ErrNoRows.
+func (h *ReportHandler) runNext(ctx context.Context) (int, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var s dueSchedule
+	err = tx.QueryRow(ctx, `
+		SELECT s.id, s.org_id, s.kind, s.cron, s.period, s.channels, s.next_run_at, COALESCE(s.last_run_at, s.created_at), o.time_zone
+		FROM report_schedules s JOIN organizations o ON o.id = s.org_id
+		WHERE s.next_run_at <= NOW()
+		ORDER BY s.next_run_at
+		LIMIT 1
+		FOR UPDATE OF s SKIP LOCKED
+	`).Scan(&s.id, &s.orgID, &s.kind, &s.cron, &s.period, &s.channels, &s.due, &s.since, &s.timeZone)
+	if err != nil {
+		return 0, err
+	}
+	if err := h.run(ctx, tx, s); err != nil {
+		return s.id, err
+	}
+	return s.id, tx.Commit(ctx)
+}
+
+// run generates, archives and delivers the reports of a due schedule, and
+// sets when it fires next.
+func (h *ReportHandler) run(ctx context.Context, tx pgx.Tx, s dueSchedule) error {
+	schedule, err := cron.Parse(s.cron)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(s.timeZone)
+	if err != nil {
+		loc, _ = time.LoadLocation(notify.DefaultTimeZone)
+	}
+
+	switch s.kind {
+	case models.ReportFleet:
+		period, ok := reportPeriods[s.period]
+		if !ok {
+			period = reportPeriods["24h"]
+		}
+		r, err := fleetReport(ctx, s.orgID, s.due.Add(-period), s.due)
+		if err != nil {
+			return err
+		}
+		from, to := r.From, r.To
+		if err := archiveReport(ctx, tx, s, models.ReportFleet, nil, &from, &to, r.Title, r.Markdown(), r); err != nil {
+			return err
+		}
+	case models.ReportTrips:
+		rows, err := db.Pool.Query(ctx, `
+			SELECT id FROM shipments sh
+			WHERE (org_id = $1 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $1))
+			AND status = 'DELIVERED' AND completed_at >= $2 AND completed_at < $3
+			AND NOT EXISTS (SELECT 1 FROM report_archive a WHERE a.schedule_id = $4 AND a.shipment_id = sh.id)
+			ORDER BY completed_at
+			LIMIT $5
+		`, s.orgID, s.since, s.due, s.id, reportTripBatch)
+		if err != nil {
+			return err
+		}
+		var delivered []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			delivered = append(delivered, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, id := range delivered {
+			t, err := tripReport(ctx, s.orgID, id)
+			if err != nil {
+				return err
+			}
+			if err := archiveReport(ctx, tx, s, models.ReportTrip, &id, nil, nil, t.Title, t.Markdown(), t); err != nil {
+				return err
+			}
+		}
+		if len(delivered) == reportTripBatch {
+			return nil // Still due, the next run picks up after the trips archived here
+		}
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE report_schedules SET next_run_at=$2, last_run_at=$3 WHERE id=$1",
+		s.id, schedule.Next(time.Now().In(loc)), s.due)
+	return err
+}
+
+// archiveReport keeps a generated report with its PDF, and queues it to the
+// organization's owners and dispatchers on the schedule's channels.
+func archiveReport(ctx context.Context, tx pgx.Tx, s dueSchedule, kind string, shipmentID *string, from, to *time.Time,
+	title, md string, data interface{}) error {
+	var id int
+	err := tx.QueryRow(ctx, `
+		INSERT INTO report_archive (org_id, schedule_id, kind, shipment_id, title, period_from, period_to, data, markdown, pdf)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id
+	`, s.orgID, s.id, kind, shipmentID, title, from, to, data, md, pdf.FromMarkdown(title, md)).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT u.id, u.email FROM org_members m JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = $1 AND m.role IN ('owner', 'dispatcher') AND u.status = 'active'
+	`, s.orgID)
+	if err != nil {
+		return err
+	}
+	type recipient struct {
+		userID string
+		email  *string
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.userID, &r.email); err != nil {
+			rows.Close()
+			return err
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// The email carries the report, the inbox links to the archive
+	reportData := map[string]interface{}{"report_id": id}
+	for _, r := range recipients {
+		for _, channel := range s.channels {
+			to, body := r.userID, "Your report is ready to download from the report archive."
+			if channel == notify.Email {
+				if r.email == nil || *r.email == "" {
+					continue
+				}
+				to, body = *r.email, md
+			}
+			_, err := tx.Exec(ctx, `
+				INSERT INTO notification_messages (user_id, channel, recipient, kind, dedup_key, subject, body, data, send_after)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW())
+				ON CONFLICT (user_id, channel, dedup_key) DO NOTHING
+			`, r.userID, channel, to, notify.KindReport, "report:"+strconv.Itoa(id), title, body, reportData)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// attachReport attaches the PDF of the archived report a message delivers.
+func attachReport(ctx context.Context, m *notify.Message) error {
+	id, ok := m.Data["report_id"].(float64)
+	if !ok {
+		return fmt.Errorf("report message without a report")
+	}
+	var r models.ArchivedReport
+	var document []byte
+	err := db.Pool.QueryRow(ctx, `
+		SELECT id, kind, shipment_id, pdf FROM report_archive WHERE id = $1
+	`, int(id)).Scan(&r.ID, &r.Kind, &r.ShipmentID, &document)
+	if err != nil {
+		return err
+	}
+	m.Attachments = append(m.Attachments, notify.Attachment{Name: archiveFilename(r), ContentType: "application/pdf", Data: document})
+	return nil
+}
@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/fleet"
+	"agri-track/internal/geo"
+	"agri-track/internal/models"
+	"agri-track/internal/roads"
+	"agri-track/internal/vrp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Collection run planning defaults
+const (
+	collectionSpeedKmh    = 40 // Average on farm roads
+	defaultServiceMinutes = 15 // Loading at each farm
+	defaultDepartureHour  = 6
+)
+
+// RouteHandler finds road routes, plans collection runs from farms to a
+// depot over the organization's trucks, and turns the plan into multi-stop
+// shipments.
+type RouteHandler struct {
+	shipments *ShipmentHandler
+	router    roads.Router
+}
+
+func NewRouteHandler(shipments *ShipmentHandler, router roads.Router) *RouteHandler {
+	return &RouteHandler{shipments: shipments, router: router}
+}
+
+// Directions returns the road route from ?from_lat=&from_lon= to
+// ?to_lat=&to_lon=, the fastest one or with ?mode=shortest the shortest.
+func (h *RouteHandler) Directions(c *gin.Context) {
+	from, okFrom := queryPoint(c, "from_lat", "from_lon")
+	to, okTo := queryPoint(c, "to_lat", "to_lon")
+	if !okFrom || !okTo {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from_lat, from_lon, to_lat and to_lon are required"})
+		return
+	}
+	mode, err := roads.ParseMode(c.Query("mode"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	path, err := h.router.Route(from, to, mode)
+	if errors.Is(err, roads.ErrOffRoad) || errors.Is(err, roads.ErrNoRoute) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to route: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find a route"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"distance_km":      path.DistanceM / 1000,
+		"duration_minutes": path.Duration.Minutes(),
+		"points":           path.Points,
+	})
+}
+
+// planTruck is a truck available for a collection run.
+type planTruck struct {
+	ID          string
+	PlateNumber string
+	CapacityKg  *float64
+	Position    *geo.Point
+}
+
+// PlanRoutes proposes which truck collects from which farms and in what
+// order. Nothing is saved, the plan is committed with CommitRoutes.
+func (h *RouteHandler) PlanRoutes(c *gin.Context) {
+	var req models.RoutePlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	ctx := c.Request.Context()
+	departure, err := defaultDeparture(ctx, c.GetString("org_id"), req.Departure)
+	if err != nil {
+		log.Printf("Failed to load organization settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to plan routes"})
+		return
+	}
+	service := defaultServiceMinutes * time.Minute
+	if req.ServiceMinutes > 0 {
+		service = time.Duration(req.ServiceMinutes) * time.Minute
+	}
+	cargoType := req.CargoType
+	if cargoType == "" {
+		cargoType = fleet.CargoTypeFor(req.Commodity)
+	}
+
+	if err := resolveDepot(ctx, c.GetString("org_id"), &req.Depot); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Location not found"})
+		return
+	}
+	trucks, err := planTrucks(ctx, c.GetString("org_id"), req.TruckIDs, cargoType)
+	if errors.Is(err, errTruckNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Truck not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load trucks for planning: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to plan routes"})
+		return
+	}
+	if len(trucks) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No active truck can carry " + cargoType + " cargo"})
+		return
+	}
+
+	depot := geo.Point{Lat: req.Depot.Lat, Lon: req.Depot.Lon}
+	problem := vrp.Problem{SpeedKmh: collectionSpeedKmh}
+	for _, t := range trucks {
+		// Trucks leave from where they last reported, or from the depot
+		start := depot
+		if t.Position != nil {
+			start = *t.Position
+		}
+		v := vrp.Vehicle{Start: start, End: depot, Departure: departure}
+		if t.CapacityKg != nil {
+			v.CapacityKg = *t.CapacityKg
+		}
+		problem.Vehicles = append(problem.Vehicles, v)
+	}
+	for _, p := range req.Pickups {
+		stop := vrp.Stop{Point: geo.Point{Lat: p.Lat, Lon: p.Lon}, DemandKg: p.QuantityKg, Service: service}
+		if p.WindowStart != nil {
+			stop.WindowStart = *p.WindowStart
+		}
+		if p.WindowEnd != nil {
+			stop.WindowEnd = *p.WindowEnd
+		}
+		problem.Stops = append(problem.Stops, stop)
+	}
+
+	sol := vrp.Solve(problem, h.router)
+
+	plan := models.RoutePlan{
+		Departure:  departure,
+		Depot:      req.Depot,
+		Commodity:  req.Commodity,
+		CargoType:  cargoType,
+		Routes:     []models.PlannedRoute{},
+		Unassigned: []models.PickupPoint{},
+		DistanceKm: sol.DistanceM / 1000,
+	}
+	for _, r := range sol.Routes {
+		if len(r.Stops) == 0 {
+			continue
+		}
+		truck := trucks[r.Vehicle]
+		route := models.PlannedRoute{
+			TruckID:     truck.ID,
+			PlateNumber: truck.PlateNumber,
+			DistanceKm:  r.DistanceM / 1000,
+			LoadKg:      r.LoadKg,
+			ReturnAt:    &r.Finish,
+		}
+		for i, stop := range r.Stops {
+			pickup := req.Pickups[stop]
+			eta := r.Arrivals[i]
+			pickup.ETA = &eta
+			route.Pickups = append(route.Pickups, pickup)
+		}
+		plan.Routes = append(plan.Routes, route)
+	}
+	for _, stop := range sol.Unassigned {
+		plan.Unassigned = append(plan.Unassigned, req.Pickups[stop])
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
+
+// CommitRoutes creates one multi-stop shipment per planned route, reserved
+// for its truck: the farms in the planned order, then the depot. Either every
+// route is created or none is.
+func (h *RouteHandler) CommitRoutes(c *gin.Context) {
+	var req models.RouteCommitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	ctx := c.Request.Context()
+	orgID := c.GetString("org_id")
+	if err := resolveDepot(ctx, orgID, &req.Depot); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Location not found"})
+		return
+	}
+	departure, err := defaultDeparture(ctx, orgID, req.Departure)
+	if err != nil {
+		log.Printf("Failed to load organization settings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create shipments"})
+		return
+	}
+
+	var created []gin.H
+	err = inTx(ctx, func(tx pgx.Tx) error {
+		for _, route := range req.Routes {
+			var owned bool
+			err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM trucks WHERE id=$1 AND org_id=$2)", route.TruckID, orgID).Scan(&owned)
+			if err != nil {
+				return err
+			}
+			if !owned {
+				return errTruckNotFound
+			}
+
+			stops := make([]models.StopRequest, 0, len(route.Pickups)+1)
+			total := 0.0
+			for _, p := range route.Pickups {
+				quantity := p.QuantityKg
+				total += quantity
+				stops = append(stops, models.StopRequest{
+					Kind: models.StopPickup, Lat: p.Lat, Lon: p.Lon, Name: p.Name, ContactPhone: p.ContactPhone,
+					QuantityKg: &quantity, WindowStart: p.WindowStart, WindowEnd: p.WindowEnd,
+				})
+			}
+			stops = append(stops, models.StopRequest{
+				Kind: models.StopDropoff, Lat: req.Depot.Lat, Lon: req.Depot.Lon, Name: req.Depot.Name, QuantityKg: &total,
+			})
+
+			truckID := route.TruckID
+			shipment, err := h.shipments.insertShipment(ctx, tx, models.ShipmentRequest{
+				TruckID:    &truckID,
+				Stops:      stops,
+				Commodity:  req.Commodity,
+				CargoType:  req.CargoType,
+				PickupFrom: &departure,
+			}, c.GetString("user_id"), orgID)
+			if err != nil {
+				return err
+			}
+			created = append(created, gin.H{
+				"id": shipment.ID, "truck_id": truckID, "pickup_code": shipment.PickupCode,
+				"pickup_code_expires_at": shipment.ExpiresAt, "stops": len(stops),
+			})
+		}
+		return nil
+	})
+	if fitError(c, err) {
+		return
+	}
+	if errors.Is(err, errInvalidStops) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to commit routes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create shipments"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"shipments": created})
+}
+
+// planTrucks returns the organization's active trucks that can carry the
+// cargo type next to what they already carry or have reserved, limited to ids
+// when given, with their last reported position. Capacity is what is left.
+func planTrucks(ctx context.Context, orgID string, ids []string, cargoType string) ([]planTruck, error) {
+	// A truck listed twice is still one truck
+	seen := make(map[string]bool, len(ids))
+	distinct := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			distinct = append(distinct, id)
+		}
+	}
+	ids = distinct
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT t.id, t.plate_number, pos.latitude, pos.longitude
+		FROM trucks t
+		LEFT JOIN LATERAL (
+			SELECT latitude, longitude FROM logistics_events e
+			WHERE e.truck_id = t.id ORDER BY e.time DESC LIMIT 1
+		) pos ON true
+		WHERE t.org_id = $1 AND t.status = 'active'
+		AND (cardinality($2::text[]) = 0 OR t.id = ANY($2))
+		ORDER BY t.plate_number
+	`, orgID, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var listed []planTruck
+	for rows.Next() {
+		var t planTruck
+		var lat, lon *float64
+		if err := rows.Scan(&t.ID, &t.PlateNumber, &lat, &lon); err != nil {
+			return nil, err
+		}
+		if lat != nil && lon != nil {
+			t.Position = &geo.Point{Lat: *lat, Lon: *lon}
+		}
+		listed = append(listed, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 && len(listed) != len(ids) {
+		return nil, errTruckNotFound
+	}
+
+	var trucks []planTruck
+	err = inTx(ctx, func(tx pgx.Tx) error {
+		for _, t := range listed {
+			capacity, carried, _, err := truckLoad(ctx, tx, t.ID, "")
+			if err != nil {
+				return err
+			}
+			if fleet.CheckFit(capacity, fleet.Load{CargoType: cargoType}, carried) != nil {
+				continue
+			}
+			kg, _ := fleet.Remaining(capacity, carried)
+			if kg != nil && *kg <= 0 {
+				// Zero would mean unlimited to the solver
+				continue
+			}
+			t.CapacityKg = kg
+			trucks = append(trucks, t)
+		}
+		return nil
+	})
+	return trucks, err
+}
+
+// resolveDepot fills in the point and name of a depot given as a saved location.
+func resolveDepot(ctx context.Context, orgID string, depot *models.Depot) error {
+	if depot.LocationID == "" {
+		return nil
+	}
+	return db.Pool.QueryRow(ctx, "SELECT name, latitude, longitude FROM locations WHERE id=$1 AND org_id=$2",
+		depot.LocationID, orgID).Scan(&depot.Name, &depot.Lat, &depot.Lon)
+}
+
+// defaultDeparture returns departure when given, otherwise the default
+// departure hour tomorrow in the organization's time zone.
+func defaultDeparture(ctx context.Context, orgID string, departure *time.Time) (time.Time, error) {
+	if departure != nil {
+		return *departure, nil
+	}
+	_, loc, err := orgSettings(ctx, orgID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return tomorrowAt(defaultDepartureHour, loc), nil
+}
+
+// tomorrowAt returns the given hour tomorrow in loc.
+func tomorrowAt(hour int, loc *time.Location) time.Time {
+	now := time.Now().In(loc)
+	return time.Date(now.Year(), now.Month(), now.Day()+1, hour, 0, 0, 0, loc)
+}
@@ -1,25 +1,96 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math"
-	"math/rand"
+	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"agri-track/internal/db"
+	"agri-track/internal/events"
+	"agri-track/internal/fleet"
+	"agri-track/internal/gazetteer"
+	"agri-track/internal/geo"
 	"agri-track/internal/models"
+	"agri-track/internal/pickupcode"
+	"agri-track/internal/ratelimit"
+	"agri-track/internal/roads"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 )
 
-type ShipmentHandler struct{}
+type ShipmentHandler struct {
+	// Limits how many wrong pickup codes a driver can try
+	pickups *ratelimit.Lockout
+	codes   *pickupcode.Generator
+	// Offers shipments created with auto_dispatch to the organization's drivers
+	dispatcher *DispatchHandler
+	// Estimates arrival of shipments in transit
+	router roads.Router
+	// Names the endpoints and stops of new shipments
+	places *gazetteer.Gazetteer
+	// The road ahead of shipments in transit, so the map can be polled
+	// without routing every shipment each time
+	routes      map[string]cachedRoute // Maps ShipmentID -> route from its last fix
+	routesMutex sync.Mutex
+	routesSwept time.Time
+}
+
+// A cached route is used until the truck has moved routeCacheMoveM from
+// where it was routed, or for routeCacheTTL when it stands still.
+const (
+	routeCacheMoveM = 1000
+	routeCacheTTL   = 5 * time.Minute
+)
 
-func NewShipmentHandler() *ShipmentHandler {
-	return &ShipmentHandler{}
+type cachedRoute struct {
+	from geo.Point
+	path roads.Path
+	err  error // Off the map, not worth trying again until the truck moves
+	at   time.Time
+}
+
+func NewShipmentHandler(pickups *ratelimit.Lockout, codes *pickupcode.Generator, dispatcher *DispatchHandler, router roads.Router, places *gazetteer.Gazetteer) *ShipmentHandler {
+	return &ShipmentHandler{pickups: pickups, codes: codes, dispatcher: dispatcher, router: router, places: places,
+		routes: make(map[string]cachedRoute)}
+}
+
+// routeAhead returns the fastest road from a shipment's last fix to its
+// destination, from the cache while the truck is close to where it was
+// last routed.
+func (h *ShipmentHandler) routeAhead(shipmentID string, at, dest geo.Point) (roads.Path, error) {
+	now := time.Now()
+	h.routesMutex.Lock()
+	cached, ok := h.routes[shipmentID]
+	h.routesMutex.Unlock()
+	if ok && now.Sub(cached.at) < routeCacheTTL && geo.Haversine(cached.from, at) < routeCacheMoveM {
+		return cached.path, cached.err
+	}
+
+	path, err := h.router.Route(at, dest, roads.Fastest)
+	h.routesMutex.Lock()
+	defer h.routesMutex.Unlock()
+	h.routes[shipmentID] = cachedRoute{from: at, path: path, err: err, at: now}
+	// Delivered shipments stop being looked up, their routes go once stale
+	if now.Sub(h.routesSwept) > routeCacheTTL {
+		for id, r := range h.routes {
+			if now.Sub(r.at) > routeCacheTTL {
+				delete(h.routes, id)
+			}
+		}
+		h.routesSwept = now
+	}
+	return path, err
 }
 
+// Number of fresh codes tried before giving up on a collision
+const pickupCodeAttempts = 5
+
 func (h *ShipmentHandler) CreateShipment(c *gin.Context) {
 	var req models.ShipmentRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -27,21 +98,186 @@ func (h *ShipmentHandler) CreateShipment(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, formatValidationError(err))
 		return
 	}
+	if req.DeliverFrom != nil && !req.DeliverBy.After(*req.DeliverFrom) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "deliver_by must be after deliver_from"})
+		return
+	}
+	if req.PickupFrom != nil && req.PickupUntil != nil && !req.PickupUntil.After(*req.PickupFrom) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pickup_until must be after pickup_from"})
+		return
+	}
 
-	id := uuid.New().String()
-	// Generate 6-digit pickup code
-	pickupCode := fmt.Sprintf("AG-%06d", rand.Intn(1000000))
-	
-	_, err := db.Pool.Exec(c.Request.Context(), `
-		INSERT INTO shipments (id, truck_id, origin_lat, origin_lon, dest_lat, dest_lon, status, pickup_code)
-		VALUES ($1, $2, $3, $4, $5, $6, 'CREATED', $7)
-	`, id, req.TruckID, req.OriginLat, req.OriginLon, req.DestLat, req.DestLon, pickupCode)
+	ctx := c.Request.Context()
+	var created newShipment
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		created, err = h.insertShipment(ctx, tx, req, c.GetString("user_id"), c.GetString("org_id"))
+		return err
+	})
 
+	if fitError(c, err) {
+		return
+	}
+	if errors.Is(err, errInvalidStops) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
+		log.Printf("Failed to create shipment: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create shipment"})
 		return
-	}	
-	c.JSON(http.StatusCreated, gin.H{"id": id, "status": "CREATED", "pickup_code": pickupCode})
+	}
+
+	// The offer sweeper retries if this fails, the shipment stays searching
+	if created.DispatchStatus != nil {
+		status, err := h.dispatcher.Dispatch(ctx, created.ID)
+		if err != nil {
+			log.Printf("Failed to dispatch shipment %s: %v", created.ID, err)
+		} else {
+			created.DispatchStatus = &status
+		}
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": created.ID, "status": "CREATED", "pickup_code": created.PickupCode, "pickup_code_expires_at": created.ExpiresAt,
+		"cargo_type": created.CargoType, "dispatch_status": created.DispatchStatus, "current_stop_seq": created.CurrentStop})
+}
+
+// newShipment is what insertShipment stored.
+type newShipment struct {
+	ID             string
+	PickupCode     string
+	ExpiresAt      time.Time
+	CargoType      string
+	DispatchStatus *string
+	CurrentStop    *int
+}
+
+// insertShipment stores a shipment from a bound request as part of tx, with
+// a fresh pickup code. Each code is tried in a savepoint so a collision
+// doesn't abort tx.
+func (h *ShipmentHandler) insertShipment(ctx context.Context, tx pgx.Tx, req models.ShipmentRequest, userID, orgID string) (newShipment, error) {
+	created := newShipment{ID: uuid.New().String(), CargoType: req.CargoType}
+	if created.CargoType == "" {
+		created.CargoType = fleet.CargoTypeFor(req.Commodity)
+	}
+
+	// A multi-stop shipment runs from its first stop to its last
+	if len(req.Stops) > 0 {
+		origin, dest, peakKg, err := planStops(req.Stops)
+		if err != nil {
+			return created, fmt.Errorf("%w: %v", errInvalidStops, err)
+		}
+		req.OriginLat, req.OriginLon, req.DestLat, req.DestLon = origin.Lat, origin.Lon, dest.Lat, dest.Lon
+		if req.WeightKg == nil {
+			req.WeightKg = peakKg
+		}
+		first := 1
+		created.CurrentStop = &first
+	}
+
+	if req.AutoDispatch {
+		status := models.DispatchSearching
+		created.DispatchStatus = &status
+	}
+
+	// A truck chosen up front must be the organization's own and able to carry the load
+	if req.TruckID != nil {
+		if _, err := lockTruck(ctx, tx, *req.TruckID, orgID); err != nil {
+			return created, err
+		}
+		load := fleet.Load{WeightKg: req.WeightKg, VolumeM3: req.VolumeM3, CargoType: created.CargoType}
+		if err := checkTruckFit(ctx, tx, *req.TruckID, "", load); err != nil {
+			return created, err
+		}
+	}
+
+	originPlace := placeName(h.places, geo.Point{Lat: req.OriginLat, Lon: req.OriginLon})
+	destPlace := placeName(h.places, geo.Point{Lat: req.DestLat, Lon: req.DestLon})
+
+	err := h.withPickupCode(func(code string, expires time.Time) error {
+		created.PickupCode, created.ExpiresAt = code, expires
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer sp.Rollback(ctx)
+
+		_, err = sp.Exec(ctx, `
+			INSERT INTO shipments (id, truck_id, origin_lat, origin_lon, dest_lat, dest_lon, status, pickup_code, pickup_code_expires_at, created_by, org_id,
+				weight_kg, volume_m3, commodity, cargo_type, payout, pickup_from, pickup_until, bid_deadline, dispatch_status, current_stop_seq,
+				origin_place, dest_place, cargo_value, deliver_from, deliver_by)
+			VALUES ($1, $2, $3, $4, $5, $6, 'CREATED', $7, $8, $9, $10, $11, $12, NULLIF($13, ''), $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25)
+		`, created.ID, req.TruckID, req.OriginLat, req.OriginLon, req.DestLat, req.DestLon, code, expires, userID, orgID,
+			req.WeightKg, req.VolumeM3, req.Commodity, created.CargoType, req.Payout, req.PickupFrom, req.PickupUntil, req.BidDeadline,
+			created.DispatchStatus, created.CurrentStop, originPlace, destPlace, req.CargoValue, req.DeliverFrom, req.DeliverBy)
+		if err != nil {
+			return err
+		}
+		return sp.Commit(ctx)
+	})
+	if err != nil {
+		return created, err
+	}
+
+	if created.CurrentStop != nil {
+		if err := h.insertStops(ctx, tx, created.ID, req.Stops); err != nil {
+			return created, err
+		}
+	}
+	err = events.Publish(ctx, tx, events.ShipmentCreated, created.ID, events.ShipmentCreatedData{
+		OrgID: orgID, CreatedBy: userID, TruckID: req.TruckID, Commodity: req.Commodity,
+		OriginLat: req.OriginLat, OriginLon: req.OriginLon, DestLat: req.DestLat, DestLon: req.DestLon,
+	})
+	return created, err
+}
+
+// RegeneratePickupCode replaces the pickup code of an unclaimed shipment,
+// e.g. when the old one expired or was shared with the wrong driver.
+func (h *ShipmentHandler) RegeneratePickupCode(c *gin.Context) {
+	shipmentID := c.Param("id")
+
+	var pickupCode string
+	var expiresAt time.Time
+	err := h.withPickupCode(func(code string, expires time.Time) error {
+		pickupCode, expiresAt = code, expires
+		tag, err := db.Pool.Exec(c.Request.Context(), `
+			UPDATE shipments SET pickup_code=$1, pickup_code_expires_at=$2
+			WHERE id=$3 AND org_id=$4 AND status='CREATED'
+		`, code, expires, shipmentID, c.GetString("org_id"))
+		if err == nil && tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		return err
+	})
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No unclaimed shipment in your organization with that ID"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to regenerate pickup code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regenerate pickup code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": shipmentID, "pickup_code": pickupCode, "pickup_code_expires_at": expiresAt})
+}
+
+// withPickupCode calls store with a fresh code until it doesn't collide
+// with the code of another open shipment.
+func (h *ShipmentHandler) withPickupCode(store func(code string, expiresAt time.Time) error) error {
+	for attempt := 0; attempt < pickupCodeAttempts; attempt++ {
+		code, err := h.codes.New()
+		if err != nil {
+			return err
+		}
+
+		err = store(code, time.Now().Add(h.codes.TTL))
+		if db.IsUniqueViolation(err, "shipments_active_pickup_code_idx") {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("no unique pickup code after %d attempts", pickupCodeAttempts)
 }
 
 func (h *ShipmentHandler) StartShipment(c *gin.Context) {
@@ -53,14 +289,19 @@ func (h *ShipmentHandler) StartShipment(c *gin.Context) {
 		return
 	}
 
-	_, err := db.Pool.Exec(c.Request.Context(), `
+	tag, err := db.Pool.Exec(c.Request.Context(), `
 		UPDATE shipments SET status='IN_TRANSIT' WHERE id=$1 AND status='CREATED'
-	`, req.ShipmentID)
+		AND (org_id = $2 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $2))
+	`, req.ShipmentID, c.GetString("org_id"))
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start shipment"})
 		return
 	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "IN_TRANSIT"})
 }
@@ -74,14 +315,29 @@ func (h *ShipmentHandler) Handshake(c *gin.Context) {
 		return
 	}
 
-	_, err := db.Pool.Exec(c.Request.Context(), `
-		UPDATE shipments SET status='DELIVERED', completed_at=$1 WHERE id=$2
-	`, time.Now(), req.ShipmentID)
+	ctx := c.Request.Context()
+	now := time.Now()
+	delivered := false
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `
+			UPDATE shipments SET status='DELIVERED', completed_at=$1 WHERE id=$2
+			AND (org_id = $3 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $3))
+		`, now, req.ShipmentID, c.GetString("org_id"))
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		delivered = true
+		return events.Publish(ctx, tx, events.ShipmentDelivered, req.ShipmentID, events.ShipmentDeliveredData{DeliveredAt: now})
+	})
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update shipment"})
 		return
 	}
+	if !delivered {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "DELIVERED"})
 }
@@ -96,58 +352,220 @@ func (h *ShipmentHandler) PickupShipment(c *gin.Context) {
 	}
 
 
-	// Get Truck ID from authenticated context
-	truckID := c.GetString("user_id")
-	if truckID == "" {
+	driverID := c.GetString("user_id")
+	if driverID == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
-	
-	// Ensure the truck exists in the trucks table (Auto-register if missing to prevent FK error)
-	// In a real app, we would have a separate registration flow for trucks.
-	// For this demo, we assume the user ID is the truck ID.
-	_, err := db.Pool.Exec(c.Request.Context(), `
-		INSERT INTO trucks (id, driver_name, plate_number) 
-		VALUES ($1, 'Driver ' || $1, 'LAG-' || SUBSTRING($1, 1, 4))
-		ON CONFLICT (id) DO NOTHING
-	`, truckID)
+
+	picked, err := h.pickup(c.Request.Context(), driverID, req.PickupCode)
+	var locked *pickupLockedError
+	switch {
+	case errors.As(err, &locked):
+		abortLocked(c, locked.retryAfter, "Too many invalid pickup codes, try again later")
+	case errors.Is(err, errNoTruck):
+		c.JSON(http.StatusConflict, gin.H{"error": "You are not assigned to a truck, ask your dispatcher to assign one"})
+	case fitError(c, err):
+	case errors.Is(err, errInvalidPickupCode):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid pickup code"})
+	case errors.Is(err, errPickupCodeExpired):
+		c.JSON(http.StatusGone, gin.H{"error": "Pickup code expired, ask the farmer for a new one"})
+	case errors.Is(err, errOtherTruck):
+		c.JSON(http.StatusConflict, gin.H{"error": "Shipment is assigned to another truck"})
+	case errors.Is(err, errAlreadyTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "Shipment already taken or completed"})
+	case err != nil:
+		log.Printf("Failed to pickup shipment: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pickup shipment"})
+	default:
+		c.JSON(http.StatusOK, gin.H{
+			"success": true, 
+			"shipment_id": picked.ShipmentID,
+			"truck_id": picked.TruckID,
+			"origin_lat": picked.OriginLat,
+			"origin_lon": picked.OriginLon,
+		})
+	}
+}
+
+// Reasons a pickup is refused
+var (
+	errNoTruck           = errors.New("not assigned to a truck")
+	errInvalidPickupCode = errors.New("invalid pickup code")
+	errPickupCodeExpired = errors.New("pickup code expired")
+	errOtherTruck        = errors.New("shipment is assigned to another truck")
+	errAlreadyTaken      = errors.New("shipment already taken or completed")
+)
+
+// pickupLockedError is returned while a driver is locked out after too many
+// invalid pickup codes.
+type pickupLockedError struct {
+	retryAfter time.Duration
+}
+
+func (e *pickupLockedError) Error() string {
+	return fmt.Sprintf("too many invalid pickup codes, retry in %s", e.retryAfter)
+}
+
+// pickedUp is a shipment a driver picked up.
+type pickedUp struct {
+	ShipmentID string
+	TruckID    string
+	OriginLat  float64
+	OriginLon  float64
+}
+
+// pickup puts the shipment with a pickup code on the driver's truck. Errors
+// for a truck that can't take the shipment are those of checkTruckFit.
+func (h *ShipmentHandler) pickup(ctx context.Context, driverID, code string) (pickedUp, error) {
+	// Pickup codes are short, so cap guesses per driver to stop enumeration
+	lockKey := "pickup:" + driverID
+	if locked, retryAfter := h.pickups.Locked(lockKey); locked {
+		return pickedUp{}, &pickupLockedError{retryAfter: retryAfter}
+	}
+
+	truckID, err := assignedTruck(ctx, db.Pool, driverID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return pickedUp{}, errNoTruck
+	}
 	if err != nil {
-		fmt.Println("Failed to auto-register truck:", err)
-		// Continue anyway, maybe it exists?
+		return pickedUp{}, fmt.Errorf("resolve truck for driver %s: %w", driverID, err)
 	}
 
+	pickupCode := pickupcode.Normalize(code)
+
+	picked := pickedUp{TruckID: truckID}
+	picked.ShipmentID, picked.OriginLat, picked.OriginLon, err = claimShipment(ctx, truckID, pickupCode)
+	if err == nil {
+		h.pickups.Reset(lockKey)
+		return picked, nil
+	}
+	var mismatch *fleet.MismatchError
+	if errors.As(err, &mismatch) || errors.Is(err, errTruckNotFound) || errors.Is(err, errTruckUnavailable) {
+		return picked, err
+	}
+
+	// Check if it was a "not found", "expired" or "conflict" (already taken)
+	// Old delivered shipments may reuse the code, so prefer the open one
+	var status string
+	var expiresAt *time.Time
+	var assignedTo *string
+	checkErr := db.Pool.QueryRow(ctx, `
+		SELECT status, pickup_code_expires_at, truck_id FROM shipments WHERE pickup_code=$1
+		ORDER BY status = 'CREATED' DESC, created_at DESC
+		LIMIT 1
+	`, pickupCode).Scan(&status, &expiresAt, &assignedTo)
+
+	switch {
+	case checkErr != nil:
+		h.pickups.Fail(lockKey)
+		return picked, errInvalidPickupCode
+	case status == "CREATED" && expiresAt != nil && expiresAt.Before(time.Now()):
+		return picked, errPickupCodeExpired
+	case status == "CREATED" && assignedTo != nil && *assignedTo != truckID:
+		return picked, errOtherTruck
+	case status != "CREATED":
+		h.pickups.Fail(lockKey)
+		return picked, errAlreadyTaken
+	}
+	return picked, err
+}
+
+// claimShipment puts the open shipment with the pickup code on the truck,
+// after checking the truck can take it on top of what it already carries.
+// It returns pgx.ErrNoRows when no claimable shipment has the code.
+func claimShipment(ctx context.Context, truckID, pickupCode string) (string, float64, float64, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+
 	var shipmentID string
 	var originLat, originLon float64
-	err = db.Pool.QueryRow(c.Request.Context(), `
-		UPDATE shipments 
-		SET status='IN_TRANSIT', truck_id=$1, started_at=NOW()
-		WHERE pickup_code=$2 AND status='CREATED'
-		RETURNING id, origin_lat, origin_lon
-	`, truckID, req.PickupCode).Scan(&shipmentID, &originLat, &originLon)
-
+	var load fleet.Load
+	err = tx.QueryRow(ctx, `
+		SELECT id, origin_lat, origin_lon, weight_kg, volume_m3, cargo_type FROM shipments
+		WHERE pickup_code=$1 AND status='CREATED'
+		AND (pickup_code_expires_at IS NULL OR pickup_code_expires_at > NOW())
+		AND (truck_id IS NULL OR truck_id = $2)
+		FOR UPDATE
+	`, pickupCode, truckID).Scan(&shipmentID, &originLat, &originLon, &load.WeightKg, &load.VolumeM3, &load.CargoType)
 	if err != nil {
-		// Check if it was a "not found" or "conflict" (already taken)
-		// Simple check: query if code exists at all
-		var status string
-		checkErr := db.Pool.QueryRow(c.Request.Context(), "SELECT status FROM shipments WHERE pickup_code=$1", req.PickupCode).Scan(&status)
-		
-		if checkErr != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Invalid pickup code"})
-		} else if status != "CREATED" {
-			c.JSON(http.StatusConflict, gin.H{"error": "Shipment already taken or completed"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pickup shipment"})
-		}
-		return
+		return "", 0, 0, err
+	}
+
+	if err := checkTruckFit(ctx, tx, truckID, shipmentID, load); err != nil {
+		return "", 0, 0, err
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"success": true, 
-		"shipment_id": shipmentID,
-		"truck_id": truckID,
-		"origin_lat": originLat,
-		"origin_lon": originLon,
+	_, err = tx.Exec(ctx, `
+		UPDATE shipments SET status='IN_TRANSIT', truck_id=$1, started_at=NOW() WHERE id=$2
+	`, truckID, shipmentID)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	// The code is handed over at the first stop of a multi-stop shipment
+	if _, err := arriveAtStop(ctx, tx, shipmentID, 1, time.Now()); err != nil {
+		return "", 0, 0, err
+	}
+	err = events.Publish(ctx, tx, events.ShipmentPickedUp, shipmentID, events.ShipmentPickedUpData{
+		TruckID: truckID, OriginLat: originLat, OriginLon: originLon,
 	})
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return shipmentID, originLat, originLon, tx.Commit(ctx)
+}
+
+// checkTruckFit locks the truck and checks it is in service and can take the
+// load, ignoring shipmentID if the truck already has it reserved.
+func checkTruckFit(ctx context.Context, tx pgx.Tx, truckID, shipmentID string, load fleet.Load) error {
+	truck, carried, status, err := truckLoad(ctx, tx, truckID, shipmentID)
+	if err != nil {
+		return err
+	}
+	if status != models.TruckActive {
+		return errTruckUnavailable
+	}
+	return fleet.CheckFit(truck, load, carried)
+}
+
+// fitError writes the response when a truck can't take a shipment and
+// reports whether it did.
+func fitError(c *gin.Context, err error) bool {
+	var mismatch *fleet.MismatchError
+	switch {
+	case errors.As(err, &mismatch):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Truck can't take this shipment: " + mismatch.Reason, "reason": mismatch.Reason})
+	case errors.Is(err, errTruckNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Truck not found"})
+	case errors.Is(err, errTruckUnavailable):
+		c.JSON(http.StatusConflict, gin.H{"error": "Truck is not in service"})
+	default:
+		return false
+	}
+	return true
+}
+
+// rowQuerier is satisfied by both the pool and a transaction.
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// assignedTruck returns the in-service truck a driver is currently assigned
+// to. In a transaction, the assignment stays as it is until it ends.
+func assignedTruck(ctx context.Context, q rowQuerier, driverID string) (string, error) {
+	var truckID string
+	err := q.QueryRow(ctx, `
+		SELECT a.truck_id FROM truck_assignments a
+		JOIN trucks t ON t.id = a.truck_id
+		JOIN drivers d ON d.user_id = a.driver_id
+		WHERE a.driver_id = $1 AND a.unassigned_at IS NULL
+		AND t.status = 'active' AND d.status = 'active'
+		FOR SHARE OF a
+	`, driverID).Scan(&truckID)
+	return truckID, err
 }
 
 func (h *ShipmentHandler) GetActiveShipments(c *gin.Context) {
@@ -156,7 +574,7 @@ func (h *ShipmentHandler) GetActiveShipments(c *gin.Context) {
 		       COALESCE(le.latitude, s.origin_lat) as lat, 
 		       COALESCE(le.longitude, s.origin_lon) as lon, 
 		       s.dest_lat, s.dest_lon, s.status, s.pickup_code,
-		       COALESCE(le.speed, 0) as speed
+		       COALESCE(le.speed, 0) as speed, s.origin_place, s.dest_place
 		FROM shipments s
 		LEFT JOIN LATERAL (
 			SELECT latitude, longitude, speed
@@ -166,7 +584,8 @@ func (h *ShipmentHandler) GetActiveShipments(c *gin.Context) {
 			LIMIT 1
 		) le ON true
 		WHERE s.status = 'IN_TRANSIT'
-	`)
+		AND (s.org_id = $1 OR s.truck_id IN (SELECT id FROM trucks WHERE org_id = $1))
+	`, c.GetString("org_id"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch active shipments"})
 		return
@@ -178,13 +597,14 @@ func (h *ShipmentHandler) GetActiveShipments(c *gin.Context) {
 		var id, status, pickupCode string
 		var truckID *string
 		var lat, lon, destLat, destLon, speed float64
+		var originPlace, destPlace *string
 		
-		err := rows.Scan(&id, &truckID, &lat, &lon, &destLat, &destLon, &status, &pickupCode, &speed)
+		err := rows.Scan(&id, &truckID, &lat, &lon, &destLat, &destLon, &status, &pickupCode, &speed, &originPlace, &destPlace)
 		if err != nil {
 			continue
 		}
 		
-		shipments = append(shipments, gin.H{
+		shipment := gin.H{
 			"id": id,
 			"truck_id": truckID,
 			"lat": lat,
@@ -194,7 +614,16 @@ func (h *ShipmentHandler) GetActiveShipments(c *gin.Context) {
 			"status": status,
 			"pickup_code": pickupCode,
 			"speed": speed,
-		})
+			"place": h.places.Describe(geo.Point{Lat: lat, Lon: lon}).Text,
+			"origin_place": originPlace,
+			"dest_place": destPlace,
+		}
+		// Remaining road distance and arrival, unknown when the truck is off the map
+		if path, err := h.routeAhead(id, geo.Point{Lat: lat, Lon: lon}, geo.Point{Lat: destLat, Lon: destLon}); err == nil {
+			shipment["remaining_km"] = path.DistanceM / 1000
+			shipment["eta"] = time.Now().Add(path.Duration)
+		}
+		shipments = append(shipments, shipment)
 	}
 
 	c.JSON(http.StatusOK, shipments)
@@ -210,7 +639,10 @@ func (h *ShipmentHandler) CompleteShipment(c *gin.Context) {
 	}
 
 	var currentStatus string
-	err := db.Pool.QueryRow(c.Request.Context(), "SELECT status FROM shipments WHERE id=$1", req.ShipmentID).Scan(&currentStatus)
+	err := db.Pool.QueryRow(c.Request.Context(), `
+		SELECT status FROM shipments WHERE id=$1
+		AND (org_id = $2 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $2))
+	`, req.ShipmentID, c.GetString("org_id")).Scan(&currentStatus)
 	
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
@@ -232,10 +664,18 @@ func (h *ShipmentHandler) CompleteShipment(c *gin.Context) {
 		return
 	}
 
-	_, err = db.Pool.Exec(c.Request.Context(), `
-		UPDATE shipments SET status='DELIVERED', completed_at=$1 
-		WHERE id=$2
-	`, time.Now(), req.ShipmentID)
+	ctx := c.Request.Context()
+	now := time.Now()
+	err = inTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			UPDATE shipments SET status='DELIVERED', completed_at=$1 
+			WHERE id=$2
+		`, now, req.ShipmentID)
+		if err != nil {
+			return err
+		}
+		return events.Publish(ctx, tx, events.ShipmentDelivered, req.ShipmentID, events.ShipmentDeliveredData{DeliveredAt: now})
+	})
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete shipment"})
@@ -245,50 +685,102 @@ func (h *ShipmentHandler) CompleteShipment(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
+// VerifyArrival checks the driver is at the destination, or for a
+// multi-stop shipment at the current stop (or stop_seq), and marks the stop
+// as reached.
 func (h *ShipmentHandler) VerifyArrival(c *gin.Context) {
 	var req struct {
 		ShipmentID string  `json:"shipment_id"`
 		Lat        float64 `json:"lat"`
 		Lon        float64 `json:"lon"`
+		StopSeq    *int    `json:"stop_seq"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	seq, err := verifyArrival(c.Request.Context(), c.GetString("org_id"), req.ShipmentID, geo.Point{Lat: req.Lat, Lon: req.Lon}, req.StopSeq)
+	var tooFar *tooFarError
+	switch {
+	case errors.Is(err, errShipmentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+	case errors.Is(err, errStopNotCurrent):
+		c.JSON(http.StatusConflict, gin.H{"error": errStopNotCurrent.Error(), "current_stop_seq": seq})
+	case errors.Is(err, errStopNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stop not found"})
+	case errors.As(err, &tooFar):
+		c.JSON(http.StatusBadRequest, gin.H{"error": tooFar.Error()})
+	case err != nil:
+		log.Printf("Failed to record arrival: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record arrival"})
+	case seq != nil:
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": "Arrival verified", "stop_seq": *seq})
+	default:
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": "Arrival verified"})
+	}
+}
+
+var errShipmentNotFound = errors.New("shipment not found")
+
+// tooFarError is returned for an arrival claimed too far from where the
+// shipment is going.
+type tooFarError struct {
+	distance float64
+	seq      *int // Stop it is going to, nil for the destination
+}
+
+func (e *tooFarError) Error() string {
+	if e.seq != nil {
+		return fmt.Sprintf("You are too far from stop %d (%.2fm away)", *e.seq, e.distance)
+	}
+	return fmt.Sprintf("You are too far from destination (%.2fm away)", e.distance)
+}
+
+// verifyArrival checks a shipment of the organization, or carried by it,
+// is at its destination or, with stops, at the current stop (which stopSeq
+// must be if given) and marks the stop reached. It returns the stop, nil
+// without stops.
+func verifyArrival(ctx context.Context, orgID, shipmentID string, at geo.Point, stopSeq *int) (*int, error) {
 	var destLat, destLon float64
-	err := db.Pool.QueryRow(c.Request.Context(), `
-		SELECT dest_lat, dest_lon FROM shipments WHERE id=$1
-	`, req.ShipmentID).Scan(&destLat, &destLon)
+	var currentSeq *int
+	err := db.Pool.QueryRow(ctx, `
+		SELECT dest_lat, dest_lon, current_stop_seq FROM shipments WHERE id=$1
+		AND (org_id = $2 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $2))
+	`, shipmentID, orgID).Scan(&destLat, &destLon, &currentSeq)
 
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
-		return
+		return nil, errShipmentNotFound
+	}
+
+	if currentSeq != nil {
+		seq := *currentSeq
+		if stopSeq != nil && *stopSeq != seq {
+			return currentSeq, errStopNotCurrent
+		}
+		err = db.Pool.QueryRow(ctx, "SELECT lat, lon FROM shipment_stops WHERE shipment_id=$1 AND seq=$2", shipmentID, seq).Scan(&destLat, &destLon)
+		if err != nil {
+			return currentSeq, errStopNotFound
+		}
+		if dist := haversine(at.Lat, at.Lon, destLat, destLon); dist > stopGeofence {
+			return currentSeq, &tooFarError{distance: dist, seq: currentSeq}
+		}
+		if _, err := arriveAtStop(ctx, db.Pool, shipmentID, seq, time.Now()); err != nil {
+			return currentSeq, err
+		}
+		return currentSeq, nil
 	}
 
 	// Calculate distance
-	dist := haversine(req.Lat, req.Lon, destLat, destLon)
+	dist := haversine(at.Lat, at.Lon, destLat, destLon)
 
 	if dist > 1000 { // 1km
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("You are too far from destination (%.2fm away)", dist)})
-		return
+		return nil, &tooFarError{distance: dist}
 	}
-
-	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Arrival verified"})
+	return nil, nil
 }
 
 // Haversine formula to calculate distance in meters
 func haversine(lat1, lon1, lat2, lon2 float64) float64 {
-	const R = 6371000 // Earth radius in meters
-	phi1 := lat1 * (math.Pi / 180)
-	phi2 := lat2 * (math.Pi / 180)
-	deltaPhi := (lat2 - lat1) * (math.Pi / 180)
-	deltaLambda := (lon2 - lon1) * (math.Pi / 180)
-
-	a := math.Sin(deltaPhi/2)*math.Sin(deltaPhi/2) +
-		math.Cos(phi1)*math.Cos(phi2)*
-			math.Sin(deltaLambda/2)*math.Sin(deltaLambda/2)
-	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
-
-	return R * c
+	return geo.Haversine(geo.Point{Lat: lat1, Lon: lon1}, geo.Point{Lat: lat2, Lon: lon2})
 }
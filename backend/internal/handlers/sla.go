@@ -0,0 +1,365 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/events"
+	"agri-track/internal/geo"
+	"agri-track/internal/models"
+	"agri-track/internal/roads"
+	"agri-track/internal/sla"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// A shipment expected within this of its deadline is at risk of being late
+const lateRiskMargin = 30 * time.Minute
+
+// SLAHandler keeps shipments to the delivery windows promised to buyers:
+// it sets windows from the organization's policies at pickup, watches the
+// arrival estimate on the road and classifies every delivery.
+type SLAHandler struct {
+	router roads.Router
+}
+
+func NewSLAHandler(router roads.Router) *SLAHandler {
+	return &SLAHandler{router: router}
+}
+
+// ListPolicies returns the organization's SLA policies.
+func (h *SLAHandler) ListPolicies(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT id, name, origin_place, dest_place, transit_hours, window_hours, created_at
+		FROM sla_policies WHERE org_id = $1
+		ORDER BY id
+	`, c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch policies"})
+		return
+	}
+	defer rows.Close()
+
+	policies := []models.SLAPolicy{}
+	for rows.Next() {
+		var p models.SLAPolicy
+		if err := rows.Scan(&p.ID, &p.Name, &p.OriginPlace, &p.DestPlace, &p.TransitHours, &p.WindowHours, &p.CreatedAt); err != nil {
+			continue
+		}
+		policies = append(policies, p)
+	}
+	c.JSON(http.StatusOK, policies)
+}
+
+// CreatePolicy promises delivery on a route, between the places shipments
+// are named after. Without places it is the organization's default.
+func (h *SLAHandler) CreatePolicy(c *gin.Context) {
+	var req models.SLAPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+
+	p := models.SLAPolicy{Name: req.Name, OriginPlace: req.OriginPlace, DestPlace: req.DestPlace,
+		TransitHours: req.TransitHours, WindowHours: req.WindowHours}
+	err := db.Pool.QueryRow(c.Request.Context(), `
+		INSERT INTO sla_policies (org_id, name, origin_place, dest_place, transit_hours, window_hours)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, c.GetString("org_id"), req.Name, req.OriginPlace, req.DestPlace, req.TransitHours, req.WindowHours).Scan(&p.ID, &p.CreatedAt)
+	if db.IsUniqueViolation(err, "sla_policies_route_idx") {
+		c.JSON(http.StatusConflict, gin.H{"error": "There is already a policy for this route"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create SLA policy: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create policy"})
+		return
+	}
+	c.JSON(http.StatusCreated, p)
+}
+
+// DeletePolicy removes a policy. Shipments keep the windows it gave them.
+func (h *SLAHandler) DeletePolicy(c *gin.Context) {
+	tag, err := db.Pool.Exec(c.Request.Context(), "DELETE FROM sla_policies WHERE id=$1 AND org_id=$2", c.Param("id"), c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete policy"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// LateRisk returns the organization's shipments on the road expected to
+// miss their window, or to make it by less than half an hour, the latest
+// first.
+func (h *SLAHandler) LateRisk(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT s.id, s.commodity, t.plate_number, s.dest_place, s.deliver_by, s.eta
+		FROM shipments s
+		LEFT JOIN trucks t ON t.id = s.truck_id
+		WHERE s.status = 'IN_TRANSIT' AND s.eta > s.deliver_by - make_interval(mins => $2)
+		AND (s.org_id = $1 OR s.truck_id IN (SELECT id FROM trucks WHERE org_id = $1))
+		ORDER BY s.eta - s.deliver_by DESC
+	`, c.GetString("org_id"), int(lateRiskMargin.Minutes()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shipments"})
+		return
+	}
+	defer rows.Close()
+
+	shipments := []models.LateRiskShipment{}
+	for rows.Next() {
+		var s models.LateRiskShipment
+		if err := rows.Scan(&s.ID, &s.Commodity, &s.Plate, &s.DestPlace, &s.DeliverBy, &s.ETA); err != nil {
+			continue
+		}
+		s.LateMinutes = s.ETA.Sub(s.DeliverBy).Minutes()
+		shipments = append(shipments, s)
+	}
+	c.JSON(http.StatusOK, shipments)
+}
+
+// TrackShipment subscribes SLA tracking to the event bus: a shipment picked
+// up without a window gets one from its organization's policy for the
+// route, and a delivered one is classified against its window. Both are
+// safe to repeat.
+func (h *SLAHandler) TrackShipment(ctx context.Context, e events.Event) error {
+	switch e.Type {
+	case events.ShipmentPickedUp:
+		return applyPolicy(ctx, e.ShipmentID)
+	case events.ShipmentDelivered:
+		return classifyDelivery(ctx, e.ShipmentID)
+	}
+	return nil
+}
+
+func applyPolicy(ctx context.Context, shipmentID string) error {
+	var orgID *string
+	var startedAt time.Time
+	var origin, dest string
+	err := db.Pool.QueryRow(ctx, `
+		SELECT org_id, started_at, COALESCE(origin_place, ''), COALESCE(dest_place, '')
+		FROM shipments WHERE id = $1 AND deliver_by IS NULL AND started_at IS NOT NULL
+	`, shipmentID).Scan(&orgID, &startedAt, &origin, &dest)
+	if errors.Is(err, pgx.ErrNoRows) || err == nil && orgID == nil {
+		return nil // Already promised, or nobody promised anything
+	}
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id, origin_place, dest_place, transit_hours, window_hours FROM sla_policies WHERE org_id = $1
+	`, *orgID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var policies []sla.Policy
+	for rows.Next() {
+		var p sla.Policy
+		if err := rows.Scan(&p.ID, &p.OriginPlace, &p.DestPlace, &p.TransitHours, &p.WindowHours); err != nil {
+			return err
+		}
+		policies = append(policies, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	p := sla.Match(policies, origin, dest)
+	if p == nil {
+		return nil
+	}
+	w := p.Window(startedAt)
+	_, err = db.Pool.Exec(ctx, `
+		UPDATE shipments SET deliver_from=$2, deliver_by=$3, sla_policy_id=$4 WHERE id=$1 AND deliver_by IS NULL
+	`, shipmentID, w.From, w.By, p.ID)
+	return err
+}
+
+// classifyDelivery records whether a shipment was delivered early, on
+// time or late, and for a late one by how much and why.
+func classifyDelivery(ctx context.Context, shipmentID string) error {
+	var w sla.Window
+	var trip sla.Trip
+	var startedAt, completedAt *time.Time
+	err := db.Pool.QueryRow(ctx, `
+		SELECT deliver_from, deliver_by, started_at, completed_at, pickup_until
+		FROM shipments WHERE id = $1 AND deliver_by IS NOT NULL AND completed_at IS NOT NULL
+	`, shipmentID).Scan(&w.From, &w.By, &startedAt, &completedAt, &trip.PickupUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil // No promise to keep, or not delivered after all
+	}
+	if err != nil {
+		return err
+	}
+
+	outcome := w.Classify(*completedAt)
+	if outcome != sla.Late {
+		_, err = db.Pool.Exec(ctx, `
+			UPDATE shipments SET sla_status=$2, delay_minutes=NULL, delay_reason=NULL WHERE id=$1
+		`, shipmentID, outcome)
+		return err
+	}
+
+	if startedAt != nil {
+		trip.StartedAt = *startedAt
+	}
+	if err := loadTrip(ctx, shipmentID, &trip); err != nil {
+		return err
+	}
+	reason, _ := sla.Attribute(trip)
+	_, err = db.Pool.Exec(ctx, `
+		UPDATE shipments SET sla_status=$2, delay_minutes=$3, delay_reason=$4 WHERE id=$1
+	`, shipmentID, outcome, completedAt.Sub(w.By).Minutes(), reason)
+	return err
+}
+
+// loadTrip reads the fixes, stops and incidents a delay is attributed from.
+func loadTrip(ctx context.Context, shipmentID string, trip *sla.Trip) error {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT time, COALESCE(speed, 0) FROM logistics_events WHERE shipment_id = $1 ORDER BY time
+	`, shipmentID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f sla.Fix
+		if err := rows.Scan(&f.Time, &f.Speed); err != nil {
+			return err
+		}
+		trip.Fixes = append(trip.Fixes, f)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Pool.Query(ctx, `
+		SELECT arrived_at, completed_at FROM shipment_stops
+		WHERE shipment_id = $1 AND arrived_at IS NOT NULL AND completed_at IS NOT NULL
+	`, shipmentID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s sla.Stop
+		if err := rows.Scan(&s.Arrived, &s.Departed); err != nil {
+			return err
+		}
+		trip.Stops = append(trip.Stops, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Pool.Query(ctx, `
+		SELECT time, incident_type, COALESCE(severity, 1) FROM logistics_incidents WHERE shipment_id = $1
+	`, shipmentID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i sla.Incident
+		if err := rows.Scan(&i.Time, &i.Type, &i.Severity); err != nil {
+			return err
+		}
+		trip.Incidents = append(trip.Incidents, i)
+	}
+	return rows.Err()
+}
+
+// StartMonitor updates arrival estimates until ctx is cancelled.
+func (h *SLAHandler) StartMonitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := h.CheckETAs(ctx); err != nil {
+				log.Printf("Checking arrival estimates failed: %v", err)
+			}
+		}
+	}
+}
+
+// CheckETAs estimates when each shipment on the road with a window will
+// arrive, from its last fix along the fastest road, and returns how many
+// it estimated. The first estimate past the window publishes an ETA
+// breach, which the shipper is alerted to.
+func (h *SLAHandler) CheckETAs(ctx context.Context) (int, error) {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT s.id, COALESCE(le.latitude, s.origin_lat), COALESCE(le.longitude, s.origin_lon), s.dest_lat, s.dest_lon,
+			s.deliver_by, s.eta_breached_at IS NOT NULL
+		FROM shipments s
+		LEFT JOIN LATERAL (
+			SELECT latitude, longitude FROM logistics_events WHERE shipment_id = s.id ORDER BY time DESC LIMIT 1
+		) le ON true
+		WHERE s.status = 'IN_TRANSIT' AND s.deliver_by IS NOT NULL
+	`)
+	if err != nil {
+		return 0, err
+	}
+	type onRoad struct {
+		id        string
+		at, dest  geo.Point
+		deliverBy time.Time
+		breached  bool
+	}
+	var batch []onRoad
+	for rows.Next() {
+		var s onRoad
+		if err := rows.Scan(&s.id, &s.at.Lat, &s.at.Lon, &s.dest.Lat, &s.dest.Lon, &s.deliverBy, &s.breached); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Routing happens outside any transaction, the updates are guarded
+	// instead so a shipment delivered meanwhile is left alone and a breach
+	// is only published once
+	now := time.Now()
+	for _, s := range batch {
+		path, err := h.router.Route(s.at, s.dest, roads.Fastest)
+		if err != nil {
+			// Off the map, estimate from the straight line
+			path, _ = roads.Straight{Detour: roads.DefaultDetour, SpeedKmh: roads.DefaultSpeedKmh}.Route(s.at, s.dest, roads.Fastest)
+		}
+		eta := now.Add(path.Duration)
+		err = inTx(ctx, func(tx pgx.Tx) error {
+			tag, err := tx.Exec(ctx, "UPDATE shipments SET eta=$2 WHERE id=$1 AND status = 'IN_TRANSIT'", s.id, eta)
+			if err != nil || tag.RowsAffected() == 0 || s.breached || !eta.After(s.deliverBy) {
+				return err
+			}
+			tag, err = tx.Exec(ctx, "UPDATE shipments SET eta_breached_at=NOW() WHERE id=$1 AND eta_breached_at IS NULL", s.id)
+			if err != nil || tag.RowsAffected() == 0 {
+				return err
+			}
+			return events.Publish(ctx, tx, events.ShipmentETABreach, s.id, events.ShipmentETABreachData{ETA: eta, DeliverBy: s.deliverBy})
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), nil
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"agri-track/internal/db"
+	"agri-track/internal/fleet"
+	"agri-track/internal/geo"
+	"agri-track/internal/models"
+	"agri-track/internal/notify"
+	"agri-track/internal/sms"
+	"agri-track/internal/smscommand"
+	"agri-track/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// SMSCommandHandler lets drivers without data report by text message. It
+// acts through the same code as the API and answers every command with a
+// text message.
+type SMSCommandHandler struct {
+	shipments *ShipmentHandler
+	telemetry *TelemetryHandler
+	sender    sms.Sender
+	// Gateways don't sign callbacks, the callback URL carries this as ?token=
+	token string
+}
+
+func NewSMSCommandHandler(shipments *ShipmentHandler, telemetry *TelemetryHandler, sender sms.Sender, token string) *SMSCommandHandler {
+	return &SMSCommandHandler{shipments: shipments, telemetry: telemetry, sender: sender, token: token}
+}
+
+// Inbound receives a text message from the gateway, in the form Africa's
+// Talking posts them. Gateways retry callbacks, so each message is only
+// acted on once.
+func (h *SMSCommandHandler) Inbound(c *gin.Context) {
+	if h.token == "" || subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(h.token)) != 1 {
+		c.String(http.StatusForbidden, "Forbidden")
+		return
+	}
+	var req struct {
+		ID   string `form:"id" binding:"required"`
+		From string `form:"from" binding:"required"`
+		Text string `form:"text"`
+	}
+	if err := c.ShouldBind(&req); err != nil {
+		c.String(http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	// Gateways send numbers in whatever format the network uses. One that
+	// can't be read is kept as sent and matches no account.
+	if phone, err := utils.NormalizePhone(req.From); err == nil {
+		req.From = phone
+	}
+
+	ctx := c.Request.Context()
+	tag, err := db.Pool.Exec(ctx, `
+		INSERT INTO inbound_sms (id, phone, body) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING
+	`, req.ID, req.From, req.Text)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.String(http.StatusOK, "Duplicate")
+		return
+	}
+
+	reply := h.handle(ctx, req.From, req.Text)
+	if reply == "" {
+		c.String(http.StatusOK, "Ignored")
+		return
+	}
+	if _, err := db.Pool.Exec(ctx, "UPDATE inbound_sms SET reply=$2 WHERE id=$1", req.ID, reply); err != nil {
+		log.Printf("Failed to store SMS reply: %v", err)
+	}
+	if err := h.sender.Send(ctx, req.From, reply); err != nil {
+		log.Printf("Failed to reply to %s: %v", req.From, err)
+	}
+	c.String(http.StatusOK, reply)
+}
+
+// handle carries out a command from a phone number and returns the reply.
+// Numbers that aren't an active driver's get none, so nobody can run up
+// the bill texting in. Only the number the driver verified by OTP counts,
+// the one on the driver profile is typed in by the fleet.
+func (h *SMSCommandHandler) handle(ctx context.Context, phone, text string) string {
+	var driverID, orgID, status string
+	err := db.Pool.QueryRow(ctx, `
+		SELECT u.id, d.org_id, u.status FROM users u JOIN drivers d ON d.user_id = u.id
+		WHERE u.phone = $1
+	`, phone).Scan(&driverID, &orgID, &status)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("Failed to look up SMS sender: %v", err)
+		}
+		return ""
+	}
+	if status == models.UserSuspended {
+		return ""
+	}
+
+	cmd, err := smscommand.Parse(text)
+	if err != nil {
+		return "Sorry, " + err.Error() + ". " + smscommand.Usage
+	}
+	var reply string
+	switch cmd.Kind {
+	case smscommand.Help:
+		return smscommand.Usage
+	case smscommand.Pickup:
+		reply, err = h.pickup(ctx, driverID, cmd)
+	case smscommand.Incident:
+		reply, err = h.incident(ctx, driverID, orgID, cmd)
+	case smscommand.Arrived:
+		reply, err = h.arrived(ctx, driverID, orgID, cmd)
+	}
+	if err != nil {
+		log.Printf("SMS command %q from %s failed: %v", text, phone, err)
+		return "Sorry, something went wrong. Please try again later."
+	}
+	return reply
+}
+
+func (h *SMSCommandHandler) pickup(ctx context.Context, driverID string, cmd smscommand.Command) (string, error) {
+	picked, err := h.shipments.pickup(ctx, driverID, cmd.PickupCode)
+	var locked *pickupLockedError
+	var mismatch *fleet.MismatchError
+	switch {
+	case errors.As(err, &locked):
+		return "Too many invalid pickup codes, try again later.", nil
+	case errors.Is(err, errNoTruck):
+		return "You are not assigned to a truck, ask your dispatcher to assign one.", nil
+	case errors.As(err, &mismatch):
+		return "Your truck can't take this shipment: " + mismatch.Reason + ".", nil
+	case errors.Is(err, errTruckNotFound), errors.Is(err, errTruckUnavailable):
+		return "Your truck is not in service.", nil
+	case errors.Is(err, errInvalidPickupCode):
+		return "Invalid pickup code " + cmd.PickupCode + ".", nil
+	case errors.Is(err, errPickupCodeExpired):
+		return "Pickup code expired, ask the farmer for a new one.", nil
+	case errors.Is(err, errOtherTruck):
+		return "That shipment is assigned to another truck.", nil
+	case errors.Is(err, errAlreadyTaken):
+		return "That shipment was already taken or completed.", nil
+	case err != nil:
+		return "", err
+	}
+	ref := shortID(picked.ShipmentID)
+	return fmt.Sprintf("Picked up shipment %s. Send ARRIVED %s at the destination.", ref, ref), nil
+}
+
+func (h *SMSCommandHandler) incident(ctx context.Context, driverID, orgID string, cmd smscommand.Command) (string, error) {
+	truckID, shipments, err := inTransit(ctx, driverID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "You are not assigned to a truck, ask your dispatcher to assign one.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(shipments) == 0 {
+		return "You have no shipment on the way to report on.", nil
+	}
+	// Incidents are on the shipment picked up last
+	shipmentID := shipments[0]
+
+	// Texts carry no position, the truck's last one is the best there is
+	at, known, err := lastPosition(ctx, truckID)
+	if err != nil {
+		return "", err
+	}
+	if !known {
+		err = db.Pool.QueryRow(ctx, "SELECT origin_lat, origin_lon FROM shipments WHERE id=$1", shipmentID).Scan(&at.Lat, &at.Lon)
+		if err != nil {
+			return "", err
+		}
+	}
+	note := cmd.Note
+	if note == "" {
+		note = "Reported by SMS"
+	}
+
+	reported, err := h.telemetry.reportIncident(ctx, orgID, models.IncidentRequest{
+		TruckID: truckID, ShipmentID: shipmentID, Latitude: at.Lat, Longitude: at.Lon,
+		IncidentType: cmd.IncidentType, Description: note, Severity: cmd.Severity,
+	})
+	if err != nil {
+		return "", err
+	}
+	if !reported {
+		return "You have no shipment on the way to report on.", nil
+	}
+	return fmt.Sprintf("Reported %s (severity %d) on shipment %s. Stay safe.", notify.IncidentText(cmd.IncidentType), cmd.Severity, shortID(shipmentID)), nil
+}
+
+func (h *SMSCommandHandler) arrived(ctx context.Context, driverID, orgID string, cmd smscommand.Command) (string, error) {
+	truckID, shipments, err := inTransit(ctx, driverID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "You are not assigned to a truck, ask your dispatcher to assign one.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	for _, id := range shipments {
+		if strings.HasPrefix(id, cmd.Shipment) {
+			matches = append(matches, id)
+		}
+	}
+	switch {
+	case len(matches) == 0 && cmd.Shipment == "":
+		return "You have no shipment on the way.", nil
+	case len(matches) == 0:
+		return "No shipment " + cmd.Shipment + " on your truck.", nil
+	case len(matches) > 1:
+		refs := make([]string, len(matches))
+		for i, id := range matches {
+			refs[i] = shortID(id)
+		}
+		return "Which shipment? Send ARRIVED with one of " + strings.Join(refs, ", ") + ".", nil
+	}
+	shipmentID := matches[0]
+
+	// Texts carry no position, the truck's last one has to be at the destination
+	at, known, err := lastPosition(ctx, truckID)
+	if err != nil {
+		return "", err
+	}
+	if !known {
+		return "Your truck's position is unknown, confirm arrival in the app.", nil
+	}
+	seq, err := verifyArrival(ctx, orgID, shipmentID, at, nil)
+	var tooFar *tooFarError
+	switch {
+	case errors.As(err, &tooFar):
+		return fmt.Sprintf("Your truck was last seen %.1f km away, send ARRIVED again once there.", tooFar.distance/1000), nil
+	case errors.Is(err, errShipmentNotFound):
+		return "No shipment " + cmd.Shipment + " on your truck.", nil
+	case err != nil:
+		return "", err
+	case seq != nil:
+		return fmt.Sprintf("Arrival at stop %d confirmed for shipment %s.", *seq, shortID(shipmentID)), nil
+	}
+	return fmt.Sprintf("Arrival confirmed for shipment %s. Hand over the goods and complete the delivery.", shortID(shipmentID)), nil
+}
+
+// inTransit returns the driver's truck and the shipments on it, picked up
+// last first. It returns pgx.ErrNoRows for a driver without a truck.
+func inTransit(ctx context.Context, driverID string) (string, []string, error) {
+	truckID, err := assignedTruck(ctx, db.Pool, driverID)
+	if err != nil {
+		return "", nil, err
+	}
+	rows, err := db.Pool.Query(ctx, `
+		SELECT id FROM shipments WHERE truck_id=$1 AND status='IN_TRANSIT' ORDER BY started_at DESC
+	`, truckID)
+	if err != nil {
+		return truckID, nil, err
+	}
+	defer rows.Close()
+
+	var shipments []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return truckID, nil, err
+		}
+		shipments = append(shipments, id)
+	}
+	return truckID, shipments, rows.Err()
+}
+
+// lastPosition returns where a truck last reported being, if it ever did.
+func lastPosition(ctx context.Context, truckID string) (geo.Point, bool, error) {
+	var p geo.Point
+	err := db.Pool.QueryRow(ctx, `
+		SELECT latitude, longitude FROM logistics_events WHERE truck_id=$1 ORDER BY time DESC LIMIT 1
+	`, truckID).Scan(&p.Lat, &p.Lon)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return p, false, nil
+	}
+	return p, err == nil, err
+}
+
+// shortID is the part of a shipment ID drivers type, enough to tell their
+// shipments apart.
+func shortID(id string) string {
+	return id[:min(len(id), 8)]
+}
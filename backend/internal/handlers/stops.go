@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/events"
+	"agri-track/internal/geo"
+	"agri-track/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// A truck within this distance of a stop has arrived, in meters
+const stopGeofence = 500
+
+var (
+	errStopNotFound   = errors.New("stop not found")
+	errStopNotCurrent = errors.New("stops must be handled in order, this is not the current stop")
+	errStopNotArrived = errors.New("arrival at this stop hasn't been verified")
+	errNotInTransit   = errors.New("shipment is not in transit")
+	errInvalidStops   = errors.New("invalid stops")
+)
+
+// planStops checks the order and quantities of a stop list and returns the
+// first and last stop, and the most the truck carries at once when every
+// quantity is known.
+func planStops(stops []models.StopRequest) (geo.Point, geo.Point, *float64, error) {
+	first, last := stops[0], stops[len(stops)-1]
+	if first.Kind != models.StopPickup {
+		return geo.Point{}, geo.Point{}, nil, errors.New("the first stop must be a pickup")
+	}
+	if last.Kind != models.StopDropoff {
+		return geo.Point{}, geo.Point{}, nil, errors.New("the last stop must be a drop-off")
+	}
+
+	onboard, peak, known := 0.0, 0.0, true
+	for i, stop := range stops {
+		if stop.QuantityKg == nil {
+			known = false
+			continue
+		}
+		if stop.Kind == models.StopPickup {
+			onboard += *stop.QuantityKg
+		} else {
+			onboard -= *stop.QuantityKg
+		}
+		if known && onboard < 0 {
+			return geo.Point{}, geo.Point{}, nil, fmt.Errorf("stop %d drops off more than was picked up", i+1)
+		}
+		peak = max(peak, onboard)
+	}
+
+	origin := geo.Point{Lat: first.Lat, Lon: first.Lon}
+	dest := geo.Point{Lat: last.Lat, Lon: last.Lon}
+	if !known {
+		return origin, dest, nil, nil
+	}
+	return origin, dest, &peak, nil
+}
+
+// insertStops stores the stops of a new shipment, numbered from 1, with the
+// name of the place each is at.
+func (h *ShipmentHandler) insertStops(ctx context.Context, tx pgx.Tx, shipmentID string, stops []models.StopRequest) error {
+	rows := make([][]interface{}, len(stops))
+	for i, s := range stops {
+		var name, phone *string
+		if s.Name != "" {
+			name = &s.Name
+		}
+		if s.ContactPhone != "" {
+			phone = &s.ContactPhone
+		}
+		place := placeName(h.places, geo.Point{Lat: s.Lat, Lon: s.Lon})
+		rows[i] = []interface{}{shipmentID, i + 1, s.Kind, s.Lat, s.Lon, name, place, phone, s.QuantityKg, s.WindowStart, s.WindowEnd}
+	}
+	_, err := tx.CopyFrom(ctx, pgx.Identifier{"shipment_stops"},
+		[]string{"shipment_id", "seq", "kind", "lat", "lon", "name", "place", "contact_phone", "quantity_kg", "window_start", "window_end"},
+		pgx.CopyFromRows(rows))
+	return err
+}
+
+// ListStops returns the stops of a shipment in order.
+func (h *ShipmentHandler) ListStops(c *gin.Context) {
+	ctx := c.Request.Context()
+	shipmentID := c.Param("id")
+
+	var currentSeq *int
+	err := db.Pool.QueryRow(ctx, `
+		SELECT current_stop_seq FROM shipments WHERE id=$1
+		AND (org_id = $2 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $2))
+	`, shipmentID, c.GetString("org_id")).Scan(&currentSeq)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+		return
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT seq, kind, lat, lon, name, place, contact_phone, quantity_kg, window_start, window_end, status, arrived_at, completed_at,
+		       COALESCE(arrived_at > window_end, false)
+		FROM shipment_stops WHERE shipment_id=$1
+		ORDER BY seq
+	`, shipmentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch stops"})
+		return
+	}
+	defer rows.Close()
+
+	stops := []models.ShipmentStop{}
+	for rows.Next() {
+		var s models.ShipmentStop
+		err := rows.Scan(&s.Seq, &s.Kind, &s.Lat, &s.Lon, &s.Name, &s.Place, &s.ContactPhone, &s.QuantityKg, &s.WindowStart, &s.WindowEnd,
+			&s.Status, &s.ArrivedAt, &s.CompletedAt, &s.Late)
+		if err != nil {
+			continue
+		}
+		stops = append(stops, s)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shipment_id": shipmentID, "current_stop_seq": currentSeq, "stops": stops})
+}
+
+// CompleteStop records that the goods were loaded or unloaded at the current
+// stop, or that it was skipped, and moves the shipment on to the next stop.
+// Completing the last stop delivers the shipment.
+func (h *ShipmentHandler) CompleteStop(c *gin.Context) {
+	var req models.CompleteStopRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+	seq, err := strconv.Atoi(c.Param("seq"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid stop number"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	shipmentID := c.Param("id")
+	var next *int
+	err = inTx(ctx, func(tx pgx.Tx) error {
+		var status string
+		var currentSeq *int
+		err := tx.QueryRow(ctx, `
+			SELECT status, current_stop_seq FROM shipments WHERE id=$1
+			AND (org_id = $2 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $2))
+			FOR UPDATE
+		`, shipmentID, c.GetString("org_id")).Scan(&status, &currentSeq)
+		if err != nil {
+			return err
+		}
+		if currentSeq == nil {
+			return errStopNotFound
+		}
+		if status != "IN_TRANSIT" {
+			return errNotInTransit
+		}
+		if seq != *currentSeq {
+			return errStopNotCurrent
+		}
+
+		next, err = completeStop(ctx, tx, shipmentID, seq, req.Skipped, req.QuantityKg)
+		return err
+	})
+
+	switch {
+	case err == nil:
+	case errors.Is(err, pgx.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+		return
+	case errors.Is(err, errStopNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stop not found"})
+		return
+	case errors.Is(err, errNotInTransit), errors.Is(err, errStopNotCurrent), errors.Is(err, errStopNotArrived):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Printf("Failed to complete stop: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete stop"})
+		return
+	}
+
+	if next == nil {
+		c.JSON(http.StatusOK, gin.H{"shipment_id": shipmentID, "status": "DELIVERED"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"shipment_id": shipmentID, "status": "IN_TRANSIT", "current_stop_seq": *next})
+}
+
+// completeStop closes a stop and makes the next open one current. A stop is
+// only completed once the truck arrived, skipping works either way. After the
+// last stop the shipment is delivered and the returned seq is nil.
+func completeStop(ctx context.Context, tx pgx.Tx, shipmentID string, seq int, skipped bool, quantityKg *float64) (*int, error) {
+	var status string
+	err := tx.QueryRow(ctx, "SELECT status FROM shipment_stops WHERE shipment_id=$1 AND seq=$2 FOR UPDATE", shipmentID, seq).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errStopNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	newStatus := models.StopCompleted
+	if skipped {
+		newStatus = models.StopSkipped
+	} else if status != models.StopArrived {
+		return nil, errStopNotArrived
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE shipment_stops SET status=$3, completed_at=NOW(), quantity_kg=COALESCE($4, quantity_kg)
+		WHERE shipment_id=$1 AND seq=$2
+	`, shipmentID, seq, newStatus, quantityKg)
+	if err != nil {
+		return nil, err
+	}
+
+	var next *int
+	err = tx.QueryRow(ctx, `
+		SELECT MIN(seq) FROM shipment_stops WHERE shipment_id=$1 AND status IN ('PENDING', 'ARRIVED')
+	`, shipmentID).Scan(&next)
+	if err != nil {
+		return nil, err
+	}
+	if next == nil {
+		now := time.Now()
+		_, err = tx.Exec(ctx, "UPDATE shipments SET status='DELIVERED', completed_at=$1 WHERE id=$2", now, shipmentID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, events.Publish(ctx, tx, events.ShipmentDelivered, shipmentID, events.ShipmentDeliveredData{DeliveredAt: now})
+	}
+	_, err = tx.Exec(ctx, "UPDATE shipments SET current_stop_seq=$1 WHERE id=$2", *next, shipmentID)
+	return next, err
+}
+
+// arriveAtStop marks a pending stop as reached, reporting whether it was pending.
+func arriveAtStop(ctx context.Context, q events.Execer, shipmentID string, seq int, at time.Time) (bool, error) {
+	tag, err := q.Exec(ctx, `
+		UPDATE shipment_stops SET status='ARRIVED', arrived_at=$3
+		WHERE shipment_id=$1 AND seq=$2 AND status='PENDING'
+	`, shipmentID, seq, at)
+	return tag.RowsAffected() == 1, err
+}
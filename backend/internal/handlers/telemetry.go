@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -11,12 +12,18 @@ import (
 	"time"
 
 	"agri-track/internal/db"
+	"agri-track/internal/events"
+	"agri-track/internal/gazetteer"
+	"agri-track/internal/geo"
 	"agri-track/internal/models"
+	"agri-track/internal/roads"
 	"agri-track/internal/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
@@ -24,23 +31,67 @@ const (
 	FlushInterval = 2 * time.Second
 )
 
+var (
+	telemetryRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "agritrack_telemetry_rejected_total",
+		Help: "Telemetry turned away with 503 because the queue was full.",
+	})
+	shipmentCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agritrack_telemetry_shipment_cache_lookups_total",
+		Help: "Shipment lookups for incoming telemetry, by whether the cache had it.",
+	}, []string{"result"})
+	telemetryBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "agritrack_telemetry_batch_size",
+		Help:    "Telemetry events written per batch.",
+		Buckets: []float64{1, 5, 10, 25, BatchSize},
+	})
+	telemetryCopyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "agritrack_telemetry_copy_duration_seconds",
+		Help:    "Time taken to copy a batch of telemetry into the database.",
+		Buckets: prometheus.DefBuckets,
+	})
+	telemetryFlushed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agritrack_telemetry_events_flushed_total",
+		Help: "Telemetry events the batch processor wrote, or lost when a batch failed.",
+	}, []string{"result"})
+	incidentsReported = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agritrack_incidents_reported_total",
+		Help: "Incidents reported by drivers, by type.",
+	}, []string{"type"})
+)
+
 type ShipmentMetadata struct {
 	Status string 
 	DestLat float64
 	DestLon float64
+	OrgID        string // Owner of the shipment
+	TruckID      string // Truck carrying it
+	CarrierOrgID string // Owner of the truck carrying it
+	// Multi-stop shipments only
+	Stops       []geo.Point // Stops[i] has seq i+1
+	CurrentStop int         // Seq of the stop the truck is heading to or at
+	AtStop      bool        // Truck has arrived at the current stop
+	// Truck has entered the destination geofence before
+	NearDestination bool
 }
 
 type TelemetryHandler struct {
 	eventChan chan models.LogisticsEvent
+	// Demo trucks follow the roads
+	router roads.Router
+	// Names the place of each incident
+	places *gazetteer.Gazetteer
 
 	// Add a cache and a lock (Mutex) for thread safety
     shipmentCache map[string]ShipmentMetadata // Maps ShipmentID -> Status
     cacheMutex    sync.RWMutex
 }
 
-func NewTelemetryHandler() *TelemetryHandler {
+func NewTelemetryHandler(router roads.Router, places *gazetteer.Gazetteer) *TelemetryHandler {
 	handler := &TelemetryHandler{
         eventChan:     make(chan models.LogisticsEvent, 1000),
+        router:        router,
+        places:        places,
         shipmentCache: make(map[string]ShipmentMetadata),
     }
     // Start a background routine to refresh cache every minute (optional but good)
@@ -102,19 +153,40 @@ func (h *TelemetryHandler) ReceiveTelemetry(c *gin.Context) {
 	meta, exists := h.shipmentCache[event.ShipmentID]
 	h.cacheMutex.RUnlock()
 
-	if !exists {
-
-		err := db.Pool.QueryRow(c.Request.Context(), 
-		"SELECT status, dest_lat, dest_lon FROM shipments WHERE id=$1", event.ShipmentID).Scan(&meta.Status, &meta.DestLat, &meta.DestLon)
+	if exists {
+		shipmentCacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		shipmentCacheLookups.WithLabelValues("miss").Inc()
+
+		var currentStop *int
+		err := db.Pool.QueryRow(c.Request.Context(), `
+			SELECT s.status, s.dest_lat, s.dest_lon, COALESCE(s.org_id, ''), COALESCE(s.truck_id, ''), COALESCE(t.org_id, ''),
+			       s.current_stop_seq, s.near_destination_at IS NOT NULL
+			FROM shipments s LEFT JOIN trucks t ON t.id = s.truck_id
+			WHERE s.id=$1
+		`, event.ShipmentID).Scan(&meta.Status, &meta.DestLat, &meta.DestLon, &meta.OrgID, &meta.TruckID, &meta.CarrierOrgID,
+			&currentStop, &meta.NearDestination)
+		if err == nil && currentStop != nil {
+			err = loadStops(c.Request.Context(), event.ShipmentID, &meta)
+		}
 		
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Shipment ID"})
 			return
 		}	
 
-		h.cacheMutex.Lock()
-		h.shipmentCache[event.ShipmentID] = meta
-		h.cacheMutex.Unlock()
+		// Only cache once the shipment is moving, before that status and truck still change
+		if meta.Status == "IN_TRANSIT" {
+			h.cacheMutex.Lock()
+			h.shipmentCache[event.ShipmentID] = meta
+			h.cacheMutex.Unlock()
+		}
+	}
+
+	orgID := c.GetString("org_id")
+	if orgID != meta.OrgID && orgID != meta.CarrierOrgID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Shipment ID"})
+		return
 	}
 
 	if meta.Status != "IN_TRANSIT" {
@@ -122,6 +194,12 @@ func (h *TelemetryHandler) ReceiveTelemetry(c *gin.Context) {
 		return
 	}
 
+	// Fixes come from the truck carrying the shipment, sent by its organization
+	if event.TruckID != meta.TruckID || orgID != meta.CarrierOrgID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the truck carrying this shipment can report its position"})
+		return
+	}
+
 	// Geofence Check
 	dist := CalculateDistance(event.Latitude, event.Longitude, meta.DestLat, meta.DestLon)
 	if dist < 500 {
@@ -136,10 +214,127 @@ func (h *TelemetryHandler) ReceiveTelemetry(c *gin.Context) {
 	// Non-blocking send to channel
 	select {
 	case h.eventChan <- event:
-		c.JSON(http.StatusAccepted, gin.H{"status": "queued", "near_destination": event.NearDestination})
 	default:
+		telemetryRejected.Inc()
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "queue full"})
+		return
+	}
+
+	// Only a fix that was kept moves the shipment along
+	if event.NearDestination && !meta.NearDestination {
+		meta = h.nearDestination(c.Request.Context(), event, meta)
+	}
+	response := gin.H{"status": "queued", "near_destination": event.NearDestination}
+	if meta.CurrentStop > 0 {
+		meta = h.trackStops(c.Request.Context(), event, meta)
+		response["current_stop_seq"] = meta.CurrentStop
+		response["at_stop"] = meta.AtStop
+	}
+	c.JSON(http.StatusAccepted, response)
+}
+
+// nearDestination records the first time the truck enters the destination
+// geofence and tells the webhook subscribers.
+func (h *TelemetryHandler) nearDestination(ctx context.Context, event models.LogisticsEvent, meta ShipmentMetadata) ShipmentMetadata {
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "UPDATE shipments SET near_destination_at=$2 WHERE id=$1 AND near_destination_at IS NULL", event.ShipmentID, event.Time)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		return events.Publish(ctx, tx, events.ShipmentNearDestination, event.ShipmentID, events.ShipmentNearDestinationData{
+			TruckID: event.TruckID, Lat: event.Latitude, Lon: event.Longitude,
+			DistanceM: CalculateDistance(event.Latitude, event.Longitude, meta.DestLat, meta.DestLon),
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to record shipment %s near destination: %v", event.ShipmentID, err)
+		return meta
+	}
+
+	meta.NearDestination = true
+	h.cacheMutex.Lock()
+	if _, cached := h.shipmentCache[event.ShipmentID]; cached {
+		h.shipmentCache[event.ShipmentID] = meta
+	}
+	h.cacheMutex.Unlock()
+	return meta
+}
+
+// trackStops moves a multi-stop shipment along its stops: entering the
+// current stop's geofence marks it as reached, and driving away completes it
+// and makes the next stop current. The last stop is completed by hand when
+// the goods are handed over.
+func (h *TelemetryHandler) trackStops(ctx context.Context, event models.LogisticsEvent, meta ShipmentMetadata) ShipmentMetadata {
+	seq := meta.CurrentStop
+	dist := geo.Haversine(geo.Point{Lat: event.Latitude, Lon: event.Longitude}, meta.Stops[seq-1])
+
+	var err error
+	switch {
+	case !meta.AtStop && dist < stopGeofence:
+		var arrived bool
+		if arrived, err = arriveAtStop(ctx, db.Pool, event.ShipmentID, seq, event.Time); err == nil && !arrived {
+			// Someone else moved the shipment on, catch up
+			err = loadStops(ctx, event.ShipmentID, &meta)
+		} else if arrived {
+			meta.AtStop = true
+		}
+	// Twice the geofence so GPS jitter at the edge doesn't complete the stop
+	case meta.AtStop && dist > 2*stopGeofence && seq < len(meta.Stops):
+		err = inTx(ctx, func(tx pgx.Tx) error {
+			var current *int
+			if err := tx.QueryRow(ctx, "SELECT current_stop_seq FROM shipments WHERE id=$1 FOR UPDATE", event.ShipmentID).Scan(&current); err != nil {
+				return err
+			}
+			if current == nil || *current != seq {
+				return errStopNotCurrent
+			}
+			_, err := completeStop(ctx, tx, event.ShipmentID, seq, false, nil)
+			return err
+		})
+		if err == nil || errors.Is(err, errStopNotCurrent) || errors.Is(err, errStopNotArrived) {
+			err = loadStops(ctx, event.ShipmentID, &meta)
+		}
+	default:
+		return meta
+	}
+	if err != nil {
+		log.Printf("Failed to track stops of shipment %s: %v", event.ShipmentID, err)
+		return meta
+	}
+
+	h.cacheMutex.Lock()
+	if _, cached := h.shipmentCache[event.ShipmentID]; cached {
+		h.shipmentCache[event.ShipmentID] = meta
 	}
+	h.cacheMutex.Unlock()
+	return meta
+}
+
+// loadStops reads the stops of a multi-stop shipment and where the truck is along them.
+func loadStops(ctx context.Context, shipmentID string, meta *ShipmentMetadata) error {
+	rows, err := db.Pool.Query(ctx, "SELECT lat, lon FROM shipment_stops WHERE shipment_id=$1 ORDER BY seq", shipmentID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	meta.Stops = nil
+	for rows.Next() {
+		var p geo.Point
+		if err := rows.Scan(&p.Lat, &p.Lon); err != nil {
+			return err
+		}
+		meta.Stops = append(meta.Stops, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return db.Pool.QueryRow(ctx, `
+		SELECT s.current_stop_seq, COALESCE(st.status = 'ARRIVED', false)
+		FROM shipments s LEFT JOIN shipment_stops st ON st.shipment_id = s.id AND st.seq = s.current_stop_seq
+		WHERE s.id = $1
+	`, shipmentID).Scan(&meta.CurrentStop, &meta.AtStop)
 }
 
 func (h *TelemetryHandler) ReportIncident(c *gin.Context) {
@@ -149,20 +344,54 @@ func (h *TelemetryHandler) ReportIncident(c *gin.Context) {
 		return
 	}
 
-	_, err := db.Pool.Exec(c.Request.Context(), `
-		INSERT INTO logistics_incidents (truck_id, shipment_id, latitude, longitude, incident_type, description, severity, time)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
-	`, req.TruckID, req.ShipmentID, req.Latitude, req.Longitude, req.IncidentType, req.Description, req.Severity)
-
+	reported, err := h.reportIncident(c.Request.Context(), c.GetString("org_id"), req)
 	if err != nil {
 		log.Printf("Failed to report incident: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to report incident"})
 		return
 	}
+	if !reported {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment or truck not found"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "Incident Reported"})
 }
 
+// reportIncident stores an incident on a shipment of the organization, or
+// carried by it, from one of the organization's trucks, and reports whether
+// there were such a shipment and truck.
+func (h *TelemetryHandler) reportIncident(ctx context.Context, orgID string, req models.IncidentRequest) (bool, error) {
+	place := placeName(h.places, geo.Point{Lat: req.Latitude, Lon: req.Longitude})
+	reported := false
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO logistics_incidents (truck_id, shipment_id, latitude, longitude, incident_type, description, severity, time, place)
+			SELECT $1, $2, $3, $4, $5, $6, $7, NOW(), $9
+			WHERE EXISTS (
+				SELECT 1 FROM shipments
+				WHERE id = $2 AND (org_id = $8 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $8))
+			)
+			AND EXISTS (SELECT 1 FROM trucks WHERE id = $1 AND org_id = $8)
+		`, req.TruckID, req.ShipmentID, req.Latitude, req.Longitude, req.IncidentType, req.Description, req.Severity, orgID, place)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		reported = true
+		return events.Publish(ctx, tx, events.IncidentReported, req.ShipmentID, events.IncidentReportedData{
+			TruckID: req.TruckID, IncidentType: req.IncidentType, Description: req.Description,
+			Severity: req.Severity, Lat: req.Latitude, Lon: req.Longitude, Place: place,
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+	if reported {
+		incidentsReported.WithLabelValues(req.IncidentType).Inc()
+	}
+	return reported, nil
+}
+
 // flushBatch needs to be updated to include ShipmentID and NearDestination
 func (h *TelemetryHandler) flushBatch(batch []models.LogisticsEvent) {
 	if len(batch) == 0 {
@@ -170,6 +399,9 @@ func (h *TelemetryHandler) flushBatch(batch []models.LogisticsEvent) {
 	}
 
 	rows := make([][]interface{}, len(batch))
+	// One event per shipment for the whole batch, not one per fix
+	accepted := map[string]*events.TelemetryAcceptedData{}
+	var shipments []string
 	for i, event := range batch {
 		rows[i] = []interface{}{
 			event.Time,
@@ -180,18 +412,49 @@ func (h *TelemetryHandler) flushBatch(batch []models.LogisticsEvent) {
 			event.EventType,
 			event.Speed,
 		}
+
+		a, ok := accepted[event.ShipmentID]
+		if !ok {
+			a = &events.TelemetryAcceptedData{From: event.Time}
+			accepted[event.ShipmentID] = a
+			shipments = append(shipments, event.ShipmentID)
+		}
+		a.Fixes++
+		if event.Time.Before(a.From) {
+			a.From = event.Time
+		}
+		if !event.Time.Before(a.Time) {
+			a.TruckID, a.Time, a.Lat, a.Lon, a.Speed, a.EventType = event.TruckID, event.Time, event.Latitude, event.Longitude, event.Speed, event.EventType
+		}
 	}
 
-	_, err := db.Pool.CopyFrom(
-		context.Background(),
-		pgx.Identifier{"logistics_events"},
-		[]string{"time", "truck_id", "shipment_id", "latitude", "longitude", "event_type", "speed"},
-		pgx.CopyFromRows(rows),
-	)
+	ctx := context.Background()
+	telemetryBatchSize.Observe(float64(len(batch)))
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		start := time.Now()
+		_, err := tx.CopyFrom(
+			ctx,
+			pgx.Identifier{"logistics_events"},
+			[]string{"time", "truck_id", "shipment_id", "latitude", "longitude", "event_type", "speed"},
+			pgx.CopyFromRows(rows),
+		)
+		telemetryCopyDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			return err
+		}
+		for _, shipmentID := range shipments {
+			if err := events.Publish(ctx, tx, events.TelemetryAccepted, shipmentID, accepted[shipmentID]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 
 	if err != nil {
+		telemetryFlushed.WithLabelValues("failed").Add(float64(len(batch)))
 		log.Printf("Error flushing batch: %v", err)
 	} else {
+		telemetryFlushed.WithLabelValues("ok").Add(float64(len(batch)))
 		log.Printf("Successfully flushed %d events", len(batch))
 	}
 }
@@ -199,11 +462,13 @@ func (h *TelemetryHandler) flushBatch(batch []models.LogisticsEvent) {
 func (h *TelemetryHandler) GetRecentIncidents(c *gin.Context) {
 	// Fetch incidents from the last 24 hours
 	rows, err := db.Pool.Query(c.Request.Context(), `
-		SELECT truck_id, incident_type, description, severity, time 
-		FROM logistics_incidents 
-		WHERE time > NOW() - INTERVAL '24 hours'
-		ORDER BY time DESC
-	`)
+		SELECT i.truck_id, i.incident_type, COALESCE(i.description, ''), i.severity, i.time, i.place
+		FROM logistics_incidents i
+		LEFT JOIN shipments s ON s.id = i.shipment_id
+		WHERE i.time > NOW() - INTERVAL '24 hours'
+		AND (i.truck_id IN (SELECT id FROM trucks WHERE org_id = $1) OR s.org_id = $1)
+		ORDER BY i.time DESC
+	`, c.GetString("org_id"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch incidents"})
 		return
@@ -217,7 +482,8 @@ func (h *TelemetryHandler) GetRecentIncidents(c *gin.Context) {
 		var truckID, iType, desc string
 		var severity int
 		var t time.Time
-		if err := rows.Scan(&truckID, &iType, &desc, &severity, &t); err != nil {
+		var place *string
+		if err := rows.Scan(&truckID, &iType, &desc, &severity, &t, &place); err != nil {
 			continue
 		}
 		result = append(result, gin.H{
@@ -226,6 +492,7 @@ func (h *TelemetryHandler) GetRecentIncidents(c *gin.Context) {
 			"description":   desc,
 			"severity":      severity,
 			"time":          t,
+			"place":         place,
 		})
 	}
 
@@ -234,9 +501,11 @@ func (h *TelemetryHandler) GetRecentIncidents(c *gin.Context) {
 
 func (h *TelemetryHandler) GetAllIncidents(c *gin.Context) {
 	rows, err := db.Pool.Query(c.Request.Context(), `
-		SELECT latitude, longitude, incident_type, severity 
-		FROM logistics_incidents
-	`)
+		SELECT i.latitude, i.longitude, i.incident_type, i.severity, i.place
+		FROM logistics_incidents i
+		LEFT JOIN shipments s ON s.id = i.shipment_id
+		WHERE i.truck_id IN (SELECT id FROM trucks WHERE org_id = $1) OR s.org_id = $1
+	`, c.GetString("org_id"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch incidents"})
 		return
@@ -248,7 +517,8 @@ func (h *TelemetryHandler) GetAllIncidents(c *gin.Context) {
 		var lat, lon float64
 		var iType string
 		var severity int
-		if err := rows.Scan(&lat, &lon, &iType, &severity); err != nil {
+		var place *string
+		if err := rows.Scan(&lat, &lon, &iType, &severity, &place); err != nil {
 			continue
 		}
 		result = append(result, gin.H{
@@ -256,6 +526,7 @@ func (h *TelemetryHandler) GetAllIncidents(c *gin.Context) {
 			"longitude":     lon,
 			"incident_type": iType,
 			"severity":      severity,
+			"place":         place,
 		})
 	}
 	c.JSON(http.StatusOK, result)
@@ -277,6 +548,10 @@ var routes = []Route{
 }
 
 func (h *TelemetryHandler) SimulateDemo(c *gin.Context) {
+	// Demo trucks and shipments belong to whoever started the demo. Each
+	// organization gets its own, so one can't take over another's.
+	orgID := c.GetString("org_id")
+
 	// Start 5 Trucks
 	for i := 0; i < 5; i++ {
 		go func(index int) {
@@ -286,7 +561,7 @@ func (h *TelemetryHandler) SimulateDemo(c *gin.Context) {
 			// 2. Select Random Route
 			route := routes[rand.Intn(len(routes))]
 			
-			truckID := fmt.Sprintf("DEMO-TRUCK-%02d", index+1)
+			truckID := fmt.Sprintf("DEMO-%s-TRUCK-%02d", orgID, index+1)
 			shipmentID := uuid.New().String()
 
 			fmt.Println("shipmentID -------- ", shipmentID)
@@ -295,34 +570,50 @@ func (h *TelemetryHandler) SimulateDemo(c *gin.Context) {
 			hashedPassword, _ := utils.HashPassword("demo")
 			db.Pool.Exec(context.Background(), `
 				INSERT INTO users (id, email, password, role) 
-				VALUES ($1, $2, $3, 'DRIVER') 
+				VALUES ($1, $2, $3, 'driver') 
 				ON CONFLICT (id) DO UPDATE SET password = EXCLUDED.password`, 
-				truckID, fmt.Sprintf("demo%d@test.com", index), hashedPassword)
+				truckID, fmt.Sprintf("demo%d+%s@test.com", index, orgID), hashedPassword)
 			
 			db.Pool.Exec(context.Background(), `
-				INSERT INTO trucks (id, driver_name, plate_number) 
-				VALUES ($1, 'AI Driver', $2) ON CONFLICT (id) DO NOTHING`, truckID, fmt.Sprintf("KW-%03d", index))
+				INSERT INTO trucks (id, plate_number, make, capacity_kg, org_id) 
+				VALUES ($1, $2, 'Demo', 10000, $3) ON CONFLICT (id) DO NOTHING`, truckID, fmt.Sprintf("KW-%03d", index), orgID)
+
+			// The demo driver drives the demo truck of the same name
+			db.Pool.Exec(context.Background(), `
+				INSERT INTO drivers (user_id, org_id, full_name) VALUES ($1, $2, 'AI Driver')
+				ON CONFLICT (user_id) DO NOTHING`, truckID, orgID)
+			db.Pool.Exec(context.Background(), `
+				INSERT INTO truck_assignments (truck_id, driver_id)
+				SELECT $1, $1 WHERE NOT EXISTS (SELECT 1 FROM truck_assignments WHERE truck_id = $1 AND unassigned_at IS NULL)`, truckID)
 
 			// Ilorin (Origin)
 			startLat, startLon := 8.5000, 4.5500
 
 			// Create Shipment
+			start, dest := geo.Point{Lat: startLat, Lon: startLon}, geo.Point{Lat: route.DestLat, Lon: route.DestLon}
 			_, err := db.Pool.Exec(context.Background(), `
-				INSERT INTO shipments (id, truck_id, origin_lat, origin_lon, dest_lat, dest_lon, status, pickup_code, created_at)
-				VALUES ($1, $2, $3, $4, $5, $6, 'IN_TRANSIT', 'DEMO', NOW())
-			`, shipmentID, truckID, startLat, startLon, route.DestLat, route.DestLon)
+				INSERT INTO shipments (id, truck_id, origin_lat, origin_lon, dest_lat, dest_lon, status, pickup_code, created_at, org_id, origin_place, dest_place)
+				VALUES ($1, $2, $3, $4, $5, $6, 'IN_TRANSIT', 'DEMO', NOW(), $7, $8, $9)
+			`, shipmentID, truckID, startLat, startLon, route.DestLat, route.DestLon, orgID, placeName(h.places, start), placeName(h.places, dest))
 
 			if err != nil {
 				log.Printf("Sim Error: %v", err)
 				return
 			}
 
+			// Drive along the road, or straight there when there's no road
+			line := []geo.Point{start, dest}
+			if path, err := h.router.Route(start, dest, roads.Fastest); err == nil {
+				line = path.Points
+			}
+			length := geo.Length(line)
+
 			// 3. The Drive Loop (60 Steps = ~2 mins)
 			steps := 60
 			for step := 0; step <= steps; step++ {
 				progress := float64(step) / float64(steps)
-				lat := startLat + (route.DestLat-startLat)*progress
-				lon := startLon + (route.DestLon-startLon)*progress
+				at := geo.Interpolate(line, length*progress)
+				lat, lon := at.Lat, at.Lon
 
 				// Vary Speed (40-90 km/h)
 				currentSpeed := 40.0 + rand.Float64()*50.0
@@ -339,14 +630,18 @@ func (h *TelemetryHandler) SimulateDemo(c *gin.Context) {
 				h.eventChan <- event
 
 				// Random Incidents
+				incident := func(incidentType, description string, severity int) {
+					db.Pool.Exec(context.Background(), `INSERT INTO logistics_incidents (truck_id, shipment_id, latitude, longitude, incident_type, description, severity, time, place) VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), $8)`,
+						truckID, shipmentID, lat, lon, incidentType, description, severity, placeName(h.places, at))
+				}
 				if step == 20 && index == 1 {
-					db.Pool.Exec(context.Background(), `INSERT INTO logistics_incidents (truck_id, shipment_id, latitude, longitude, incident_type, description, severity, time) VALUES ($1, $2, $3, $4, 'POLICE_CHECKPOINT', 'Simulated Checkpoint', 1, NOW())`, truckID, shipmentID, lat, lon)
+					incident("POLICE_CHECKPOINT", "Simulated Checkpoint", 1)
 				}
 				if step == 30 && index == 2 {
-					db.Pool.Exec(context.Background(), `INSERT INTO logistics_incidents (truck_id, shipment_id, latitude, longitude, incident_type, description, severity, time) VALUES ($1, $2, $3, $4, 'TRAFFIC', 'Heavy Congestion', 2, NOW())`, truckID, shipmentID, lat, lon)
+					incident("TRAFFIC", "Heavy Congestion", 2)
 				}
 				if step == 40 && index == 3 {
-					db.Pool.Exec(context.Background(), `INSERT INTO logistics_incidents (truck_id, shipment_id, latitude, longitude, incident_type, description, severity, time) VALUES ($1, $2, $3, $4, 'BAD_ROAD', 'Potholes Detected', 2, NOW())`, truckID, shipmentID, lat, lon)
+					incident("BAD_ROAD", "Potholes Detected", 2)
 				}
 
 				time.Sleep(2 * time.Second)
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/geo"
+	"agri-track/internal/models"
+	"agri-track/internal/roads"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// GetTrack returns the GPS fixes of a shipment in order, and the track
+// matched to the roads when it has been.
+func (h *TelemetryHandler) GetTrack(c *gin.Context) {
+	ctx := c.Request.Context()
+	shipmentID := c.Param("id")
+	if !h.visible(c, shipmentID) {
+		return
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT time, latitude, longitude, speed, matched_lat, matched_lon
+		FROM logistics_events WHERE shipment_id=$1
+		ORDER BY time
+	`, shipmentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch track"})
+		return
+	}
+	defer rows.Close()
+
+	fixes := []models.TrackFix{}
+	for rows.Next() {
+		var f models.TrackFix
+		if err := rows.Scan(&f.Time, &f.Lat, &f.Lon, &f.Speed, &f.MatchedLat, &f.MatchedLon); err != nil {
+			continue
+		}
+		fixes = append(fixes, f)
+	}
+	rows.Close()
+
+	var path []geo.Point
+	var distance, rawDistance float64
+	var total, matched int
+	var matchedAt time.Time
+	err = db.Pool.QueryRow(ctx, `
+		SELECT path, distance_m, raw_distance_m, fixes, matched_fixes, matched_at FROM shipment_tracks WHERE shipment_id=$1
+	`, shipmentID).Scan(&path, &distance, &rawDistance, &total, &matched, &matchedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusOK, gin.H{"shipment_id": shipmentID, "fixes": fixes, "matched": nil})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch track"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shipment_id": shipmentID, "fixes": fixes, "matched": gin.H{
+		"path":            path,
+		"distance_km":     distance / 1000,
+		"raw_distance_km": rawDistance / 1000,
+		"fixes":           total,
+		"matched_fixes":   matched,
+		"matched_at":      matchedAt,
+	}})
+}
+
+// MatchTrack snaps the GPS track of a shipment to the roads it most likely
+// drove. The snapped position of each fix is stored next to it, and the road
+// path and its distance with the shipment. Matching again replaces them.
+func (h *TelemetryHandler) MatchTrack(c *gin.Context) {
+	matcher, ok := h.router.(roads.Matcher)
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No road network is loaded to match tracks to"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	shipmentID := c.Param("id")
+	if !h.visible(c, shipmentID) {
+		return
+	}
+
+	rows, err := db.Pool.Query(ctx, "SELECT time, latitude, longitude FROM logistics_events WHERE shipment_id=$1 ORDER BY time", shipmentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch track"})
+		return
+	}
+	var times []time.Time
+	var track []geo.Point
+	for rows.Next() {
+		var t time.Time
+		var p geo.Point
+		if err := rows.Scan(&t, &p.Lat, &p.Lon); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch track"})
+			return
+		}
+		times = append(times, t)
+		track = append(track, p)
+	}
+	rows.Close()
+	if len(track) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No GPS fixes recorded for this shipment"})
+		return
+	}
+
+	match, err := matcher.Match(track)
+	if errors.Is(err, roads.ErrOffRoad) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "The track is nowhere near a known road"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to match track of shipment %s: %v", shipmentID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to match track"})
+		return
+	}
+
+	matchedLats, matchedLons := make([]*float64, len(track)), make([]*float64, len(track))
+	matched := 0
+	for i, p := range match.Snapped {
+		if p != nil {
+			matchedLats[i], matchedLons[i] = &p.Lat, &p.Lon
+			matched++
+		}
+	}
+	path, _ := json.Marshal(match.Points)
+	rawDistance := geo.Length(track)
+
+	err = inTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			UPDATE logistics_events e SET matched_lat = m.lat, matched_lon = m.lon
+			FROM unnest($2::timestamptz[], $3::float8[], $4::float8[]) AS m(time, lat, lon)
+			WHERE e.shipment_id = $1 AND e.time = m.time
+		`, shipmentID, times, matchedLats, matchedLons)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO shipment_tracks (shipment_id, path, distance_m, raw_distance_m, fixes, matched_fixes)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (shipment_id) DO UPDATE SET path = EXCLUDED.path, distance_m = EXCLUDED.distance_m,
+				raw_distance_m = EXCLUDED.raw_distance_m, fixes = EXCLUDED.fixes,
+				matched_fixes = EXCLUDED.matched_fixes, matched_at = NOW()
+		`, shipmentID, path, match.DistanceM, rawDistance, len(track), matched)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to store matched track of shipment %s: %v", shipmentID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store matched track"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"shipment_id":     shipmentID,
+		"distance_km":     match.DistanceM / 1000,
+		"raw_distance_km": rawDistance / 1000,
+		"fixes":           len(track),
+		"matched_fixes":   matched,
+		"path":            match.Points,
+	})
+}
+
+// visible reports whether the shipment belongs to, or is carried by, the
+// caller's organization, and responds 404 when it isn't.
+func (h *TelemetryHandler) visible(c *gin.Context, shipmentID string) bool {
+	var exists bool
+	err := db.Pool.QueryRow(c.Request.Context(), `
+		SELECT EXISTS (SELECT 1 FROM shipments WHERE id=$1
+		AND (org_id = $2 OR truck_id IN (SELECT id FROM trucks WHERE org_id = $2)))
+	`, shipmentID, c.GetString("org_id")).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shipment"})
+		return false
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Shipment not found"})
+		return false
+	}
+	return true
+}
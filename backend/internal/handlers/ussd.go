@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/models"
+	"agri-track/internal/ussd"
+	"agri-track/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// USSDHandler answers USSD gateway callbacks for farmers on basic phones.
+// Shipments are created the same way as through CreateShipment.
+type USSDHandler struct {
+	shipments *ShipmentHandler
+	// Gateways don't sign callbacks, the callback URL carries this as ?token=
+	token string
+}
+
+func NewUSSDHandler(shipments *ShipmentHandler, token string) *USSDHandler {
+	return &USSDHandler{shipments: shipments, token: token}
+}
+
+// Callback answers one key press of a session, in plain text as gateways
+// expect. Callers are known by the phone number on their account and act
+// for their personal organization, as OrgMiddleware picks without X-Org-ID.
+func (h *USSDHandler) Callback(c *gin.Context) {
+	if h.token == "" || subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(h.token)) != 1 {
+		c.String(http.StatusForbidden, "Forbidden")
+		return
+	}
+	var req ussd.Request
+	if err := c.ShouldBind(&req); err != nil {
+		c.String(http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	// Gateways send numbers in whatever format the network uses
+	phone, err := utils.NormalizePhone(req.PhoneNumber)
+	if err != nil {
+		c.String(http.StatusOK, ussd.Response{Text: "This number is not registered with AgriTrack. Sign up in the app first.", End: true}.String())
+		return
+	}
+
+	ctx := c.Request.Context()
+	var userID, orgID, status string
+	err = db.Pool.QueryRow(ctx, `
+		SELECT u.id, m.org_id, u.status
+		FROM users u
+		JOIN org_members m ON m.user_id = u.id
+		JOIN organizations o ON o.id = m.org_id
+		WHERE u.phone = $1
+		ORDER BY o.kind <> 'individual', m.joined_at
+		LIMIT 1
+	`, phone).Scan(&userID, &orgID, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.String(http.StatusOK, ussd.Response{Text: "This number is not registered with AgriTrack. Sign up in the app first.", End: true}.String())
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if status == models.UserSuspended {
+		c.String(http.StatusOK, ussd.Response{Text: "Your account is suspended.", End: true}.String())
+		return
+	}
+	_, quiet, err := loadPreferences(ctx, userID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	menu := ussd.Menu{Backend: ussdSession{shipments: h.shipments, userID: userID, orgID: orgID}, Location: quiet.Location}
+	resp, err := menu.Handle(ctx, ussd.Inputs(req.Text))
+	if err != nil {
+		log.Printf("USSD session %s failed: %v", req.SessionID, err)
+	}
+	c.String(http.StatusOK, resp.String())
+}
+
+// ussdSession is the menu's view of the caller's shipments and locations.
+type ussdSession struct {
+	shipments *ShipmentHandler
+	userID    string
+	orgID     string
+}
+
+func (s ussdSession) Locations(ctx context.Context) ([]ussd.Location, error) {
+	rows, err := db.Pool.Query(ctx, "SELECT id, name FROM locations WHERE org_id=$1 ORDER BY name", s.orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []ussd.Location
+	for rows.Next() {
+		var l ussd.Location
+		if err := rows.Scan(&l.ID, &l.Name); err != nil {
+			return nil, err
+		}
+		locations = append(locations, l)
+	}
+	return locations, rows.Err()
+}
+
+func (s ussdSession) Shipments(ctx context.Context) ([]ussd.Shipment, error) {
+	return s.query(ctx, false)
+}
+
+func (s ussdSession) Unclaimed(ctx context.Context) ([]ussd.Shipment, error) {
+	return s.query(ctx, true)
+}
+
+// query returns the caller's latest shipments, named by where they go: a
+// saved location there, or else the gazetteer's name for it.
+func (s ussdSession) query(ctx context.Context, unclaimed bool) ([]ussd.Shipment, error) {
+	rows, err := db.Pool.Query(ctx, `
+		SELECT s.id, COALESCE(s.commodity, 'produce'), COALESCE(l.name, s.dest_place, 'destination'), s.status,
+		       COALESCE(t.plate_number, ''), s.created_at
+		FROM shipments s
+		LEFT JOIN trucks t ON t.id = s.truck_id
+		LEFT JOIN LATERAL (
+			SELECT name FROM locations WHERE org_id = s.org_id AND latitude = s.dest_lat AND longitude = s.dest_lon LIMIT 1
+		) l ON TRUE
+		WHERE s.created_by = $1 AND (NOT $2 OR s.status = 'CREATED')
+		ORDER BY s.created_at DESC
+		LIMIT 5
+	`, s.userID, unclaimed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shipments []ussd.Shipment
+	for rows.Next() {
+		var sh ussd.Shipment
+		if err := rows.Scan(&sh.ID, &sh.Commodity, &sh.Dest, &sh.Status, &sh.Plate, &sh.CreatedAt); err != nil {
+			return nil, err
+		}
+		shipments = append(shipments, sh)
+	}
+	return shipments, rows.Err()
+}
+
+func (s ussdSession) CreateShipment(ctx context.Context, origin, dest ussd.Location, commodity string) (ussd.Shipment, ussd.PickupCode, error) {
+	req := models.ShipmentRequest{Commodity: commodity}
+	var created newShipment
+	err := inTx(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "SELECT latitude, longitude FROM locations WHERE id=$1 AND org_id=$2", origin.ID, s.orgID).Scan(&req.OriginLat, &req.OriginLon)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRow(ctx, "SELECT latitude, longitude FROM locations WHERE id=$1 AND org_id=$2", dest.ID, s.orgID).Scan(&req.DestLat, &req.DestLon)
+		if err != nil {
+			return err
+		}
+		created, err = s.shipments.insertShipment(ctx, tx, req, s.userID, s.orgID)
+		return err
+	})
+	if err != nil {
+		return ussd.Shipment{}, ussd.PickupCode{}, err
+	}
+	shipment := ussd.Shipment{ID: created.ID, Commodity: commodity, Dest: dest.Name, Status: "CREATED", CreatedAt: time.Now()}
+	return shipment, ussd.PickupCode{Code: created.PickupCode, ExpiresAt: created.ExpiresAt}, nil
+}
+
+func (s ussdSession) PickupCode(ctx context.Context, shipmentID string) (ussd.PickupCode, error) {
+	var code ussd.PickupCode
+	err := db.Pool.QueryRow(ctx, `
+		SELECT pickup_code, pickup_code_expires_at FROM shipments WHERE id=$1 AND created_by=$2 AND status='CREATED'
+	`, shipmentID, s.userID).Scan(&code.Code, &code.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return code, ussd.ErrNotFound
+	}
+	if err != nil || time.Now().Before(code.ExpiresAt) {
+		return code, err
+	}
+
+	// Nobody can use an expired code, read back a fresh one instead
+	err = s.shipments.withPickupCode(func(fresh string, expires time.Time) error {
+		code = ussd.PickupCode{Code: fresh, ExpiresAt: expires}
+		tag, err := db.Pool.Exec(ctx, `
+			UPDATE shipments SET pickup_code=$1, pickup_code_expires_at=$2 WHERE id=$3 AND status='CREATED'
+		`, fresh, expires, shipmentID)
+		if err == nil && tag.RowsAffected() == 0 {
+			return ussd.ErrNotFound
+		}
+		return err
+	})
+	return code, err
+}
@@ -3,6 +3,11 @@ package handlers
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"agri-track/internal/ratelimit"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -19,3 +24,9 @@ func formatValidationError(err error) gin.H {
 	}
 	return gin.H{"error": err.Error()}
 }
+
+// abortLocked responds 429 with a Retry-After header for a locked out key.
+func abortLocked(c *gin.Context, retryAfter time.Duration, msg string) {
+	c.Header("Retry-After", strconv.Itoa(ratelimit.RetryAfterSeconds(retryAfter)))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": msg})
+}
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/events"
+	"agri-track/internal/models"
+	"agri-track/internal/webhook"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Deliveries sent per round of the worker
+const webhookBatch = 50
+
+// WebhookHandler manages an organization's webhook subscriptions and sends
+// the deliveries queued for them, retrying failures with backoff.
+type WebhookHandler struct {
+	cfg    webhook.Config
+	client *webhook.Client
+}
+
+func NewWebhookHandler(cfg webhook.Config) *WebhookHandler {
+	return &WebhookHandler{cfg: cfg, client: webhook.NewClient(cfg)}
+}
+
+// QueueDeliveries subscribes webhooks to the event bus: it queues a delivery
+// of the event for each active subscription to it of the shipment's
+// organization and of the carrier's. An event handed over again isn't
+// queued twice.
+func (h *WebhookHandler) QueueDeliveries(ctx context.Context, e events.Event) error {
+	var data map[string]interface{}
+	if err := e.Decode(&data); err != nil {
+		return err
+	}
+	data["shipment_id"] = e.ShipmentID
+	payload, err := json.Marshal(gin.H{
+		"id":          strconv.FormatInt(e.ID, 10),
+		"type":        e.Type,
+		"occurred_at": e.OccurredAt.UTC(),
+		"data":        data,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Pool.Exec(ctx, `
+		INSERT INTO webhook_deliveries (id, subscription_id, event_id, event_type, payload)
+		SELECT gen_random_uuid()::text, w.id, $2, $3, $4 FROM webhook_subscriptions w
+		WHERE w.active AND $3 = ANY(w.event_types)
+		AND w.org_id IN (
+			SELECT org_id FROM shipments WHERE id = $1
+			UNION SELECT t.org_id FROM shipments s JOIN trucks t ON t.id = s.truck_id WHERE s.id = $1
+		)
+		ON CONFLICT (subscription_id, event_id) DO NOTHING
+	`, e.ShipmentID, e.ID, e.Type, payload)
+	return err
+}
+
+// CreateSubscription subscribes a URL to events of the organization. The
+// signing secret is only shown in this response.
+func (h *WebhookHandler) CreateSubscription(c *gin.Context) {
+	var req models.WebhookSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, formatValidationError(err))
+		return
+	}
+	if !h.cfg.ValidURL(req.URL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be a public http or https URL"})
+		return
+	}
+	for _, t := range req.EventTypes {
+		if !slices.Contains(webhook.EventTypes, t) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event type " + t, "event_types": webhook.EventTypes})
+			return
+		}
+	}
+
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create subscription"})
+		return
+	}
+	sub := models.WebhookSubscription{
+		ID:         uuid.New().String(),
+		URL:        req.URL,
+		EventTypes: req.EventTypes,
+		Active:     true,
+		Secret:     secret,
+	}
+	err = db.Pool.QueryRow(c.Request.Context(), `
+		INSERT INTO webhook_subscriptions (id, org_id, url, secret, event_types)
+		VALUES ($1, $2, $3, $4, $5) RETURNING created_at
+	`, sub.ID, c.GetString("org_id"), sub.URL, secret, sub.EventTypes).Scan(&sub.CreatedAt)
+	if err != nil {
+		log.Printf("Failed to create webhook subscription: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create subscription"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, sub)
+}
+
+// ListSubscriptions returns the organization's subscriptions, without their secrets.
+func (h *WebhookHandler) ListSubscriptions(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT id, url, event_types, active, created_at FROM webhook_subscriptions
+		WHERE org_id = $1 ORDER BY created_at
+	`, c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch subscriptions"})
+		return
+	}
+	defer rows.Close()
+
+	subs := []models.WebhookSubscription{}
+	for rows.Next() {
+		var s models.WebhookSubscription
+		if err := rows.Scan(&s.ID, &s.URL, &s.EventTypes, &s.Active, &s.CreatedAt); err != nil {
+			continue
+		}
+		subs = append(subs, s)
+	}
+
+	c.JSON(http.StatusOK, subs)
+}
+
+// DeleteSubscription removes a subscription and its delivery log.
+func (h *WebhookHandler) DeleteSubscription(c *gin.Context) {
+	tag, err := db.Pool.Exec(c.Request.Context(), "DELETE FROM webhook_subscriptions WHERE id=$1 AND org_id=$2", c.Param("id"), c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete subscription"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ListDeliveries returns the latest deliveries to a subscription, only those
+// with a status with ?status=, e.g. ?status=dead for the dead-letter queue.
+func (h *WebhookHandler) ListDeliveries(c *gin.Context) {
+	rows, err := db.Pool.Query(c.Request.Context(), `
+		SELECT d.id, d.subscription_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt_at,
+		       d.last_status_code, d.last_error, d.created_at, d.delivered_at
+		FROM webhook_deliveries d JOIN webhook_subscriptions w ON w.id = d.subscription_id
+		WHERE d.subscription_id = $1 AND w.org_id = $2 AND ($3 = '' OR d.status = $3)
+		ORDER BY d.created_at DESC
+		LIMIT 100
+	`, c.Param("id"), c.GetString("org_id"), c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deliveries"})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var d models.WebhookDelivery
+		err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+			&d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// GetDelivery returns a delivery with the log of every attempt at it.
+func (h *WebhookHandler) GetDelivery(c *gin.Context) {
+	ctx := c.Request.Context()
+	var d models.WebhookDelivery
+	err := db.Pool.QueryRow(ctx, `
+		SELECT d.id, d.subscription_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt_at,
+		       d.last_status_code, d.last_error, d.created_at, d.delivered_at
+		FROM webhook_deliveries d JOIN webhook_subscriptions w ON w.id = d.subscription_id
+		WHERE d.id = $1 AND d.subscription_id = $2 AND w.org_id = $3
+	`, c.Param("delivery_id"), c.Param("id"), c.GetString("org_id")).Scan(&d.ID, &d.SubscriptionID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch delivery"})
+		return
+	}
+
+	rows, err := db.Pool.Query(ctx, `
+		SELECT status_code, error, duration_ms, attempted_at FROM webhook_attempts
+		WHERE delivery_id = $1 ORDER BY attempted_at
+	`, d.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch delivery"})
+		return
+	}
+	defer rows.Close()
+
+	d.Log = []models.WebhookAttempt{}
+	for rows.Next() {
+		var a models.WebhookAttempt
+		if err := rows.Scan(&a.StatusCode, &a.Error, &a.DurationMs, &a.AttemptedAt); err != nil {
+			continue
+		}
+		d.Log = append(d.Log, a)
+	}
+
+	c.JSON(http.StatusOK, d)
+}
+
+// Redeliver queues a delivery to be sent again right away, with a fresh set
+// of attempts. Used to replay dead-lettered deliveries once the receiver is
+// fixed, or to resend a delivered one.
+func (h *WebhookHandler) Redeliver(c *gin.Context) {
+	tag, err := db.Pool.Exec(c.Request.Context(), `
+		UPDATE webhook_deliveries d SET status='pending', attempts=0, next_attempt_at=NOW()
+		FROM webhook_subscriptions w
+		WHERE d.id = $1 AND d.subscription_id = $2 AND w.id = d.subscription_id AND w.org_id = $3
+	`, c.Param("delivery_id"), c.Param("id"), c.GetString("org_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeliver"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "status": "pending"})
+}
+
+// StartDeliveryWorker sends due deliveries until ctx is cancelled.
+func (h *WebhookHandler) StartDeliveryWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := h.DeliverDue(ctx); err != nil {
+				log.Printf("Webhook delivery failed: %v", err)
+			}
+		}
+	}
+}
+
+// DeliverDue makes an attempt at every delivery that is due, up to a batch,
+// and returns how many it attempted. Claimed deliveries are leased for
+// longer than an attempt takes, so several workers never send one twice at
+// the same time; one that dies mid-attempt is retried once the lease ends.
+func (h *WebhookHandler) DeliverDue(ctx context.Context) (int, error) {
+	lease := 2 * h.cfg.Timeout
+	rows, err := db.Pool.Query(ctx, `
+		UPDATE webhook_deliveries d SET next_attempt_at = NOW() + $1::interval
+		FROM webhook_subscriptions w
+		WHERE w.id = d.subscription_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, w.url, w.secret, d.event_type, d.payload, d.attempts
+	`, lease, webhookBatch)
+	if err != nil {
+		return 0, err
+	}
+	type claimed struct {
+		webhook.Delivery
+		attempts int
+	}
+	var batch []claimed
+	for rows.Next() {
+		var d claimed
+		if err := rows.Scan(&d.ID, &d.URL, &d.Secret, &d.Event, &d.Payload, &d.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// One slow receiver shouldn't hold up the others
+	var wg sync.WaitGroup
+	for _, d := range batch {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := h.client.Send(ctx, d.Delivery)
+			if err := h.record(ctx, d.ID, d.attempts+1, result); err != nil {
+				log.Printf("Failed to record webhook delivery %s: %v", d.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return len(batch), nil
+}
+
+// record stores the outcome of an attempt, scheduling the next one after a
+// failure or dead-lettering the delivery once it is out of attempts.
+func (h *WebhookHandler) record(ctx context.Context, deliveryID string, attempts int, result webhook.Result) error {
+	var statusCode *int
+	if result.StatusCode != 0 {
+		statusCode = &result.StatusCode
+	}
+	var lastError *string
+	if result.Error != "" {
+		lastError = &result.Error
+	}
+
+	status, next := models.WebhookPending, time.Now().Add(h.cfg.Backoff(attempts))
+	switch {
+	case result.OK():
+		status = models.WebhookDelivered
+	case attempts >= h.cfg.MaxAttempts:
+		status = models.WebhookDead
+	}
+
+	return inTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			UPDATE webhook_deliveries SET status=$2, attempts=$3, next_attempt_at=$4, last_status_code=$5, last_error=$6,
+				delivered_at = CASE WHEN $2 = 'delivered' THEN NOW() END
+			WHERE id=$1
+		`, deliveryID, status, attempts, next, statusCode, lastError)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms) VALUES ($1, $2, $3, $4)
+		`, deliveryID, statusCode, lastError, result.Duration.Milliseconds())
+		return err
+	})
+}
@@ -6,6 +6,9 @@ import (
 	"os"
 	"strings"
 
+	"agri-track/internal/db"
+	"agri-track/internal/models"
+
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -46,6 +49,37 @@ func AuthMiddleware() gin.HandlerFunc {
 			c.Set("role", claims["role"])
 		}
 
+		// Role changes and suspensions take effect immediately, not when the token expires
+		var role, status string
+		err = db.Pool.QueryRow(c.Request.Context(), "SELECT role, status FROM users WHERE id=$1", c.GetString("user_id")).Scan(&role, &status)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Account not found"})
+			c.Abort()
+			return
+		}
+		if status == models.UserSuspended {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account suspended"})
+			c.Abort()
+			return
+		}
+		c.Set("role", role)
+
 		c.Next()
 	}
 }
+
+// RequireRole rejects requests from users without one of the given roles.
+// It must run after AuthMiddleware.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		for _, r := range roles {
+			if r == role {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		c.Abort()
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+
+	"agri-track/internal/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OrgMiddleware resolves the organization a request acts for and stores it as
+// "org_id" and "org_role". Clients pick one with the X-Org-ID header, otherwise
+// the user acts for their personal organization, so joining another one never
+// changes what a request without the header does.
+// It must run after AuthMiddleware.
+func OrgMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var orgID, orgRole string
+		err := db.Pool.QueryRow(c.Request.Context(), `
+			SELECT m.org_id, m.role
+			FROM org_members m
+			JOIN organizations o ON o.id = m.org_id
+			WHERE m.user_id = $1 AND ($2 = '' OR m.org_id = $2)
+			ORDER BY o.kind <> 'individual', m.joined_at
+			LIMIT 1
+		`, c.GetString("user_id"), c.GetHeader("X-Org-ID")).Scan(&orgID, &orgRole)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this organization"})
+			c.Abort()
+			return
+		}
+
+		c.Set("org_id", orgID)
+		c.Set("org_role", orgRole)
+		c.Next()
+	}
+}
+
+// RequireOrgRole rejects requests from members without one of the given roles
+// in the current organization. It must run after OrgMiddleware.
+func RequireOrgRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("org_role")
+		for _, r := range roles {
+			if r == role {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient organization permissions"})
+		c.Abort()
+	}
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"agri-track/internal/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit throttles requests with a token bucket per key.
+// Requests over the limit get 429 with a Retry-After header.
+func RateLimit(store ratelimit.Store, limit ratelimit.Limit, key func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, retryAfter := store.Take(key(c), limit, time.Now())
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(ratelimit.RetryAfterSeconds(retryAfter)))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, slow down"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// ByIP keys buckets on the client IP.
+func ByIP(prefix string) func(c *gin.Context) string {
+	return func(c *gin.Context) string {
+		return prefix + ":ip:" + c.ClientIP()
+	}
+}
+
+// ByUser keys buckets on the authenticated account, falling back to the
+// client IP. It must run after AuthMiddleware.
+func ByUser(prefix string) func(c *gin.Context) string {
+	return func(c *gin.Context) string {
+		if userID := c.GetString("user_id"); userID != "" {
+			return prefix + ":user:" + userID
+		}
+		return prefix + ":ip:" + c.ClientIP()
+	}
+}
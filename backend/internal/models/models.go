@@ -2,10 +2,189 @@ package models
 
 import "time"
 
+// Account roles. Farmers and drivers can sign themselves up, organization
+// owners make their members depot managers, and admins are created by another
+// admin or from ADMIN_EMAIL at startup.
+const (
+	RoleFarmer       = "farmer"
+	RoleDriver       = "driver"
+	RoleDepotManager = "depot_manager"
+	RoleAdmin        = "admin"
+)
+
+// Account statuses
+const (
+	UserActive    = "active"
+	UserSuspended = "suspended"
+)
+
+// Truck statuses. Retired trucks are kept for their history.
+const (
+	TruckActive      = "active"
+	TruckMaintenance = "maintenance"
+	TruckRetired     = "retired"
+)
+
+// Driver profile statuses
+const (
+	DriverActive   = "active"
+	DriverInactive = "inactive"
+)
+
 type Truck struct {
-	ID          string `json:"id"`
-	DriverName  string `json:"driver_name"`
-	PlateNumber string `json:"plate_number"`
+	ID           string    `json:"id"`
+	PlateNumber  string    `json:"plate_number"`
+	Make         *string   `json:"make"`
+	CapacityKg   *float64  `json:"capacity_kg"`
+	CapacityM3   *float64  `json:"capacity_m3"`
+	Refrigerated bool      `json:"refrigerated"`
+	Covered      bool      `json:"covered"`
+	Livestock    bool      `json:"livestock"` // Fitted to carry animals
+	Status       string    `json:"status"`
+	DriverID     *string   `json:"driver_id"` // Currently assigned driver, if any
+	DriverName   *string   `json:"driver_name"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type Driver struct {
+	UserID        string    `json:"user_id"`
+	FullName      string    `json:"full_name"`
+	LicenseNumber *string   `json:"license_number"`
+	Phone         *string   `json:"phone"`
+	Status        string    `json:"status"`
+	TruckID       *string   `json:"truck_id"` // Currently assigned truck, if any
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type TruckAssignment struct {
+	ID           int        `json:"id"`
+	TruckID      string     `json:"truck_id"`
+	PlateNumber  string     `json:"plate_number"`
+	DriverID     string     `json:"driver_id"`
+	DriverName   string     `json:"driver_name"`
+	AssignedBy   *string    `json:"assigned_by"`
+	AssignedAt   time.Time  `json:"assigned_at"`
+	UnassignedAt *time.Time `json:"unassigned_at"`
+}
+
+type TruckRequest struct {
+	PlateNumber  string   `json:"plate_number" binding:"required"`
+	Make         *string  `json:"make"`
+	CapacityKg   *float64 `json:"capacity_kg" binding:"omitempty,gt=0"`
+	CapacityM3   *float64 `json:"capacity_m3" binding:"omitempty,gt=0"`
+	Refrigerated bool     `json:"refrigerated"`
+	Covered      bool     `json:"covered"`
+	Livestock    bool     `json:"livestock"`
+	Status       string   `json:"status" binding:"omitempty,oneof=active maintenance retired"` // Defaults to active
+}
+
+// DriverRequest creates a driver profile for an existing driver account,
+// found by user ID, email or phone.
+type DriverRequest struct {
+	UserID        string  `json:"user_id"`
+	Email         string  `json:"email"`
+	Phone         string  `json:"phone"`
+	FullName      string  `json:"full_name" binding:"required"`
+	LicenseNumber *string `json:"license_number"`
+	Status        string  `json:"status" binding:"omitempty,oneof=active inactive"`
+}
+
+type AssignRequest struct {
+	DriverID string `json:"driver_id" binding:"required"`
+}
+
+// Organization kinds
+const (
+	OrgIndividual  = "individual" // Personal organization created for every account
+	OrgCooperative = "cooperative"
+	OrgHaulage     = "haulage"
+)
+
+// Roles within an organization
+const (
+	OrgRoleOwner      = "owner"
+	OrgRoleDispatcher = "dispatcher"
+	OrgRoleMember     = "member"
+)
+
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	Role      string    `json:"role,omitempty"` // The caller's role, when listing their organizations
+	TimeZone  string    `json:"time_zone"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrgMember struct {
+	UserID   string    `json:"user_id"`
+	Email    *string   `json:"email"`
+	Phone    *string   `json:"phone"`
+	Name     *string   `json:"name"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Invitation statuses
+const (
+	InvitationPending  = "PENDING"
+	InvitationAccepted = "ACCEPTED"
+	InvitationDeclined = "DECLINED"
+)
+
+// OrgInvitation asks an account to join an organization. Nobody becomes a
+// member without accepting.
+type OrgInvitation struct {
+	ID        int       `json:"id"`
+	OrgID     string    `json:"org_id"`
+	OrgName   string    `json:"org_name"`
+	Role      string    `json:"role"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	// Set when the invitation is to drive for the organization
+	DriverFullName      *string `json:"driver_full_name,omitempty"`
+	DriverLicenseNumber *string `json:"driver_license_number,omitempty"`
+	DriverStatus        *string `json:"driver_status,omitempty"`
+}
+
+type Location struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrgRequest struct {
+	Name string `json:"name" binding:"required"`
+	Kind string `json:"kind" binding:"required,oneof=cooperative haulage"`
+}
+
+// OrgMemberRequest adds an existing account by email or phone
+type OrgMemberRequest struct {
+	Email string `json:"email" binding:"required_without=Phone"`
+	Phone string `json:"phone"`
+	Role  string `json:"role" binding:"required,oneof=owner dispatcher member"`
+}
+
+type OrgRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=owner dispatcher member"`
+}
+
+// AccountRoleRequest makes an organization member a depot manager or a farmer again
+type AccountRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=farmer depot_manager"`
+}
+
+// OrgSettingsRequest changes the current organization's settings
+type OrgSettingsRequest struct {
+	TimeZone string `json:"time_zone" binding:"required"` // IANA name, e.g. Africa/Lagos
+}
+
+type LocationRequest struct {
+	Name      string  `json:"name" binding:"required"`
+	Latitude  float64 `json:"latitude" binding:"required,latitude"`
+	Longitude float64 `json:"longitude" binding:"required,longitude"`
 }
 
 type LogisticsEvent struct {
@@ -48,13 +227,18 @@ type TruckStatus struct {
 	Longitude float64   `json:"longitude"`
 	Speed     float64   `json:"speed"`
 	EventType string    `json:"event_type"`
+	Place     string    `json:"place,omitempty"`
 }
 
 type User struct {
-	ID       string `json:"id"`
-	Email string `json:"email"`
-	Password string `json:"password"`
-	Role     string `json:"role"`
+	ID        string    `json:"id"`
+	Email     *string   `json:"email"`
+	Phone     *string   `json:"phone"`
+	Name      *string   `json:"name"`
+	Password  string    `json:"-"`
+	Role      string    `json:"role"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type Shipment struct {
@@ -66,6 +250,13 @@ type Shipment struct {
 	DestLon     float64    `json:"dest_lon"`
 	Status      string     `json:"status"`
 	PickupCode  string     `json:"pickup_code"`
+	WeightKg    *float64   `json:"weight_kg"`
+	VolumeM3    *float64   `json:"volume_m3"`
+	Commodity   *string    `json:"commodity"`
+	CargoType   string     `json:"cargo_type"`
+	Payout      *float64   `json:"payout"`
+	PickupFrom  *time.Time `json:"pickup_from"`
+	PickupUntil *time.Time `json:"pickup_until"`
 	CreatedAt   time.Time  `json:"created_at"`
 	CompletedAt *time.Time `json:"completed_at"`
 }
@@ -73,13 +264,459 @@ type Shipment struct {
 type LoginRequest struct {
 	Email string `json:"email" binding:"required"`
 	Password string `json:"password" binding:"required"`
-	Role     string `json:"role"` // Optional for login, required/used for register
+}
+
+type RegisterRequest struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Role     string `json:"role" binding:"omitempty,oneof=farmer driver"` // Defaults to farmer
+}
+
+type OTPRequest struct {
+	Phone string `json:"phone" binding:"required"`
+}
+
+type OTPVerifyRequest struct {
+	Phone string `json:"phone" binding:"required"`
+	Code  string `json:"code" binding:"required"`
+	Name  string `json:"name"` // Used when the number is registering for the first time
+	Role  string `json:"role" binding:"omitempty,oneof=farmer driver"`
+}
+
+type AttachEmailRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required,min=8"`
+}
+
+type RoleChangeRequest struct {
+	Role string `json:"role" binding:"required,oneof=farmer driver depot_manager admin"`
+}
+
+type SuspendRequest struct {
+	Reason string `json:"reason"`
 }
 
 type ShipmentRequest struct {
 	TruckID   *string `json:"truck_id,omitempty"` // Optional, can be nil
-	OriginLat float64 `json:"origin_lat" binding:"required,latitude"`
-	OriginLon float64 `json:"origin_lon" binding:"required,longitude"`
-	DestLat   float64 `json:"dest_lat" binding:"required,latitude"`
-	DestLon   float64 `json:"dest_lon" binding:"required,longitude"`
+	OriginLat float64 `json:"origin_lat" binding:"required_without=Stops,latitude"`
+	OriginLon float64 `json:"origin_lon" binding:"required_without=Stops,longitude"`
+	DestLat   float64 `json:"dest_lat" binding:"required_without=Stops,latitude"`
+	DestLon   float64 `json:"dest_lon" binding:"required_without=Stops,longitude"`
+	// Ordered pickups and drop-offs, replaces origin and destination
+	Stops     []StopRequest `json:"stops" binding:"omitempty,min=2,max=25,dive"`
+	WeightKg  *float64      `json:"weight_kg" binding:"omitempty,gt=0"`
+	VolumeM3  *float64      `json:"volume_m3" binding:"omitempty,gt=0"`
+	Commodity string        `json:"commodity"`
+	CargoType string        `json:"cargo_type" binding:"omitempty,oneof=general dry chilled livestock"` // Defaults from the commodity
+	// Shown on the load board
+	Payout      *float64   `json:"payout" binding:"omitempty,gt=0"`
+	PickupFrom  *time.Time `json:"pickup_from"`
+	PickupUntil *time.Time `json:"pickup_until"` // After PickupFrom when both are given, checked by the handler
+	BidDeadline *time.Time `json:"bid_deadline"` // Bids on the shipment expire by then
+	// Offer the job to the organization's own trucks, nearest suitable first
+	AutoDispatch bool `json:"auto_dispatch" binding:"excluded_with=TruckID"`
+	// What the cargo is worth in naira, for the spoilage exposure in fleet reports
+	CargoValue *float64 `json:"cargo_value" binding:"omitempty,gt=0"`
+	// Delivery window promised to the buyer, otherwise set by the SLA policy at pickup
+	DeliverFrom *time.Time `json:"deliver_from"`
+	DeliverBy   *time.Time `json:"deliver_by" binding:"required_with=DeliverFrom"` // After DeliverFrom, checked by the handler
+}
+
+// Stop kinds
+const (
+	StopPickup  = "pickup"
+	StopDropoff = "dropoff"
+)
+
+// Stop statuses
+const (
+	StopPending   = "PENDING"
+	StopArrived   = "ARRIVED"
+	StopCompleted = "COMPLETED"
+	StopSkipped   = "SKIPPED"
+)
+
+type ShipmentStop struct {
+	Seq          int        `json:"seq"`
+	Kind         string     `json:"kind"`
+	Lat          float64    `json:"lat"`
+	Lon          float64    `json:"lon"`
+	Name         *string    `json:"name"`
+	Place        *string    `json:"place"` // From the gazetteer
+	ContactPhone *string    `json:"contact_phone"`
+	QuantityKg   *float64   `json:"quantity_kg"`
+	WindowStart  *time.Time `json:"window_start"`
+	WindowEnd    *time.Time `json:"window_end"`
+	Status       string     `json:"status"`
+	ArrivedAt    *time.Time `json:"arrived_at"`
+	CompletedAt  *time.Time `json:"completed_at"`
+	Late         bool       `json:"late"` // Arrived after the window closed
+}
+
+type StopRequest struct {
+	Kind         string     `json:"kind" binding:"required,oneof=pickup dropoff"`
+	Lat          float64    `json:"lat" binding:"required,latitude"`
+	Lon          float64    `json:"lon" binding:"required,longitude"`
+	Name         string     `json:"name"`
+	ContactPhone string     `json:"contact_phone"`
+	QuantityKg   *float64   `json:"quantity_kg" binding:"omitempty,gt=0"`
+	WindowStart  *time.Time `json:"window_start"`
+	WindowEnd    *time.Time `json:"window_end" binding:"omitempty,gtfield=WindowStart"`
+}
+
+// Depot is where a collection run takes the produce: one of the
+// organization's saved locations, or a point.
+type Depot struct {
+	LocationID string  `json:"location_id,omitempty"`
+	Lat        float64 `json:"lat" binding:"required_without=LocationID,latitude"`
+	Lon        float64 `json:"lon" binding:"required_without=LocationID,longitude"`
+	Name       string  `json:"name"`
+}
+
+// PickupPoint is a farm to collect from on a planned run.
+type PickupPoint struct {
+	Lat          float64    `json:"lat" binding:"required,latitude"`
+	Lon          float64    `json:"lon" binding:"required,longitude"`
+	Name         string     `json:"name"`
+	ContactPhone string     `json:"contact_phone"`
+	QuantityKg   float64    `json:"quantity_kg" binding:"required,gt=0"`
+	WindowStart  *time.Time `json:"window_start"`
+	WindowEnd    *time.Time `json:"window_end" binding:"omitempty,gtfield=WindowStart"`
+	ETA          *time.Time `json:"eta,omitempty"` // Set by the planner
+}
+
+type RoutePlanRequest struct {
+	Depot          Depot         `json:"depot" binding:"required"`
+	Pickups        []PickupPoint `json:"pickups" binding:"required,min=1,max=200,dive"`
+	TruckIDs       []string      `json:"truck_ids"`                                         // Defaults to every active truck of the organization
+	Departure      *time.Time    `json:"departure"`                                         // Defaults to 06:00 tomorrow
+	ServiceMinutes int           `json:"service_minutes" binding:"omitempty,min=1,max=240"` // Loading time at each farm, 15 by default
+	Commodity      string        `json:"commodity"`
+	CargoType      string        `json:"cargo_type" binding:"omitempty,oneof=general dry chilled livestock"`
+}
+
+// PlannedRoute is the run of one truck, in the order the farms are visited.
+type PlannedRoute struct {
+	TruckID     string        `json:"truck_id" binding:"required"`
+	PlateNumber string        `json:"plate_number,omitempty"`
+	Pickups     []PickupPoint `json:"pickups" binding:"required,min=1,dive"`
+	DistanceKm  float64       `json:"distance_km"`
+	LoadKg      float64       `json:"load_kg"`
+	ReturnAt    *time.Time    `json:"return_at,omitempty"` // Arrival back at the depot
+}
+
+type RoutePlan struct {
+	Departure  time.Time      `json:"departure"`
+	Depot      Depot          `json:"depot"`
+	Commodity  string         `json:"commodity,omitempty"`
+	CargoType  string         `json:"cargo_type,omitempty"`
+	Routes     []PlannedRoute `json:"routes"`
+	Unassigned []PickupPoint  `json:"unassigned"` // Farms no truck can reach in time or has room for
+	DistanceKm float64        `json:"distance_km"`
+}
+
+// RouteCommitRequest turns a plan, as returned or after edits, into shipments.
+type RouteCommitRequest struct {
+	Depot     Depot          `json:"depot" binding:"required"`
+	Routes    []PlannedRoute `json:"routes" binding:"required,min=1,dive"`
+	Departure *time.Time     `json:"departure"`
+	Commodity string         `json:"commodity"`
+	CargoType string         `json:"cargo_type" binding:"omitempty,oneof=general dry chilled livestock"`
+}
+
+// TrackFix is one GPS fix of a shipment, with where it lies on the road once
+// the track is matched.
+type TrackFix struct {
+	Time       time.Time `json:"time"`
+	Lat        float64   `json:"lat"`
+	Lon        float64   `json:"lon"`
+	Speed      *float64  `json:"speed"`
+	MatchedLat *float64  `json:"matched_lat"`
+	MatchedLon *float64  `json:"matched_lon"`
+}
+
+type CompleteStopRequest struct {
+	QuantityKg *float64 `json:"quantity_kg" binding:"omitempty,gte=0"` // What was actually loaded or unloaded
+	Skipped    bool     `json:"skipped"`
+}
+
+// Automatic dispatch progress of a shipment
+const (
+	DispatchSearching = "searching"
+	DispatchAssigned  = "assigned"
+	DispatchFailed    = "failed" // No truck took the job, a dispatcher has to step in
+)
+
+// Dispatch offer statuses
+const (
+	OfferOpen      = "OFFERED"
+	OfferAccepted  = "ACCEPTED"
+	OfferDeclined  = "DECLINED"
+	OfferExpired   = "EXPIRED"
+	OfferCancelled = "CANCELLED" // The shipment was taken some other way
+)
+
+type DispatchOffer struct {
+	ID          int        `json:"id"`
+	ShipmentID  string     `json:"shipment_id"`
+	TruckID     string     `json:"truck_id"`
+	DriverID    string     `json:"driver_id"`
+	PickupKm    float64    `json:"pickup_km"`
+	Status      string     `json:"status"`
+	OfferedAt   time.Time  `json:"offered_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	RespondedAt *time.Time `json:"responded_at"`
+	// Shipment details for the driver
+	OriginLat float64  `json:"origin_lat"`
+	OriginLon float64  `json:"origin_lon"`
+	DestLat   float64  `json:"dest_lat"`
+	DestLon   float64  `json:"dest_lon"`
+	Commodity *string  `json:"commodity"`
+	WeightKg  *float64 `json:"weight_kg"`
+	Payout    *float64 `json:"payout"`
+}
+
+// Claim statuses
+const (
+	ClaimPending   = "PENDING"
+	ClaimAccepted  = "ACCEPTED"
+	ClaimRejected  = "REJECTED"
+	ClaimWithdrawn = "WITHDRAWN"
+)
+
+// LoadBoardEntry is an open shipment as drivers see it. The pickup code is
+// only handed over by the farmer.
+type LoadBoardEntry struct {
+	ShipmentID  string     `json:"shipment_id"`
+	OriginLat   float64    `json:"origin_lat"`
+	OriginLon   float64    `json:"origin_lon"`
+	DestLat     float64    `json:"dest_lat"`
+	DestLon     float64    `json:"dest_lon"`
+	Commodity   *string    `json:"commodity"`
+	CargoType   string     `json:"cargo_type"`
+	WeightKg    *float64   `json:"weight_kg"`
+	VolumeM3    *float64   `json:"volume_m3"`
+	Payout      *float64   `json:"payout"`
+	PickupFrom  *time.Time `json:"pickup_from"`
+	PickupUntil *time.Time `json:"pickup_until"`
+	DistanceKm  float64    `json:"distance_km"` // From the driver to the pickup
+	TripKm      float64    `json:"trip_km"`     // From pickup to drop-off
+	Fits        bool       `json:"fits"`        // Whether the driver's truck can take it
+	FitReason   string     `json:"fit_reason,omitempty"`
+	MyClaim     *string    `json:"my_claim"` // Status of the driver's latest claim
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type ShipmentClaim struct {
+	ID          int        `json:"id"`
+	ShipmentID  string     `json:"shipment_id"`
+	DriverID    string     `json:"driver_id"`
+	DriverName  *string    `json:"driver_name"`
+	TruckID     string     `json:"truck_id"`
+	PlateNumber string     `json:"plate_number"`
+	Message     *string    `json:"message"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DecidedAt   *time.Time `json:"decided_at"`
+}
+
+// Bid statuses
+const (
+	BidPending   = "PENDING"
+	BidCountered = "COUNTERED" // Answered by a counter-offer
+	BidAccepted  = "ACCEPTED"
+	BidRejected  = "REJECTED"
+	BidExpired   = "EXPIRED"
+	BidWithdrawn = "WITHDRAWN"
+)
+
+// Which party made an offer
+const (
+	BidSideCarrier = "carrier"
+	BidSideShipper = "shipper"
+)
+
+type Bid struct {
+	ID          int        `json:"id"`
+	ShipmentID  string     `json:"shipment_id"`
+	ParentBidID *int       `json:"parent_bid_id"`
+	BidderOrgID string     `json:"bidder_org_id"`
+	BidderName  string     `json:"bidder_name"`
+	TruckID     string     `json:"truck_id"`
+	PlateNumber string     `json:"plate_number"`
+	Side        string     `json:"side"`
+	Price       float64    `json:"price"`
+	EtaMinutes  *int       `json:"eta_minutes"`
+	Note        *string    `json:"note"`
+	Status      string     `json:"status"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DecidedAt   *time.Time `json:"decided_at"`
+}
+
+type BidRequest struct {
+	TruckID          string  `json:"truck_id" binding:"required"`
+	Price            float64 `json:"price" binding:"required,gt=0"`
+	EtaMinutes       *int    `json:"eta_minutes" binding:"omitempty,min=0"`
+	Note             string  `json:"note" binding:"max=500"`
+	ExpiresInMinutes int     `json:"expires_in_minutes" binding:"omitempty,min=5,max=10080"` // Defaults to a day
+}
+
+type CounterRequest struct {
+	Price            float64 `json:"price" binding:"required,gt=0"`
+	EtaMinutes       *int    `json:"eta_minutes" binding:"omitempty,min=0"`
+	Note             string  `json:"note" binding:"max=500"`
+	ExpiresInMinutes int     `json:"expires_in_minutes" binding:"omitempty,min=5,max=10080"`
+}
+
+type Notification struct {
+	ID        int                    `json:"id"`
+	Kind      string                 `json:"kind"`
+	Title     string                 `json:"title"`
+	Body      string                 `json:"body"`
+	Data      map[string]interface{} `json:"data"`
+	CreatedAt time.Time              `json:"created_at"`
+	ReadAt    *time.Time             `json:"read_at"`
+}
+
+type ClaimRequest struct {
+	Message string `json:"message" binding:"max=500"`
+}
+
+// TruckCapacity is what a truck can still take on top of its open shipments.
+type TruckCapacity struct {
+	TruckID     string   `json:"truck_id"`
+	CapacityKg  *float64 `json:"capacity_kg"`
+	CapacityM3  *float64 `json:"capacity_m3"`
+	LoadKg      float64  `json:"load_kg"`
+	LoadM3      float64  `json:"load_m3"`
+	RemainingKg *float64 `json:"remaining_kg"`
+	RemainingM3 *float64 `json:"remaining_m3"`
+	CargoTypes  []string `json:"cargo_types"`
+}
+
+type WebhookSubscriptionRequest struct {
+	URL        string   `json:"url" binding:"required,max=2000"`
+	EventTypes []string `json:"event_types" binding:"required,min=1,dive,required"`
+}
+
+type WebhookSubscription struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	Active     bool      `json:"active"`
+	Secret     string    `json:"secret,omitempty"` // Only when created
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Webhook delivery statuses
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookDead      = "dead" // Out of attempts, in the dead-letter queue
+)
+
+type WebhookDelivery struct {
+	ID             string                 `json:"id"`
+	SubscriptionID string                 `json:"subscription_id"`
+	EventType      string                 `json:"event_type"`
+	Payload        map[string]interface{} `json:"payload"`
+	Status         string                 `json:"status"`
+	Attempts       int                    `json:"attempts"`
+	NextAttemptAt  time.Time              `json:"next_attempt_at"`
+	LastStatusCode *int                   `json:"last_status_code"`
+	LastError      *string                `json:"last_error"`
+	CreatedAt      time.Time              `json:"created_at"`
+	DeliveredAt    *time.Time             `json:"delivered_at"`
+	Log            []WebhookAttempt       `json:"log,omitempty"`
+}
+
+type WebhookAttempt struct {
+	StatusCode  *int      `json:"status_code"`
+	Error       *string   `json:"error"`
+	DurationMs  int       `json:"duration_ms"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// NotificationPreferences are the channels a user hears about their
+// shipments on. Quiet hours hold back text messages and email, not the inbox.
+type NotificationPreferences struct {
+	Channels   []string    `json:"channels" binding:"required,dive,oneof=sms email in_app"`
+	QuietHours *QuietHours `json:"quiet_hours"`
+	TimeZone   string      `json:"time_zone"` // IANA name, defaults to Africa/Lagos
+}
+
+type QuietHours struct {
+	Start string `json:"start" binding:"required"` // HH:MM
+	End   string `json:"end" binding:"required"`
+}
+
+// Report kinds
+const (
+	ReportFleet = "fleet"
+	ReportTrip  = "trip"
+	ReportTrips = "trips" // Schedules of a trip report for each delivery
+)
+
+type ReportSchedule struct {
+	ID        int        `json:"id"`
+	Kind      string     `json:"kind"`
+	Cron      string     `json:"cron"`
+	Range     string     `json:"range"`
+	Channels  []string   `json:"channels"`
+	TimeZone  string     `json:"time_zone"`
+	NextRunAt time.Time  `json:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ReportScheduleRequest has a report generated and delivered to the
+// organization's owners and dispatchers when the cron expression fires.
+type ReportScheduleRequest struct {
+	Kind     string   `json:"kind" binding:"required,oneof=fleet trips"`
+	Cron     string   `json:"cron" binding:"required"`                              // e.g. "0 7 * * *" for 07:00 daily
+	Range    string   `json:"range" binding:"omitempty,oneof=24h 7d 30d"`           // Of fleet reports, 24h by default
+	Channels []string `json:"channels" binding:"omitempty,dive,oneof=email in_app"` // Both by default
+}
+
+// ArchivedReport is a report kept in the archive, without its contents.
+type ArchivedReport struct {
+	ID         int        `json:"id"`
+	Kind       string     `json:"kind"`
+	ScheduleID *int       `json:"schedule_id"`
+	ShipmentID *string    `json:"shipment_id"`
+	Title      string     `json:"title"`
+	From       *time.Time `json:"from"`
+	To         *time.Time `json:"to"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type SLAPolicy struct {
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	OriginPlace  *string   `json:"origin_place"` // Any when null
+	DestPlace    *string   `json:"dest_place"`
+	TransitHours float64   `json:"transit_hours"`
+	WindowHours  float64   `json:"window_hours"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type SLAPolicyRequest struct {
+	Name         string  `json:"name" binding:"required,max=100"`
+	OriginPlace  *string `json:"origin_place" binding:"omitempty,min=1"`
+	DestPlace    *string `json:"dest_place" binding:"omitempty,min=1"`
+	TransitHours float64 `json:"transit_hours" binding:"required,gt=0,lte=720"`
+	WindowHours  float64 `json:"window_hours" binding:"gte=0,ltefield=TransitHours"`
+}
+
+// LateRiskShipment is a shipment on the road expected to miss its window,
+// or to only just make it.
+type LateRiskShipment struct {
+	ID          string    `json:"id"`
+	Commodity   *string   `json:"commodity"`
+	Plate       *string   `json:"plate"`
+	DestPlace   *string   `json:"dest_place"`
+	DeliverBy   time.Time `json:"deliver_by"`
+	ETA         time.Time `json:"eta"`
+	LateMinutes float64   `json:"late_minutes"` // Negative while it should still make it
 }
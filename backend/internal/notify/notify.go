@@ -0,0 +1,319 @@
+// Package notify tells people what happens to their shipments over the
+// channels they choose: text message, email or the in-app inbox. Messages
+// are rendered from templates and sent by a Driver per channel.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // Users pick their time zone, containers may lack the database
+
+	"agri-track/internal/sms"
+)
+
+// Channels
+const (
+	SMS   = "sms"
+	Email = "email"
+	InApp = "in_app"
+)
+
+var Channels = []string{SMS, Email, InApp}
+
+// DefaultChannels are used until a user sets preferences. Most farmers have
+// a phone, fewer read email.
+var DefaultChannels = []string{InApp, SMS}
+
+// DefaultTimeZone is used for quiet hours and times in messages until a user
+// picks one.
+const DefaultTimeZone = "Africa/Lagos"
+
+// KindReport is the kind of messages delivering a scheduled report.
+const KindReport = "report"
+
+// Message is a rendered notification.
+type Message struct {
+	Kind        string // Event type it is about
+	Subject     string // Email subject and inbox title, unused by SMS
+	Body        string
+	Data        map[string]interface{} // Kept with inbox messages for the app to link to
+	Attachments []Attachment           // Only sent by email
+}
+
+// Attachment is a file sent along with an email.
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Driver sends messages on one channel. The address is a phone number for
+// SMS, an email address for email and a user ID for the inbox.
+type Driver interface {
+	Send(ctx context.Context, to string, m Message) error
+}
+
+// Drivers picks the driver for each channel.
+type Drivers map[string]Driver
+
+// SMSDriver sends the body of messages as text messages.
+type SMSDriver struct {
+	Sender sms.Sender
+}
+
+func (d SMSDriver) Send(ctx context.Context, to string, m Message) error {
+	return d.Sender.Send(ctx, to, m.Body)
+}
+
+// SMTPTimeout bounds sending one email, from dialing the server to QUIT, so
+// a server that stops answering can't hold up the messages behind it.
+const SMTPTimeout = 30 * time.Second
+
+// SMTPDriver sends messages as plain-text email through an SMTP server,
+// with their attachments.
+type SMTPDriver struct {
+	Addr     string // host:port
+	Username string // No authentication when empty
+	Password string
+	From     string
+}
+
+func (d SMTPDriver) Send(ctx context.Context, to string, m Message) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(m.Subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+	var auth smtp.Auth
+	if d.Username != "" {
+		host, _, _ := strings.Cut(d.Addr, ":")
+		auth = smtp.PlainAuth("", d.Username, d.Password, host)
+	}
+	var msg bytes.Buffer
+	msg.WriteString("From: " + d.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", m.Subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n")
+	if len(m.Attachments) == 0 {
+		msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n" + m.Body + "\r\n")
+		return d.sendMail(ctx, auth, to, msg.Bytes())
+	}
+
+	mw := multipart.NewWriter(&msg)
+	msg.WriteString("Content-Type: multipart/mixed; boundary=" + mw.Boundary() + "\r\n\r\n")
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}})
+	if err != nil {
+		return err
+	}
+	part.Write([]byte(m.Body + "\r\n"))
+	for _, a := range m.Attachments {
+		if strings.ContainsAny(a.Name, "\r\n\"") {
+			return fmt.Errorf("invalid attachment name")
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {`attachment; filename="` + a.Name + `"`},
+		})
+		if err != nil {
+			return err
+		}
+		// Base64 in lines of 76 characters, as MIME wants
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return d.sendMail(ctx, auth, to, msg.Bytes())
+}
+
+// sendMail does what smtp.SendMail does, within SMTPTimeout and the
+// deadline of ctx.
+func (d SMTPDriver) sendMail(ctx context.Context, auth smtp.Auth, to string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, SMTPTimeout)
+	defer cancel()
+
+	dialer := net.Dialer{Timeout: SMTPTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+	host, _, _ := strings.Cut(d.Addr, ":")
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(d.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// EmailFromEnv returns an SMTP driver configured by SMTP_ADDR, SMTP_USERNAME,
+// SMTP_PASSWORD and SMTP_FROM, or a fake that only logs without SMTP_ADDR.
+func EmailFromEnv() Driver {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return NewFakeDriver(Email)
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "AgriTrack <no-reply@agritrack.ng>"
+	}
+	return SMTPDriver{Addr: addr, Username: os.Getenv("SMTP_USERNAME"), Password: os.Getenv("SMTP_PASSWORD"), From: from}
+}
+
+// Sent is a message a FakeDriver was asked to send.
+type Sent struct {
+	To      string
+	Message Message
+	SentAt  time.Time
+}
+
+// FakeDriver keeps messages in memory instead of sending them.
+// Used for local development and tests.
+type FakeDriver struct {
+	channel string
+	mu      sync.Mutex
+	sent    []Sent
+	fail    int
+}
+
+func NewFakeDriver(channel string) *FakeDriver {
+	return &FakeDriver{channel: channel}
+}
+
+func (f *FakeDriver) Send(ctx context.Context, to string, m Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail > 0 {
+		f.fail--
+		return fmt.Errorf("%s unavailable", f.channel)
+	}
+	f.sent = append(f.sent, Sent{To: to, Message: m, SentAt: time.Now()})
+
+	log.Printf("[%s] to %s: %s", f.channel, to, m.Body)
+	return nil
+}
+
+// FailNext has the next n sends fail.
+func (f *FakeDriver) FailNext(n int) {
+	f.mu.Lock()
+	f.fail = n
+	f.mu.Unlock()
+}
+
+// Sent returns a copy of everything sent so far.
+func (f *FakeDriver) Sent() []Sent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]Sent, len(f.sent))
+	copy(out, f.sent)
+	return out
+}
+
+// QuietHours is a daily window, in a user's time zone, in which nothing is
+// sent that would buzz a phone. It may span midnight, e.g. 21:00 to 06:00,
+// and is empty when it starts and ends at the same time.
+type QuietHours struct {
+	Start    Clock
+	End      Clock
+	Location *time.Location
+}
+
+// Clock is a time of day in minutes after midnight.
+type Clock int
+
+// ParseClock parses a time of day like "21:30".
+func ParseClock(s string) (Clock, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return Clock(t.Hour()*60 + t.Minute()), nil
+}
+
+func (c Clock) String() string {
+	return fmt.Sprintf("%02d:%02d", c/60, c%60)
+}
+
+// Contains reports whether t falls in quiet hours.
+func (q QuietHours) Contains(t time.Time) bool {
+	local := t.In(q.Location)
+	now := Clock(local.Hour()*60 + local.Minute())
+	if q.Start <= q.End {
+		return q.Start <= now && now < q.End
+	}
+	return now >= q.Start || now < q.End
+}
+
+// Until returns when a message due at t may be sent: t itself outside quiet
+// hours, otherwise when they end.
+func (q QuietHours) Until(t time.Time) time.Time {
+	if !q.Contains(t) {
+		return t
+	}
+	local := t.In(q.Location)
+	end := time.Date(local.Year(), local.Month(), local.Day(), int(q.End)/60, int(q.End)%60, 0, 0, q.Location)
+	if !end.After(local) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// Deferrable reports whether messages on a channel wait out quiet hours.
+// The inbox makes no noise, so it never waits.
+func Deferrable(channel string) bool {
+	return channel != InApp
+}
@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"agri-track/internal/events"
+)
+
+// Data fills in message templates.
+type Data struct {
+	ShipmentID string
+	Commodity  string // What the shipment carries, "shipment" when unknown
+	Plate      string // Plate number of the truck carrying it
+	Time       string // When it happened, in the recipient's time zone
+	Place      string
+	Incident   string // Kind of incident, in words
+	DistanceKm int
+	Due        string // When it was promised, in the recipient's time zone
+}
+
+type messageTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func newTemplate(subject, body string) messageTemplate {
+	return messageTemplate{
+		subject: template.Must(template.New("subject").Parse(subject)),
+		body:    template.Must(template.New("body").Parse(body)),
+	}
+}
+
+// Kept short, an SMS is 160 characters. Worded so the verb doesn't have
+// to agree with the commodity, "your yams" or "your maize".
+var templates = map[string]messageTemplate{
+	events.ShipmentPickedUp: newTemplate(
+		"Picked up: your {{.Commodity}}",
+		"{{.Plate}} picked up your {{.Commodity}} at {{.Time}}.",
+	),
+	events.ShipmentNearDestination: newTemplate(
+		"Almost there: your {{.Commodity}}",
+		"{{.Plate}} is {{.DistanceKm}} km from delivering your {{.Commodity}}.",
+	),
+	events.ShipmentDelivered: newTemplate(
+		"Delivered: your {{.Commodity}}",
+		"{{.Plate}} delivered your {{.Commodity}} at {{.Time}}.",
+	),
+	events.IncidentReported: newTemplate(
+		"Incident: {{.Plate}} reported {{.Incident}}",
+		"{{.Plate}} carrying your {{.Commodity}} reported {{.Incident}}{{if .Place}} ({{.Place}}){{end}} at {{.Time}}.",
+	),
+	events.ShipmentETABreach: newTemplate(
+		"Running late: your {{.Commodity}}",
+		"{{.Plate}} now expects to deliver your {{.Commodity}} at {{.Time}}, after the promised {{.Due}}.",
+	),
+}
+
+// Kinds are the event types there are messages for.
+func Kinds() []string {
+	kinds := make([]string, 0, len(templates))
+	for k := range templates {
+		kinds = append(kinds, k)
+	}
+	return kinds
+}
+
+// Render returns the message about an event of the given type.
+func Render(kind string, d Data) (Message, error) {
+	t, ok := templates[kind]
+	if !ok {
+		return Message{}, fmt.Errorf("no template for %s", kind)
+	}
+	if d.Commodity == "" {
+		d.Commodity = "shipment"
+	}
+	if d.Plate == "" {
+		d.Plate = "the truck"
+	}
+	var subject, body strings.Builder
+	if err := t.subject.Execute(&subject, d); err != nil {
+		return Message{}, err
+	}
+	if err := t.body.Execute(&body, d); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Kind:    kind,
+		Subject: subject.String(),
+		Body:    body.String(),
+		Data:    map[string]interface{}{"shipment_id": d.ShipmentID},
+	}, nil
+}
+
+var incidentText = map[string]string{
+	"POLICE_CHECKPOINT": "a police checkpoint",
+	"BREAKDOWN":         "a breakdown",
+	"ACCIDENT":          "an accident",
+	"TRAFFIC":           "heavy traffic",
+	"BAD_ROAD":          "a bad road",
+}
+
+// IncidentText puts an incident type in words.
+func IncidentText(incidentType string) string {
+	if s, ok := incidentText[incidentType]; ok {
+		return s
+	}
+	return "an incident"
+}
@@ -0,0 +1,167 @@
+package otp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"agri-track/internal/db"
+	"agri-track/internal/sms"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrRateLimited     = errors.New("too many codes requested for this number")
+	ErrCooldown        = errors.New("a code was sent recently, please wait before requesting another")
+	ErrInvalidCode     = errors.New("invalid code")
+	ErrExpired         = errors.New("code expired")
+	ErrTooManyAttempts = errors.New("too many attempts, request a new code")
+)
+
+// Service issues and checks one-time login codes sent by SMS.
+// Codes are stored hashed in the otp_codes table.
+type Service struct {
+	sender sms.Sender
+	secret []byte
+
+	CodeLength  int
+	TTL         time.Duration
+	MaxAttempts int
+	MaxRequests int           // codes per phone within Window
+	Window      time.Duration // rate limit window
+	Cooldown    time.Duration // minimum gap between two codes
+}
+
+func NewService(sender sms.Sender) *Service {
+	return &Service{
+		sender:      sender,
+		secret:      []byte(os.Getenv("JWT_SECRET")),
+		CodeLength:  6,
+		TTL:         5 * time.Minute,
+		MaxAttempts: 5,
+		MaxRequests: 5,
+		Window:      time.Hour,
+		Cooldown:    time.Minute,
+	}
+}
+
+// Request generates a fresh code for the phone number and sends it.
+// Any code previously issued to the number stops working.
+func (s *Service) Request(ctx context.Context, phone string) error {
+	var count int
+	var last *time.Time
+	err := db.Pool.QueryRow(ctx, `
+		SELECT COUNT(*), MAX(created_at) FROM otp_codes
+		WHERE phone=$1 AND created_at > $2
+	`, phone, time.Now().Add(-s.Window)).Scan(&count, &last)
+	if err != nil {
+		return fmt.Errorf("failed to check otp rate limit: %v", err)
+	}
+	if count >= s.MaxRequests {
+		return ErrRateLimited
+	}
+	if last != nil && time.Since(*last) < s.Cooldown {
+		return ErrCooldown
+	}
+
+	code, err := s.generateCode()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Pool.Exec(ctx, "UPDATE otp_codes SET consumed_at=NOW() WHERE phone=$1 AND consumed_at IS NULL", phone)
+	if err != nil {
+		return fmt.Errorf("failed to invalidate old codes: %v", err)
+	}
+
+	_, err = db.Pool.Exec(ctx, `
+		INSERT INTO otp_codes (phone, code_hash, expires_at) VALUES ($1, $2, $3)
+	`, phone, s.hash(phone, code), time.Now().Add(s.TTL))
+	if err != nil {
+		return fmt.Errorf("failed to store otp: %v", err)
+	}
+
+	body := fmt.Sprintf("Your AgriTrack code is %s. It expires in %d minutes.", code, int(s.TTL.Minutes()))
+	if err := s.sender.Send(ctx, phone, body); err != nil {
+		return fmt.Errorf("failed to send otp: %v", err)
+	}
+	return nil
+}
+
+// Verify checks a code against the latest one issued to the phone number
+// and consumes it on success. Failed attempts count towards MaxAttempts.
+func (s *Service) Verify(ctx context.Context, phone, code string) error {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var id, attempts int
+	var codeHash string
+	var expiresAt time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT id, code_hash, expires_at, attempts FROM otp_codes
+		WHERE phone=$1 AND consumed_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT 1
+		FOR UPDATE
+	`, phone).Scan(&id, &codeHash, &expiresAt, &attempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInvalidCode
+	}
+	if err != nil {
+		return err
+	}
+
+	if time.Now().After(expiresAt) {
+		return ErrExpired
+	}
+	if attempts >= s.MaxAttempts {
+		return ErrTooManyAttempts
+	}
+
+	if !hmac.Equal([]byte(codeHash), []byte(s.hash(phone, code))) {
+		if _, err := tx.Exec(ctx, "UPDATE otp_codes SET attempts = attempts + 1 WHERE id=$1", id); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+		if attempts+1 >= s.MaxAttempts {
+			return ErrTooManyAttempts
+		}
+		return ErrInvalidCode
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE otp_codes SET consumed_at=NOW() WHERE id=$1", id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *Service) generateCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < s.CodeLength; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate otp: %v", err)
+	}
+	return fmt.Sprintf("%0*d", s.CodeLength, n), nil
+}
+
+func (s *Service) hash(phone, code string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(phone + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,282 @@
+package pdf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Page layout, in points
+const (
+	margin       = 50.0
+	contentWidth = PageWidth - 2*margin
+	bottom       = PageHeight - 60 // Where text stops, above the footer
+	indent       = 18.0
+)
+
+// Text sizes
+const (
+	titleSize   = 18.0
+	headingSize = 13.0
+	bodySize    = 10.0
+	tableSize   = 9.0
+	footerSize  = 8.0
+)
+
+var (
+	numbered  = regexp.MustCompile(`^(\d+)\. (.*)$`)
+	separator = regexp.MustCompile(`^:?-+:?$`)
+)
+
+// FromMarkdown lays out the Markdown reports are written in: headings,
+// paragraphs, bulleted and numbered lists, tables and **bold** text.
+// Every page gets a footer with the title and page number.
+func FromMarkdown(title, md string) []byte {
+	l := &layout{doc: New(title)}
+	l.newPage()
+
+	lines := strings.Split(strings.ReplaceAll(md, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " ")
+		switch {
+		case strings.HasPrefix(line, "# "):
+			l.heading(line[2:], titleSize, 0)
+		case strings.HasPrefix(line, "## "):
+			l.heading(line[3:], headingSize, 10)
+		case strings.HasPrefix(line, "|"):
+			var rows []string
+			for ; i < len(lines) && strings.HasPrefix(lines[i], "|"); i++ {
+				rows = append(rows, lines[i])
+			}
+			i--
+			l.table(rows)
+		case strings.HasPrefix(line, "- "):
+			l.doc.Text(margin+6, l.y+bodySize, Regular, bodySize, "•")
+			l.flow(spans(line[2:]), margin+indent, bodySize)
+		case numbered.MatchString(line):
+			m := numbered.FindStringSubmatch(line)
+			l.doc.Text(margin, l.y+bodySize, Regular, bodySize, m[1]+".")
+			l.flow(spans(m[2]), margin+indent, bodySize)
+		case line == "" || line == "---":
+			l.y += bodySize / 2
+		default:
+			l.flow(spans(line), margin, bodySize)
+		}
+	}
+
+	pages := l.doc.Pages()
+	for i := 0; i < pages; i++ {
+		footer := fmt.Sprintf("Page %d of %d", i+1, pages)
+		l.doc.SetPage(i)
+		l.doc.Text(margin, PageHeight-30, Regular, footerSize, title)
+		l.doc.Text(PageWidth-margin-Width(footer, Regular, footerSize), PageHeight-30, Regular, footerSize, footer)
+	}
+	return l.doc.Bytes()
+}
+
+type layout struct {
+	doc *Document
+	y   float64 // Top of the next line
+}
+
+func (l *layout) newPage() {
+	l.doc.AddPage()
+	l.y = margin
+}
+
+// room starts a new page unless height fits on this one.
+func (l *layout) room(height float64) {
+	if l.y+height > bottom {
+		l.newPage()
+	}
+}
+
+func lineHeight(size float64) float64 {
+	return size * 1.4
+}
+
+func (l *layout) heading(text string, size, before float64) {
+	if l.y > margin {
+		l.y += before
+	}
+	// Keep a heading with the line after it
+	l.room(lineHeight(size) + 2*lineHeight(bodySize))
+	l.flow([]span{{strings.ReplaceAll(text, "**", ""), Bold}}, margin, size)
+	l.doc.Line(margin, l.y, PageWidth-margin, l.y, 0.5, 0.6)
+	l.y += 6
+}
+
+type span struct {
+	text string
+	font int
+}
+
+// spans splits text at ** into regular and bold runs.
+func spans(text string) []span {
+	var list []span
+	font := Regular
+	for i, part := range strings.Split(text, "**") {
+		if i > 0 {
+			font = 1 - font
+		}
+		if part != "" {
+			list = append(list, span{part, font})
+		}
+	}
+	return list
+}
+
+// flow sets text from x to the right margin, wrapping between words.
+func (l *layout) flow(text []span, x float64, size float64) {
+	type word struct {
+		text  string
+		font  int
+		space bool // Preceded by a space
+	}
+	var words []word
+	space := false
+	for _, s := range text {
+		for i, w := range strings.Split(s.text, " ") {
+			space = space || i > 0
+			if w != "" {
+				words = append(words, word{w, s.font, space && len(words) > 0})
+				space = false
+			}
+		}
+	}
+
+	spaceWidth := Width(" ", Regular, size)
+	var line []word
+	lineWidth := 0.0
+	emit := func() {
+		l.room(lineHeight(size))
+		cx := x
+		for i := 0; i < len(line); {
+			// Words in the same font are set as one run
+			run := line[i].text
+			j := i + 1
+			for ; j < len(line) && line[j].font == line[i].font; j++ {
+				if line[j].space {
+					run += " "
+				}
+				run += line[j].text
+			}
+			if i > 0 && line[i].space {
+				cx += spaceWidth
+			}
+			l.doc.Text(cx, l.y+size, line[i].font, size, run)
+			cx += Width(run, line[i].font, size)
+			i = j
+		}
+		l.y += lineHeight(size)
+		line, lineWidth = nil, 0
+	}
+	for _, w := range words {
+		width := Width(w.text, w.font, size)
+		if w.space && len(line) > 0 {
+			width += spaceWidth
+		}
+		if len(line) > 0 && lineWidth+width > PageWidth-margin-x {
+			emit()
+			w.space = false
+			width = Width(w.text, w.font, size)
+		}
+		line = append(line, w)
+		lineWidth += width
+	}
+	if len(line) > 0 || len(words) == 0 {
+		emit()
+	}
+}
+
+// table sets Markdown table rows, the first one as the header. Columns
+// are as wide as their widest cell, scaled down to fit the page.
+func (l *layout) table(rows []string) {
+	var cells [][]string
+	var right []bool
+	for _, row := range rows {
+		row = strings.Trim(strings.TrimSpace(row), "|")
+		parts := strings.Split(row, "|")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		if isSeparator(parts) {
+			right = make([]bool, len(parts))
+			for i, p := range parts {
+				right[i] = strings.HasSuffix(p, ":")
+			}
+			continue
+		}
+		cells = append(cells, parts)
+	}
+	if len(cells) == 0 {
+		return
+	}
+
+	columns := 0
+	for _, row := range cells {
+		columns = max(columns, len(row))
+	}
+	const padding = 8.0
+	widths := make([]float64, columns)
+	total := 0.0
+	for _, row := range cells {
+		for i, cell := range row {
+			widths[i] = max(widths[i], Width(strings.ReplaceAll(cell, "**", ""), Bold, tableSize)+padding)
+		}
+	}
+	for _, w := range widths {
+		total += w
+	}
+	if total > contentWidth {
+		for i := range widths {
+			widths[i] *= contentWidth / total
+		}
+		total = contentWidth
+	}
+
+	height := lineHeight(tableSize) + 2
+	for r, row := range cells {
+		l.room(height)
+		font := Regular
+		if r == 0 {
+			font = Bold
+		}
+		x := margin
+		for i, cell := range row {
+			cell = fit(strings.ReplaceAll(cell, "**", ""), font, widths[i]-padding)
+			cx := x
+			if i < len(right) && right[i] {
+				cx = x + widths[i] - padding - Width(cell, font, tableSize)
+			}
+			l.doc.Text(cx, l.y+tableSize, font, tableSize, cell)
+			x += widths[i]
+		}
+		l.y += height
+		if r == 0 {
+			l.doc.Line(margin, l.y-3, margin+total, l.y-3, 0.5, 0.6)
+		}
+	}
+	l.y += bodySize / 2
+}
+
+func isSeparator(cells []string) bool {
+	for _, c := range cells {
+		if !separator.MatchString(c) {
+			return false
+		}
+	}
+	return len(cells) > 0
+}
+
+// fit shortens text with an ellipsis until it is no wider than width.
+func fit(text string, font int, width float64) string {
+	if Width(text, font, tableSize) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && Width(string(runes)+"…", font, tableSize) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "…"
+}
@@ -0,0 +1,150 @@
+// Package pdf writes simple PDF documents: pages of text and lines in the
+// Helvetica fonts every PDF reader has, so nothing needs embedding. It
+// covers what reports need, not the PDF specification.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+)
+
+// A4 in points
+const (
+	PageWidth  = 595.0
+	PageHeight = 842.0
+)
+
+// Fonts
+const (
+	Regular = iota
+	Bold
+)
+
+var fontNames = []string{"Helvetica", "Helvetica-Bold"}
+
+// Document is a PDF being written. The origin of a page is its top left
+// corner, y grows downwards.
+type Document struct {
+	title   string
+	pages   []*bytes.Buffer
+	current int
+}
+
+func New(title string) *Document {
+	return &Document{title: title}
+}
+
+// AddPage starts a new page, which the drawing methods then draw on.
+func (d *Document) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.current = len(d.pages) - 1
+}
+
+// SetPage goes back to draw on page i, counted from 0.
+func (d *Document) SetPage(i int) {
+	d.current = i
+}
+
+// Pages is how many pages the document has.
+func (d *Document) Pages() int {
+	return len(d.pages)
+}
+
+func (d *Document) page() *bytes.Buffer {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+	return d.pages[d.current]
+}
+
+// Text draws s with its baseline at y.
+func (d *Document) Text(x, y float64, font int, size float64, s string) {
+	fmt.Fprintf(d.page(), "BT /F%d %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font+1, size, x, PageHeight-y, escape(encode(s)))
+}
+
+// Line draws a line of the given width in grey, 0 black to 1 white.
+func (d *Document) Line(x1, y1, x2, y2, width, grey float64) {
+	fmt.Fprintf(d.page(), "%.2f G %.2f w %.2f %.2f m %.2f %.2f l S\n", grey, width, x1, PageHeight-y1, x2, PageHeight-y2)
+}
+
+// Bytes returns the finished document.
+func (d *Document) Bytes() []byte {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	// Objects 1 to 4 are the catalog, the page tree, the fonts and the
+	// info, then each page and its contents.
+	const firstPage = 5
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object(fmt.Sprintf("<< /F1 << /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >> "+
+		"/F2 << /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >> >>", fontNames[Regular], fontNames[Bold]))
+	object(fmt.Sprintf("<< /Title (%s) /Producer (AgriTrack) >>", escape(encode(d.title))))
+
+	for i, content := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font 3 0 R >> /Contents %d 0 R >>",
+			PageWidth, PageHeight, firstPage+2*i+1))
+		var z bytes.Buffer
+		w := zlib.NewWriter(&z)
+		w.Write(content.Bytes())
+		w.Close()
+		object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", z.Len(), z.Bytes()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 4 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// Characters outside Latin-1 that WinAnsiEncoding has
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+// Characters it doesn't, written out
+var spelled = map[rune]string{
+	'₦': "NGN ",
+	'→': "->",
+	'≈': "~",
+}
+
+// encode converts s to WinAnsiEncoding, replacing what it can't encode.
+func encode(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch c, ok := winAnsi[r]; {
+		case ok:
+			b.WriteByte(c)
+		case r < 0x80 || r >= 0xa0 && r <= 0xff:
+			b.WriteByte(byte(r))
+		case spelled[r] != "":
+			b.WriteString(spelled[r])
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`, "\r", `\r`, "\n", `\n`).Replace(s)
+}
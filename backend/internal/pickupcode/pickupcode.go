@@ -0,0 +1,79 @@
+package pickupcode
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAlphabet leaves out characters that are easy to misread (0/O, 1/I/L)
+	DefaultAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	DefaultLength   = 6
+	DefaultTTL      = 72 * time.Hour
+	Prefix          = "AG-"
+)
+
+// Generator produces the codes farmers hand to drivers to claim a load.
+type Generator struct {
+	Alphabet string
+	Length   int
+	TTL      time.Duration
+}
+
+// FromEnv reads PICKUP_CODE_ALPHABET, PICKUP_CODE_LENGTH and PICKUP_CODE_TTL,
+// using the defaults for anything unset.
+func FromEnv() (*Generator, error) {
+	g := &Generator{Alphabet: DefaultAlphabet, Length: DefaultLength, TTL: DefaultTTL}
+
+	if v := os.Getenv("PICKUP_CODE_ALPHABET"); v != "" {
+		g.Alphabet = strings.ToUpper(v)
+	}
+	if v := os.Getenv("PICKUP_CODE_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PICKUP_CODE_LENGTH: %v", err)
+		}
+		g.Length = n
+	}
+	if v := os.Getenv("PICKUP_CODE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PICKUP_CODE_TTL: %v", err)
+		}
+		g.TTL = d
+	}
+
+	if len(g.Alphabet) < 2 || g.Length < 4 {
+		return nil, fmt.Errorf("pickup codes need at least 2 symbols and 4 characters")
+	}
+	return g, nil
+}
+
+// New returns a random code such as "AG-7KQ2MX".
+func (g *Generator) New() (string, error) {
+	max := big.NewInt(int64(len(g.Alphabet)))
+	code := make([]byte, g.Length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate pickup code: %v", err)
+		}
+		code[i] = g.Alphabet[n.Int64()]
+	}
+	return Prefix + string(code), nil
+}
+
+// Normalize makes user input comparable with stored codes: it trims,
+// upper-cases and adds the prefix if it was left out.
+func Normalize(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !strings.HasPrefix(code, Prefix) {
+		code = Prefix + code
+	}
+	return code
+}
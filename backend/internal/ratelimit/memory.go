@@ -0,0 +1,151 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// full reports whether the bucket would have refilled completely by now,
+// at which point forgetting it changes nothing.
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= float64(b.limit.Burst)
+}
+
+type failures struct {
+	times  []time.Time
+	window time.Duration
+}
+
+// MemoryStore is a Store that keeps all state in process memory.
+type MemoryStore struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	failures map[string]*failures
+	locks    map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:  make(map[string]*bucket),
+		failures: make(map[string]*failures),
+		locks:    make(map[string]time.Time),
+	}
+}
+
+func (m *MemoryStore) Take(key string, limit Limit, now time.Time) (bool, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		m.buckets[key] = b
+	}
+	b.limit = limit
+
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / limit.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+func (m *MemoryStore) AddFailure(key string, window time.Duration, now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.failures[key]
+	if !ok {
+		f = &failures{}
+		m.failures[key] = f
+	}
+	f.window = window
+
+	cutoff := now.Add(-window)
+	kept := f.times[:0]
+	for _, t := range f.times {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	f.times = append(kept, now)
+	return len(f.times)
+}
+
+func (m *MemoryStore) ClearFailures(key string) {
+	m.mu.Lock()
+	delete(m.failures, key)
+	m.mu.Unlock()
+}
+
+func (m *MemoryStore) Lock(key string, until time.Time) {
+	m.mu.Lock()
+	m.locks[key] = until
+	m.mu.Unlock()
+}
+
+func (m *MemoryStore) LockedUntil(key string, now time.Time) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	until, ok := m.locks[key]
+	if !ok {
+		return time.Time{}
+	}
+	if !now.Before(until) {
+		delete(m.locks, key)
+		return time.Time{}
+	}
+	return until
+}
+
+// StartCleanup periodically drops refilled buckets, old failures and expired
+// locks so the maps don't grow with every IP that ever connected.
+func (m *MemoryStore) StartCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.cleanup(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *MemoryStore) cleanup(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, b := range m.buckets {
+		if b.full(now) {
+			delete(m.buckets, key)
+		}
+	}
+	for key, f := range m.failures {
+		if len(f.times) == 0 || now.Sub(f.times[len(f.times)-1]) > f.window {
+			delete(m.failures, key)
+		}
+	}
+	for key, until := range m.locks {
+		if !now.Before(until) {
+			delete(m.locks, key)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Limit describes a token bucket that holds up to Burst tokens
+// and refills at Rate tokens per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Every returns a Limit that allows one request per interval
+// with bursts of up to burst requests.
+func Every(interval time.Duration, burst int) Limit {
+	return Limit{Rate: 1 / interval.Seconds(), Burst: burst}
+}
+
+// Store holds rate limiter state. MemoryStore keeps it in process; a shared
+// backend can implement the same interface when running several instances.
+type Store interface {
+	// Take removes a token from the bucket at key. When the bucket is empty
+	// it reports how long until the next token is available.
+	Take(key string, limit Limit, now time.Time) (ok bool, retryAfter time.Duration)
+
+	// AddFailure records a failure at key and returns the number of failures within window.
+	AddFailure(key string, window time.Duration, now time.Time) int
+	ClearFailures(key string)
+
+	// Lock blocks key until the given time. LockedUntil returns the zero time if key is not locked.
+	Lock(key string, until time.Time)
+	LockedUntil(key string, now time.Time) time.Time
+}
+
+// Lockout blocks a key (an account, a driver) after too many failures in a row.
+type Lockout struct {
+	store Store
+
+	MaxFailures int
+	Window      time.Duration // failures older than this are forgotten
+	Duration    time.Duration // how long the key stays locked
+}
+
+func NewLockout(store Store, maxFailures int, window, duration time.Duration) *Lockout {
+	return &Lockout{store: store, MaxFailures: maxFailures, Window: window, Duration: duration}
+}
+
+// Locked reports whether key is locked and for how much longer.
+func (l *Lockout) Locked(key string) (bool, time.Duration) {
+	now := time.Now()
+	until := l.store.LockedUntil(key, now)
+	if until.IsZero() {
+		return false, 0
+	}
+	return true, until.Sub(now)
+}
+
+// Fail records a failure for key and locks it once MaxFailures is reached.
+func (l *Lockout) Fail(key string) (locked bool, retryAfter time.Duration) {
+	now := time.Now()
+	if l.store.AddFailure(key, l.Window, now) < l.MaxFailures {
+		return false, 0
+	}
+	l.store.ClearFailures(key)
+	l.store.Lock(key, now.Add(l.Duration))
+	return true, l.Duration
+}
+
+// Reset forgets previous failures, e.g. after a successful login.
+func (l *Lockout) Reset(key string) {
+	l.store.ClearFailures(key)
+}
+
+// RetryAfterSeconds rounds d up to whole seconds for the Retry-After header.
+func RetryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
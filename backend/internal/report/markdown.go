@@ -0,0 +1,191 @@
+package report
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of incident types and delay causes in the report
+var causeNames = map[string]string{
+	"BREAKDOWN":         "Breakdown",
+	"ACCIDENT":          "Accident",
+	"TRAFFIC":           "Traffic",
+	"POLICE_CHECKPOINT": "Police checkpoint",
+	"BAD_ROAD":          "Bad road",
+	Unexplained:         "No incident reported",
+}
+
+func causeName(cause string) string {
+	if name, ok := causeNames[cause]; ok {
+		return name
+	}
+	return strings.ReplaceAll(cause, "_", " ")
+}
+
+// Naira formats an amount like ₦1,250,000.
+func Naira(amount float64) string {
+	if amount < 0 {
+		return "-" + Naira(-amount)
+	}
+	return "₦" + thousands(amount)
+}
+
+// thousands formats a rounded number with thousands separators.
+func thousands(v float64) string {
+	digits := strconv.FormatInt(int64(math.Round(v)), 10)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	return b.String()
+}
+
+func percent(rate float64) string {
+	return fmt.Sprintf("%.0f%%", rate*100)
+}
+
+// change describes a trend, "up 25% from 4" or "no change from 4".
+func change(t Trend, format func(float64) string) string {
+	switch {
+	case t.Change == nil && t.Current == 0:
+		return "none in either period"
+	case t.Change == nil:
+		return "none the period before"
+	case math.Abs(*t.Change) < 0.005:
+		return "no change from " + format(t.Previous)
+	case *t.Change > 0:
+		return fmt.Sprintf("up %s from %s", percent(*t.Change), format(t.Previous))
+	}
+	return fmt.Sprintf("down %s from %s", percent(-*t.Change), format(t.Previous))
+}
+
+func (r Report) trend(metric string) (Trend, bool) {
+	for _, t := range r.Trends {
+		if t.Metric == metric {
+			return t, true
+		}
+	}
+	return Trend{}, false
+}
+
+// Markdown renders the report as a briefing.
+func (r Report) Markdown() string {
+	loc, err := time.LoadLocation(r.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	count := func(v float64) string { return strconv.Itoa(int(v)) }
+	f := r.Figures
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", r.Title)
+	fmt.Fprintf(&b, "**Period:** %s to %s  \n", r.From.In(loc).Format("2 Jan 2006 15:04"), r.To.In(loc).Format("2 Jan 2006 15:04 MST"))
+	fmt.Fprintf(&b, "**Generated:** %s\n\n", r.GeneratedAt.In(loc).Format("2 Jan 2006 15:04 MST"))
+
+	b.WriteString("## Summary\n")
+	if t, ok := r.trend(MetricDeliveries); ok {
+		fmt.Fprintf(&b, "- **Deliveries:** %d (%s)\n", f.Deliveries, change(t, count))
+	}
+	if f.OnTimeRate != nil {
+		fmt.Fprintf(&b, "- **On time:** %s, %d of %d timed deliveries", percent(*f.OnTimeRate), f.OnTime, f.OnTime+f.Late)
+		if t, ok := r.trend(MetricOnTimeRate); ok {
+			fmt.Fprintf(&b, " (%s)", change(t, percent))
+		}
+		b.WriteString("\n")
+	} else {
+		b.WriteString("- **On time:** no timed deliveries\n")
+	}
+	if t, ok := r.trend(MetricIncidents); ok {
+		fmt.Fprintf(&b, "- **Incidents:** %d (%s)\n", f.Incidents, change(t, count))
+	}
+	if f.AvgSpeedKmh != nil {
+		fmt.Fprintf(&b, "- **Average speed:** %.0f km/h", *f.AvgSpeedKmh)
+		if t, ok := r.trend(MetricAvgSpeed); ok {
+			fmt.Fprintf(&b, " (%s)", change(t, func(v float64) string { return fmt.Sprintf("%.0f km/h", v) }))
+		}
+		b.WriteString("\n")
+	}
+	if t, ok := r.trend(MetricValueAtRisk); ok {
+		fmt.Fprintf(&b, "- **Perishable cargo at risk:** %s (%s)\n", Naira(f.ValueAtRisk), change(t, Naira))
+	}
+
+	b.WriteString("\n## Incident Hotspots\n")
+	if len(r.Hotspots) == 0 {
+		b.WriteString("No incidents were reported.\n")
+	}
+	for i, h := range r.Hotspots {
+		types := make([]string, 0, len(h.Types))
+		for _, t := range sortedKeys(h.Types) {
+			types = append(types, fmt.Sprintf("%s ×%d", causeName(t), h.Types[t]))
+		}
+		fmt.Fprintf(&b, "%d. **%s**: %d incident%s (%s)\n", i+1, h.Place, h.Incidents, plural(h.Incidents), strings.Join(types, ", "))
+	}
+
+	b.WriteString("\n## Delay Attribution\n")
+	if len(r.Delays) == 0 {
+		b.WriteString("No deliveries were late.\n")
+	} else {
+		fmt.Fprintf(&b, "%d late deliver%s, %.1f hours behind plan in all.\n\n", f.Late, pluralY(f.Late), f.DelayHours)
+		b.WriteString("| Cause | Hours | Deliveries |\n|---|---:|---:|\n")
+		for _, d := range r.Delays {
+			fmt.Fprintf(&b, "| %s | %.1f | %d |\n", causeName(d.Cause), d.Hours, d.Deliveries)
+		}
+	}
+
+	b.WriteString("\n## Spoilage Exposure\n")
+	e := r.Exposure
+	if e.Shipments == 0 {
+		b.WriteString("No perishable cargo was held up.\n")
+	} else {
+		fmt.Fprintf(&b, "%s of perishable cargo on %d shipment%s was late, overdue or caught in a serious incident.\n",
+			Naira(e.Value), e.Shipments, plural(e.Shipments))
+		if e.Unvalued > 0 {
+			fmt.Fprintf(&b, "%d of them had no declared value and are not counted in it.\n", e.Unvalued)
+		}
+		b.WriteString("\n")
+		for _, c := range e.Commodities {
+			value := "no declared value"
+			if c.Value > 0 {
+				value = Naira(c.Value)
+			}
+			fmt.Fprintf(&b, "- **%s:** %s on %d shipment%s\n", c.Commodity, value, c.Shipments, plural(c.Shipments))
+		}
+	}
+	return b.String()
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	// Most frequent first
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+func pluralY(n int) string {
+	if n == 1 {
+		return "y"
+	}
+	return "ies"
+}
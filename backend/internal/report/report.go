@@ -0,0 +1,441 @@
+// Package report builds the fleet intelligence report: where incidents
+// cluster, what made deliveries late, how many arrived on time and how
+// much perishable cargo was at risk, each compared with the period before.
+// It works on rows the caller loads, so it can be built for any period.
+package report
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"agri-track/internal/geo"
+)
+
+// Deliveries without a window are planned at this speed over the
+// straight-line distance stretched by roadFactor, plus handoverAllowance
+// for loading and unloading. Slower than that is late.
+const (
+	plannedSpeedKmh   = 40.0
+	roadFactor        = 1.3
+	handoverAllowance = time.Hour
+)
+
+// Incidents at least this severe put perishable cargo at risk
+const seriousSeverity = 3
+
+// MaxHotspots is how many places the report lists.
+const MaxHotspots = 5
+
+// Unexplained is the delay cause of late deliveries without incidents.
+const Unexplained = "UNEXPLAINED"
+
+// Cargo types that spoil when held up
+var perishable = map[string]bool{
+	"chilled":   true,
+	"livestock": true,
+}
+
+// Shipment is what the report needs to know about a shipment.
+type Shipment struct {
+	ID          string
+	Commodity   string
+	CargoType   string
+	Status      string
+	CargoValue  *float64 // Declared by the shipper, in naira
+	Origin      geo.Point
+	Dest        geo.Point
+	StartedAt   *time.Time
+	CompletedAt *time.Time
+	DeliverBy   *time.Time // End of the delivery window, nil without one
+}
+
+// Incident is a reported incident.
+type Incident struct {
+	ShipmentID  string
+	Time        time.Time
+	Type        string
+	Severity    int
+	Point       geo.Point
+	Place       string // From the gazetteer, empty when unknown
+	Description string
+}
+
+// Speed is a truck's average speed over an hour, from avg_speed_hourly.
+type Speed struct {
+	Bucket time.Time
+	Kmh    float64
+}
+
+// Input is everything a report is built from. Shipments, incidents and
+// speeds have to cover the previous period too, From minus the period's
+// length, for the trends.
+type Input struct {
+	Title     string
+	From, To  time.Time
+	Location  *time.Location // Times are shown in this zone
+	Shipments []Shipment
+	Incidents []Incident
+	Speeds    []Speed
+}
+
+// Report is the built report.
+type Report struct {
+	Title       string       `json:"title"`
+	From        time.Time    `json:"from"`
+	To          time.Time    `json:"to"`
+	Figures     Figures      `json:"figures"`
+	Previous    Figures      `json:"previous"`
+	Trends      []Trend      `json:"trends"`
+	Hotspots    []Hotspot    `json:"hotspots"`
+	Delays      []DelayCause `json:"delays"`
+	Exposure    Exposure     `json:"exposure"`
+	TimeZone    string       `json:"time_zone"` // Of the times in the Markdown
+	GeneratedAt time.Time    `json:"generated_at"`
+}
+
+// Figures sum up a period.
+type Figures struct {
+	Deliveries      int            `json:"deliveries"`
+	OnTime          int            `json:"on_time"`
+	Late            int            `json:"late"`
+	OnTimeRate      *float64       `json:"on_time_rate"` // Share of timed deliveries, nil without any
+	DelayHours      float64        `json:"delay_hours"`
+	Incidents       int            `json:"incidents"`
+	IncidentsByType map[string]int `json:"incidents_by_type"`
+	AvgSpeedKmh     *float64       `json:"avg_speed_kmh"`
+	ValueAtRisk     float64        `json:"value_at_risk"`
+}
+
+// Trend compares a figure with the previous period. Change is relative,
+// nil when the previous period had nothing to compare with.
+type Trend struct {
+	Metric   string   `json:"metric"`
+	Current  float64  `json:"current"`
+	Previous float64  `json:"previous"`
+	Change   *float64 `json:"change"`
+}
+
+// Hotspot is a place where incidents cluster.
+type Hotspot struct {
+	Place     string         `json:"place"`
+	Point     geo.Point      `json:"point"` // Average of the incidents
+	Incidents int            `json:"incidents"`
+	Severity  int            `json:"severity"` // Sum over the incidents
+	Types     map[string]int `json:"types"`
+}
+
+// DelayCause is how much of the lateness of deliveries is put down to a
+// kind of incident. A late delivery's delay is split between the incidents
+// on its trip by severity.
+type DelayCause struct {
+	Cause      string  `json:"cause"`
+	Hours      float64 `json:"hours"`
+	Deliveries int     `json:"deliveries"`
+}
+
+// Exposure is the perishable cargo held up in the period: delivered late,
+// overdue on the road, or hit by a serious incident.
+type Exposure struct {
+	Value       float64             `json:"value"`
+	Shipments   int                 `json:"shipments"`
+	Unvalued    int                 `json:"unvalued"` // Shipments without a declared value
+	Commodities []CommodityExposure `json:"commodities"`
+}
+
+// CommodityExposure is the exposure of one commodity.
+type CommodityExposure struct {
+	Commodity string  `json:"commodity"`
+	Value     float64 `json:"value"`
+	Shipments int     `json:"shipments"`
+}
+
+// ExpectedDuration is how long a trip between two points is planned to take.
+func ExpectedDuration(origin, dest geo.Point) time.Duration {
+	km := geo.Haversine(origin, dest) / 1000 * roadFactor
+	return time.Duration(km/plannedSpeedKmh*float64(time.Hour)) + handoverAllowance
+}
+
+// Delay is how late a shipment was delivered, or is by now if it is still
+// on the road: past the end of its window if it has one, the planned
+// duration otherwise. It is zero for shipments on time or not picked up.
+func (s Shipment) Delay(now time.Time) time.Duration {
+	if s.StartedAt == nil {
+		return 0
+	}
+	end := now
+	if s.CompletedAt != nil {
+		end = *s.CompletedAt
+	}
+	if s.DeliverBy != nil {
+		return max(end.Sub(*s.DeliverBy), 0)
+	}
+	return max(end.Sub(*s.StartedAt)-ExpectedDuration(s.Origin, s.Dest), 0)
+}
+
+// Build builds the report for in.From to in.To, as of now.
+func Build(in Input, now time.Time) Report {
+	loc := in.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	prevFrom := in.From.Add(-in.To.Sub(in.From))
+
+	r := Report{
+		Title:       in.Title,
+		From:        in.From,
+		To:          in.To,
+		Hotspots:    []Hotspot{},
+		Delays:      []DelayCause{},
+		TimeZone:    loc.String(),
+		GeneratedAt: now,
+	}
+	var exposure Exposure
+	r.Figures = figures(in, in.From, in.To, now, &exposure)
+	r.Previous = figures(in, prevFrom, in.From, in.From, nil)
+	r.Exposure = exposure
+	r.Trends = trends(r.Figures, r.Previous)
+	r.Hotspots = hotspots(in.Incidents, in.From, in.To)
+	r.Delays = delays(in, in.From, in.To)
+	return r
+}
+
+func within(t, from, to time.Time) bool {
+	return !t.Before(from) && t.Before(to)
+}
+
+// figures sums up from to to as it stood at asOf, and fills in exposure
+// if it is given.
+func figures(in Input, from, to, asOf time.Time, exposure *Exposure) Figures {
+	f := Figures{IncidentsByType: map[string]int{}}
+
+	serious := map[string]bool{}
+	for _, i := range in.Incidents {
+		if !within(i.Time, from, to) {
+			continue
+		}
+		f.Incidents++
+		f.IncidentsByType[i.Type]++
+		if i.Severity >= seriousSeverity {
+			serious[i.ShipmentID] = true
+		}
+	}
+
+	commodities := map[string]*CommodityExposure{}
+	for _, s := range in.Shipments {
+		delivered := s.CompletedAt != nil && within(*s.CompletedAt, from, to)
+		if delivered {
+			f.Deliveries++
+		}
+		late := false
+		if delivered && s.StartedAt != nil {
+			if delay := s.Delay(asOf); delay > 0 {
+				f.Late++
+				f.DelayHours += delay.Hours()
+				late = true
+			} else {
+				f.OnTime++
+			}
+		}
+		// Shipments still on the road at the end of the period
+		onRoad := s.StartedAt != nil && s.StartedAt.Before(to) && (s.CompletedAt == nil || !s.CompletedAt.Before(to)) &&
+			s.Status != "CANCELLED"
+		overdue := onRoad && asOf.Sub(*s.StartedAt) > ExpectedDuration(s.Origin, s.Dest)
+		if onRoad && s.DeliverBy != nil {
+			overdue = asOf.After(*s.DeliverBy)
+		}
+
+		if !perishable[s.CargoType] || !(late || overdue || serious[s.ID]) {
+			continue
+		}
+		if s.CargoValue != nil {
+			f.ValueAtRisk += *s.CargoValue
+		}
+		if exposure == nil {
+			continue
+		}
+		exposure.Shipments++
+		commodity := s.Commodity
+		if commodity == "" {
+			commodity = "unspecified"
+		}
+		c := commodities[commodity]
+		if c == nil {
+			c = &CommodityExposure{Commodity: commodity}
+			commodities[commodity] = c
+		}
+		c.Shipments++
+		if s.CargoValue == nil {
+			exposure.Unvalued++
+			continue
+		}
+		exposure.Value += *s.CargoValue
+		c.Value += *s.CargoValue
+	}
+	if timed := f.OnTime + f.Late; timed > 0 {
+		rate := float64(f.OnTime) / float64(timed)
+		f.OnTimeRate = &rate
+	}
+
+	var sum float64
+	var n int
+	for _, s := range in.Speeds {
+		if within(s.Bucket, from, to) {
+			sum += s.Kmh
+			n++
+		}
+	}
+	if n > 0 {
+		avg := sum / float64(n)
+		f.AvgSpeedKmh = &avg
+	}
+
+	if exposure != nil {
+		exposure.Commodities = []CommodityExposure{}
+		for _, c := range commodities {
+			exposure.Commodities = append(exposure.Commodities, *c)
+		}
+		sort.Slice(exposure.Commodities, func(i, j int) bool {
+			a, b := exposure.Commodities[i], exposure.Commodities[j]
+			if a.Value != b.Value {
+				return a.Value > b.Value
+			}
+			return a.Commodity < b.Commodity
+		})
+	}
+	return f
+}
+
+// Trend metrics
+const (
+	MetricDeliveries  = "deliveries"
+	MetricOnTimeRate  = "on_time_rate"
+	MetricIncidents   = "incidents"
+	MetricAvgSpeed    = "avg_speed_kmh"
+	MetricValueAtRisk = "value_at_risk"
+)
+
+func trends(cur, prev Figures) []Trend {
+	trend := func(metric string, c, p float64) Trend {
+		t := Trend{Metric: metric, Current: c, Previous: p}
+		if p != 0 {
+			change := (c - p) / p
+			t.Change = &change
+		}
+		return t
+	}
+	list := []Trend{
+		trend(MetricDeliveries, float64(cur.Deliveries), float64(prev.Deliveries)),
+		trend(MetricIncidents, float64(cur.Incidents), float64(prev.Incidents)),
+		trend(MetricValueAtRisk, cur.ValueAtRisk, prev.ValueAtRisk),
+	}
+	// Rates and averages are only compared when both periods have one
+	if cur.OnTimeRate != nil && prev.OnTimeRate != nil {
+		list = append(list, trend(MetricOnTimeRate, *cur.OnTimeRate, *prev.OnTimeRate))
+	}
+	if cur.AvgSpeedKmh != nil && prev.AvgSpeedKmh != nil {
+		list = append(list, trend(MetricAvgSpeed, *cur.AvgSpeedKmh, *prev.AvgSpeedKmh))
+	}
+	return list
+}
+
+// hotspots groups incidents by the place they were reported at. Incidents
+// without a place name are grouped on a grid of about 5 km.
+func hotspots(incidents []Incident, from, to time.Time) []Hotspot {
+	byPlace := map[string]*Hotspot{}
+	var order []string
+	for _, i := range incidents {
+		if !within(i.Time, from, to) {
+			continue
+		}
+		place := i.Place
+		if place == "" {
+			place = fmt.Sprintf("%.2f, %.2f", math.Round(i.Point.Lat*20)/20, math.Round(i.Point.Lon*20)/20)
+		}
+		h := byPlace[place]
+		if h == nil {
+			h = &Hotspot{Place: place, Types: map[string]int{}}
+			byPlace[place] = h
+			order = append(order, place)
+		}
+		h.Incidents++
+		h.Severity += i.Severity
+		h.Types[i.Type]++
+		// Running average of the position
+		h.Point.Lat += (i.Point.Lat - h.Point.Lat) / float64(h.Incidents)
+		h.Point.Lon += (i.Point.Lon - h.Point.Lon) / float64(h.Incidents)
+	}
+
+	list := make([]Hotspot, 0, len(order))
+	for _, place := range order {
+		list = append(list, *byPlace[place])
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Incidents != list[j].Incidents {
+			return list[i].Incidents > list[j].Incidents
+		}
+		return list[i].Severity > list[j].Severity
+	})
+	return list[:min(len(list), MaxHotspots)]
+}
+
+// delays puts the lateness of deliveries in the period down to the
+// incidents on their trips.
+func delays(in Input, from, to time.Time) []DelayCause {
+	onTrip := map[string][]Incident{}
+	for _, i := range in.Incidents {
+		onTrip[i.ShipmentID] = append(onTrip[i.ShipmentID], i)
+	}
+
+	causes := map[string]*DelayCause{}
+	add := func(cause string, hours float64, counted map[string]bool) {
+		c := causes[cause]
+		if c == nil {
+			c = &DelayCause{Cause: cause}
+			causes[cause] = c
+		}
+		c.Hours += hours
+		if !counted[cause] {
+			c.Deliveries++
+			counted[cause] = true
+		}
+	}
+	for _, s := range in.Shipments {
+		if s.CompletedAt == nil || !within(*s.CompletedAt, from, to) {
+			continue
+		}
+		delay := s.Delay(*s.CompletedAt)
+		if delay <= 0 {
+			continue
+		}
+		var trip []Incident
+		var severity int
+		for _, i := range onTrip[s.ID] {
+			if within(i.Time, *s.StartedAt, s.CompletedAt.Add(time.Nanosecond)) {
+				trip = append(trip, i)
+				severity += max(i.Severity, 1)
+			}
+		}
+		counted := map[string]bool{}
+		if len(trip) == 0 {
+			add(Unexplained, delay.Hours(), counted)
+			continue
+		}
+		for _, i := range trip {
+			add(i.Type, delay.Hours()*float64(max(i.Severity, 1))/float64(severity), counted)
+		}
+	}
+
+	list := make([]DelayCause, 0, len(causes))
+	for _, c := range causes {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Hours != list[j].Hours {
+			return list[i].Hours > list[j].Hours
+		}
+		return list[i].Cause < list[j].Cause
+	})
+	return list
+}
@@ -0,0 +1,281 @@
+package report
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"agri-track/internal/geo"
+)
+
+// Below this a truck counts as stopped, in km/h
+const stoppedSpeed = 5.0
+
+// Longer gaps between fixes are lost signal, not time stopped
+const maxFixGap = 30 * time.Minute
+
+// Trip outcomes
+const (
+	NotStarted = "not_started"
+	InTransit  = "in_transit"
+	OnTime     = "on_time"
+	Late       = "late"
+)
+
+// Fix is a GPS fix of a trip.
+type Fix struct {
+	Time  time.Time
+	Point geo.Point
+	Speed float64 // km/h
+}
+
+// TripInput is everything a trip report is built from.
+type TripInput struct {
+	Shipment          Shipment
+	CreatedAt         time.Time
+	NearDestinationAt *time.Time
+	OriginPlace       string
+	DestPlace         string
+	Plate             string
+	WeightKg          *float64
+	Fixes             []Fix    // In time order
+	RoadDistanceM     *float64 // Of the track matched to the roads, when it has been
+	Incidents         []Incident
+	Location          *time.Location // Times are shown in this zone
+}
+
+// Trip is the report of one shipment's journey, for the shipper and
+// their insurer.
+type Trip struct {
+	Title             string         `json:"title"`
+	ShipmentID        string         `json:"shipment_id"`
+	Commodity         string         `json:"commodity"`
+	CargoType         string         `json:"cargo_type"`
+	CargoValue        *float64       `json:"cargo_value"`
+	WeightKg          *float64       `json:"weight_kg"`
+	Status            string         `json:"status"`
+	Outcome           string         `json:"outcome"`
+	Plate             string         `json:"plate"`
+	Origin            string         `json:"origin"`
+	Destination       string         `json:"destination"`
+	CreatedAt         time.Time      `json:"created_at"`
+	StartedAt         *time.Time     `json:"started_at"`
+	NearDestinationAt *time.Time     `json:"near_destination_at"`
+	CompletedAt       *time.Time     `json:"completed_at"`
+	DistanceKm        float64        `json:"distance_km"`
+	RoadMatched       bool           `json:"road_matched"` // Distance along the roads rather than between fixes
+	DurationMinutes   *float64       `json:"duration_minutes"`
+	PlannedMinutes    float64        `json:"planned_minutes"`
+	DelayMinutes      float64        `json:"delay_minutes"`
+	AvgSpeedKmh       *float64       `json:"avg_speed_kmh"` // While moving
+	MaxSpeedKmh       *float64       `json:"max_speed_kmh"`
+	StoppedMinutes    float64        `json:"stopped_minutes"`
+	Fixes             int            `json:"fixes"`
+	Incidents         []TripIncident `json:"incidents"`
+	TimeZone          string         `json:"time_zone"` // Of the times in the Markdown
+	GeneratedAt       time.Time      `json:"generated_at"`
+}
+
+// TripIncident is an incident on the trip.
+type TripIncident struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Severity    int       `json:"severity"`
+	Place       string    `json:"place"`
+	Description string    `json:"description"`
+}
+
+// BuildTrip builds the trip report as of now.
+func BuildTrip(in TripInput, now time.Time) Trip {
+	loc := in.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	s := in.Shipment
+	t := Trip{
+		ShipmentID:        s.ID,
+		Commodity:         s.Commodity,
+		CargoType:         s.CargoType,
+		CargoValue:        s.CargoValue,
+		WeightKg:          in.WeightKg,
+		Status:            s.Status,
+		Plate:             in.Plate,
+		Origin:            placeOr(in.OriginPlace, s.Origin),
+		Destination:       placeOr(in.DestPlace, s.Dest),
+		CreatedAt:         in.CreatedAt,
+		StartedAt:         s.StartedAt,
+		NearDestinationAt: in.NearDestinationAt,
+		CompletedAt:       s.CompletedAt,
+		PlannedMinutes:    ExpectedDuration(s.Origin, s.Dest).Minutes(),
+		Fixes:             len(in.Fixes),
+		Incidents:         []TripIncident{},
+		TimeZone:          loc.String(),
+		GeneratedAt:       now,
+	}
+	commodity := s.Commodity
+	if commodity == "" {
+		commodity = "Cargo"
+	}
+	t.Title = fmt.Sprintf("Trip Report: %s, shipment %s", strings.ToUpper(commodity[:1])+commodity[1:], s.ID[:min(len(s.ID), 8)])
+
+	switch {
+	case s.StartedAt == nil:
+		t.Outcome = NotStarted
+	case s.CompletedAt == nil:
+		t.Outcome = InTransit
+	case s.Delay(now) > 0:
+		t.Outcome = Late
+	default:
+		t.Outcome = OnTime
+	}
+	if s.StartedAt != nil {
+		end := now
+		if s.CompletedAt != nil {
+			end = *s.CompletedAt
+		}
+		duration := end.Sub(*s.StartedAt).Minutes()
+		t.DurationMinutes = &duration
+		t.DelayMinutes = s.Delay(now).Minutes()
+	}
+
+	var moving, top float64
+	var movingFixes int
+	for i, f := range in.Fixes {
+		if i > 0 {
+			prev := in.Fixes[i-1]
+			t.DistanceKm += geo.Haversine(prev.Point, f.Point) / 1000
+			if gap := f.Time.Sub(prev.Time); prev.Speed < stoppedSpeed && f.Speed < stoppedSpeed && gap <= maxFixGap {
+				t.StoppedMinutes += gap.Minutes()
+			}
+		}
+		if f.Speed >= stoppedSpeed {
+			moving += f.Speed
+			movingFixes++
+		}
+		top = max(top, f.Speed)
+	}
+	if in.RoadDistanceM != nil {
+		t.DistanceKm = *in.RoadDistanceM / 1000
+		t.RoadMatched = true
+	}
+	if movingFixes > 0 {
+		avg := moving / float64(movingFixes)
+		t.AvgSpeedKmh = &avg
+	}
+	if len(in.Fixes) > 0 {
+		t.MaxSpeedKmh = &top
+	}
+
+	for _, i := range in.Incidents {
+		t.Incidents = append(t.Incidents, TripIncident{
+			Time: i.Time, Type: i.Type, Severity: i.Severity, Place: placeOr(i.Place, i.Point), Description: i.Description,
+		})
+	}
+	return t
+}
+
+func placeOr(place string, p geo.Point) string {
+	if place != "" {
+		return place
+	}
+	return fmt.Sprintf("%.4f, %.4f", p.Lat, p.Lon)
+}
+
+// minutes formats a duration like "2 h 05 min".
+func minutes(m float64) string {
+	total := int(m + 0.5)
+	if total < 60 {
+		return fmt.Sprintf("%d min", total)
+	}
+	return fmt.Sprintf("%d h %02d min", total/60, total%60)
+}
+
+// Markdown renders the trip report.
+func (t Trip) Markdown() string {
+	loc, err := time.LoadLocation(t.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	stamp := func(at *time.Time) string {
+		if at == nil {
+			return "-"
+		}
+		return at.In(loc).Format("2 Jan 2006 15:04 MST")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", t.Title)
+	fmt.Fprintf(&b, "**Generated:** %s\n\n", stamp(&t.GeneratedAt))
+
+	b.WriteString("## Shipment\n")
+	fmt.Fprintf(&b, "- **Shipment:** %s\n", t.ShipmentID)
+	if t.Commodity != "" {
+		fmt.Fprintf(&b, "- **Commodity:** %s (%s cargo)\n", t.Commodity, t.CargoType)
+	} else {
+		fmt.Fprintf(&b, "- **Cargo:** %s\n", t.CargoType)
+	}
+	if t.WeightKg != nil {
+		fmt.Fprintf(&b, "- **Weight:** %s kg\n", thousands(*t.WeightKg))
+	}
+	if t.CargoValue != nil {
+		fmt.Fprintf(&b, "- **Declared value:** %s\n", Naira(*t.CargoValue))
+	}
+	if t.Plate != "" {
+		fmt.Fprintf(&b, "- **Truck:** %s\n", t.Plate)
+	}
+	fmt.Fprintf(&b, "- **From:** %s\n", t.Origin)
+	fmt.Fprintf(&b, "- **To:** %s\n", t.Destination)
+	switch t.Outcome {
+	case NotStarted:
+		b.WriteString("- **Status:** Waiting for pickup\n")
+	case InTransit:
+		fmt.Fprintf(&b, "- **Status:** On the way")
+		if t.DelayMinutes > 0 {
+			fmt.Fprintf(&b, ", %s behind plan", minutes(t.DelayMinutes))
+		}
+		b.WriteString("\n")
+	case Late:
+		fmt.Fprintf(&b, "- **Status:** Delivered %s late\n", minutes(t.DelayMinutes))
+	case OnTime:
+		b.WriteString("- **Status:** Delivered on time\n")
+	}
+
+	b.WriteString("\n## Timeline\n")
+	b.WriteString("| Event | Time |\n|---|---|\n")
+	fmt.Fprintf(&b, "| Created | %s |\n", stamp(&t.CreatedAt))
+	fmt.Fprintf(&b, "| Picked up | %s |\n", stamp(t.StartedAt))
+	fmt.Fprintf(&b, "| Near destination | %s |\n", stamp(t.NearDestinationAt))
+	fmt.Fprintf(&b, "| Delivered | %s |\n", stamp(t.CompletedAt))
+
+	b.WriteString("\n## Journey\n")
+	source := "between GPS fixes"
+	if t.RoadMatched {
+		source = "along the roads"
+	}
+	fmt.Fprintf(&b, "- **Distance:** %.1f km %s\n", t.DistanceKm, source)
+	if t.DurationMinutes != nil {
+		fmt.Fprintf(&b, "- **Time on the road:** %s, planned %s\n", minutes(*t.DurationMinutes), minutes(t.PlannedMinutes))
+	} else {
+		fmt.Fprintf(&b, "- **Planned time on the road:** %s\n", minutes(t.PlannedMinutes))
+	}
+	if t.AvgSpeedKmh != nil {
+		fmt.Fprintf(&b, "- **Average speed while moving:** %.0f km/h\n", *t.AvgSpeedKmh)
+	}
+	if t.MaxSpeedKmh != nil {
+		fmt.Fprintf(&b, "- **Top speed:** %.0f km/h\n", *t.MaxSpeedKmh)
+	}
+	fmt.Fprintf(&b, "- **Stopped:** %s\n", minutes(t.StoppedMinutes))
+	fmt.Fprintf(&b, "- **GPS fixes:** %d\n", t.Fixes)
+
+	b.WriteString("\n## Incidents\n")
+	if len(t.Incidents) == 0 {
+		b.WriteString("No incidents were reported.\n")
+		return b.String()
+	}
+	b.WriteString("| Time | Incident | Severity | Place | Note |\n|---|---|---:|---|---|\n")
+	for _, i := range t.Incidents {
+		note := strings.ReplaceAll(i.Description, "|", "/")
+		fmt.Fprintf(&b, "| %s | %s | %d | %s | %s |\n", i.Time.In(loc).Format("2 Jan 15:04"), causeName(i.Type), i.Severity, i.Place, note)
+	}
+	return b.String()
+}
@@ -0,0 +1,329 @@
+package roads
+
+import (
+	"context"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"agri-track/internal/geo"
+
+	"github.com/paulmach/osm"
+	"github.com/paulmach/osm/osmpbf"
+)
+
+// Truck speeds by highway class in km/h, allowing for the state of the
+// roads. Classes not listed, like footways, can't be driven.
+var speeds = map[string]float64{
+	"motorway":       80,
+	"motorway_link":  50,
+	"trunk":          70,
+	"trunk_link":     40,
+	"primary":        60,
+	"primary_link":   40,
+	"secondary":      50,
+	"secondary_link": 35,
+	"tertiary":       40,
+	"tertiary_link":  30,
+	"unclassified":   30,
+	"road":           25,
+	"residential":    25,
+	"living_street":  10,
+	"service":        15,
+	"track":          15, // Farm tracks, the first and last mile of most pickups
+}
+
+type edge struct {
+	to      int32
+	meters  float32
+	seconds float32
+}
+
+// Graph is a road network held in memory. It is safe for concurrent use.
+type Graph struct {
+	points   []geo.Point
+	first    []int32 // Edges leaving node i are edges[first[i]:first[i+1]]
+	edges    []edge
+	grid     map[cell][]int32 // Nodes of the main network by cell, to snap points to
+	segments map[cell][]int32 // Edges of the main network by the cells they cross, to match tracks to
+	maxSpeed float64          // Fastest edge in m/s, bounds the remaining time
+	searches sync.Pool
+}
+
+// Size returns the number of nodes and directed edges.
+func (g *Graph) Size() (int, int) {
+	return len(g.points), len(g.edges)
+}
+
+// Load builds the graph of the driveable roads in an .osm.pbf extract. The
+// file is read twice: first the roads, then the coordinates of their nodes.
+func Load(ctx context.Context, path string) (*Graph, error) {
+	b := newBuilder()
+
+	err := scan(ctx, path, func(s *osmpbf.Scanner) {
+		s.SkipNodes, s.SkipRelations = true, true
+		s.FilterWay = func(w *osm.Way) bool { return w.Tags.Find("highway") != "" }
+	}, func(o osm.Object) {
+		if w, ok := o.(*osm.Way); ok {
+			b.addWay(w)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.allocate()
+	err = scan(ctx, path, func(s *osmpbf.Scanner) {
+		s.SkipWays, s.SkipRelations = true, true
+		s.FilterNode = func(n *osm.Node) bool {
+			_, ok := b.index[n.ID]
+			return ok
+		}
+	}, func(o osm.Object) {
+		if n, ok := o.(*osm.Node); ok {
+			b.addNode(n)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.build(), nil
+}
+
+func scan(ctx context.Context, path string, setup func(*osmpbf.Scanner), each func(osm.Object)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := osmpbf.New(ctx, f, runtime.GOMAXPROCS(0))
+	defer s.Close()
+	setup(s)
+	for s.Scan() {
+		each(s.Object())
+	}
+	return s.Err()
+}
+
+// FromOSM builds the graph of the driveable roads in already decoded data,
+// such as a small .osm XML extract.
+func FromOSM(o *osm.OSM) *Graph {
+	b := newBuilder()
+	for _, w := range o.Ways {
+		b.addWay(w)
+	}
+	b.allocate()
+	for _, n := range o.Nodes {
+		b.addNode(n)
+	}
+	return b.build()
+}
+
+type way struct {
+	nodes             []osm.NodeID
+	speedKmh          float64
+	forward, backward bool
+}
+
+type builder struct {
+	ways   []way
+	index  map[osm.NodeID]int32
+	points []geo.Point
+	found  []bool // The extract may cut a road short, leaving nodes without coordinates
+}
+
+func newBuilder() *builder {
+	return &builder{index: make(map[osm.NodeID]int32)}
+}
+
+func (b *builder) addWay(w *osm.Way) {
+	speed, forward, backward, ok := profile(w.Tags)
+	if !ok || len(w.Nodes) < 2 {
+		return
+	}
+	ids := make([]osm.NodeID, len(w.Nodes))
+	for i, n := range w.Nodes {
+		ids[i] = n.ID
+		if _, seen := b.index[n.ID]; !seen {
+			b.index[n.ID] = int32(len(b.index))
+		}
+	}
+	b.ways = append(b.ways, way{nodes: ids, speedKmh: speed, forward: forward, backward: backward})
+}
+
+func (b *builder) allocate() {
+	b.points = make([]geo.Point, len(b.index))
+	b.found = make([]bool, len(b.index))
+}
+
+func (b *builder) addNode(n *osm.Node) {
+	if i, ok := b.index[n.ID]; ok {
+		b.points[i] = geo.Point{Lat: n.Lat, Lon: n.Lon}
+		b.found[i] = true
+	}
+}
+
+func (b *builder) build() *Graph {
+	type arc struct {
+		from int32
+		edge
+	}
+	var arcs []arc
+	g := &Graph{points: b.points}
+	for _, w := range b.ways {
+		mps := w.speedKmh / 3.6
+		g.maxSpeed = max(g.maxSpeed, mps)
+		for i := 1; i < len(w.nodes); i++ {
+			from, to := b.index[w.nodes[i-1]], b.index[w.nodes[i]]
+			if !b.found[from] || !b.found[to] {
+				continue
+			}
+			meters := geo.Haversine(b.points[from], b.points[to])
+			seconds := meters / mps
+			if w.forward {
+				arcs = append(arcs, arc{from, edge{to, float32(meters), float32(seconds)}})
+			}
+			if w.backward {
+				arcs = append(arcs, arc{to, edge{from, float32(meters), float32(seconds)}})
+			}
+		}
+	}
+	b.ways = nil
+
+	// Lay the edges out by node
+	g.first = make([]int32, len(g.points)+1)
+	for _, a := range arcs {
+		g.first[a.from+1]++
+	}
+	for i := 1; i < len(g.first); i++ {
+		g.first[i] += g.first[i-1]
+	}
+	g.edges = make([]edge, len(arcs))
+	next := append([]int32(nil), g.first[:len(g.points)]...)
+	for _, a := range arcs {
+		g.edges[next[a.from]] = a.edge
+		next[a.from]++
+	}
+
+	g.indexMainNetwork()
+	return g
+}
+
+// indexMainNetwork puts the nodes and edges of the largest connected network
+// on the grid, so points aren't snapped to a stray fragment no route can leave.
+func (g *Graph) indexMainNetwork() {
+	parent := make([]int32, len(g.points))
+	for i := range parent {
+		parent[i] = int32(i)
+	}
+	var find func(int32) int32
+	find = func(n int32) int32 {
+		for parent[n] != n {
+			parent[n] = parent[parent[n]]
+			n = parent[n]
+		}
+		return n
+	}
+	for from := range g.points {
+		for _, e := range g.edges[g.first[from]:g.first[from+1]] {
+			if a, b := find(int32(from)), find(e.to); a != b {
+				parent[a] = b
+			}
+		}
+	}
+
+	sizes := make(map[int32]int)
+	var main int32 = -1
+	for n := range g.points {
+		if g.first[n] == g.first[n+1] {
+			continue
+		}
+		root := find(int32(n))
+		sizes[root]++
+		if main < 0 || sizes[root] > sizes[main] {
+			main = root
+		}
+	}
+
+	g.grid = make(map[cell][]int32)
+	g.segments = make(map[cell][]int32)
+	for n, p := range g.points {
+		if main < 0 || find(int32(n)) != main {
+			continue
+		}
+		c := cellOf(p)
+		g.grid[c] = append(g.grid[c], int32(n))
+
+		for i := g.first[n]; i < g.first[n+1]; i++ {
+			to := cellOf(g.points[g.edges[i].to])
+			for lat := min(c.lat, to.lat); lat <= max(c.lat, to.lat); lat++ {
+				for lon := min(c.lon, to.lon); lon <= max(c.lon, to.lon); lon++ {
+					g.segments[cell{lat, lon}] = append(g.segments[cell{lat, lon}], i)
+				}
+			}
+		}
+	}
+}
+
+// profile reads how fast and in which directions a truck can drive a way.
+func profile(tags osm.Tags) (speedKmh float64, forward, backward, ok bool) {
+	speedKmh, ok = speeds[tags.Find("highway")]
+	if !ok {
+		return 0, false, false, false
+	}
+	// The most specific access tag given wins
+	for _, key := range []string{"access", "vehicle", "motor_vehicle", "hgv"} {
+		switch tags.Find(key) {
+		case "no", "private":
+			ok = false
+		case "yes", "designated", "permissive", "destination", "agricultural":
+			ok = true
+		}
+	}
+	if !ok {
+		return 0, false, false, false
+	}
+	if limit := parseMaxspeed(tags.Find("maxspeed")); limit > 0 && limit < speedKmh {
+		speedKmh = limit
+	}
+
+	switch tags.Find("oneway") {
+	case "yes", "true", "1":
+		return speedKmh, true, false, true
+	case "-1", "reverse":
+		return speedKmh, false, true, true
+	case "no":
+		return speedKmh, true, true, true
+	}
+	oneway := tags.Find("highway") == "motorway" || tags.Find("junction") == "roundabout"
+	return speedKmh, true, !oneway, true
+}
+
+// parseMaxspeed reads a maxspeed tag like "50" or "30 mph" as km/h, 0 if unknown.
+func parseMaxspeed(v string) float64 {
+	fields := strings.Fields(v)
+	if len(fields) == 0 {
+		return 0
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(fields[0], "mph"), 64)
+	if err != nil {
+		return 0
+	}
+	if strings.HasSuffix(v, "mph") {
+		speed *= 1.609
+	}
+	return speed
+}
+
+// Snapping grid cells are this many degrees on a side
+const cellDeg = 0.01
+
+type cell struct{ lat, lon int32 }
+
+func cellOf(p geo.Point) cell {
+	return cell{int32(math.Floor(p.Lat / cellDeg)), int32(math.Floor(p.Lon / cellDeg))}
+}
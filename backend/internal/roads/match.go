@@ -0,0 +1,241 @@
+package roads
+
+import (
+	"math"
+	"sort"
+
+	"agri-track/internal/geo"
+)
+
+// Map-matching model, after Newson and Krumm's hidden Markov model: a fix is
+// likely near the road the truck is on, and the road distance between two
+// fixes is likely close to the straight-line distance.
+const (
+	matchSigma      = 20.0  // GPS noise of a cheap tracker, in meters
+	matchRadius     = 100.0 // Roads farther than this from a fix aren't considered
+	matchBeta       = 10.0  // How much longer than straight the road between fixes tends to be, in meters
+	matchCandidates = 8     // Nearest roads considered per fix
+)
+
+// Match is a GPS track snapped to the roads.
+type Match struct {
+	Snapped   []*geo.Point // Where each fix lies on the road, nil for fixes far from any road
+	Points    []geo.Point  // Road geometry driven through the matched fixes
+	DistanceM float64
+}
+
+// Matcher snaps GPS tracks to roads, which takes a road network.
+type Matcher interface {
+	Match(track []geo.Point) (Match, error)
+}
+
+// candidate is a place on an edge a fix may have been taken at.
+type candidate struct {
+	edge  int32
+	frac  float64 // How far along the edge, 0 at its start and 1 at its end
+	point geo.Point
+	score float64 // Log probability of the best way to get here
+	back  int     // Candidate of the previous fix on that way, -1 at the start of a run
+}
+
+// Match finds the roads a truck most likely drove to produce track. Fixes
+// too close to the previous one to tell apart are given its position. When
+// no road joins two fixes, like after a gap in reception, matching restarts
+// and the gap counts as a straight line.
+func (g *Graph) Match(track []geo.Point) (Match, error) {
+	m := Match{Snapped: make([]*geo.Point, len(track))}
+
+	// Viterbi over the fixes with candidates
+	var steps [][]candidate
+	var fixes []int
+	last := -1
+	for i, p := range track {
+		if last >= 0 && geo.Haversine(track[last], p) < 2*matchSigma {
+			continue
+		}
+		cands := g.candidates(p)
+		if len(cands) == 0 {
+			continue
+		}
+		if len(steps) > 0 {
+			g.transition(steps[len(steps)-1], cands, geo.Haversine(track[last], p))
+		}
+		steps = append(steps, cands)
+		fixes = append(fixes, i)
+		last = i
+	}
+	if len(steps) == 0 {
+		return m, ErrOffRoad
+	}
+
+	// Follow the best candidates back from the end, run by run
+	chosen := make([]int, len(steps))
+	best := func(cands []candidate) int {
+		b := 0
+		for j := range cands {
+			if cands[j].score > cands[b].score {
+				b = j
+			}
+		}
+		return b
+	}
+	chosen[len(steps)-1] = best(steps[len(steps)-1])
+	for k := len(steps) - 1; k > 0; k-- {
+		if back := steps[k][chosen[k]].back; back >= 0 {
+			chosen[k-1] = back
+		} else {
+			chosen[k-1] = best(steps[k-1])
+		}
+	}
+
+	for k, step := range steps {
+		c := step[chosen[k]]
+		if k == 0 {
+			m.Points = append(m.Points, c.point)
+		} else {
+			prev := steps[k-1][chosen[k-1]]
+			if c.back >= 0 {
+				meters, nodes := g.between(prev, c)
+				m.DistanceM += meters
+				for _, n := range nodes {
+					m.Points = append(m.Points, g.points[n])
+				}
+			} else {
+				m.DistanceM += geo.Haversine(prev.point, c.point)
+			}
+			m.Points = append(m.Points, c.point)
+		}
+
+		// Fixes skipped after this one were taken about here
+		end := len(track)
+		if k+1 < len(fixes) {
+			end = fixes[k+1]
+		}
+		point := c.point
+		for i := fixes[k]; i < end; i++ {
+			if i == fixes[k] || geo.Haversine(track[fixes[k]], track[i]) < 2*matchSigma {
+				m.Snapped[i] = &point
+			}
+		}
+	}
+	return m, nil
+}
+
+// candidates returns the nearest places on the roads around p.
+func (g *Graph) candidates(p geo.Point) []candidate {
+	center := cellOf(p)
+	seen := make(map[int32]bool)
+	var cands []candidate
+	var dists []float64
+	for lat := center.lat - 1; lat <= center.lat+1; lat++ {
+		for lon := center.lon - 1; lon <= center.lon+1; lon++ {
+			for _, i := range g.segments[cell{lat, lon}] {
+				if seen[i] {
+					continue
+				}
+				seen[i] = true
+				a, b := g.points[g.tail(i)], g.points[g.edges[i].to]
+				t, off := geo.Project(p, a, b)
+				if off > matchRadius {
+					continue
+				}
+				at := geo.Point{Lat: a.Lat + (b.Lat-a.Lat)*t, Lon: a.Lon + (b.Lon-a.Lon)*t}
+				// Emission: how likely the fix is this far off the road
+				score := -0.5 * (off / matchSigma) * (off / matchSigma)
+				cands = append(cands, candidate{edge: i, frac: t, point: at, score: score, back: -1})
+				dists = append(dists, off)
+			}
+		}
+	}
+
+	sort.Sort(byDistance{cands, dists})
+	if len(cands) > matchCandidates {
+		cands = cands[:matchCandidates]
+	}
+	return cands
+}
+
+// transition scores each candidate of a fix by the best way to reach it from
+// the candidates of the previous fix, straight meters away. Candidates no
+// road reaches in reason start a new run.
+func (g *Graph) transition(prev, next []candidate, straight float64) {
+	// Trucks don't drive several times the straight distance between fixes
+	limit := 2*straight + 2*matchRadius + 500
+
+	best := make([]float64, len(next))
+	for j := range next {
+		best[j] = math.Inf(-1)
+	}
+	targets := make([]int32, len(next))
+	for j, to := range next {
+		targets[j] = g.tail(to.edge)
+	}
+	for i, from := range prev {
+		fromEdge := g.edges[from.edge]
+		road := g.distancesFrom(fromEdge.to, targets, limit)
+		for j, to := range next {
+			var meters float64
+			if from.edge == to.edge && to.frac >= from.frac {
+				meters = (to.frac - from.frac) * float64(fromEdge.meters)
+			} else {
+				// To the end of this edge, over the roads, then along the next one
+				meters = (1-from.frac)*float64(fromEdge.meters) + road[targets[j]] + to.frac*float64(g.edges[to.edge].meters)
+			}
+			if math.IsInf(meters, 1) {
+				continue
+			}
+			score := from.score - math.Abs(meters-straight)/matchBeta
+			if score > best[j] {
+				best[j], next[j].back = score, i
+			}
+		}
+	}
+
+	connected := false
+	for j := range next {
+		if next[j].back >= 0 {
+			next[j].score += best[j]
+			connected = true
+		}
+	}
+	if !connected {
+		return
+	}
+	// Once any candidate continues the run, the rest can't start a new one
+	for j := range next {
+		if next[j].back < 0 {
+			next[j].score = math.Inf(-1)
+		}
+	}
+}
+
+// between returns the road distance from one candidate to another and the
+// nodes driven through.
+func (g *Graph) between(from, to candidate) (float64, []int32) {
+	fromEdge, toEdge := g.edges[from.edge], g.edges[to.edge]
+	if from.edge == to.edge && to.frac >= from.frac {
+		return (to.frac - from.frac) * float64(fromEdge.meters), nil
+	}
+
+	meters := (1-from.frac)*float64(fromEdge.meters) + to.frac*float64(toEdge.meters)
+	src := fromEdge.to
+	used, _ := g.astar(src, g.tail(to.edge), Shortest)
+	nodes := []int32{src}
+	for _, i := range used {
+		meters += float64(g.edges[i].meters)
+		nodes = append(nodes, g.edges[i].to)
+	}
+	return meters, nodes
+}
+
+type byDistance struct {
+	cands []candidate
+	dists []float64
+}
+
+func (b byDistance) Len() int           { return len(b.cands) }
+func (b byDistance) Less(i, j int) bool { return b.dists[i] < b.dists[j] }
+func (b byDistance) Swap(i, j int) {
+	b.cands[i], b.cands[j] = b.cands[j], b.cands[i]
+	b.dists[i], b.dists[j] = b.dists[j], b.dists[i]
+}
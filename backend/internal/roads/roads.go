@@ -0,0 +1,101 @@
+// Package roads finds paths for trucks over the road network. A Graph is
+// built from a local OpenStreetMap extract and kept in memory; without one,
+// Straight estimates paths from the straight line.
+package roads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"agri-track/internal/geo"
+)
+
+// Used when no road network is loaded, or no road connects two points
+const (
+	DefaultDetour   = 1.3 // Roads are never straight
+	DefaultSpeedKmh = 50
+)
+
+var (
+	ErrOffRoad  = errors.New("point is too far from any road")
+	ErrNoRoute  = errors.New("no road connects these points")
+	ErrBadMode  = errors.New("mode must be fastest or shortest")
+	defaultPath = Straight{Detour: DefaultDetour, SpeedKmh: DefaultSpeedKmh}
+)
+
+// Mode is what a path minimizes.
+type Mode int
+
+const (
+	Fastest Mode = iota
+	Shortest
+)
+
+// ParseMode reads "fastest" or "shortest", empty is fastest.
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "", "fastest":
+		return Fastest, nil
+	case "shortest":
+		return Shortest, nil
+	}
+	return Fastest, ErrBadMode
+}
+
+// Path is a way from one point to another.
+type Path struct {
+	DistanceM float64
+	Duration  time.Duration
+	Points    []geo.Point // Polyline from start to end
+}
+
+// Router finds paths between points. Distance makes every Router a
+// vrp.Metric.
+type Router interface {
+	Route(from, to geo.Point, mode Mode) (Path, error)
+	// Distance returns the length of the shortest path in meters, estimated
+	// when there is none.
+	Distance(a, b geo.Point) float64
+}
+
+// Straight goes in a straight line, stretched by Detour, at SpeedKmh.
+type Straight struct {
+	Detour   float64
+	SpeedKmh float64
+}
+
+func (s Straight) Route(from, to geo.Point, _ Mode) (Path, error) {
+	meters := s.Distance(from, to)
+	return Path{
+		DistanceM: meters,
+		Duration:  time.Duration(meters / (s.SpeedKmh / 3.6) * float64(time.Second)),
+		Points:    []geo.Point{from, to},
+	}, nil
+}
+
+func (s Straight) Distance(a, b geo.Point) float64 {
+	return geo.Haversine(a, b) * s.Detour
+}
+
+// FromEnv loads the OpenStreetMap extract at OSM_PBF_PATH, or falls back to
+// straight lines when it isn't set.
+func FromEnv(ctx context.Context) (Router, error) {
+	path := os.Getenv("OSM_PBF_PATH")
+	if path == "" {
+		log.Println("OSM_PBF_PATH not set, estimating routes from straight lines")
+		return defaultPath, nil
+	}
+
+	start := time.Now()
+	g, err := Load(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load road network from %s: %v", path, err)
+	}
+	nodes, edges := g.Size()
+	log.Printf("Loaded road network from %s in %s: %d nodes, %d edges", path, time.Since(start).Round(time.Second), nodes, edges)
+	return g, nil
+}
@@ -0,0 +1,286 @@
+package roads
+
+import (
+	"container/heap"
+	"math"
+	"time"
+
+	"agri-track/internal/geo"
+)
+
+const (
+	maxSnapMeters = 5000 // Farther than this from any road is off the map
+	offRoadKmh    = 15   // Speed from a point to the road it snaps to
+)
+
+// Route finds the fastest or shortest path by road between two points. Each
+// point is joined to its nearest road in a straight line.
+func (g *Graph) Route(from, to geo.Point, mode Mode) (Path, error) {
+	src, srcOff, err := g.snap(from)
+	if err != nil {
+		return Path{}, err
+	}
+	dst, dstOff, err := g.snap(to)
+	if err != nil {
+		return Path{}, err
+	}
+
+	used, ok := g.astar(src, dst, mode)
+	if !ok {
+		return Path{}, ErrNoRoute
+	}
+
+	offSeconds := (srcOff + dstOff) / (offRoadKmh / 3.6)
+	path := Path{DistanceM: srcOff + dstOff, Points: make([]geo.Point, 0, len(used)+3)}
+	seconds := offSeconds
+	path.Points = append(path.Points, from, g.points[src])
+	for _, i := range used {
+		e := g.edges[i]
+		path.DistanceM += float64(e.meters)
+		seconds += float64(e.seconds)
+		path.Points = append(path.Points, g.points[e.to])
+	}
+	path.Points = append(path.Points, to)
+	path.Duration = time.Duration(seconds * float64(time.Second))
+	return path, nil
+}
+
+// astar returns the edges of the best path from src to dst, in order.
+func (g *Graph) astar(src, dst int32, mode Mode) ([]int32, bool) {
+	s := g.search()
+	defer g.searches.Put(s)
+
+	cost := func(e edge) float64 {
+		if mode == Shortest {
+			return float64(e.meters)
+		}
+		return float64(e.seconds)
+	}
+	// Straight-line distance, or time at top speed, never overestimates
+	remaining := func(n int32) float64 {
+		d := geo.Haversine(g.points[n], g.points[dst])
+		if mode == Shortest {
+			return d
+		}
+		return d / g.maxSpeed
+	}
+
+	s.reach(src, 0, -1)
+	q := &queue{{node: src, cost: 0, key: remaining(src)}}
+	for q.Len() > 0 {
+		it := heap.Pop(q).(item)
+		if it.node == dst {
+			break
+		}
+		if it.cost > s.cost[it.node] {
+			continue
+		}
+		for i := g.first[it.node]; i < g.first[it.node+1]; i++ {
+			e := g.edges[i]
+			c := it.cost + cost(e)
+			if c < s.cost[e.to] {
+				s.reach(e.to, c, i)
+				heap.Push(q, item{node: e.to, cost: c, key: c + remaining(e.to)})
+			}
+		}
+	}
+	if math.IsInf(s.cost[dst], 1) {
+		return nil, false
+	}
+
+	// Walk back from the destination
+	var used []int32
+	for n := dst; n != src; {
+		i := s.via[n]
+		used = append(used, i)
+		n = g.tail(i)
+	}
+	for l, r := 0, len(used)-1; l < r; l, r = l+1, r-1 {
+		used[l], used[r] = used[r], used[l]
+	}
+	return used, true
+}
+
+// Distance returns the length of the shortest road path, or an estimate
+// from the straight line when there is none.
+func (g *Graph) Distance(a, b geo.Point) float64 {
+	path, err := g.Route(a, b, Shortest)
+	if err != nil {
+		return defaultPath.Distance(a, b)
+	}
+	return path.DistanceM
+}
+
+// Matrix returns the shortest road distance from every point to every other,
+// with one search per point. Pairs no road connects are estimated from the
+// straight line.
+func (g *Graph) Matrix(points []geo.Point) [][]float64 {
+	nodes := make([]int32, len(points))
+	offs := make([]float64, len(points))
+	for i, p := range points {
+		n, off, err := g.snap(p)
+		if err != nil {
+			n = -1
+		}
+		nodes[i], offs[i] = n, off
+	}
+
+	d := make([][]float64, len(points))
+	for i := range points {
+		d[i] = make([]float64, len(points))
+		cost := g.distancesFrom(nodes[i], nodes, math.Inf(1))
+		for j := range points {
+			switch {
+			case i == j:
+			case nodes[i] < 0 || nodes[j] < 0 || math.IsInf(cost[nodes[j]], 1):
+				d[i][j] = defaultPath.Distance(points[i], points[j])
+			default:
+				d[i][j] = offs[i] + cost[nodes[j]] + offs[j]
+			}
+		}
+	}
+	return d
+}
+
+// distancesFrom runs a shortest path search from src until every target is
+// settled or the search is limit meters out, and returns the distances to the
+// targets.
+func (g *Graph) distancesFrom(src int32, targets []int32, limit float64) map[int32]float64 {
+	out := make(map[int32]float64, len(targets))
+	pending := make(map[int32]bool, len(targets))
+	for _, t := range targets {
+		if t >= 0 {
+			out[t] = math.Inf(1)
+			pending[t] = true
+		}
+	}
+	if src < 0 {
+		return out
+	}
+
+	s := g.search()
+	defer g.searches.Put(s)
+	s.reach(src, 0, -1)
+	q := &queue{{node: src}}
+	for q.Len() > 0 && len(pending) > 0 {
+		it := heap.Pop(q).(item)
+		if it.cost > limit {
+			break
+		}
+		if it.cost > s.cost[it.node] {
+			continue
+		}
+		if pending[it.node] {
+			out[it.node] = it.cost
+			delete(pending, it.node)
+		}
+		for i := g.first[it.node]; i < g.first[it.node+1]; i++ {
+			e := g.edges[i]
+			c := it.cost + float64(e.meters)
+			if c < s.cost[e.to] {
+				s.reach(e.to, c, i)
+				heap.Push(q, item{node: e.to, cost: c, key: c})
+			}
+		}
+	}
+	return out
+}
+
+// snap returns the nearest node of the main network and how far away it is.
+func (g *Graph) snap(p geo.Point) (int32, float64, error) {
+	center := cellOf(p)
+	// Any node r rings out is at least this far away
+	ringMeters := cellDeg * math.Pi / 180 * geo.EarthRadius * math.Max(math.Cos(p.Lat*math.Pi/180), 0.01)
+
+	best, bestDist := int32(-1), math.Inf(1)
+	for r := int32(0); float64(r-1)*ringMeters <= maxSnapMeters; r++ {
+		if best >= 0 && float64(r-1)*ringMeters > bestDist {
+			break
+		}
+		for lat := center.lat - r; lat <= center.lat+r; lat++ {
+			for lon := center.lon - r; lon <= center.lon+r; lon++ {
+				// Only the ring, the inside was searched already
+				if lat != center.lat-r && lat != center.lat+r && lon != center.lon-r && lon != center.lon+r {
+					continue
+				}
+				for _, n := range g.grid[cell{lat, lon}] {
+					if d := geo.Haversine(p, g.points[n]); d < bestDist {
+						best, bestDist = n, d
+					}
+				}
+			}
+		}
+	}
+	if best < 0 || bestDist > maxSnapMeters {
+		return 0, 0, ErrOffRoad
+	}
+	return best, bestDist, nil
+}
+
+// search is the scratch state of one path search, reused between searches
+// since a country's road network has millions of nodes.
+type search struct {
+	cost    []float64
+	via     []int32 // Edge the node was reached by
+	touched []int32
+}
+
+func (g *Graph) search() *search {
+	if s, ok := g.searches.Get().(*search); ok {
+		s.reset()
+		return s
+	}
+	s := &search{cost: make([]float64, len(g.points)), via: make([]int32, len(g.points))}
+	for i := range s.cost {
+		s.cost[i] = math.Inf(1)
+	}
+	return s
+}
+
+func (s *search) reach(n int32, cost float64, via int32) {
+	if math.IsInf(s.cost[n], 1) {
+		s.touched = append(s.touched, n)
+	}
+	s.cost[n], s.via[n] = cost, via
+}
+
+func (s *search) reset() {
+	for _, n := range s.touched {
+		s.cost[n] = math.Inf(1)
+	}
+	s.touched = s.touched[:0]
+}
+
+// tail returns the node edge i leaves from.
+func (g *Graph) tail(i int32) int32 {
+	// first is sorted, find the last node whose edges start at or before i
+	lo, hi := 0, len(g.points)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if g.first[mid] <= i {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return int32(lo)
+}
+
+type item struct {
+	node int32
+	cost float64
+	key  float64 // Cost plus the estimate of what remains
+}
+
+type queue []item
+
+func (q queue) Len() int            { return len(q) }
+func (q queue) Less(i, j int) bool  { return q[i].key < q[j].key }
+func (q queue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *queue) Push(x interface{}) { *q = append(*q, x.(item)) }
+func (q *queue) Pop() interface{} {
+	old := *q
+	it := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return it
+}
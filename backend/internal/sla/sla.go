@@ -0,0 +1,235 @@
+// Package sla works out the delivery windows promised to buyers, whether
+// shipments kept them, and what made the late ones late.
+package sla
+
+import (
+	"sort"
+	"time"
+)
+
+// Outcomes of a delivery against its window
+const (
+	Early  = "early"
+	OnTime = "on_time"
+	Late   = "late"
+)
+
+// Delay reasons, besides the incident types that caused a stop
+const (
+	ReasonLatePickup  = "LATE_PICKUP"  // Collected after the pickup window closed
+	ReasonStopDwell   = "STOP_DWELL"   // Too long at the shipment's own stops
+	ReasonIdle        = "IDLE"         // Stopped on the road with nothing reported
+	ReasonSlow        = "SLOW_DRIVING" // Moving, just slowly
+	ReasonUnexplained = "UNEXPLAINED"  // No telemetry to tell
+)
+
+const (
+	stoppedSpeed   = 5.0              // km/h
+	maxFixGap      = 30 * time.Minute // Longer gaps are lost signal, not time stopped
+	stopAllowance  = 30 * time.Minute // To load or unload at a stop
+	incidentLeadIn = 15 * time.Minute // An incident explains a stop starting this soon after
+)
+
+// Policy is what an organization promises on a route: delivery within
+// TransitHours of pickup, and not more than WindowHours before that. A nil
+// place matches any.
+type Policy struct {
+	ID           int
+	OriginPlace  *string
+	DestPlace    *string
+	TransitHours float64
+	WindowHours  float64
+}
+
+// Match returns the policy for a shipment from origin to dest: one for the
+// exact route over one for either end, over the organization's default.
+// It returns nil if none applies.
+func Match(policies []Policy, origin, dest string) *Policy {
+	var best *Policy
+	bestScore := -1
+	for i, p := range policies {
+		score := 0
+		if p.OriginPlace != nil {
+			if *p.OriginPlace != origin {
+				continue
+			}
+			score++
+		}
+		if p.DestPlace != nil {
+			if *p.DestPlace != dest {
+				continue
+			}
+			score += 2 // Where it must arrive matters more than where it left
+		}
+		if score > bestScore || score == bestScore && p.ID < best.ID {
+			best, bestScore = &policies[i], score
+		}
+	}
+	return best
+}
+
+// Window is when a shipment is promised: by By, and not before From when
+// there is one.
+type Window struct {
+	From *time.Time
+	By   time.Time
+}
+
+// Window returns the window the policy promises for a pickup at pickedUp.
+func (p Policy) Window(pickedUp time.Time) Window {
+	w := Window{By: pickedUp.Add(time.Duration(p.TransitHours * float64(time.Hour)))}
+	if p.WindowHours > 0 {
+		from := w.By.Add(-time.Duration(p.WindowHours * float64(time.Hour)))
+		if from.After(pickedUp) {
+			w.From = &from
+		}
+	}
+	return w
+}
+
+// Classify returns whether a delivery at deliveredAt was early, on time
+// or late.
+func (w Window) Classify(deliveredAt time.Time) string {
+	switch {
+	case deliveredAt.After(w.By):
+		return Late
+	case w.From != nil && deliveredAt.Before(*w.From):
+		return Early
+	default:
+		return OnTime
+	}
+}
+
+// Fix is a GPS fix of the trip.
+type Fix struct {
+	Time  time.Time
+	Speed float64 // km/h
+}
+
+// Stop is a visit to one of the shipment's stops.
+type Stop struct {
+	Arrived  time.Time
+	Departed time.Time
+}
+
+type Incident struct {
+	Time     time.Time
+	Type     string
+	Severity int
+}
+
+// Trip is what a delay is attributed from.
+type Trip struct {
+	PickupUntil *time.Time
+	StartedAt   time.Time
+	Fixes       []Fix // In time order
+	Stops       []Stop
+	Incidents   []Incident
+}
+
+// Attribute finds what made a trip late, and how long each cause held it
+// up. Time stopped on the road goes to an incident reported as the stop
+// began or during it, or counts as idle. Time at the shipment's stops
+// beyond what loading takes counts as dwell. With no time lost to any of
+// these, the most severe incident is the reason, or slow driving.
+func Attribute(t Trip) (string, map[string]time.Duration) {
+	causes := map[string]time.Duration{}
+	if t.PickupUntil != nil && t.StartedAt.After(*t.PickupUntil) {
+		causes[ReasonLatePickup] = t.StartedAt.Sub(*t.PickupUntil)
+	}
+	for _, s := range t.Stops {
+		if dwell := s.Departed.Sub(s.Arrived) - stopAllowance; dwell > 0 {
+			causes[ReasonStopDwell] += dwell
+		}
+	}
+	for _, e := range stoppedEpisodes(t.Fixes) {
+		if atStop(e, t.Stops) {
+			continue
+		}
+		cause := ReasonIdle
+		if i := worst(between(t.Incidents, e.start.Add(-incidentLeadIn), e.end)); i != nil {
+			cause = i.Type
+		}
+		causes[cause] += e.end.Sub(e.start)
+	}
+
+	reason := ""
+	var longest time.Duration
+	for _, cause := range sortedCauses(causes) {
+		if causes[cause] > longest {
+			reason, longest = cause, causes[cause]
+		}
+	}
+	if reason != "" {
+		return reason, causes
+	}
+	if i := worst(t.Incidents); i != nil {
+		return i.Type, causes
+	}
+	if len(t.Fixes) > 0 {
+		return ReasonSlow, causes
+	}
+	return ReasonUnexplained, causes
+}
+
+type episode struct {
+	start, end time.Time
+}
+
+// stoppedEpisodes returns the spans the truck stood still between fixes.
+func stoppedEpisodes(fixes []Fix) []episode {
+	var list []episode
+	for i := 1; i < len(fixes); i++ {
+		prev, f := fixes[i-1], fixes[i]
+		if prev.Speed >= stoppedSpeed || f.Speed >= stoppedSpeed || f.Time.Sub(prev.Time) > maxFixGap {
+			continue
+		}
+		if n := len(list); n > 0 && list[n-1].end.Equal(prev.Time) {
+			list[n-1].end = f.Time
+		} else {
+			list = append(list, episode{prev.Time, f.Time})
+		}
+	}
+	return list
+}
+
+func atStop(e episode, stops []Stop) bool {
+	for _, s := range stops {
+		if e.start.Before(s.Departed) && e.end.After(s.Arrived) {
+			return true
+		}
+	}
+	return false
+}
+
+func between(incidents []Incident, from, to time.Time) []Incident {
+	var list []Incident
+	for _, i := range incidents {
+		if !i.Time.Before(from) && !i.Time.After(to) {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+// worst returns the most severe incident, the earliest of equally severe
+// ones.
+func worst(incidents []Incident) *Incident {
+	var w *Incident
+	for i, in := range incidents {
+		if w == nil || in.Severity > w.Severity || in.Severity == w.Severity && in.Time.Before(w.Time) {
+			w = &incidents[i]
+		}
+	}
+	return w
+}
+
+// sortedCauses orders causes by name, so ties go the same way every time.
+func sortedCauses(causes map[string]time.Duration) []string {
+	names := make([]string, 0, len(causes))
+	for name := range causes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
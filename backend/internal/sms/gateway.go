@@ -0,0 +1,78 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultGatewayURL is the Africa's Talking messaging endpoint.
+const DefaultGatewayURL = "https://api.africastalking.com/version1/messaging"
+
+// GatewaySender sends text messages through an Africa's Talking style HTTP
+// gateway.
+type GatewaySender struct {
+	URL      string
+	Username string
+	APIKey   string
+	From     string // Sender ID or short code, the gateway's default when empty
+	client   *http.Client
+}
+
+func NewGatewaySender(gatewayURL, username, apiKey, from string) *GatewaySender {
+	return &GatewaySender{URL: gatewayURL, Username: username, APIKey: apiKey, From: from, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (g *GatewaySender) Send(ctx context.Context, to, body string) error {
+	form := url.Values{"username": {g.Username}, "to": {to}, "message": {body}}
+	if g.From != "" {
+		form.Set("from", g.From)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("apiKey", g.APIKey)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("sms gateway answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// ErrNoGateway is returned by FromEnv when no gateway is configured and the
+// fake sender wasn't asked for.
+var ErrNoGateway = errors.New("SMS_API_KEY is not set, set SMS_FAKE=true to keep messages in memory instead")
+
+// FromEnv returns a gateway sender configured by SMS_USERNAME, SMS_API_KEY,
+// SMS_FROM and SMS_GATEWAY_URL. Without an API key it fails, unless SMS_FAKE
+// is set for local development, as nothing would reach the phones.
+func FromEnv() (Sender, error) {
+	apiKey := os.Getenv("SMS_API_KEY")
+	if apiKey == "" {
+		if fake, _ := strconv.ParseBool(os.Getenv("SMS_FAKE")); fake {
+			return NewFakeSender(), nil
+		}
+		return nil, ErrNoGateway
+	}
+	gatewayURL := os.Getenv("SMS_GATEWAY_URL")
+	if gatewayURL == "" {
+		gatewayURL = DefaultGatewayURL
+	}
+	return NewGatewaySender(gatewayURL, os.Getenv("SMS_USERNAME"), apiKey, os.Getenv("SMS_FROM")), nil
+}
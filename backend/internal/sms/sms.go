@@ -0,0 +1,61 @@
+package sms
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Sender delivers a text message to a phone number in E.164 format.
+type Sender interface {
+	Send(ctx context.Context, to, body string) error
+}
+
+type Message struct {
+	To     string    `json:"to"`
+	Body   string    `json:"body"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// FakeSender keeps messages in memory instead of sending them.
+// Used for local development and tests.
+type FakeSender struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewFakeSender() *FakeSender {
+	return &FakeSender{}
+}
+
+func (f *FakeSender) Send(ctx context.Context, to, body string) error {
+	f.mu.Lock()
+	f.messages = append(f.messages, Message{To: to, Body: body, SentAt: time.Now()})
+	f.mu.Unlock()
+
+	// Bodies carry login codes, they stay out of the log
+	log.Printf("[sms] to %s: %d characters", to, len(body))
+	return nil
+}
+
+// Messages returns a copy of everything sent so far.
+func (f *FakeSender) Messages() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]Message, len(f.messages))
+	copy(out, f.messages)
+	return out
+}
+
+// Last returns the most recent message sent to the given number.
+func (f *FakeSender) Last(to string) (Message, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.messages) - 1; i >= 0; i-- {
+		if f.messages[i].To == to {
+			return f.messages[i], true
+		}
+	}
+	return Message{}, false
+}
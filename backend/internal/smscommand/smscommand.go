@@ -0,0 +1,96 @@
+// Package smscommand parses the text messages drivers send when they have
+// no data connection, e.g. "INC BREAKDOWN 3 flat tyre near Jebba".
+package smscommand
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Commands
+const (
+	Incident = "INC"
+	Pickup   = "PICKUP"
+	Arrived  = "ARRIVED"
+	Help     = "HELP"
+)
+
+// Usage is sent back to drivers who get a command wrong.
+const Usage = "Send INC <type> <severity 1-5> <note>, PICKUP <code> or ARRIVED <shipment>. Types: BREAKDOWN, ACCIDENT, TRAFFIC, POLICE, ROAD."
+
+var keywords = map[string]string{
+	"INC":      Incident,
+	"INCIDENT": Incident,
+	"PICKUP":   Pickup,
+	"PICK":     Pickup,
+	"ARRIVED":  Arrived,
+	"ARRIVE":   Arrived,
+	"HELP":     Help,
+}
+
+// Incident types by the words drivers use for them
+var incidentTypes = map[string]string{
+	"BREAKDOWN":         "BREAKDOWN",
+	"ACCIDENT":          "ACCIDENT",
+	"TRAFFIC":           "TRAFFIC",
+	"POLICE":            "POLICE_CHECKPOINT",
+	"CHECKPOINT":        "POLICE_CHECKPOINT",
+	"POLICE_CHECKPOINT": "POLICE_CHECKPOINT",
+	"ROAD":              "BAD_ROAD",
+	"BADROAD":           "BAD_ROAD",
+	"BAD_ROAD":          "BAD_ROAD",
+}
+
+// Command is a parsed message. Only the fields of its Kind are set.
+type Command struct {
+	Kind         string
+	IncidentType string // One of the incident types of the API
+	Severity     int
+	Note         string
+	PickupCode   string // As typed, normalize before use
+	Shipment     string // ID or its first characters, empty for the driver's only one
+}
+
+// Parse reads a command from a message, ignoring case and extra spaces.
+func Parse(text string) (Command, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return Command{}, fmt.Errorf("empty message")
+	}
+	kind, ok := keywords[strings.ToUpper(fields[0])]
+	if !ok {
+		return Command{}, fmt.Errorf("unknown command %q", fields[0])
+	}
+	cmd := Command{Kind: kind}
+	args := fields[1:]
+
+	switch kind {
+	case Incident:
+		if len(args) < 2 {
+			return cmd, fmt.Errorf("INC needs a type and a severity")
+		}
+		if cmd.IncidentType, ok = incidentTypes[strings.ToUpper(args[0])]; !ok {
+			return cmd, fmt.Errorf("unknown incident type %q", args[0])
+		}
+		severity, err := strconv.Atoi(args[1])
+		if err != nil || severity < 1 || severity > 5 {
+			return cmd, fmt.Errorf("severity must be 1 to 5")
+		}
+		cmd.Severity = severity
+		cmd.Note = strings.Join(args[2:], " ")
+	case Pickup:
+		if len(args) != 1 {
+			return cmd, fmt.Errorf("PICKUP needs the pickup code")
+		}
+		cmd.PickupCode = args[0]
+	case Arrived:
+		if len(args) > 1 {
+			return cmd, fmt.Errorf("ARRIVED takes one shipment")
+		}
+		if len(args) == 1 {
+			cmd.Shipment = strings.ToLower(args[0])
+		}
+	}
+	return cmd, nil
+}
@@ -0,0 +1,284 @@
+// Package ussd runs the menus farmers on basic phones dial into. Gateways in
+// the style of Africa's Talking call back on every key press with the whole
+// session so far as "*"-separated inputs, so the menu is a state machine
+// replayed from those inputs and nothing is kept between callbacks.
+package ussd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Menus list at most this many choices, a USSD screen is ~160 characters
+const maxChoices = 5
+
+// Longest commodity name accepted
+const maxCommodity = 40
+
+// Inputs that navigate instead of answering
+const (
+	Back = "0"
+	Home = "00"
+)
+
+// Request is a gateway callback.
+type Request struct {
+	SessionID   string `form:"sessionId" binding:"required"`
+	ServiceCode string `form:"serviceCode"`
+	PhoneNumber string `form:"phoneNumber" binding:"required"`
+	Text        string `form:"text"` // Inputs so far, e.g. "1*2*yams"
+}
+
+// Response is what the phone shows next.
+type Response struct {
+	Text string
+	End  bool // Closes the session
+}
+
+// String formats the response for the gateway.
+func (r Response) String() string {
+	if r.End {
+		return "END " + r.Text
+	}
+	return "CON " + r.Text
+}
+
+func prompt(text string) Response { return Response{Text: text} }
+func end(text string) Response    { return Response{Text: text, End: true} }
+
+// Inputs splits the text of a callback into the answers given so far,
+// applying Back and Home along the way.
+func Inputs(text string) []string {
+	inputs := []string{}
+	if text == "" {
+		return inputs
+	}
+	for _, in := range strings.Split(text, "*") {
+		switch in = strings.TrimSpace(in); in {
+		case Back:
+			if len(inputs) > 0 {
+				inputs = inputs[:len(inputs)-1]
+			}
+		case Home:
+			inputs = inputs[:0]
+		default:
+			inputs = append(inputs, in)
+		}
+	}
+	return inputs
+}
+
+// Location is a saved pickup or drop-off point.
+type Location struct {
+	ID   string
+	Name string
+}
+
+// Shipment is a shipment as read back to its owner.
+type Shipment struct {
+	ID        string
+	Commodity string
+	Dest      string // Where it is going, in words
+	Status    string
+	Plate     string // Of the truck carrying it, if any
+	CreatedAt time.Time
+}
+
+// PickupCode is the code a driver needs to collect a shipment.
+type PickupCode struct {
+	Code      string
+	ExpiresAt time.Time
+}
+
+// Backend is what the menu reads and changes, on behalf of the caller.
+type Backend interface {
+	Locations(ctx context.Context) ([]Location, error)
+	Shipments(ctx context.Context) ([]Shipment, error)
+	// Unclaimed returns the shipments still waiting for a driver.
+	Unclaimed(ctx context.Context) ([]Shipment, error)
+	CreateShipment(ctx context.Context, origin, dest Location, commodity string) (Shipment, PickupCode, error)
+	// PickupCode returns a shipment's code, a fresh one if it expired.
+	PickupCode(ctx context.Context, shipmentID string) (PickupCode, error)
+}
+
+// ErrNotFound is returned by a Backend for a shipment that is gone or was
+// claimed meanwhile.
+var ErrNotFound = errors.New("not found")
+
+// Menu answers callbacks. Times are read out in Location.
+type Menu struct {
+	Backend  Backend
+	Location *time.Location
+}
+
+const mainMenu = "Welcome to AgriTrack\n1. Send produce\n2. My shipments\n3. Pickup code"
+
+var errInvalid = errors.New("invalid choice")
+
+// Handle returns the next screen for a session with the given inputs.
+// Errors from the backend end the session with an apology.
+func (m Menu) Handle(ctx context.Context, inputs []string) (Response, error) {
+	if len(inputs) == 0 {
+		return prompt(mainMenu), nil
+	}
+	var resp Response
+	var err error
+	switch inputs[0] {
+	case "1":
+		resp, err = m.send(ctx, inputs[1:])
+	case "2":
+		resp, err = m.status(ctx)
+	case "3":
+		resp, err = m.pickupCode(ctx, inputs[1:])
+	default:
+		err = errInvalid
+	}
+	if errors.Is(err, errInvalid) {
+		return end("Invalid choice. Please dial again."), nil
+	}
+	if err != nil {
+		return end("Sorry, something went wrong. Please try again later."), err
+	}
+	return resp, nil
+}
+
+// send walks through creating a shipment: pickup location, drop-off
+// location, commodity, confirmation.
+func (m Menu) send(ctx context.Context, inputs []string) (Response, error) {
+	locations, err := m.Backend.Locations(ctx)
+	if err != nil {
+		return Response{}, err
+	}
+	if len(locations) < 2 {
+		return end("Save your pickup and drop-off locations in the AgriTrack app first."), nil
+	}
+	if len(inputs) == 0 {
+		return prompt("Pick up from:\n" + menuOf(locations, func(l Location) string { return l.Name })), nil
+	}
+	origin, err := choose(locations, inputs[0])
+	if err != nil {
+		return Response{}, err
+	}
+	if len(inputs) == 1 {
+		return prompt("Deliver to:\n" + menuOf(locations, func(l Location) string { return l.Name })), nil
+	}
+	dest, err := choose(locations, inputs[1])
+	if err != nil {
+		return Response{}, err
+	}
+	if dest.ID == origin.ID {
+		return end("Pickup and drop-off must differ. Please dial again."), nil
+	}
+	if len(inputs) == 2 {
+		return prompt("What are you sending? (e.g. yams)"), nil
+	}
+	commodity := strings.TrimSpace(inputs[2])
+	if commodity == "" || len(commodity) > maxCommodity {
+		return Response{}, errInvalid
+	}
+	if len(inputs) == 3 {
+		return prompt(fmt.Sprintf("Send %s from %s to %s?\n1. Confirm\n2. Cancel", commodity, origin.Name, dest.Name)), nil
+	}
+	switch inputs[3] {
+	case "1":
+		_, code, err := m.Backend.CreateShipment(ctx, origin, dest, commodity)
+		if err != nil {
+			return Response{}, err
+		}
+		return end(fmt.Sprintf("Shipment created. Pickup code: %s, valid until %s. Give it to the driver.", code.Code, m.clock(code.ExpiresAt))), nil
+	case "2":
+		return end("Cancelled."), nil
+	}
+	return Response{}, errInvalid
+}
+
+// status reads back the caller's latest shipments.
+func (m Menu) status(ctx context.Context) (Response, error) {
+	shipments, err := m.Backend.Shipments(ctx)
+	if err != nil {
+		return Response{}, err
+	}
+	if len(shipments) == 0 {
+		return end("You have no shipments yet."), nil
+	}
+	lines := []string{"Your shipments:"}
+	for i, s := range shipments[:min(len(shipments), maxChoices)] {
+		line := fmt.Sprintf("%d. %s to %s: %s", i+1, s.Commodity, s.Dest, statusText(s.Status))
+		if s.Plate != "" && s.Status != "CREATED" {
+			line += " (" + s.Plate + ")"
+		}
+		lines = append(lines, line)
+	}
+	return end(strings.Join(lines, "\n")), nil
+}
+
+// pickupCode reads back the code of one of the caller's unclaimed shipments.
+func (m Menu) pickupCode(ctx context.Context, inputs []string) (Response, error) {
+	shipments, err := m.Backend.Unclaimed(ctx)
+	if err != nil {
+		return Response{}, err
+	}
+	if len(shipments) == 0 {
+		return end("None of your shipments is waiting for pickup."), nil
+	}
+	if len(inputs) == 0 {
+		return prompt("Which shipment?\n" + menuOf(shipments, func(s Shipment) string {
+			return fmt.Sprintf("%s to %s, %s", s.Commodity, s.Dest, s.CreatedAt.In(m.Location).Format("2 Jan"))
+		})), nil
+	}
+	s, err := choose(shipments, inputs[0])
+	if err != nil {
+		return Response{}, err
+	}
+	code, err := m.Backend.PickupCode(ctx, s.ID)
+	if errors.Is(err, ErrNotFound) {
+		return end("That shipment was already picked up."), nil
+	}
+	if err != nil {
+		return Response{}, err
+	}
+	return end(fmt.Sprintf("Pickup code for %s to %s: %s, valid until %s.", s.Commodity, s.Dest, code.Code, m.clock(code.ExpiresAt))), nil
+}
+
+func (m Menu) clock(t time.Time) string {
+	local := t.In(m.Location)
+	if y, mo, d := time.Now().In(m.Location).Date(); local.Year() == y && local.Month() == mo && local.Day() == d {
+		return local.Format("15:04")
+	}
+	return local.Format("15:04 on 2 Jan")
+}
+
+func menuOf[T any](items []T, label func(T) string) string {
+	lines := make([]string, 0, maxChoices)
+	for i, item := range items[:min(len(items), maxChoices)] {
+		lines = append(lines, strconv.Itoa(i+1)+". "+label(item))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func choose[T any](items []T, input string) (T, error) {
+	var zero T
+	n, err := strconv.Atoi(input)
+	if err != nil || n < 1 || n > min(len(items), maxChoices) {
+		return zero, errInvalid
+	}
+	return items[n-1], nil
+}
+
+func statusText(status string) string {
+	switch status {
+	case "CREATED":
+		return "waiting for pickup"
+	case "IN_TRANSIT":
+		return "on the way"
+	case "ARRIVED":
+		return "arrived"
+	case "DELIVERED":
+		return "delivered"
+	}
+	return strings.ToLower(status)
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// NormalizePhone converts a phone number to E.164 format. Local Nigerian
+// numbers ("0803...") are assumed when no country code is given.
+func NormalizePhone(phone string) (string, error) {
+	var digits strings.Builder
+	for i, r := range strings.TrimSpace(phone) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+		case r == ' ' || r == '-' || r == '(' || r == ')':
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+
+	d := digits.String()
+	switch {
+	case strings.HasPrefix(d, "00"):
+		d = d[2:]
+	case strings.HasPrefix(d, "0") && len(d) == 11:
+		d = "234" + d[1:]
+	}
+
+	if len(d) < 10 || len(d) > 15 || d[0] == '0' {
+		return "", ErrInvalidPhone
+	}
+	return "+" + d, nil
+}
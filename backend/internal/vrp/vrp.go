@@ -0,0 +1,294 @@
+// Package vrp plans vehicle routes: which truck visits which stops, and in
+// what order, within truck capacities and stop time windows. It builds a
+// solution by cheapest insertion and improves it with local search, which
+// gives good routes for the few dozen stops of a collection run in
+// milliseconds.
+package vrp
+
+import (
+	"time"
+
+	"agri-track/internal/geo"
+)
+
+// Metric gives the travel distance between two points.
+type Metric interface {
+	// Distance returns the distance from a to b in meters.
+	Distance(a, b geo.Point) float64
+}
+
+// MatrixMetric is a Metric that can compute all distances between a set of
+// points at once more cheaply than pair by pair, like a road graph.
+type MatrixMetric interface {
+	Metric
+	// Matrix returns the distance from every point to every other, in meters.
+	Matrix(points []geo.Point) [][]float64
+}
+
+// Haversine measures straight-line distance, stretched by Detour (e.g. 1.3)
+// because roads are never straight.
+type Haversine struct {
+	Detour float64
+}
+
+func (m Haversine) Distance(a, b geo.Point) float64 {
+	d := geo.Haversine(a, b)
+	if m.Detour > 0 {
+		d *= m.Detour
+	}
+	return d
+}
+
+// Stop is a place to visit. Zero window times leave that side of the window open.
+type Stop struct {
+	Point       geo.Point
+	DemandKg    float64
+	WindowStart time.Time
+	WindowEnd   time.Time     // Latest arrival
+	Service     time.Duration // Time spent loading
+}
+
+// Vehicle starts at Start at Departure and ends at End.
+type Vehicle struct {
+	Start      geo.Point
+	End        geo.Point
+	CapacityKg float64 // Zero for unlimited
+	Departure  time.Time
+}
+
+type Problem struct {
+	Vehicles []Vehicle
+	Stops    []Stop
+	SpeedKmh float64
+}
+
+// Route is the plan of one vehicle.
+type Route struct {
+	Vehicle   int         // Index into Problem.Vehicles
+	Stops     []int       // Indexes into Problem.Stops in visiting order
+	Arrivals  []time.Time // Arrival at each stop
+	Finish    time.Time   // Arrival at the vehicle's end
+	DistanceM float64
+	LoadKg    float64
+}
+
+type Solution struct {
+	Routes     []Route // One per vehicle, in the order of Problem.Vehicles
+	Unassigned []int   // Stops no vehicle can take
+	DistanceM  float64
+}
+
+// Upper bound on improvement passes, so a pathological input can't spin forever
+const maxPasses = 100
+
+type solver struct {
+	p      Problem
+	dist   [][]float64
+	routes [][]int
+}
+
+// Solve plans routes for p, measuring distances with m.
+func Solve(p Problem, m Metric) Solution {
+	s := &solver{p: p, dist: matrix(p, m), routes: make([][]int, len(p.Vehicles))}
+
+	unassigned := make([]int, len(p.Stops))
+	for i := range unassigned {
+		unassigned[i] = i
+	}
+	unassigned = s.insert(unassigned)
+	for pass := 0; pass < maxPasses && s.improve(); pass++ {
+	}
+	// Local search may have freed room for a stop that didn't fit before
+	unassigned = s.insert(unassigned)
+
+	sol := Solution{Unassigned: unassigned}
+	for v, seq := range s.routes {
+		r := Route{Vehicle: v, Stops: seq}
+		r.DistanceM, r.Arrivals, r.Finish, r.LoadKg, _ = s.evaluate(v, seq)
+		sol.Routes = append(sol.Routes, r)
+		sol.DistanceM += r.DistanceM
+	}
+	return sol
+}
+
+// matrix lays out stops first, then the start and end of each vehicle.
+func matrix(p Problem, m Metric) [][]float64 {
+	points := make([]geo.Point, 0, len(p.Stops)+2*len(p.Vehicles))
+	for _, st := range p.Stops {
+		points = append(points, st.Point)
+	}
+	for _, v := range p.Vehicles {
+		points = append(points, v.Start, v.End)
+	}
+
+	if mm, ok := m.(MatrixMetric); ok {
+		return mm.Matrix(points)
+	}
+	d := make([][]float64, len(points))
+	for i := range points {
+		d[i] = make([]float64, len(points))
+		for j := range points {
+			if i != j {
+				d[i][j] = m.Distance(points[i], points[j])
+			}
+		}
+	}
+	return d
+}
+
+func (s *solver) start(v int) int { return len(s.p.Stops) + 2*v }
+func (s *solver) end(v int) int   { return len(s.p.Stops) + 2*v + 1 }
+
+func (s *solver) travel(meters float64) time.Duration {
+	speed := s.p.SpeedKmh
+	if speed <= 0 {
+		speed = 40
+	}
+	return time.Duration(meters / 1000 / speed * float64(time.Hour))
+}
+
+// length returns the distance vehicle v drives to visit seq.
+func (s *solver) length(v int, seq []int) float64 {
+	prev, total := s.start(v), 0.0
+	for _, i := range seq {
+		total += s.dist[prev][i]
+		prev = i
+	}
+	return total + s.dist[prev][s.end(v)]
+}
+
+// evaluate drives vehicle v through seq and reports whether it stays within
+// capacity and reaches every stop before its window closes. A truck early
+// for a window waits for it to open.
+func (s *solver) evaluate(v int, seq []int) (meters float64, arrivals []time.Time, finish time.Time, load float64, ok bool) {
+	veh := s.p.Vehicles[v]
+	t := veh.Departure
+	prev := s.start(v)
+	ok = true
+	for _, i := range seq {
+		st := s.p.Stops[i]
+		meters += s.dist[prev][i]
+		t = t.Add(s.travel(s.dist[prev][i]))
+		arrivals = append(arrivals, t)
+		if !st.WindowEnd.IsZero() && t.After(st.WindowEnd) {
+			ok = false
+		}
+		if t.Before(st.WindowStart) {
+			t = st.WindowStart
+		}
+		t = t.Add(st.Service)
+		load += st.DemandKg
+		prev = i
+	}
+	if veh.CapacityKg > 0 && load > veh.CapacityKg {
+		ok = false
+	}
+	meters += s.dist[prev][s.end(v)]
+	finish = t.Add(s.travel(s.dist[prev][s.end(v)]))
+	return meters, arrivals, finish, load, ok
+}
+
+func (s *solver) feasible(v int, seq []int) bool {
+	_, _, _, _, ok := s.evaluate(v, seq)
+	return ok
+}
+
+// insert adds stops one at a time wherever they lengthen the routes the
+// least, and returns the stops that fit nowhere.
+func (s *solver) insert(stops []int) []int {
+	for len(stops) > 0 {
+		bestStop, bestV, bestPos, bestDelta := -1, -1, -1, 0.0
+		for k, i := range stops {
+			for v, seq := range s.routes {
+				base := s.length(v, seq)
+				for pos := 0; pos <= len(seq); pos++ {
+					cand := insertAt(seq, pos, i)
+					delta := s.length(v, cand) - base
+					if bestStop >= 0 && delta >= bestDelta {
+						continue
+					}
+					if s.feasible(v, cand) {
+						bestStop, bestV, bestPos, bestDelta = k, v, pos, delta
+					}
+				}
+			}
+		}
+		if bestStop < 0 {
+			return stops
+		}
+		s.routes[bestV] = insertAt(s.routes[bestV], bestPos, stops[bestStop])
+		stops = append(stops[:bestStop:bestStop], stops[bestStop+1:]...)
+	}
+	return []int{}
+}
+
+// improve makes one pass of 2-opt within each route and of moving single
+// stops between routes, and reports whether anything got shorter.
+func (s *solver) improve() bool {
+	improved := false
+
+	for v, seq := range s.routes {
+		for i := 0; i < len(seq)-1; i++ {
+			for j := i + 1; j < len(seq); j++ {
+				cand := reverse(seq, i, j)
+				if s.length(v, cand) < s.length(v, seq)-1e-6 && s.feasible(v, cand) {
+					seq, improved = cand, true
+				}
+			}
+		}
+		s.routes[v] = seq
+	}
+
+	for from := range s.routes {
+		for i := 0; i < len(s.routes[from]); i++ {
+			stop := s.routes[from][i]
+			shorter := removeAt(s.routes[from], i)
+			saved := s.length(from, s.routes[from]) - s.length(from, shorter)
+
+			bestTo, bestPos, bestGain := -1, -1, 1e-6
+			for to := range s.routes {
+				target := s.routes[to]
+				if to == from {
+					target = shorter
+				}
+				base := s.length(to, target)
+				for pos := 0; pos <= len(target); pos++ {
+					cand := insertAt(target, pos, stop)
+					gain := saved - (s.length(to, cand) - base)
+					if gain > bestGain && s.feasible(to, cand) {
+						bestTo, bestPos, bestGain = to, pos, gain
+					}
+				}
+			}
+			if bestTo < 0 {
+				continue
+			}
+			s.routes[from] = shorter
+			s.routes[bestTo] = insertAt(s.routes[bestTo], bestPos, stop)
+			improved = true
+		}
+	}
+	return improved
+}
+
+func insertAt(seq []int, pos, stop int) []int {
+	out := make([]int, 0, len(seq)+1)
+	out = append(out, seq[:pos]...)
+	out = append(out, stop)
+	return append(out, seq[pos:]...)
+}
+
+func removeAt(seq []int, pos int) []int {
+	out := make([]int, 0, len(seq)-1)
+	out = append(out, seq[:pos]...)
+	return append(out, seq[pos+1:]...)
+}
+
+// reverse returns seq with the stops from i to j (inclusive) in reverse order.
+func reverse(seq []int, i, j int) []int {
+	out := append([]int(nil), seq...)
+	for ; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Received is a delivery as a Receiver saw it.
+type Received struct {
+	ID      string
+	Event   string
+	Payload []byte
+	Valid   bool // The signature checked out
+	At      time.Time
+}
+
+// Receiver is a local HTTP endpoint that records the webhooks sent to it.
+// Used for local development and tests.
+type Receiver struct {
+	server *httptest.Server
+	secret string
+
+	mu       sync.Mutex
+	received []Received
+	failures int
+}
+
+// NewReceiver starts a receiver checking signatures against secret. Set the
+// secret later with SetSecret when it is only known once subscribed.
+func NewReceiver(secret string) *Receiver {
+	r := &Receiver{secret: secret}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+func (r *Receiver) serve(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received = append(r.received, Received{
+		ID:      req.Header.Get(HeaderID),
+		Event:   req.Header.Get(HeaderEvent),
+		Payload: body,
+		Valid:   Verify(r.secret, req.Header, body, 5*time.Minute),
+		At:      time.Now(),
+	})
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// URL is where to send webhooks.
+func (r *Receiver) URL() string {
+	return r.server.URL
+}
+
+func (r *Receiver) SetSecret(secret string) {
+	r.mu.Lock()
+	r.secret = secret
+	r.mu.Unlock()
+}
+
+// FailNext makes the next n deliveries fail with a 500.
+func (r *Receiver) FailNext(n int) {
+	r.mu.Lock()
+	r.failures = n
+	r.mu.Unlock()
+}
+
+// Received returns a copy of every request received so far, failed ones included.
+func (r *Receiver) Received() []Received {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]Received, len(r.received))
+	copy(out, r.received)
+	return out
+}
+
+func (r *Receiver) Close() {
+	r.server.Close()
+}
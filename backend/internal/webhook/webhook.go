@@ -0,0 +1,239 @@
+// Package webhook signs and sends event notifications to URLs organizations
+// subscribe, and decides when to retry the ones that fail.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"agri-track/internal/events"
+)
+
+// Event types a subscription can filter on
+const (
+	ShipmentPickedUp        = events.ShipmentPickedUp
+	ShipmentNearDestination = events.ShipmentNearDestination
+	ShipmentDelivered       = events.ShipmentDelivered
+	IncidentReported        = events.IncidentReported
+	ShipmentETABreach       = events.ShipmentETABreach
+)
+
+var EventTypes = []string{ShipmentPickedUp, ShipmentNearDestination, ShipmentDelivered, IncidentReported, ShipmentETABreach}
+
+// Headers of each delivery
+const (
+	HeaderID        = "X-Webhook-Id" // Same for every attempt, so receivers can drop duplicates
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Config tunes delivery and retries.
+type Config struct {
+	Timeout     time.Duration // For the receiver to answer
+	BaseDelay   time.Duration // Before the first retry, doubling after each
+	MaxDelay    time.Duration
+	MaxAttempts int // After this many failures a delivery is dead-lettered
+	// Deliver to loopback and private networks too, for receivers in tests.
+	// Otherwise subscribers could make the server call its own network.
+	AllowPrivate bool
+}
+
+var DefaultConfig = Config{
+	Timeout:     10 * time.Second,
+	BaseDelay:   30 * time.Second,
+	MaxDelay:    6 * time.Hour,
+	MaxAttempts: 10,
+}
+
+// Backoff returns how long to wait after the given number of failed attempts.
+func (c Config) Backoff(failures int) time.Duration {
+	delay := c.BaseDelay
+	for i := 1; i < failures && delay < c.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, c.MaxDelay)
+}
+
+// NewSecret returns a random signing secret.
+func NewSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature of a payload sent at timestamp (Unix seconds):
+// the hex HMAC-SHA256 of "timestamp.body" keyed with the secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature headers of a delivery, rejecting ones signed
+// more than tolerance ago so captured requests can't be replayed.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) bool {
+	timestamp, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(header.Get(HeaderSignature)), []byte(Sign(secret, timestamp, body)))
+}
+
+// Delivery is one event on its way to one subscription.
+type Delivery struct {
+	ID      string
+	URL     string
+	Secret  string
+	Event   string
+	Payload []byte
+}
+
+// Result is the outcome of one attempt.
+type Result struct {
+	StatusCode int // 0 when no response came back
+	Error      string
+	Duration   time.Duration
+}
+
+// OK reports whether the receiver accepted the delivery.
+func (r Result) OK() bool {
+	return r.Error == "" && r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// Client sends deliveries.
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(cfg Config) *Client {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivate {
+		// Checked on the address actually dialed, after DNS, so a name that
+		// resolves elsewhere by the time of delivery can't slip through
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip, err := netip.ParseAddr(host); err != nil || !publicAddr(ip) {
+				return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+			}
+			return nil
+		}
+	}
+	return &Client{http: &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			Proxy:               nil, // A proxy would dial the receiver past the check
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: cfg.Timeout,
+			MaxIdleConnsPerHost: 2,
+		},
+		// A redirect could point the signed payload somewhere else
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}}
+}
+
+// Send makes one attempt at a delivery.
+func (c *Client) Send(ctx context.Context, d Delivery) Result {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "AgriTrack-Webhooks/1.0")
+	req.Header.Set(HeaderID, d.ID)
+	req.Header.Set(HeaderEvent, d.Event)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(d.Secret, timestamp, d.Payload))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return Result{Error: err.Error(), Duration: time.Since(start)}
+	}
+	defer resp.Body.Close()
+	// Drain a little so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	r := Result{StatusCode: resp.StatusCode, Duration: time.Since(start)}
+	if !r.OK() {
+		r.Error = fmt.Sprintf("receiver answered %s", resp.Status)
+	}
+	return r
+}
+
+// ErrPrivateAddress is why a delivery to a private address failed.
+var ErrPrivateAddress = errors.New("receiver address is not public")
+
+// Ranges besides loopback, private, link-local and unspecified addresses
+// that don't lead to a subscriber's server
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64, could map to any of the above
+}
+
+// publicAddr reports whether ip is on the public internet, so neither the
+// server itself, its network nor a cloud metadata service.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, p := range reservedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidURL reports whether a subscription URL can be delivered to. Names
+// are only resolved when delivering, addresses and localhost are turned
+// away here already.
+func (c Config) ValidURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return false
+	}
+	if c.AllowPrivate {
+		return true
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !publicAddr(ip) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleValidation(t *testing.T) {
+	ClearDB(t)
+	router := TestRouter
+
+	for role, want := range map[string]int{
+		"admin":         http.StatusBadRequest,
+		"DRIVER":        http.StatusBadRequest,
+		"driver":        http.StatusCreated,
+		"depot_manager": http.StatusBadRequest, // Granted by an organization owner
+		"":              http.StatusCreated,
+	} {
+		payload := map[string]string{
+			"email":    "role-" + role + "@test.com",
+			"password": "securepassword",
+			"role":     role,
+		}
+		body, _ := json.Marshal(payload)
+		req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, want, w.Code, "role %q", role)
+	}
+}
+
+func TestAdminUserManagement(t *testing.T) {
+	ClearDB(t)
+
+	adminToken, _ := CreateTestAccount(t, "admin@test.com", "admin")
+	farmerToken, farmerID := CreateTestAccount(t, "farmer@test.com", "farmer")
+
+	t.Run("Non-Admin Forbidden", func(t *testing.T) {
+		code, _ := Do(t, "GET", "/api/admin/users", farmerToken, nil)
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("Search Users", func(t *testing.T) {
+		code, body := Do(t, "GET", "/api/admin/users?q=farmer", adminToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+
+		var resp struct {
+			Users []map[string]interface{} `json:"users"`
+		}
+		json.Unmarshal(body, &resp)
+		assert.Len(t, resp.Users, 1)
+		assert.Equal(t, farmerID, resp.Users[0]["id"])
+	})
+
+	t.Run("Suspend Blocks Access", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/admin/users/"+farmerID+"/suspend", adminToken, map[string]string{"reason": "fraud"})
+		assert.Equal(t, http.StatusOK, code)
+
+		code, _ = Do(t, "GET", "/api/admin/users", farmerToken, nil)
+		assert.Equal(t, http.StatusForbidden, code)
+
+		code, _ = Do(t, "POST", "/api/admin/users/"+farmerID+"/reactivate", adminToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("Change Role", func(t *testing.T) {
+		code, _ := Do(t, "PUT", "/api/admin/users/"+farmerID+"/role", adminToken, map[string]string{"role": "driver"})
+		assert.Equal(t, http.StatusOK, code)
+
+		var role string
+		db.Pool.QueryRow(context.Background(), "SELECT role FROM users WHERE id=$1", farmerID).Scan(&role)
+		assert.Equal(t, "driver", role)
+	})
+
+	t.Run("Delete And Audit", func(t *testing.T) {
+		code, _ := Do(t, "DELETE", "/api/admin/users/"+farmerID, adminToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+
+		var count int
+		db.Pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM audit_log WHERE target_id=$1", farmerID).Scan(&count)
+		assert.Equal(t, 4, count, "suspend, reactivate, role change and delete are audited")
+	})
+}
+
+func TestDepotManagerGrantedByOwner(t *testing.T) {
+	ClearDB(t)
+	ctx := context.Background()
+	ownerToken, _ := CreateTestAccount(t, "depot-owner@test.com", "farmer")
+	_, memberID := CreateTestAccount(t, "depot-member@test.com", "farmer")
+	_, driverID := CreateTestAccount(t, "depot-driver@test.com", "driver")
+	_, outsiderID := CreateTestAccount(t, "depot-outsider@test.com", "farmer")
+
+	_, body := Do(t, "POST", "/api/orgs", ownerToken, map[string]string{"name": "Ilorin Depot", "kind": "cooperative"})
+	orgID := Decode(body)["id"].(string)
+	for _, id := range []string{memberID, driverID} {
+		db.Pool.Exec(ctx, "INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, 'member')", orgID, id)
+	}
+	path := func(userID string) string { return "/api/org/members/" + userID + "/account-role" }
+
+	code, _ := Do(t, "PUT", path(memberID), ownerToken, map[string]string{"role": "admin"}, orgID)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = Do(t, "PUT", path(outsiderID), ownerToken, map[string]string{"role": "depot_manager"}, orgID)
+	assert.Equal(t, http.StatusNotFound, code, "only members of the organization")
+	code, _ = Do(t, "PUT", path(driverID), ownerToken, map[string]string{"role": "depot_manager"}, orgID)
+	assert.Equal(t, http.StatusBadRequest, code, "drivers keep their role")
+
+	code, _ = Do(t, "PUT", path(memberID), ownerToken, map[string]string{"role": "depot_manager"}, orgID)
+	assert.Equal(t, http.StatusOK, code)
+	var role string
+	db.Pool.QueryRow(ctx, "SELECT role FROM users WHERE id=$1", memberID).Scan(&role)
+	assert.Equal(t, "depot_manager", role)
+
+	var audited int
+	db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM audit_log WHERE target_id=$1 AND action='user.role_change'", memberID).Scan(&audited)
+	assert.Equal(t, 1, audited)
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type seriesResponse struct {
+	Bucket   string `json:"bucket"`
+	TimeZone string `json:"time_zone"`
+	Series   []struct {
+		Name   string `json:"name"`
+		Points []struct {
+			Bucket string   `json:"bucket"`
+			Value  *float64 `json:"value"`
+		} `json:"points"`
+	} `json:"series"`
+}
+
+// values returns a series' values, -1 where it has none.
+func (r seriesResponse) values(name string) []float64 {
+	for _, s := range r.Series {
+		if s.Name != name {
+			continue
+		}
+		values := make([]float64, len(s.Points))
+		for i, p := range s.Points {
+			values[i] = -1
+			if p.Value != nil {
+				values[i] = *p.Value
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func TestAnalyticsSeries(t *testing.T) {
+	ClearDB(t)
+	ctx := context.Background()
+	token, userID := CreateTestAccount(t, "analytics@test.com", "farmer")
+	orgID := OrgOf(t, userID)
+	_, otherID := CreateTestAccount(t, "analytics-other@test.com", "farmer")
+	truckID := CreateTestTruck(t)
+	otherTruckID := CreateTestTruck(t)
+
+	// Three days in Lagos, from Monday 5 January 2026
+	shipment := func(org, truck, completed string) string {
+		id := CreateOrgShipment(t, truck, "DELIVERED", org)
+		db.Pool.Exec(ctx, `
+			UPDATE shipments SET completed_at=$2, origin_place='Kano', dest_place='Lagos' WHERE id=$1
+		`, id, completed)
+		return id
+	}
+	first := shipment(orgID, truckID, "2026-01-05T10:00:00+01:00")
+	shipment(orgID, truckID, "2026-01-07T00:30:00+01:00") // The 6th in UTC
+	shipment(OrgOf(t, otherID), otherTruckID, "2026-01-05T11:00:00+01:00")
+	db.Pool.Exec(ctx, `
+		INSERT INTO logistics_events (time, truck_id, shipment_id, latitude, longitude, event_type, speed) VALUES
+			('2026-01-05T08:10:00+01:00', $1, $2, 1, 1, 'moving', 40),
+			('2026-01-05T08:20:00+01:00', $1, $2, 1, 1, 'moving', 60),
+			('2026-01-05T09:10:00+01:00', $1, $2, 1, 1, 'moving', 80),
+			('2026-01-05T08:15:00+01:00', $3, NULL, 1, 1, 'moving', 90)
+	`, truckID, first, otherTruckID)
+	db.Pool.Exec(ctx, `
+		INSERT INTO logistics_incidents (time, truck_id, shipment_id, latitude, longitude, incident_type, severity) VALUES
+			('2026-01-05T09:00:00+01:00', $1, $2, 1, 1, 'TRAFFIC', 1),
+			('2026-01-06T09:00:00+01:00', $1, $2, 1, 1, 'TRAFFIC', 1),
+			('2026-01-06T10:00:00+01:00', $1, $2, 1, 1, 'BREAKDOWN', 3)
+	`, truckID, first)
+
+	days := url.Values{"from": {"2026-01-05T00:00:00+01:00"}, "to": {"2026-01-08T00:00:00+01:00"}}
+
+	t.Run("Deliveries", func(t *testing.T) {
+		code, body := Do(t, "GET", "/api/analytics/deliveries?"+days.Encode(), token, nil)
+		var resp seriesResponse
+		json.Unmarshal(body, &resp)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "1d", resp.Bucket)
+		assert.Equal(t, "Africa/Lagos", resp.TimeZone)
+		assert.Equal(t, []float64{1, 0, 1}, resp.values("deliveries"))
+	})
+
+	t.Run("ActiveTrucks", func(t *testing.T) {
+		query := url.Values{"from": {"2026-01-05T08:00:00+01:00"}, "to": {"2026-01-05T11:00:00+01:00"}}
+		code, body := Do(t, "GET", "/api/analytics/active-trucks?"+query.Encode(), token, nil)
+		var resp seriesResponse
+		json.Unmarshal(body, &resp)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []float64{1, 1, 0}, resp.values("active_trucks"))
+	})
+
+	t.Run("Incidents", func(t *testing.T) {
+		_, body := Do(t, "GET", "/api/analytics/incidents?"+days.Encode(), token, nil)
+		var resp seriesResponse
+		json.Unmarshal(body, &resp)
+		assert.Equal(t, []float64{0, 1, 0}, resp.values("BREAKDOWN"))
+		assert.Equal(t, []float64{1, 1, 0}, resp.values("TRAFFIC"))
+	})
+
+	t.Run("Corridors", func(t *testing.T) {
+		_, body := Do(t, "GET", "/api/analytics/corridors?"+days.Encode(), token, nil)
+		var resp seriesResponse
+		json.Unmarshal(body, &resp)
+		if assert.Len(t, resp.Series, 1) {
+			assert.Equal(t, "Kano → Lagos", resp.Series[0].Name)
+		}
+		assert.Equal(t, []float64{60, -1, -1}, resp.values("Kano → Lagos"))
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		for _, query := range []url.Values{
+			{"bucket": {"5m"}},
+			{"range": {"1y"}},
+			{"to": {"2026-01-08T00:00:00Z"}},
+			{"from": {"yesterday"}},
+			{"from": {"2026-01-08T00:00:00Z"}, "to": {"2026-01-05T00:00:00Z"}},
+			{"from": {"2025-01-01T00:00:00Z"}, "to": {"2026-06-01T00:00:00Z"}},
+			{"range": {"90d"}, "bucket": {"1h"}},
+		} {
+			code, _ := Do(t, "GET", "/api/analytics/deliveries?"+query.Encode(), token, nil)
+			assert.Equal(t, http.StatusBadRequest, code, query.Encode())
+		}
+	})
+}
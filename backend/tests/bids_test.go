@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBidding(t *testing.T) {
+	ClearDB(t)
+	farmerToken, _ := CreateTestAccount(t, "bid-farmer@test.com", "farmer")
+	driverToken, driverID := CreateTestAccount(t, "bid-driver@test.com", "driver")
+	otherToken, otherID := CreateTestAccount(t, "bid-other@test.com", "driver")
+	truckID := AssignTestTruck(t, driverID)
+	otherTruckID := AssignTestTruck(t, otherID)
+
+	idOf := func(body []byte) int {
+		id, _ := Decode(body)["id"].(float64)
+		return int(id)
+	}
+
+	_, body := Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{
+		"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.13, "dest_lon": 4.83, "weight_kg": 2000,
+	})
+	var shipment map[string]interface{}
+	json.Unmarshal(body, &shipment)
+	shipmentID := shipment["id"].(string)
+	bidsPath := "/api/shipments/" + shipmentID + "/bids"
+
+	var driverBid, otherBid int
+	t.Run("Place Bids", func(t *testing.T) {
+		code, _ := Do(t, "POST", bidsPath, driverToken, map[string]interface{}{"truck_id": otherTruckID, "price": 30000})
+		assert.Equal(t, http.StatusForbidden, code, "can't bid with someone else's truck")
+
+		code, _ = Do(t, "POST", bidsPath, farmerToken, map[string]interface{}{"truck_id": truckID, "price": 30000})
+		assert.Equal(t, http.StatusBadRequest, code, "can't bid on your own shipment")
+
+		code, body := Do(t, "POST", bidsPath, driverToken, map[string]interface{}{"truck_id": truckID, "price": 30000, "eta_minutes": 45})
+		assert.Equal(t, http.StatusCreated, code)
+		first := idOf(body)
+
+		// A second bid replaces the first
+		code, body = Do(t, "POST", bidsPath, driverToken, map[string]interface{}{"truck_id": truckID, "price": 28000})
+		assert.Equal(t, http.StatusCreated, code)
+		driverBid = idOf(body)
+		assert.NotEqual(t, first, driverBid)
+
+		code, body = Do(t, "POST", bidsPath, otherToken, map[string]interface{}{"truck_id": otherTruckID, "price": 35000})
+		assert.Equal(t, http.StatusCreated, code)
+		otherBid = idOf(body)
+	})
+
+	t.Run("Visibility", func(t *testing.T) {
+		_, body := Do(t, "GET", bidsPath, farmerToken, nil)
+		var bids []map[string]interface{}
+		json.Unmarshal(body, &bids)
+		assert.Len(t, bids, 3)
+
+		_, body = Do(t, "GET", bidsPath, otherToken, nil)
+		json.Unmarshal(body, &bids)
+		assert.Len(t, bids, 1, "carriers only see their own offers")
+	})
+
+	var counterID int
+	t.Run("Counter Offer", func(t *testing.T) {
+		code, _ := Do(t, "POST", fmt.Sprintf("/api/bids/%d/counter", driverBid), driverToken, map[string]interface{}{"price": 25000})
+		assert.Equal(t, http.StatusForbidden, code, "can't answer your own offer")
+
+		code, body := Do(t, "POST", fmt.Sprintf("/api/bids/%d/counter", driverBid), farmerToken, map[string]interface{}{"price": 25000})
+		assert.Equal(t, http.StatusCreated, code)
+		counterID = idOf(body)
+
+		code, _ = Do(t, "POST", fmt.Sprintf("/api/bids/%d/accept", driverBid), farmerToken, nil)
+		assert.Equal(t, http.StatusConflict, code, "countered offer is closed")
+
+		code, _ = Do(t, "POST", fmt.Sprintf("/api/bids/%d/accept", counterID), farmerToken, nil)
+		assert.Equal(t, http.StatusForbidden, code, "the carrier answers the counter")
+	})
+
+	t.Run("Accept Assigns Truck", func(t *testing.T) {
+		code, body := Do(t, "POST", fmt.Sprintf("/api/bids/%d/accept", counterID), driverToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var resp map[string]interface{}
+		json.Unmarshal(body, &resp)
+		assert.Equal(t, truckID, resp["truck_id"])
+		assert.Equal(t, 25000.0, resp["price"])
+
+		code, _ = Do(t, "POST", fmt.Sprintf("/api/bids/%d/accept", otherBid), farmerToken, nil)
+		assert.Equal(t, http.StatusConflict, code)
+
+		_, body = Do(t, "GET", "/api/bids", otherToken, nil)
+		var bids []map[string]interface{}
+		json.Unmarshal(body, &bids)
+		assert.Len(t, bids, 1)
+		assert.Equal(t, "REJECTED", bids[0]["status"])
+
+		code, _ = Do(t, "POST", bidsPath, otherToken, map[string]interface{}{"truck_id": otherTruckID, "price": 20000})
+		assert.Equal(t, http.StatusConflict, code, "shipment is no longer open")
+	})
+
+	t.Run("Everyone Notified", func(t *testing.T) {
+		var notes []map[string]interface{}
+		_, body := Do(t, "GET", "/api/notifications?unread=true", otherToken, nil)
+		json.Unmarshal(body, &notes)
+		assert.NotEmpty(t, notes)
+		assert.Equal(t, "bid.lost", notes[0]["kind"])
+
+		_, body = Do(t, "GET", "/api/notifications", driverToken, nil)
+		json.Unmarshal(body, &notes)
+		kinds := map[interface{}]bool{}
+		for _, n := range notes {
+			kinds[n["kind"]] = true
+			if n["kind"] == "shipment.assigned" {
+				data, _ := n["data"].(map[string]interface{})
+				assert.Equal(t, shipment["pickup_code"], data["pickup_code"], "the driver gets the code to collect the load with")
+				assert.NotEmpty(t, data["pickup_code_expires_at"])
+			}
+		}
+		assert.True(t, kinds["bid.countered"])
+		assert.True(t, kinds["shipment.assigned"])
+
+		code, _ := Do(t, "POST", "/api/notifications/read", otherToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		_, body = Do(t, "GET", "/api/notifications?unread=true", otherToken, nil)
+		json.Unmarshal(body, &notes)
+		assert.Empty(t, notes)
+	})
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"agri-track/internal/fleet"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFit(t *testing.T) {
+	kg := func(v float64) *float64 { return &v }
+	flatbed := fleet.Truck{CapacityKg: kg(5000)}
+	reefer := fleet.Truck{CapacityKg: kg(5000), Refrigerated: true}
+	cattle := fleet.Truck{CapacityKg: kg(8000), Livestock: true}
+
+	assert.Equal(t, fleet.CargoDry, fleet.CargoTypeFor(" Maize "))
+	assert.Equal(t, fleet.CargoGeneral, fleet.CargoTypeFor("yam"))
+
+	tests := []struct {
+		name    string
+		truck   fleet.Truck
+		load    fleet.Load
+		carried fleet.Carried
+		fits    bool
+	}{
+		{"General Cargo On Flatbed", flatbed, fleet.Load{WeightKg: kg(2000), CargoType: fleet.CargoGeneral}, fleet.Carried{}, true},
+		{"Chilled Needs Reefer", flatbed, fleet.Load{CargoType: fleet.CargoChilled}, fleet.Carried{}, false},
+		{"Chilled On Reefer", reefer, fleet.Load{CargoType: fleet.CargoChilled}, fleet.Carried{}, true},
+		{"Dry Needs Cover", flatbed, fleet.Load{CargoType: fleet.CargoDry}, fleet.Carried{}, false},
+		{"Reefer Counts As Covered", reefer, fleet.Load{CargoType: fleet.CargoDry}, fleet.Carried{}, true},
+		{"Livestock Needs Fitted Truck", reefer, fleet.Load{CargoType: fleet.CargoLivestock}, fleet.Carried{}, false},
+		{"No Goods With Animals", cattle, fleet.Load{CargoType: fleet.CargoGeneral}, fleet.Carried{CargoTypes: []string{fleet.CargoLivestock}}, false},
+		{"Over Capacity", flatbed, fleet.Load{WeightKg: kg(6000), CargoType: fleet.CargoGeneral}, fleet.Carried{}, false},
+		{"Over Remaining Capacity", flatbed, fleet.Load{WeightKg: kg(2000), CargoType: fleet.CargoGeneral}, fleet.Carried{WeightKg: 3500}, false},
+		{"Unknown Weight Not Checked", flatbed, fleet.Load{CargoType: fleet.CargoGeneral}, fleet.Carried{WeightKg: 5000}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fleet.CheckFit(tt.truck, tt.load, tt.carried)
+			if tt.fits {
+				assert.NoError(t, err)
+				return
+			}
+			var mismatch *fleet.MismatchError
+			assert.True(t, errors.As(err, &mismatch))
+			assert.NotEmpty(t, mismatch.Reason)
+		})
+	}
+}
+
+func TestPickupCargoMatching(t *testing.T) {
+	ClearDB(t)
+	farmerToken, _ := CreateTestAccount(t, "cargo-farmer@test.com", "farmer")
+	driverToken, driverID := CreateTestAccount(t, "cargo-driver@test.com", "driver")
+	truckID := AssignTestTruck(t, driverID) // 10 000 kg, not refrigerated
+
+	create := func(commodity string, weight float64) string {
+		code, body := Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{
+			"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.13, "dest_lon": 4.83,
+			"commodity": commodity, "weight_kg": weight,
+		})
+		resp := Decode(body)
+		assert.Equal(t, http.StatusCreated, code)
+		return resp["pickup_code"].(string)
+	}
+
+	t.Run("Chilled Cargo Rejected", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": create("tomatoes", 1000)})
+		resp := Decode(body)
+		assert.Equal(t, http.StatusUnprocessableEntity, code)
+		assert.Contains(t, resp["reason"], "refrigerated")
+	})
+
+	t.Run("Capacity Tracked Across Loads", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": create("yam", 6000)})
+		assert.Equal(t, http.StatusOK, code)
+
+		code, body := Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": create("yam", 5000)})
+		resp := Decode(body)
+		assert.Equal(t, http.StatusUnprocessableEntity, code)
+		assert.Contains(t, resp["reason"], "4000 kg")
+
+		code, _ = Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": create("yam", 4000)})
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("Preassigned Truck Checked On Create", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments", driverToken, map[string]interface{}{
+			"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.13, "dest_lon": 4.83,
+			"truck_id": truckID, "weight_kg": 500,
+		})
+		assert.Equal(t, http.StatusUnprocessableEntity, code, "truck is already full")
+	})
+
+	t.Run("Other Organization's Truck Not Found", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{
+			"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.13, "dest_lon": 4.83,
+			"truck_id": truckID, "weight_kg": 500,
+		})
+		resp := Decode(body)
+		assert.Equal(t, http.StatusNotFound, code)
+		assert.Nil(t, resp["reason"], "says nothing of the truck's load")
+	})
+}
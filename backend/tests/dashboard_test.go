@@ -13,26 +13,36 @@ func TestDashboardEndpoint(t *testing.T) {
 	// Ensure clean state
 	ClearDB(t)
 
+	token, userID := CreateTestAccount(t, "dashboard@test.com", "farmer")
+	orgID := OrgOf(t, userID)
+
 	// Setup Fixtures
 	// 1. Active Truck (IN_TRANSIT)
 	truck1 := CreateTestTruck(t)
-	CreateTestShipment(t, truck1, "IN_TRANSIT")
+	CreateOrgShipment(t, truck1, "IN_TRANSIT", orgID)
 
 	// 2. Another Active Truck (IN_TRANSIT)
 	truck2 := CreateTestTruck(t)
-	CreateTestShipment(t, truck2, "IN_TRANSIT")
+	CreateOrgShipment(t, truck2, "IN_TRANSIT", orgID)
 
 	// 3. Completed Shipment (DELIVERED)
 	truck3 := CreateTestTruck(t)
-	CreateTestShipment(t, truck3, "DELIVERED")
+	CreateOrgShipment(t, truck3, "DELIVERED", orgID)
 
 	// 4. Idle Truck (No active shipment) - Should not count as active truck in dashboard logic
 	CreateTestTruck(t)
 
+	// 5. Another organization's shipments - Should never be counted
+	_, otherUserID := CreateTestAccount(t, "other-coop@test.com", "farmer")
+	otherOrgID := OrgOf(t, otherUserID)
+	CreateOrgShipment(t, CreateTestTruck(t), "IN_TRANSIT", otherOrgID)
+	CreateOrgShipment(t, CreateTestTruck(t), "DELIVERED", otherOrgID)
+
 	router := TestRouter
 
 	t.Run("Get Summary", func(t *testing.T) {
-		req, _ := http.NewRequest("GET", "/dashboard/summary?range=24h", nil)
+		req, _ := http.NewRequest("GET", "/api/dashboard/summary?range=24h", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
 
@@ -54,4 +64,14 @@ func TestDashboardEndpoint(t *testing.T) {
 		
 		assert.Equal(t, "24h", resp["time_range"])
 	})
+
+	t.Run("Foreign Org Header Rejected", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/dashboard/summary", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Org-ID", otherOrgID)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
 }
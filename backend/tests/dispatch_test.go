@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"agri-track/internal/dispatch"
+	"agri-track/internal/fleet"
+	"agri-track/internal/geo"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRankCandidates(t *testing.T) {
+	kg := func(v float64) *float64 { return &v }
+	at := func(lat, lon float64) *geo.Point { return &geo.Point{Lat: lat, Lon: lon} }
+	job := dispatch.Job{
+		Origin:      geo.Point{Lat: 8.5, Lon: 4.55},
+		Destination: geo.Point{Lat: 9.13, Lon: 4.83},
+		Load:        fleet.Load{WeightKg: kg(3000), CargoType: fleet.CargoGeneral},
+	}
+	truck := fleet.Truck{CapacityKg: kg(10000)}
+
+	ranked := dispatch.Rank(job, []dispatch.Candidate{
+		{TruckID: "far", Position: at(8.8, 4.7), Truck: truck},
+		{TruckID: "near", Position: at(8.51, 4.56), Truck: truck},
+		{TruckID: "unknown", Truck: truck},
+		{TruckID: "too-far", Position: at(12.0, 8.5), Truck: truck},
+		{TruckID: "full", Position: at(8.5, 4.55), Truck: truck, Carried: fleet.Carried{WeightKg: 8000}},
+		{TruckID: "tired", Position: at(8.5, 4.55), Truck: truck, DrivenHours: 10},
+		{TruckID: "nearly-full", Position: at(8.5, 4.55), Truck: truck, Carried: fleet.Carried{WeightKg: 7000}},
+	}, dispatch.DefaultConfig)
+
+	var order []string
+	for _, r := range ranked {
+		order = append(order, r.TruckID)
+	}
+	// A nearly full truck at the pickup loses to an empty one a couple of kilometers out
+	assert.Equal(t, []string{"near", "nearly-full", "far"}, order)
+	assert.InDelta(t, 1.5, ranked[0].PickupKm, 0.5)
+}
+
+func TestAutoDispatch(t *testing.T) {
+	ClearDB(t)
+	ownerToken, _ := CreateTestAccount(t, "dispatch-owner@test.com", "farmer")
+	nearToken, nearID := CreateTestAccount(t, "dispatch-near@test.com", "driver")
+	farToken, farID := CreateTestAccount(t, "dispatch-far@test.com", "driver")
+
+	_, body := Do(t, "POST", "/api/orgs", ownerToken, map[string]string{"name": "Kwara Farms", "kind": "cooperative"})
+	orgID := Decode(body)["id"].(string)
+
+	// Two trucks reporting around Ilorin, and one that never reported
+	addTruck := func(plate, email, driverToken, driverID string, lat, lon float64) string {
+		_, body := Do(t, "POST", "/api/fleet/trucks", ownerToken, map[string]interface{}{"plate_number": plate, "capacity_kg": 10000}, orgID)
+		truckID := Decode(body)["id"].(string)
+		if driverID != "" {
+			Do(t, "POST", "/api/fleet/drivers", ownerToken, map[string]string{"email": email, "full_name": email}, orgID)
+			AcceptInvitations(t, driverToken)
+			code, _ := Do(t, "POST", "/api/fleet/trucks/"+truckID+"/assign", ownerToken, map[string]string{"driver_id": driverID}, orgID)
+			assert.Equal(t, http.StatusOK, code)
+			_, err := db.Pool.Exec(context.Background(), `
+				INSERT INTO logistics_events (time, truck_id, latitude, longitude, event_type, speed)
+				VALUES ($1, $2, $3, $4, 'stopped', 0)
+			`, time.Now().Add(-time.Minute), truckID, lat, lon)
+			assert.NoError(t, err)
+		}
+		return truckID
+	}
+	addTruck("KWR-100-AA", "dispatch-near@test.com", nearToken, nearID, 8.51, 4.56)
+	farTruck := addTruck("KWR-200-BB", "dispatch-far@test.com", farToken, farID, 8.7, 4.7)
+	addTruck("KWR-300-CC", "", "", "", 0, 0)
+
+	offers := func(token string) []map[string]interface{} {
+		_, body := Do(t, "GET", "/api/dispatch/offers", token, nil)
+		var list []map[string]interface{}
+		json.Unmarshal(body, &list)
+		return list
+	}
+
+	var shipmentID, pickupCode string
+	t.Run("Nearest Driver Offered First", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/shipments", ownerToken, map[string]interface{}{
+			"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.13, "dest_lon": 4.83, "weight_kg": 2000, "auto_dispatch": true,
+		}, orgID)
+		assert.Equal(t, http.StatusCreated, code)
+		resp := Decode(body)
+		shipmentID = resp["id"].(string)
+		pickupCode, _ = resp["pickup_code"].(string)
+		assert.Equal(t, "searching", resp["dispatch_status"])
+
+		list := offers(nearToken)
+		assert.Len(t, list, 1)
+		assert.Equal(t, "OFFERED", list[0]["status"])
+		assert.Empty(t, offers(farToken))
+	})
+
+	t.Run("Decline Falls Through", func(t *testing.T) {
+		nearOffer := int(offers(nearToken)[0]["id"].(float64))
+		code, _ := Do(t, "POST", fmt.Sprintf("/api/dispatch/offers/%d/accept", nearOffer), farToken, nil)
+		assert.Equal(t, http.StatusNotFound, code, "not your offer")
+
+		code, _ = Do(t, "POST", fmt.Sprintf("/api/dispatch/offers/%d/decline", nearOffer), nearToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+
+		list := offers(farToken)
+		assert.Len(t, list, 1)
+		code, body := Do(t, "POST", fmt.Sprintf("/api/dispatch/offers/%d/accept", int(list[0]["id"].(float64))), farToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		accepted := Decode(body)
+		assert.Equal(t, farTruck, accepted["truck_id"])
+		assert.Equal(t, pickupCode, accepted["pickup_code"], "the driver gets the code to collect the load with")
+		assert.NotEmpty(t, accepted["pickup_code_expires_at"])
+
+		var noted string
+		db.Pool.QueryRow(context.Background(), `
+			SELECT data->>'pickup_code' FROM user_notifications WHERE user_id=$1 AND kind='shipment.assigned'
+		`, farID).Scan(&noted)
+		assert.Equal(t, pickupCode, noted)
+
+		code, _ = Do(t, "POST", fmt.Sprintf("/api/dispatch/offers/%d/accept", nearOffer), nearToken, nil)
+		assert.Equal(t, http.StatusConflict, code, "declined offers stay declined")
+	})
+
+	t.Run("No Suitable Truck", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/shipments", ownerToken, map[string]interface{}{
+			"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.13, "dest_lon": 4.83, "commodity": "tomatoes", "auto_dispatch": true,
+		}, orgID)
+		assert.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, "failed", Decode(body)["dispatch_status"], "no refrigerated truck")
+
+		code, _ = Do(t, "POST", "/api/shipments/"+shipmentID+"/dispatch", ownerToken, nil, orgID)
+		assert.Equal(t, http.StatusNotFound, code, "already assigned")
+	})
+	t.Run("Busy Drivers Keep It Searching", func(t *testing.T) {
+		create := func() string {
+			code, body := Do(t, "POST", "/api/shipments", ownerToken, map[string]interface{}{
+				"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.13, "dest_lon": 4.83, "weight_kg": 500, "auto_dispatch": true,
+			}, orgID)
+			assert.Equal(t, http.StatusCreated, code)
+			return Decode(body)["dispatch_status"].(string)
+		}
+		assert.Equal(t, "searching", create())
+		assert.Equal(t, "searching", create())
+		assert.Equal(t, "searching", create(), "both drivers have an offer to answer first")
+
+		var open int
+		db.Pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM dispatch_offers WHERE status='OFFERED'").Scan(&open)
+		assert.Equal(t, 2, open)
+	})
+}
@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"agri-track/internal/events"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	ClearDB(t)
+	ctx := context.Background()
+	token, userID := CreateTestAccount(t, "events-farmer@test.com", "farmer")
+
+	var seen, flaky []events.Event
+	failing := true
+	bus := events.NewBus(db.Pool)
+	bus.Subscribe("recorder", func(ctx context.Context, e events.Event) error {
+		seen = append(seen, e)
+		return nil
+	}, events.ShipmentCreated)
+	bus.Subscribe("flaky", func(ctx context.Context, e events.Event) error {
+		flaky = append(flaky, e)
+		if failing {
+			return errors.New("receiver down")
+		}
+		return nil
+	})
+	bus.Subscribe("deliveries only", func(ctx context.Context, e events.Event) error {
+		t.Errorf("got a %s event", e.Type)
+		return nil
+	}, events.ShipmentDelivered)
+
+	t.Run("Published With The Change", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/shipments", token, map[string]interface{}{
+			"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.1333, "dest_lon": 4.8333, "commodity": "yam",
+		})
+		created := Decode(body)
+		assert.Equal(t, http.StatusCreated, code)
+
+		// A shipment that fails to be created publishes nothing
+		code, _ = Do(t, "POST", "/api/shipments", token, map[string]interface{}{
+			"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.1333, "dest_lon": 4.8333, "truck_id": "no-such-truck",
+		})
+		assert.NotEqual(t, http.StatusCreated, code)
+
+		n, err := bus.DispatchDue(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		if assert.Len(t, seen, 1) {
+			assert.Equal(t, events.ShipmentCreated, seen[0].Type)
+			assert.Equal(t, created["id"], seen[0].ShipmentID)
+			var data events.ShipmentCreatedData
+			assert.NoError(t, seen[0].Decode(&data))
+			assert.Equal(t, userID, data.CreatedBy)
+			assert.Equal(t, "yam", data.Commodity)
+		}
+	})
+
+	t.Run("Retried Only For The Failed Subscriber", func(t *testing.T) {
+		assert.Len(t, flaky, 1)
+		var attempts int
+		var pending []string
+		err := db.Pool.QueryRow(ctx, "SELECT attempts, pending_subscribers FROM outbox_events").Scan(&attempts, &pending)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, attempts)
+		assert.Equal(t, []string{"flaky"}, pending)
+
+		// Not due again until the backoff is over
+		n, _ := bus.DispatchDue(ctx)
+		assert.Equal(t, 0, n)
+
+		failing = false
+		db.Pool.Exec(ctx, "UPDATE outbox_events SET next_attempt_at = NOW()")
+		n, err = bus.DispatchDue(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Len(t, flaky, 2)
+		assert.Len(t, seen, 1, "the recorder already had it")
+
+		var dispatched bool
+		db.Pool.QueryRow(ctx, "SELECT dispatched_at IS NOT NULL FROM outbox_events").Scan(&dispatched)
+		assert.True(t, dispatched)
+	})
+}
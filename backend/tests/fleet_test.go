@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFleetManagement(t *testing.T) {
+	ClearDB(t)
+
+	ownerToken, _ := CreateTestAccount(t, "fleet-owner@test.com", "farmer")
+	driverToken, driverID := CreateTestAccount(t, "fleet-driver@test.com", "driver")
+	farmerToken, _ := CreateTestAccount(t, "fleet-farmer@test.com", "farmer")
+
+	_, body := Do(t, "POST", "/api/orgs", ownerToken, map[string]string{"name": "Kwara Haulage", "kind": "haulage"})
+	orgID := Decode(body)["id"].(string)
+
+	code, body := Do(t, "POST", "/api/fleet/trucks", ownerToken, map[string]interface{}{
+		"plate_number": " kwr-123-aa ", "make": "Isuzu NPR", "capacity_kg": 5000, "capacity_m3": 20, "refrigerated": true,
+	}, orgID)
+	truck := Decode(body)
+	assert.Equal(t, http.StatusCreated, code)
+	truckA := truck["id"].(string)
+	assert.Equal(t, "KWR-123-AA", truck["plate_number"])
+
+	_, body = Do(t, "POST", "/api/fleet/trucks", ownerToken, map[string]interface{}{"plate_number": "KWR-456-BB", "capacity_kg": 12000}, orgID)
+	truck = Decode(body)
+	truckB := truck["id"].(string)
+
+	t.Run("Duplicate Plate Rejected", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/fleet/trucks", ownerToken, map[string]interface{}{"plate_number": "KWR-123-AA"}, orgID)
+		assert.Equal(t, http.StatusConflict, code)
+	})
+
+	t.Run("Driver Profile", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/fleet/drivers", ownerToken, map[string]string{"email": "fleet-farmer@test.com", "full_name": "Not A Driver"}, orgID)
+		assert.Equal(t, http.StatusAccepted, code)
+		_, body := Do(t, "GET", "/api/invitations", farmerToken, nil)
+		assert.JSONEq(t, "[]", string(body), "only driver accounts are invited")
+
+		code, _ = Do(t, "POST", "/api/fleet/drivers", ownerToken, map[string]string{"email": "fleet-driver@test.com", "full_name": "Musa Bello"}, orgID)
+		assert.Equal(t, http.StatusAccepted, code)
+		code, _ = Do(t, "POST", "/api/fleet/trucks/"+truckA+"/assign", ownerToken, map[string]string{"driver_id": driverID}, orgID)
+		assert.Equal(t, http.StatusNotFound, code, "no profile until the driver accepts")
+
+		AcceptInvitations(t, driverToken)
+		_, body = Do(t, "GET", "/api/fleet/drivers", ownerToken, nil, orgID)
+		assert.Contains(t, string(body), "Musa Bello")
+	})
+
+	shipment := map[string]float64{"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.13, "dest_lon": 4.83}
+
+	t.Run("Pickup Requires Assignment", func(t *testing.T) {
+		_, body := Do(t, "POST", "/api/shipments", farmerToken, shipment)
+		created := Decode(body)
+		code, _ := Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": created["pickup_code"].(string)}, orgID)
+		assert.Equal(t, http.StatusConflict, code)
+	})
+
+	t.Run("Assign And Pickup", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/fleet/trucks/"+truckA+"/assign", driverToken, map[string]string{"driver_id": driverID}, orgID)
+		assert.Equal(t, http.StatusForbidden, code, "members can't assign")
+
+		code, _ = Do(t, "POST", "/api/fleet/trucks/"+truckA+"/assign", ownerToken, map[string]string{"driver_id": driverID}, orgID)
+		assert.Equal(t, http.StatusOK, code)
+
+		_, body := Do(t, "POST", "/api/shipments", farmerToken, shipment)
+		created := Decode(body)
+		code, body = Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": created["pickup_code"].(string)}, orgID)
+		resp := Decode(body)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, truckA, resp["truck_id"])
+
+		code, _ = Do(t, "DELETE", "/api/fleet/trucks/"+truckA, ownerToken, nil, orgID)
+		assert.Equal(t, http.StatusConflict, code, "can't retire a truck on the road")
+
+		Do(t, "POST", "/handshake", farmerToken, map[string]string{"shipment_id": resp["shipment_id"].(string)})
+	})
+
+	t.Run("Reassign Keeps History", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/fleet/trucks/"+truckB+"/assign", ownerToken, map[string]string{"driver_id": driverID}, orgID)
+		assert.Equal(t, http.StatusOK, code)
+
+		_, body := Do(t, "GET", "/api/fleet/drivers/"+driverID+"/assignments", ownerToken, nil, orgID)
+		var history []map[string]interface{}
+		json.Unmarshal(body, &history)
+		assert.Len(t, history, 2)
+		assert.Equal(t, truckB, history[0]["truck_id"])
+		assert.Nil(t, history[0]["unassigned_at"])
+		assert.Equal(t, truckA, history[1]["truck_id"])
+		assert.NotNil(t, history[1]["unassigned_at"])
+
+		code, body = Do(t, "GET", "/api/fleet/me", driverToken, nil, orgID)
+		mine := Decode(body)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, truckB, mine["id"])
+	})
+
+	t.Run("Retired Truck Can't Be Assigned", func(t *testing.T) {
+		code, _ := Do(t, "DELETE", "/api/fleet/trucks/"+truckA, ownerToken, nil, orgID)
+		assert.Equal(t, http.StatusOK, code)
+
+		code, _ = Do(t, "POST", "/api/fleet/trucks/"+truckA+"/assign", ownerToken, map[string]string{"driver_id": driverID}, orgID)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Other Orgs Can't See Trucks", func(t *testing.T) {
+		code, _ := Do(t, "GET", "/api/fleet/trucks/"+truckB, farmerToken, nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+}
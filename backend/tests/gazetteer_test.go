@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"agri-track/internal/gazetteer"
+	"agri-track/internal/geo"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGazetteer(t *testing.T) {
+	g := gazetteer.Bundled()
+
+	t.Run("Landmark", func(t *testing.T) {
+		d := g.Describe(geo.Point{Lat: 8.4927, Lon: 4.5510})
+		assert.Equal(t, "near Oja Oba, Ilorin", d.Text)
+		assert.Equal(t, "Ilorin West", d.LGA)
+		assert.Equal(t, "Kwara", d.State)
+	})
+
+	t.Run("Town", func(t *testing.T) {
+		d := g.Describe(geo.Point{Lat: 8.85, Lon: 4.68})
+		assert.Equal(t, "near Lanwa", d.Text)
+		assert.Equal(t, "Moro", d.LGA)
+	})
+
+	t.Run("Road", func(t *testing.T) {
+		// Halfway between Oloru and Lanwa
+		d := g.Describe(geo.Point{Lat: 8.7917, Lon: 4.65})
+		assert.Equal(t, "Ilorin–Jebba Rd", d.Road)
+		assert.InDelta(t, 35, d.RoadKm, 1)
+		assert.Equal(t, "Ilorin–Jebba Rd, km 35", d.Text)
+	})
+
+	t.Run("Off The Road", func(t *testing.T) {
+		d := g.Describe(geo.Point{Lat: 8.0, Lon: 4.72})
+		assert.Equal(t, "17 km S of Offa", d.Text)
+	})
+
+	t.Run("Only The LGA", func(t *testing.T) {
+		d := g.Describe(geo.Point{Lat: 9.9, Lon: 4.0})
+		assert.Equal(t, "Kaiama LGA, Kwara", d.Text)
+	})
+
+	t.Run("Nowhere Known", func(t *testing.T) {
+		assert.Empty(t, g.Describe(geo.Point{Lat: 3, Lon: 3}).Text)
+	})
+
+	t.Run("Imported", func(t *testing.T) {
+		imported, err := gazetteer.Load(fstest.MapFS{
+			"places.csv": {Data: []byte("kind,name,lat,lon,town,lga,state\ntown,Igbeti,8.75,4.13,,Olorunsogo,Oyo\n")},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "near Igbeti", imported.Describe(geo.Point{Lat: 8.751, Lon: 4.131}).Text)
+
+		_, err = gazetteer.Load(fstest.MapFS{
+			"places.csv": {Data: []byte("kind,name,lat,lon,town,lga,state\nvillage,Igbeti,8.75,4.13,,Olorunsogo,Oyo\n")},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestPlaceNames(t *testing.T) {
+	ClearDB(t)
+	token, farmerID := CreateTestAccount(t, "places-farmer@test.com", "farmer")
+	truckID := AssignTestTruck(t, farmerID) // The cooperative runs its own truck
+
+	t.Run("Reverse Geocode", func(t *testing.T) {
+		code, body := Do(t, "GET", "/api/geocode/reverse?lat=8.4927&lon=4.5510", token, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var d map[string]interface{}
+		json.Unmarshal(body, &d)
+		assert.Equal(t, "near Oja Oba, Ilorin", d["text"])
+
+		code, _ = Do(t, "GET", "/api/geocode/reverse?lat=north", token, nil)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Named At Write Time", func(t *testing.T) {
+		_, body := Do(t, "POST", "/api/shipments", token, map[string]interface{}{
+			"origin_lat": 8.4927, "origin_lon": 4.5510, "dest_lat": 9.1333, "dest_lon": 4.8333,
+		})
+		var created map[string]interface{}
+		json.Unmarshal(body, &created)
+		shipmentID := created["id"].(string)
+
+		var originPlace, destPlace string
+		err := db.Pool.QueryRow(context.Background(), "SELECT origin_place, dest_place FROM shipments WHERE id=$1", shipmentID).Scan(&originPlace, &destPlace)
+		assert.NoError(t, err)
+		assert.Equal(t, "near Oja Oba, Ilorin", originPlace)
+		assert.Equal(t, "near Jebba Paper Mill, Jebba", destPlace)
+
+		code, _ := Do(t, "POST", "/api/telemetry/incident", token, map[string]interface{}{
+			"truck_id": truckID, "shipment_id": shipmentID, "latitude": 8.7917, "longitude": 4.65,
+			"incident_type": "POLICE_CHECKPOINT", "description": "Checkpoint", "severity": 1,
+		})
+		assert.Equal(t, http.StatusOK, code)
+
+		code, body = Do(t, "GET", "/api/incidents", token, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var incidents []map[string]interface{}
+		json.Unmarshal(body, &incidents)
+		if assert.Len(t, incidents, 1) {
+			assert.Equal(t, "Ilorin–Jebba Rd, km 35", incidents[0]["place"])
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadBoard(t *testing.T) {
+	ClearDB(t)
+	farmerToken, _ := CreateTestAccount(t, "board-farmer@test.com", "farmer")
+	driverToken, driverID := CreateTestAccount(t, "board-driver@test.com", "driver")
+	otherToken, otherID := CreateTestAccount(t, "board-other@test.com", "driver")
+	truckID := AssignTestTruck(t, driverID)
+	AssignTestTruck(t, otherID)
+
+	create := func(lat, lon, payout float64) (string, string) {
+		_, body := Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{
+			"origin_lat": lat, "origin_lon": lon, "dest_lat": 9.13, "dest_lon": 4.83, "payout": payout,
+		})
+		var resp map[string]interface{}
+		json.Unmarshal(body, &resp)
+		return resp["id"].(string), resp["pickup_code"].(string)
+	}
+
+	// Two loads around Ilorin and one in Kano
+	nearID, nearCode := create(8.49, 4.54, 20000)
+	farID, _ := create(8.70, 4.70, 45000)
+	create(12.0, 8.59, 90000)
+
+	type board struct {
+		Shipments []map[string]interface{} `json:"shipments"`
+	}
+
+	t.Run("Nearby By Distance", func(t *testing.T) {
+		code, body := Do(t, "GET", "/api/loadboard?lat=8.5&lon=4.55&radius_km=50", driverToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var b board
+		json.Unmarshal(body, &b)
+		assert.Len(t, b.Shipments, 2)
+		assert.Equal(t, nearID, b.Shipments[0]["shipment_id"])
+		assert.Nil(t, b.Shipments[0]["pickup_code"], "codes aren't on the board")
+		assert.Equal(t, true, b.Shipments[0]["fits"])
+	})
+
+	t.Run("Sorted By Payout", func(t *testing.T) {
+		_, body := Do(t, "GET", "/api/loadboard?lat=8.5&lon=4.55&sort=payout", driverToken, nil)
+		var b board
+		json.Unmarshal(body, &b)
+		assert.Equal(t, farID, b.Shipments[0]["shipment_id"])
+	})
+
+	t.Run("Along Route", func(t *testing.T) {
+		// Driving Ilorin to Jebba passes both loads, driving south passes neither
+		_, body := Do(t, "GET", "/api/loadboard?lat=8.4&lon=4.5&dest_lat=9.2&dest_lon=4.9&corridor_km=20", driverToken, nil)
+		var b board
+		json.Unmarshal(body, &b)
+		assert.Len(t, b.Shipments, 2)
+
+		_, body = Do(t, "GET", "/api/loadboard?lat=8.4&lon=4.5&dest_lat=7.5&dest_lon=4.5&corridor_km=20", driverToken, nil)
+		json.Unmarshal(body, &b)
+		assert.Len(t, b.Shipments, 0)
+	})
+
+	var claimID float64
+	t.Run("Claim And Accept", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/loadboard/"+nearID+"/claim", driverToken, map[string]string{"message": "Can come today"})
+		assert.Equal(t, http.StatusCreated, code)
+		var claim map[string]interface{}
+		json.Unmarshal(body, &claim)
+		claimID = claim["id"].(float64)
+
+		code, _ = Do(t, "POST", "/api/loadboard/"+nearID+"/claim", driverToken, nil)
+		assert.Equal(t, http.StatusConflict, code, "one pending claim per driver")
+
+		code, _ = Do(t, "POST", "/api/loadboard/"+nearID+"/claim", otherToken, nil)
+		assert.Equal(t, http.StatusCreated, code)
+
+		code, _ = Do(t, "POST", fmt.Sprintf("/api/shipments/%s/claims/%d/accept", nearID, int(claimID)), driverToken, nil)
+		assert.Equal(t, http.StatusNotFound, code, "only the owner decides")
+
+		code, _ = Do(t, "POST", fmt.Sprintf("/api/shipments/%s/claims/%d/accept", nearID, int(claimID)), farmerToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+
+		_, body = Do(t, "GET", "/api/shipments/"+nearID+"/claims", farmerToken, nil)
+		var claims []map[string]interface{}
+		json.Unmarshal(body, &claims)
+		assert.Len(t, claims, 2)
+		for _, cl := range claims {
+			if cl["driver_id"] == driverID {
+				assert.Equal(t, "ACCEPTED", cl["status"])
+			} else {
+				assert.Equal(t, "REJECTED", cl["status"])
+			}
+		}
+
+		_, body = Do(t, "GET", "/api/notifications", driverToken, nil)
+		var notifications []struct {
+			Kind string                 `json:"kind"`
+			Data map[string]interface{} `json:"data"`
+		}
+		json.Unmarshal(body, &notifications)
+		if assert.NotEmpty(t, notifications) {
+			assert.Equal(t, "claim.accepted", notifications[0].Kind)
+			assert.Equal(t, nearCode, notifications[0].Data["pickup_code"], "the driver is sent the code")
+		}
+	})
+
+	t.Run("Assigned Shipment Leaves Board", func(t *testing.T) {
+		_, body := Do(t, "GET", "/api/loadboard?lat=8.5&lon=4.55", otherToken, nil)
+		var b board
+		json.Unmarshal(body, &b)
+		assert.Len(t, b.Shipments, 1)
+	})
+
+	t.Run("Only Assigned Truck Picks Up", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments/pickup", otherToken, map[string]string{"pickup_code": nearCode})
+		assert.Equal(t, http.StatusConflict, code)
+
+		code, body := Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": nearCode})
+		assert.Equal(t, http.StatusOK, code)
+		var resp map[string]interface{}
+		json.Unmarshal(body, &resp)
+		assert.Equal(t, truckID, resp["truck_id"])
+	})
+
+	t.Run("Expired Load Can't Be Claimed", func(t *testing.T) {
+		db.Pool.Exec(context.Background(), "UPDATE shipments SET pickup_until = NOW() - INTERVAL '1 minute' WHERE id=$1", farID)
+		code, _ := Do(t, "POST", "/api/loadboard/"+farID+"/claim", otherToken, nil)
+		assert.Equal(t, http.StatusConflict, code)
+	})
+}
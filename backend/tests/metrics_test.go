@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"agri-track/internal/handlers"
+	"agri-track/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// metricValue returns the value of a series in a scrape, -1 if it isn't there.
+func metricValue(scrape, series string) float64 {
+	for _, line := range strings.Split(scrape, "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, _ := strconv.ParseFloat(value, 64)
+			return v
+		}
+	}
+	return -1
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	ClearDB(t)
+	router := TestRouter
+	token, userID := CreateTestAccount(t, "metrics@test.com", "driver")
+	truckID := AssignTestTruck(t, userID)
+	shipmentID := CreateOrgShipment(t, truckID, "IN_TRANSIT", OrgOf(t, userID))
+
+	scrape := func() string {
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer test-metrics-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	t.Run("Token Required", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Not Found Without Token Configured", func(t *testing.T) {
+		open := gin.New()
+		open.GET("/metrics", handlers.NewMetricsHandler(handlers.NewTelemetryHandler(nil, nil), "").Serve)
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		w := httptest.NewRecorder()
+		open.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Telemetry Pipeline", func(t *testing.T) {
+		before := scrape()
+		for i := 0; i < 2; i++ {
+			code, _ := Do(t, "POST", "/api/telemetry", token, models.LogisticsEvent{
+				TruckID: truckID, ShipmentID: shipmentID, Latitude: 5, Longitude: 5, EventType: "moving", Speed: 40, Time: time.Now(),
+			})
+			assert.Equal(t, http.StatusAccepted, code)
+		}
+
+		after := scrape()
+		assert.Equal(t, max(0, metricValue(before, `agritrack_telemetry_shipment_cache_lookups_total{result="miss"}`))+1,
+			metricValue(after, `agritrack_telemetry_shipment_cache_lookups_total{result="miss"}`))
+		assert.Equal(t, max(0, metricValue(before, `agritrack_telemetry_shipment_cache_lookups_total{result="hit"}`))+1,
+			metricValue(after, `agritrack_telemetry_shipment_cache_lookups_total{result="hit"}`))
+		assert.Equal(t, 1000.0, metricValue(after, "agritrack_telemetry_queue_capacity"))
+		assert.Contains(t, after, `agritrack_http_requests_total{method="POST",route="/api/telemetry",status="202"}`)
+
+		flushed := max(0, metricValue(before, `agritrack_telemetry_events_flushed_total{result="ok"}`))
+		assert.Eventually(t, func() bool {
+			return metricValue(scrape(), `agritrack_telemetry_events_flushed_total{result="ok"}`) >= flushed+2
+		}, 5*time.Second, 100*time.Millisecond)
+		assert.Greater(t, metricValue(scrape(), "agritrack_telemetry_copy_duration_seconds_count"), 0.0)
+	})
+
+	t.Run("Domain", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/telemetry/incident", token, map[string]interface{}{
+			"truck_id": truckID, "shipment_id": shipmentID, "latitude": 5, "longitude": 5,
+			"incident_type": "BAD_ROAD", "description": "Potholes", "severity": 2,
+		})
+		assert.Equal(t, http.StatusOK, code)
+
+		s := scrape()
+		assert.Equal(t, 1.0, metricValue(s, `agritrack_shipments{status="IN_TRANSIT"}`))
+		assert.Equal(t, 1.0, metricValue(s, `agritrack_incidents_last_24h{type="BAD_ROAD"}`))
+		assert.GreaterOrEqual(t, metricValue(s, `agritrack_incidents_reported_total{type="BAD_ROAD"}`), 1.0)
+		assert.Greater(t, metricValue(s, "agritrack_db_pool_max_conns"), 0.0)
+		assert.Greater(t, metricValue(s, "go_goroutines"), 0.0, "runtime collectors are served too")
+	})
+}
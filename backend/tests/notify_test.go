@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"agri-track/internal/events"
+	"agri-track/internal/notify"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotificationChannels(t *testing.T) {
+	ClearDB(t)
+	ctx := context.Background()
+	farmerToken, farmerID := CreateTestAccount(t, "notify-farmer@test.com", "farmer")
+	driverToken, driverID := CreateTestAccount(t, "notify-driver@test.com", "driver")
+	truckID := AssignTestTruck(t, driverID)
+	phone := "+2348030000043"
+	db.Pool.Exec(ctx, "UPDATE users SET phone=$2 WHERE id=$1", farmerID, phone)
+	db.Pool.Exec(ctx, "UPDATE trucks SET plate_number='LAG-004' WHERE id=$1", truckID)
+
+	sendAll := func() {
+		_, err := TestEvents.DispatchDue(ctx)
+		assert.NoError(t, err)
+		_, err = TestNotifications.SendDue(ctx)
+		assert.NoError(t, err)
+	}
+	inbox := func() []map[string]interface{} {
+		code, body := Do(t, "GET", "/api/notifications", farmerToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var resp []map[string]interface{}
+		json.Unmarshal(body, &resp)
+		return resp
+	}
+	mailed := func() []notify.Sent {
+		var out []notify.Sent
+		for _, s := range TestMail.Sent() {
+			if s.To == "notify-farmer@test.com" {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+
+	t.Run("Preferences", func(t *testing.T) {
+		code, body := Do(t, "GET", "/api/notifications/preferences", farmerToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var prefs map[string]interface{}
+		json.Unmarshal(body, &prefs)
+		assert.ElementsMatch(t, []interface{}{"in_app", "sms"}, prefs["channels"])
+		assert.Equal(t, "Africa/Lagos", prefs["time_zone"])
+
+		code, _ = Do(t, "PUT", "/api/notifications/preferences", farmerToken, map[string]interface{}{"channels": []string{"pigeon"}})
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = Do(t, "PUT", "/api/notifications/preferences", farmerToken, map[string]interface{}{"channels": []string{"sms"}, "time_zone": "Mars/Olympus"})
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = Do(t, "PUT", "/api/notifications/preferences", farmerToken, map[string]interface{}{
+			"channels": []string{"sms"}, "quiet_hours": map[string]string{"start": "late", "end": "06:00"},
+		})
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _ = Do(t, "PUT", "/api/notifications/preferences", farmerToken, map[string]interface{}{"channels": []string{"sms", "email", "in_app"}})
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	_, body := Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{
+		"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 8.6, "dest_lon": 4.6, "commodity": "yams",
+	})
+	var created map[string]interface{}
+	json.Unmarshal(body, &created)
+	shipmentID := created["id"].(string)
+
+	t.Run("Every Channel", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": created["pickup_code"].(string)})
+		assert.Equal(t, http.StatusOK, code)
+		sendAll()
+
+		sms, ok := TestSMS.Last(phone)
+		if assert.True(t, ok) {
+			assert.Contains(t, sms.Body, "LAG-004 picked up your yams at ")
+		}
+		if mail := mailed(); assert.Len(t, mail, 1) {
+			assert.Equal(t, "Picked up: your yams", mail[0].Message.Subject)
+		}
+		if messages := inbox(); assert.Len(t, messages, 1) {
+			assert.Equal(t, events.ShipmentPickedUp, messages[0]["kind"])
+			assert.Equal(t, shipmentID, messages[0]["data"].(map[string]interface{})["shipment_id"])
+		}
+	})
+
+	t.Run("Deduplicated", func(t *testing.T) {
+		// The bus hands events over again after a failure
+		e := events.Event{ID: 999, Type: events.ShipmentPickedUp, ShipmentID: shipmentID, Data: []byte("{}"), OccurredAt: time.Now()}
+		assert.NoError(t, TestNotifications.NotifyShipper(ctx, e))
+		sendAll()
+		assert.Len(t, mailed(), 1)
+		assert.Len(t, inbox(), 1)
+	})
+
+	t.Run("Minor Incidents Skipped", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/telemetry/incident", driverToken, map[string]interface{}{
+			"truck_id": truckID, "shipment_id": shipmentID, "latitude": 8.55, "longitude": 4.57,
+			"incident_type": "TRAFFIC", "description": "Slow", "severity": 1,
+		})
+		assert.Equal(t, http.StatusOK, code)
+		sendAll()
+		assert.Len(t, inbox(), 1)
+	})
+
+	t.Run("Quiet Hours", func(t *testing.T) {
+		lagos, _ := time.LoadLocation("Africa/Lagos")
+		now := time.Now().In(lagos)
+		code, _ := Do(t, "PUT", "/api/notifications/preferences", farmerToken, map[string]interface{}{
+			"channels":    []string{"sms", "email", "in_app"},
+			"quiet_hours": map[string]string{"start": now.Add(-time.Hour).Format("15:04"), "end": now.Add(time.Hour).Format("15:04")},
+		})
+		assert.Equal(t, http.StatusOK, code)
+		texts := len(TestSMS.Messages())
+
+		code, _ = Do(t, "POST", "/api/handshake", driverToken, map[string]string{"shipment_id": shipmentID})
+		assert.Equal(t, http.StatusOK, code)
+		sendAll()
+
+		assert.Len(t, TestSMS.Messages(), texts, "texts wait for quiet hours to end")
+		assert.Len(t, mailed(), 1)
+		if messages := inbox(); assert.Len(t, messages, 2) {
+			assert.Equal(t, events.ShipmentDelivered, messages[0]["kind"])
+			assert.Contains(t, messages[0]["body"], "LAG-004 delivered your yams at ")
+		}
+
+		var waiting int
+		db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM notification_messages WHERE user_id=$1 AND status='pending' AND send_after > NOW()", farmerID).Scan(&waiting)
+		assert.Equal(t, 2, waiting)
+	})
+
+	t.Run("Retried After A Failure", func(t *testing.T) {
+		code, _ := Do(t, "PUT", "/api/notifications/preferences", farmerToken, map[string]interface{}{"channels": []string{"email"}})
+		assert.Equal(t, http.StatusOK, code)
+		TestMail.FailNext(1)
+		e := events.Event{ID: 1000, Type: events.IncidentReported, ShipmentID: shipmentID, OccurredAt: time.Now(),
+			Data: []byte(`{"incident_type": "BREAKDOWN", "severity": 4}`)}
+		assert.NoError(t, TestNotifications.NotifyShipper(ctx, e))
+		sendAll()
+		assert.Len(t, mailed(), 1)
+
+		var attempts int
+		db.Pool.QueryRow(ctx, "SELECT attempts FROM notification_messages WHERE user_id=$1 AND kind=$2", farmerID, events.IncidentReported).Scan(&attempts)
+		assert.Equal(t, 1, attempts)
+
+		db.Pool.Exec(ctx, "UPDATE notification_messages SET send_after=NOW() WHERE user_id=$1 AND kind=$2", farmerID, events.IncidentReported)
+		sendAll()
+		if mail := mailed(); assert.Len(t, mail, 2) {
+			assert.Equal(t, "Incident: LAG-004 reported a breakdown", mail[1].Message.Subject)
+		}
+	})
+}
+
+func TestSMTPTimeout(t *testing.T) {
+	// A server that takes the connection and never greets
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = notify.SMTPDriver{Addr: ln.Addr().String(), From: "no-reply@agritrack.ng"}.Send(ctx, "farmer@test.com", notify.Message{Subject: "Hello", Body: "Hi"})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second, "gives up at the deadline")
+}
@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrgInvitations(t *testing.T) {
+	ClearDB(t)
+	ownerToken, _ := CreateTestAccount(t, "coop-owner@test.com", "farmer")
+	memberToken, memberID := CreateTestAccount(t, "coop-member@test.com", "farmer")
+	otherToken, _ := CreateTestAccount(t, "coop-other@test.com", "farmer")
+
+	_, body := Do(t, "POST", "/api/orgs", ownerToken, map[string]string{"name": "Oyo Farmers", "kind": "cooperative"})
+	orgID := Decode(body)["id"].(string)
+
+	members := func(token string, orgID ...string) []map[string]interface{} {
+		_, body := Do(t, "GET", "/api/org/members", token, nil, orgID...)
+		var list []map[string]interface{}
+		json.Unmarshal(body, &list)
+		return list
+	}
+	invitations := func(token string) []map[string]interface{} {
+		_, body := Do(t, "GET", "/api/invitations", token, nil)
+		var list []map[string]interface{}
+		json.Unmarshal(body, &list)
+		return list
+	}
+
+	var invitationID int
+	t.Run("Invite", func(t *testing.T) {
+		code, known := Do(t, "POST", "/api/org/members", ownerToken, map[string]string{"email": "coop-member@test.com", "role": "member"}, orgID)
+		assert.Equal(t, http.StatusAccepted, code)
+		code, unknown := Do(t, "POST", "/api/org/members", ownerToken, map[string]string{"email": "nobody@test.com", "role": "member"}, orgID)
+		assert.Equal(t, http.StatusAccepted, code)
+		assert.Equal(t, string(known), string(unknown), "doesn't tell who has an account")
+
+		assert.Len(t, members(ownerToken, orgID), 1, "not a member before accepting")
+		list := invitations(memberToken)
+		if assert.Len(t, list, 1) {
+			assert.Equal(t, "Oyo Farmers", list[0]["org_name"])
+			invitationID = int(list[0]["id"].(float64))
+		}
+	})
+
+	t.Run("Only The Invitee Answers", func(t *testing.T) {
+		code, _ := Do(t, "POST", fmt.Sprintf("/api/invitations/%d/accept", invitationID), otherToken, nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+		code, _ := Do(t, "POST", fmt.Sprintf("/api/invitations/%d/accept", invitationID), memberToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Len(t, members(ownerToken, orgID), 2)
+		code, _ = Do(t, "POST", fmt.Sprintf("/api/invitations/%d/accept", invitationID), memberToken, nil)
+		assert.Equal(t, http.StatusNotFound, code, "already answered")
+
+		// Joining doesn't change what requests without X-Org-ID act for
+		mine := members(memberToken)
+		if assert.Len(t, mine, 1) {
+			assert.Equal(t, memberID, mine[0]["user_id"])
+		}
+
+		code, _ = Do(t, "POST", "/api/org/members", ownerToken, map[string]string{"email": "coop-member@test.com", "role": "member"}, orgID)
+		assert.Equal(t, http.StatusAccepted, code)
+		assert.Empty(t, invitations(memberToken), "members aren't invited again")
+	})
+
+	t.Run("Decline", func(t *testing.T) {
+		Do(t, "POST", "/api/org/members", ownerToken, map[string]string{"email": "coop-other@test.com", "role": "dispatcher"}, orgID)
+		list := invitations(otherToken)
+		if !assert.Len(t, list, 1) {
+			return
+		}
+		code, _ := Do(t, "POST", fmt.Sprintf("/api/invitations/%d/decline", int(list[0]["id"].(float64))), otherToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Empty(t, invitations(otherToken))
+		assert.Len(t, members(ownerToken, orgID), 2)
+	})
+}
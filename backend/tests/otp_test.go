@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"agri-track/internal/utils"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	cases := map[string]string{
+		"08031234567":       "+2348031234567",
+		"+234 803 123 4567": "+2348031234567",
+		"002348031234567":   "+2348031234567",
+		"(0803) 123-4567":   "+2348031234567",
+	}
+	for in, want := range cases {
+		got, err := utils.NormalizePhone(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	for _, bad := range []string{"", "12345", "0803abc4567", "+0803123456789"} {
+		_, err := utils.NormalizePhone(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestOTPLogin(t *testing.T) {
+	ClearDB(t)
+	phone := "+2348031234567"
+	var token string
+
+	t.Run("Request Code", func(t *testing.T) {
+		status, _ := Do(t, "POST", "/otp/request", "", map[string]string{"phone": "08031234567"})
+		assert.Equal(t, http.StatusAccepted, status)
+
+		_, ok := TestSMS.Last(phone)
+		assert.True(t, ok, "code should be sent by SMS")
+	})
+
+	t.Run("Cooldown Between Requests", func(t *testing.T) {
+		status, _ := Do(t, "POST", "/otp/request", "", map[string]string{"phone": phone})
+		assert.Equal(t, http.StatusTooManyRequests, status)
+	})
+
+	t.Run("Wrong Code", func(t *testing.T) {
+		status, _ := Do(t, "POST", "/otp/verify", "", map[string]string{"phone": phone, "code": "000000x"})
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Correct Code Registers Account", func(t *testing.T) {
+		msg, _ := TestSMS.Last(phone)
+		code := regexp.MustCompile(`\d{6}`).FindString(msg.Body)
+
+		status, body := Do(t, "POST", "/otp/verify", "", map[string]string{"phone": phone, "code": code, "role": "driver"})
+		assert.Equal(t, http.StatusOK, status)
+
+		var resp map[string]interface{}
+		json.Unmarshal(body, &resp)
+		assert.NotEmpty(t, resp["token"])
+		assert.Equal(t, true, resp["created"])
+		token, _ = resp["token"].(string)
+	})
+
+	t.Run("Attach Email", func(t *testing.T) {
+		CreateTestAccount(t, "taken@test.com", "farmer")
+		status, _ := Do(t, "POST", "/api/account/email", token, map[string]string{"email": "taken@test.com", "password": "securepassword"})
+		assert.Equal(t, http.StatusConflict, status, "email belongs to another account")
+
+		status, _ = Do(t, "POST", "/api/account/email", token, map[string]string{"email": "otp-driver@test.com", "password": "securepassword"})
+		assert.Equal(t, http.StatusOK, status)
+		status, _ = Do(t, "POST", "/api/account/email", token, map[string]string{"email": "otp-again@test.com", "password": "securepassword"})
+		assert.Equal(t, http.StatusConflict, status, "account already has an email")
+	})
+
+	t.Run("Code Cannot Be Reused", func(t *testing.T) {
+		msg, _ := TestSMS.Last(phone)
+		code := regexp.MustCompile(`\d{6}`).FindString(msg.Body)
+
+		status, _ := Do(t, "POST", "/otp/verify", "", map[string]string{"phone": phone, "code": code})
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Attempts Capped", func(t *testing.T) {
+		other := "+2348031234568"
+		status, _ := Do(t, "POST", "/otp/request", "", map[string]string{"phone": other})
+		assert.Equal(t, http.StatusAccepted, status)
+		msg, _ := TestSMS.Last(other)
+		code := regexp.MustCompile(`\d{6}`).FindString(msg.Body)
+
+		for i := 1; i < 5; i++ {
+			status, _ := Do(t, "POST", "/otp/verify", "", map[string]string{"phone": other, "code": "000000x"})
+			assert.Equal(t, http.StatusUnauthorized, status, "attempt %d", i)
+		}
+		status, _ = Do(t, "POST", "/otp/verify", "", map[string]string{"phone": other, "code": "000000x"})
+		assert.Equal(t, http.StatusTooManyRequests, status, "fifth wrong code uses up the code")
+
+		status, _ = Do(t, "POST", "/otp/verify", "", map[string]string{"phone": other, "code": code})
+		assert.Equal(t, http.StatusTooManyRequests, status, "right code no longer accepted")
+	})
+}
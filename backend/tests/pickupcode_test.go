@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"agri-track/internal/pickupcode"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickupCodeGenerator(t *testing.T) {
+	g := &pickupcode.Generator{Alphabet: "AB", Length: 8}
+
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		code, err := g.New()
+		assert.NoError(t, err)
+		assert.Len(t, code, len(pickupcode.Prefix)+8)
+		assert.Empty(t, strings.Trim(strings.TrimPrefix(code, pickupcode.Prefix), "AB"), "only alphabet symbols are used")
+		seen[code] = true
+	}
+	assert.Greater(t, len(seen), 1, "codes are random")
+
+	assert.Equal(t, "AG-7KQ2MX", pickupcode.Normalize(" ag-7kq2mx "))
+	assert.Equal(t, "AG-7KQ2MX", pickupcode.Normalize("7kq2mx"))
+}
+
+func TestPickupCodeLifecycle(t *testing.T) {
+	ClearDB(t)
+	farmerToken, _ := CreateTestAccount(t, "codes-farmer@test.com", "farmer")
+	driverToken, driverID := CreateTestAccount(t, "codes-driver@test.com", "driver")
+	AssignTestTruck(t, driverID)
+
+	code, body := Do(t, "POST", "/api/shipments", farmerToken, map[string]float64{
+		"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.13, "dest_lon": 4.83,
+	})
+	created := Decode(body)
+	assert.Equal(t, http.StatusCreated, code)
+	shipmentID := created["id"].(string)
+	oldCode := created["pickup_code"].(string)
+
+	t.Run("Only Owner Regenerates", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments/"+shipmentID+"/pickup-code", driverToken, nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	var newCode string
+	t.Run("Regenerate Replaces Code", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/shipments/"+shipmentID+"/pickup-code", farmerToken, nil)
+		resp := Decode(body)
+		assert.Equal(t, http.StatusOK, code)
+		newCode = resp["pickup_code"].(string)
+		assert.NotEqual(t, oldCode, newCode)
+
+		code, _ = Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": oldCode})
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("Expired Code Rejected", func(t *testing.T) {
+		db.Pool.Exec(context.Background(), "UPDATE shipments SET pickup_code_expires_at = NOW() - INTERVAL '1 minute' WHERE id=$1", shipmentID)
+
+		code, _ := Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": newCode})
+		assert.Equal(t, http.StatusGone, code)
+	})
+}
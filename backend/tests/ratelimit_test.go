@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"agri-track/internal/middleware"
+	"agri-track/internal/ratelimit"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	limit := ratelimit.Every(time.Second, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		ok, _ := store.Take("k", limit, now)
+		assert.True(t, ok, "burst request %d", i)
+	}
+
+	ok, retryAfter := store.Take("k", limit, now)
+	assert.False(t, ok)
+	assert.InDelta(t, time.Second, retryAfter, float64(time.Millisecond))
+
+	ok, _ = store.Take("k", limit, now.Add(time.Second))
+	assert.True(t, ok, "bucket refills over time")
+
+	ok, _ = store.Take("other", limit, now)
+	assert.True(t, ok, "keys are independent")
+}
+
+func TestLockout(t *testing.T) {
+	lockout := ratelimit.NewLockout(ratelimit.NewMemoryStore(), 3, time.Minute, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		locked, _ := lockout.Fail("driver-1")
+		assert.False(t, locked)
+	}
+	lockout.Reset("driver-1")
+
+	for i := 0; i < 2; i++ {
+		lockout.Fail("driver-1")
+	}
+	locked, _ := lockout.Locked("driver-1")
+	assert.False(t, locked, "reset clears earlier failures")
+
+	locked, retryAfter := lockout.Fail("driver-1")
+	assert.True(t, locked)
+	assert.Equal(t, time.Hour, retryAfter)
+
+	locked, _ = lockout.Locked("driver-1")
+	assert.True(t, locked)
+}
+
+func TestLoginLockout(t *testing.T) {
+	ClearDB(t)
+	router := TestRouter
+	CreateTestAccount(t, "locked@test.com", "farmer")
+
+	login := func(ip, password string) int {
+		body, _ := json.Marshal(map[string]string{"email": "locked@test.com", "password": password})
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(body))
+		req.RemoteAddr = ip + ":40000"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusUnauthorized, login("203.0.113.7", "wrongpassword"))
+	}
+
+	// Even the right password is refused while locked
+	assert.Equal(t, http.StatusTooManyRequests, login("203.0.113.7", "testpassword"))
+
+	// The owner logging in from elsewhere isn't locked out
+	assert.Equal(t, http.StatusOK, login("198.51.100.20", "testpassword"))
+
+	// Guesses spread over many IPs add up for the account
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, http.StatusUnauthorized, login(fmt.Sprintf("192.0.2.%d", i+1), "wrongpassword"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, login("198.51.100.20", "testpassword"))
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	// The test router leaves rate limits out, so the middleware gets its own
+	r := gin.New()
+	r.GET("/limited", middleware.RateLimit(ratelimit.NewMemoryStore(), ratelimit.Every(time.Minute, 2), middleware.ByIP("test")), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	get := func(ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/limited", nil)
+		req.RemoteAddr = ip + ":40000"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusOK, get("203.0.113.7").Code, "burst request %d", i)
+	}
+	w := get("203.0.113.7")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	// Other clients have their own bucket
+	assert.Equal(t, http.StatusOK, get("198.51.100.20").Code)
+}
+
+func TestPickupCodeLockout(t *testing.T) {
+	ClearDB(t)
+	token, driverID := CreateTestAccount(t, "guesser@test.com", "driver")
+	AssignTestTruck(t, driverID)
+
+	for i := 0; i < 5; i++ {
+		code, _ := Do(t, "POST", "/api/shipments/pickup", token, map[string]string{"pickup_code": "AG-00000" + string(rune('0'+i))})
+		assert.Equal(t, http.StatusNotFound, code)
+	}
+	code, _ := Do(t, "POST", "/api/shipments/pickup", token, map[string]string{"pickup_code": "AG-000009"})
+	assert.Equal(t, http.StatusTooManyRequests, code)
+}
@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFleetReport(t *testing.T) {
+	ClearDB(t)
+	ctx := context.Background()
+	token, userID := CreateTestAccount(t, "report@test.com", "farmer")
+	orgID := OrgOf(t, userID)
+	_, otherID := CreateTestAccount(t, "report-other@test.com", "farmer")
+	truckID := CreateTestTruck(t)
+
+	// About 12 km apart, planned at an hour and a half
+	shipment := func(org, commodity, cargoType string, value interface{}, started, completed string) string {
+		id := uuid.New().String()
+		_, err := db.Pool.Exec(ctx, `
+			INSERT INTO shipments (id, truck_id, origin_lat, origin_lon, dest_lat, dest_lon, status, commodity, cargo_type, cargo_value,
+				started_at, completed_at, org_id)
+			VALUES ($1, $2, 8.5, 4.55, 8.6, 4.6, 'DELIVERED', $3, $4, $5, NOW() - $6::interval, NOW() - $7::interval, $8)
+		`, id, truckID, commodity, cargoType, value, started, completed, org)
+		if err != nil {
+			t.Fatalf("Failed to create shipment: %v", err)
+		}
+		return id
+	}
+	late := shipment(orgID, "tomatoes", "chilled", 450000, "10 hours", "6 hours")
+	shipment(orgID, "maize", "dry", nil, "5 hours", "4 hours")
+	shipment(orgID, "maize", "dry", nil, "30 hours", "29 hours") // The day before
+	shipment(OrgOf(t, otherID), "fish", "chilled", 900000, "10 hours", "2 hours")
+	db.Pool.Exec(ctx, `
+		INSERT INTO logistics_incidents (time, truck_id, shipment_id, latitude, longitude, incident_type, severity, place)
+		VALUES (NOW() - INTERVAL '9 hours', $1, $2, 8.55, 4.57, 'BREAKDOWN', 3, 'Ilorin–Jebba Rd, km 42')
+	`, truckID, late)
+
+	t.Run("Figures", func(t *testing.T) {
+		code, body := Do(t, "GET", "/api/reports/fleet?range=24h", token, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var resp struct {
+			Figures struct {
+				Deliveries  int      `json:"deliveries"`
+				OnTime      int      `json:"on_time"`
+				Late        int      `json:"late"`
+				OnTimeRate  *float64 `json:"on_time_rate"`
+				Incidents   int      `json:"incidents"`
+				ValueAtRisk float64  `json:"value_at_risk"`
+			} `json:"figures"`
+			Previous struct {
+				Deliveries int `json:"deliveries"`
+			} `json:"previous"`
+			Hotspots []struct {
+				Place     string `json:"place"`
+				Incidents int    `json:"incidents"`
+			} `json:"hotspots"`
+			Delays []struct {
+				Cause string `json:"cause"`
+			} `json:"delays"`
+			Exposure struct {
+				Value     float64 `json:"value"`
+				Shipments int     `json:"shipments"`
+			} `json:"exposure"`
+			Markdown string `json:"markdown"`
+		}
+		json.Unmarshal(body, &resp)
+
+		assert.Equal(t, 2, resp.Figures.Deliveries, "other organizations' deliveries are left out")
+		assert.Equal(t, 1, resp.Figures.OnTime)
+		assert.Equal(t, 1, resp.Figures.Late)
+		if assert.NotNil(t, resp.Figures.OnTimeRate) {
+			assert.Equal(t, 0.5, *resp.Figures.OnTimeRate)
+		}
+		assert.Equal(t, 1, resp.Figures.Incidents)
+		assert.Equal(t, 450000.0, resp.Figures.ValueAtRisk)
+		assert.Equal(t, 1, resp.Previous.Deliveries)
+		if assert.Len(t, resp.Hotspots, 1) {
+			assert.Equal(t, "Ilorin–Jebba Rd, km 42", resp.Hotspots[0].Place)
+		}
+		if assert.Len(t, resp.Delays, 1) {
+			assert.Equal(t, "BREAKDOWN", resp.Delays[0].Cause)
+		}
+		assert.Equal(t, 450000.0, resp.Exposure.Value)
+		assert.Equal(t, 1, resp.Exposure.Shipments)
+		assert.Contains(t, resp.Markdown, "- **Deliveries:** 2 (up 100% from 1)")
+		assert.Contains(t, resp.Markdown, "- **tomatoes:** ₦450,000 on 1 shipment")
+	})
+
+	t.Run("Markdown", func(t *testing.T) {
+		// The content type matters here, so the request goes through a recorder
+		req, _ := http.NewRequest("GET", "/api/reports/fleet?range=7d&format=markdown", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		TestRouter.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/markdown; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.True(t, strings.HasPrefix(w.Body.String(), "# "), w.Body.String())
+		assert.Contains(t, w.Body.String(), "| Breakdown |")
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		code, _ := Do(t, "GET", "/api/reports/fleet?range=1y", token, nil)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Window Decides Lateness", func(t *testing.T) {
+		// Slower than planned, but inside the window promised
+		slow := shipment(orgID, "yam", "general", nil, "20 hours", "3 hours")
+		db.Pool.Exec(ctx, "UPDATE shipments SET deliver_by = NOW() - INTERVAL '1 hour' WHERE id=$1", slow)
+
+		var resp struct {
+			Figures struct {
+				OnTime int `json:"on_time"`
+				Late   int `json:"late"`
+			} `json:"figures"`
+		}
+		_, body := Do(t, "GET", "/api/reports/fleet?range=24h", token, nil)
+		json.Unmarshal(body, &resp)
+		assert.Equal(t, 2, resp.Figures.OnTime)
+		assert.Equal(t, 1, resp.Figures.Late)
+	})
+}
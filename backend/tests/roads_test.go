@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"agri-track/internal/geo"
+	"agri-track/internal/roads"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/paulmach/osm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoadRouting(t *testing.T) {
+	// A farm track straight from A to C, a trunk road around through D, and
+	// a one-way street from C to F
+	points := map[osm.NodeID]geo.Point{
+		1: {Lat: 8.500, Lon: 4.500}, // A
+		2: {Lat: 8.500, Lon: 4.520}, // B
+		3: {Lat: 8.500, Lon: 4.540}, // C
+		4: {Lat: 8.510, Lon: 4.520}, // D
+		5: {Lat: 8.490, Lon: 4.540}, // F
+	}
+	data := &osm.OSM{}
+	for id, p := range points {
+		data.Nodes = append(data.Nodes, &osm.Node{ID: id, Lat: p.Lat, Lon: p.Lon})
+	}
+	road := func(id osm.WayID, tags osm.Tags, nodes ...osm.NodeID) {
+		w := &osm.Way{ID: id, Tags: tags}
+		for _, n := range nodes {
+			w.Nodes = append(w.Nodes, osm.WayNode{ID: n})
+		}
+		data.Ways = append(data.Ways, w)
+	}
+	road(1, osm.Tags{{Key: "highway", Value: "track"}}, 1, 2, 3)
+	road(2, osm.Tags{{Key: "highway", Value: "trunk"}}, 1, 4, 3)
+	road(3, osm.Tags{{Key: "highway", Value: "residential"}, {Key: "oneway", Value: "yes"}}, 3, 5)
+	road(4, osm.Tags{{Key: "highway", Value: "footway"}}, 2, 5)
+	g := roads.FromOSM(data)
+
+	a, c, f := points[1], points[3], points[5]
+
+	t.Run("Fastest Takes The Trunk Road", func(t *testing.T) {
+		path, err := g.Route(a, c, roads.Fastest)
+		assert.NoError(t, err)
+		assert.Contains(t, path.Points, points[4])
+		assert.InDelta(t, 4.9, path.DistanceM/1000, 0.1)
+		assert.InDelta(t, 4.2, path.Duration.Minutes(), 0.2)
+	})
+
+	t.Run("Shortest Takes The Track", func(t *testing.T) {
+		path, err := g.Route(a, c, roads.Shortest)
+		assert.NoError(t, err)
+		assert.Contains(t, path.Points, points[2])
+		assert.InDelta(t, 4.4, path.DistanceM/1000, 0.1)
+		assert.InDelta(t, path.DistanceM, g.Matrix([]geo.Point{a, c})[0][1], 1)
+	})
+
+	t.Run("One Way And Footway", func(t *testing.T) {
+		_, err := g.Route(c, f, roads.Fastest)
+		assert.NoError(t, err)
+		_, err = g.Route(f, c, roads.Fastest)
+		assert.ErrorIs(t, err, roads.ErrNoRoute, "against the one-way, and trucks can't take the footway")
+	})
+
+	t.Run("Loaded From PBF", func(t *testing.T) {
+		// testdata/junction.osm.pbf holds the same roads, as dense nodes
+		loaded, err := roads.Load(context.Background(), "testdata/junction.osm.pbf")
+		if !assert.NoError(t, err) {
+			return
+		}
+		nodes, edges := g.Size()
+		loadedNodes, loadedEdges := loaded.Size()
+		assert.Equal(t, nodes, loadedNodes)
+		assert.Equal(t, edges, loadedEdges)
+
+		want, _ := g.Route(a, c, roads.Fastest)
+		path, err := loaded.Route(a, c, roads.Fastest)
+		assert.NoError(t, err)
+		assert.InDelta(t, want.DistanceM, path.DistanceM, 1)
+		_, err = loaded.Route(f, c, roads.Fastest)
+		assert.ErrorIs(t, err, roads.ErrNoRoute)
+
+		_, err = roads.Load(context.Background(), "testdata/missing.osm.pbf")
+		assert.Error(t, err)
+	})
+
+	t.Run("Off The Map", func(t *testing.T) {
+		_, err := g.Route(a, geo.Point{Lat: 9.5, Lon: 5.5}, roads.Fastest)
+		assert.ErrorIs(t, err, roads.ErrOffRoad)
+		// Distances still get an estimate for planning
+		assert.Greater(t, g.Distance(a, geo.Point{Lat: 9.5, Lon: 5.5}), 100000.0)
+	})
+
+	t.Run("Map Matching", func(t *testing.T) {
+		// A truck on the farm track with a tracker jumping 15m either side,
+		// and one fix 60m off
+		var track []geo.Point
+		for i := 0; i <= 20; i++ {
+			jitter := 0.000135
+			if i%2 == 1 {
+				jitter = -jitter
+			}
+			if i == 10 {
+				jitter = 0.00055
+			}
+			track = append(track, geo.Point{Lat: 8.5 + jitter, Lon: 4.5 + float64(i)*0.002})
+		}
+		track = append(track, geo.Point{Lat: 9.5, Lon: 5.5}) // Nowhere near a road
+
+		match, err := g.Match(track)
+		assert.NoError(t, err)
+		for i, p := range match.Snapped[:21] {
+			if assert.NotNil(t, p, "fix %d", i) {
+				assert.InDelta(t, 8.5, p.Lat, 0.00001, "fix %d is on the track", i)
+			}
+		}
+		assert.Nil(t, match.Snapped[21])
+		assert.InDelta(t, 4399, match.DistanceM, 30)
+		assert.Greater(t, geo.Length(track[:21]), match.DistanceM, "jitter inflates the raw distance")
+		assert.Contains(t, match.Points, points[2])
+
+		_, err = g.Match([]geo.Point{{Lat: 9.5, Lon: 5.5}})
+		assert.ErrorIs(t, err, roads.ErrOffRoad)
+	})
+
+	t.Run("Following A Polyline", func(t *testing.T) {
+		line := []geo.Point{a, points[2], c}
+		length := geo.Length(line)
+		mid := geo.Interpolate(line, length/2)
+		assert.InDelta(t, 4.52, mid.Lon, 0.001)
+
+		along, off := geo.ProjectLine(points[4], line)
+		assert.InDelta(t, length/2, along, 10)
+		assert.InDelta(t, 1100, off, 20)
+	})
+}
+
+func TestDirections(t *testing.T) {
+	ClearDB(t)
+	token, _ := CreateTestAccount(t, "directions@test.com", "driver")
+
+	// Without an extract the route is estimated from the straight line
+	code, body := Do(t, "GET", "/api/routes/directions?from_lat=8.5&from_lon=4.55&to_lat=9.1333&to_lon=4.8333", token, nil)
+	resp := Decode(body)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, resp["points"], 2)
+	assert.InDelta(t, 100, resp["distance_km"], 1)
+
+	code, _ = Do(t, "GET", "/api/routes/directions?from_lat=8.5&from_lon=4.55&to_lat=9.1333&to_lon=4.8333&mode=scenic", token, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = Do(t, "GET", "/api/routes/directions?from_lat=8.5&from_lon=4.55", token, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"agri-track/internal/geo"
+	"agri-track/internal/vrp"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSolveRoutes(t *testing.T) {
+	depot := geo.Point{Lat: 8.49, Lon: 4.55}
+	departure := time.Date(2025, 3, 1, 6, 0, 0, 0, time.UTC)
+	farm := func(lat, lon, kg float64) vrp.Stop {
+		return vrp.Stop{Point: geo.Point{Lat: lat, Lon: lon}, DemandKg: kg, Service: 15 * time.Minute}
+	}
+	truck := vrp.Vehicle{Start: depot, End: depot, CapacityKg: 3000, Departure: departure}
+
+	t.Run("Capacity Splits Runs", func(t *testing.T) {
+		// Two clusters of farms, each a full truck load
+		sol := vrp.Solve(vrp.Problem{
+			Vehicles: []vrp.Vehicle{truck, truck},
+			Stops: []vrp.Stop{
+				farm(8.60, 4.50, 1000), farm(8.38, 4.62, 1000), farm(8.61, 4.52, 1000),
+				farm(8.37, 4.60, 1000), farm(8.62, 4.49, 1000), farm(8.36, 4.61, 1000),
+			},
+			SpeedKmh: 40,
+		}, vrp.Haversine{Detour: 1.3})
+
+		assert.Empty(t, sol.Unassigned)
+		for _, r := range sol.Routes {
+			assert.Len(t, r.Stops, 3)
+			assert.Equal(t, 3000.0, r.LoadKg)
+			north := r.Stops[0]%2 == 0
+			for _, s := range r.Stops {
+				assert.Equal(t, north, s%2 == 0, "a truck stays in one cluster")
+			}
+		}
+	})
+
+	t.Run("Closed Window Leaves Stop Unassigned", func(t *testing.T) {
+		late := farm(9.5, 5.5, 500)
+		late.WindowEnd = departure.Add(30 * time.Minute)
+		sol := vrp.Solve(vrp.Problem{
+			Vehicles: []vrp.Vehicle{truck},
+			Stops:    []vrp.Stop{farm(8.55, 4.56, 500), late},
+			SpeedKmh: 40,
+		}, vrp.Haversine{Detour: 1.3})
+
+		assert.Equal(t, []int{1}, sol.Unassigned)
+		assert.Equal(t, []int{0}, sol.Routes[0].Stops)
+	})
+
+	t.Run("Window Decides Order", func(t *testing.T) {
+		// The shortest order is near then far, but far closes too soon for that
+		near, far := farm(8.52, 4.55, 500), farm(8.70, 4.55, 500)
+		far.WindowEnd = departure.Add(50 * time.Minute)
+		sol := vrp.Solve(vrp.Problem{
+			Vehicles: []vrp.Vehicle{{Start: depot, End: geo.Point{Lat: 8.80, Lon: 4.55}, Departure: departure}},
+			Stops:    []vrp.Stop{near, far},
+			SpeedKmh: 40,
+		}, vrp.Haversine{Detour: 1.3})
+
+		assert.Empty(t, sol.Unassigned)
+		assert.Equal(t, []int{1, 0}, sol.Routes[0].Stops)
+		assert.True(t, sol.Routes[0].Arrivals[0].Before(far.WindowEnd))
+	})
+}
+
+func TestCollectionRuns(t *testing.T) {
+	ClearDB(t)
+	ownerToken, _ := CreateTestAccount(t, "routes-owner@test.com", "farmer")
+
+	_, body := Do(t, "POST", "/api/orgs", ownerToken, map[string]string{"name": "Offa Growers", "kind": "cooperative"})
+	orgID := Decode(body)["id"].(string)
+	var truckIDs []string
+	for _, plate := range []string{"OFA-100-AA", "OFA-200-BB"} {
+		code, body := Do(t, "POST", "/api/fleet/trucks", ownerToken, map[string]interface{}{"plate_number": plate, "capacity_kg": 2500, "covered": true}, orgID)
+		assert.Equal(t, http.StatusCreated, code)
+		truckIDs = append(truckIDs, Decode(body)["id"].(string))
+	}
+
+	request := map[string]interface{}{
+		"depot": map[string]interface{}{"lat": 8.15, "lon": 4.72, "name": "Offa aggregation centre"},
+		"pickups": []map[string]interface{}{
+			{"lat": 8.25, "lon": 4.70, "name": "Farm A", "quantity_kg": 1200},
+			{"lat": 8.26, "lon": 4.72, "name": "Farm B", "quantity_kg": 1200},
+			{"lat": 8.05, "lon": 4.75, "name": "Farm C", "quantity_kg": 1200},
+			{"lat": 8.04, "lon": 4.73, "name": "Farm D", "quantity_kg": 1200},
+			{"lat": 8.10, "lon": 4.80, "name": "Farm E", "quantity_kg": 5000},
+		},
+		"commodity": "maize",
+	}
+
+	t.Run("Truck Listed Twice", func(t *testing.T) {
+		twice := map[string]interface{}{"truck_ids": []string{truckIDs[0], truckIDs[0]}}
+		for k, v := range request {
+			twice[k] = v
+		}
+		code, body := Do(t, "POST", "/api/routes/plan", ownerToken, twice, orgID)
+		assert.Equal(t, http.StatusOK, code)
+		routes := Decode(body)["routes"].([]interface{})
+		if assert.Len(t, routes, 1) {
+			assert.Equal(t, truckIDs[0], routes[0].(map[string]interface{})["truck_id"])
+		}
+	})
+
+	var plan map[string]interface{}
+	t.Run("Plan", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/routes/plan", ownerToken, request, orgID)
+		assert.Equal(t, http.StatusOK, code)
+		plan = Decode(body)
+
+		routes := plan["routes"].([]interface{})
+		assert.Len(t, routes, 2)
+		for _, r := range routes {
+			route := r.(map[string]interface{})
+			assert.Len(t, route["pickups"], 2)
+			assert.Equal(t, 2400.0, route["load_kg"])
+		}
+		unassigned := plan["unassigned"].([]interface{})
+		assert.Len(t, unassigned, 1, "too heavy for any truck")
+		assert.Equal(t, "Farm E", unassigned[0].(map[string]interface{})["name"])
+	})
+
+	t.Run("Commit", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/routes/commit", ownerToken, plan, orgID)
+		assert.Equal(t, http.StatusCreated, code)
+		shipments := Decode(body)["shipments"].([]interface{})
+		assert.Len(t, shipments, 2)
+
+		shipment := shipments[0].(map[string]interface{})
+		code, body = Do(t, "GET", "/api/shipments/"+shipment["id"].(string)+"/stops", ownerToken, nil, orgID)
+		assert.Equal(t, http.StatusOK, code)
+		stops := Decode(body)["stops"].([]interface{})
+		assert.Len(t, stops, 3)
+		last := stops[2].(map[string]interface{})
+		assert.Equal(t, "dropoff", last["kind"])
+		assert.Equal(t, 2400.0, last["quantity_kg"])
+	})
+
+	t.Run("Reserved Load Leaves Less Room", func(t *testing.T) {
+		// Each truck now has 2400 of its 2500 kg reserved
+		code, body := Do(t, "POST", "/api/routes/plan", ownerToken, request, orgID)
+		assert.Equal(t, http.StatusOK, code)
+		replan := Decode(body)
+		assert.Empty(t, replan["routes"])
+		assert.Len(t, replan["unassigned"], 5)
+	})
+
+	t.Run("Foreign Truck Rejected", func(t *testing.T) {
+		plan["routes"].([]interface{})[0].(map[string]interface{})["truck_id"] = "TRK-NOT-OURS"
+		code, _ := Do(t, "POST", "/api/routes/commit", ownerToken, plan, orgID)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+}
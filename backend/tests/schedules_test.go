@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"agri-track/internal/handlers"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportSchedules(t *testing.T) {
+	ClearDB(t)
+	router := TestRouter
+	ctx := context.Background()
+	reports := handlers.NewReportHandler()
+	token, userID := CreateTestAccount(t, "schedules@test.com", "farmer")
+	orgID := OrgOf(t, userID)
+	otherToken, _ := CreateTestAccount(t, "schedules-other@test.com", "farmer")
+	truckID := CreateTestTruck(t)
+	shipmentID := CreateOrgShipment(t, truckID, "DELIVERED", orgID)
+	db.Pool.Exec(ctx, `
+		UPDATE shipments SET commodity='tomatoes', started_at=NOW() - INTERVAL '3 hours', completed_at=NOW() - INTERVAL '1 hour' WHERE id=$1
+	`, shipmentID)
+
+	t.Run("TimeZone", func(t *testing.T) {
+		code, _ := Do(t, "PUT", "/api/org", token, map[string]interface{}{"time_zone": "Mars/Olympus"})
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = Do(t, "PUT", "/api/org", token, map[string]interface{}{"time_zone": "Africa/Accra"})
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	var scheduleIDs []int
+	t.Run("Create", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/reports/schedules", token, map[string]interface{}{"kind": "fleet", "cron": "0 25 * * *"})
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = Do(t, "POST", "/api/reports/schedules", token, map[string]interface{}{"kind": "fleet", "cron": "0 0 31 2 *"})
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		for _, kind := range []string{"fleet", "trips"} {
+			code, body = Do(t, "POST", "/api/reports/schedules", token, map[string]interface{}{"kind": kind, "cron": "0 7 * * *"})
+			assert.Equal(t, http.StatusCreated, code)
+			var s struct {
+				ID       int      `json:"id"`
+				Range    string   `json:"range"`
+				Channels []string `json:"channels"`
+				TimeZone string   `json:"time_zone"`
+			}
+			json.Unmarshal(body, &s)
+			assert.Equal(t, "24h", s.Range)
+			assert.ElementsMatch(t, []string{"email", "in_app"}, s.Channels)
+			assert.Equal(t, "Africa/Accra", s.TimeZone)
+			scheduleIDs = append(scheduleIDs, s.ID)
+		}
+
+		_, body = Do(t, "GET", "/api/reports/schedules", otherToken, nil)
+		assert.Equal(t, "[]", string(body))
+	})
+
+	t.Run("Run", func(t *testing.T) {
+		// Nothing is due until 7 AM
+		n, err := reports.RunDue(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+
+		db.Pool.Exec(ctx, `
+			UPDATE report_schedules SET next_run_at = NOW() - INTERVAL '1 minute', created_at = NOW() - INTERVAL '1 day' WHERE org_id=$1
+		`, orgID)
+		n, err = reports.RunDue(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		var due bool
+		db.Pool.QueryRow(ctx, "SELECT bool_or(next_run_at <= NOW()) FROM report_schedules WHERE org_id=$1", orgID).Scan(&due)
+		assert.False(t, due)
+	})
+
+	t.Run("Delivery", func(t *testing.T) {
+		_, err := TestNotifications.SendDue(ctx)
+		assert.NoError(t, err)
+
+		var names []string
+		for _, s := range TestMail.Sent() {
+			if s.To != "schedules@test.com" {
+				continue
+			}
+			for _, a := range s.Message.Attachments {
+				assert.Equal(t, "application/pdf", a.ContentType)
+				assert.True(t, bytes.HasPrefix(a.Data, []byte("%PDF-")))
+				names = append(names, a.Name)
+			}
+		}
+		assert.Len(t, names, 2)
+		assert.Contains(t, names, "trip-report-"+shipmentID[:8]+".pdf")
+
+		var inApp int
+		db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM notification_messages WHERE user_id=$1 AND channel='in_app' AND kind='report'", userID).Scan(&inApp)
+		assert.Equal(t, 2, inApp)
+	})
+
+	t.Run("Archive", func(t *testing.T) {
+		code, body := Do(t, "GET", "/api/reports/archive", token, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var archive []struct {
+			ID         int     `json:"id"`
+			Kind       string  `json:"kind"`
+			ShipmentID *string `json:"shipment_id"`
+		}
+		json.Unmarshal(body, &archive)
+		assert.Len(t, archive, 2)
+
+		_, body = Do(t, "GET", "/api/reports/archive?kind=trip", token, nil)
+		json.Unmarshal(body, &archive)
+		if assert.Len(t, archive, 1) {
+			assert.Equal(t, shipmentID, *archive[0].ShipmentID)
+		}
+
+		path := "/api/reports/archive/" + strconv.Itoa(archive[0].ID)
+		// Headers matter for downloads, so these go through a recorder
+		req, _ := http.NewRequest("GET", path+"?format=pdf", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		pdf := httptest.NewRecorder()
+		router.ServeHTTP(pdf, req)
+		assert.Equal(t, http.StatusOK, pdf.Code)
+		assert.Equal(t, "application/pdf", pdf.Header().Get("Content-Type"))
+		assert.True(t, bytes.HasPrefix(pdf.Body.Bytes(), []byte("%PDF-")))
+
+		_, body = Do(t, "GET", path+"?format=markdown", token, nil)
+		assert.Contains(t, string(body), "# Trip Report: Tomatoes")
+
+		code, _ = Do(t, "GET", path, otherToken, nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("TripReport", func(t *testing.T) {
+		code, body := Do(t, "GET", "/api/shipments/"+shipmentID+"/report", token, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var trip struct {
+			Outcome  string `json:"outcome"`
+			TimeZone string `json:"time_zone"`
+		}
+		json.Unmarshal(body, &trip)
+		assert.Equal(t, "Africa/Accra", trip.TimeZone)
+
+		req, _ := http.NewRequest("GET", "/api/shipments/"+shipmentID+"/report?format=pdf", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		pdf := httptest.NewRecorder()
+		router.ServeHTTP(pdf, req)
+		assert.Equal(t, http.StatusOK, pdf.Code)
+		assert.Contains(t, pdf.Header().Get("Content-Disposition"), "trip-report-")
+
+		code, _ = Do(t, "GET", "/api/shipments/"+shipmentID+"/report?format=docx", token, nil)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _ = Do(t, "GET", "/api/shipments/"+shipmentID+"/report", otherToken, nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("Failure Backs Off", func(t *testing.T) {
+		db.Pool.Exec(ctx, "UPDATE report_schedules SET next_run_at = NOW() - INTERVAL '1 minute' WHERE org_id=$1", orgID)
+		db.Pool.Exec(ctx, "UPDATE report_schedules SET cron = 'not a cron' WHERE id=$1", scheduleIDs[0])
+
+		n, err := reports.RunDue(ctx)
+		assert.NoError(t, err, "one broken schedule doesn't stop the round")
+		assert.Equal(t, 1, n)
+
+		var retryIn float64
+		db.Pool.QueryRow(ctx, "SELECT EXTRACT(EPOCH FROM next_run_at - NOW()) FROM report_schedules WHERE id=$1", scheduleIDs[0]).Scan(&retryIn)
+		assert.InDelta(t, 15*60, retryIn, 60)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		code, _ := Do(t, "DELETE", "/api/reports/schedules/"+strconv.Itoa(scheduleIDs[0]), otherToken, nil)
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = Do(t, "DELETE", "/api/reports/schedules/"+strconv.Itoa(scheduleIDs[0]), token, nil)
+		assert.Equal(t, http.StatusNoContent, code)
+	})
+}
@@ -2,11 +2,26 @@ package tests
 
 import (
 	"agri-track/internal/db"
+	"agri-track/internal/dispatch"
+	"agri-track/internal/events"
+	"agri-track/internal/gazetteer"
 	"agri-track/internal/handlers"
 	"agri-track/internal/middleware"
+	"agri-track/internal/pickupcode"
+	"agri-track/internal/ratelimit"
+	"agri-track/internal/models"
+	"agri-track/internal/notify"
+	"agri-track/internal/sms"
 	"agri-track/internal/utils"
+	"agri-track/internal/roads"
+	"agri-track/internal/webhook"
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -19,6 +34,33 @@ import (
 
 var TestRouter *gin.Engine
 
+// TestSMS captures every text message sent by the router under test.
+var TestSMS = sms.NewFakeSender()
+
+// TestMail captures every email sent by the router under test.
+var TestMail = notify.NewFakeDriver(notify.Email)
+
+// TestNotifications sends the notifications queued by the router under test
+// when a test calls SendDue.
+var TestNotifications = handlers.NewNotificationHandler(notify.Drivers{
+	notify.SMS:   notify.SMSDriver{Sender: TestSMS},
+	notify.Email: TestMail,
+	notify.InApp: handlers.Inbox{},
+})
+
+// TestEvents hands the events published by the router under test to their
+// subscribers when a test calls DispatchDue.
+var TestEvents *events.Bus
+
+// TestWebhooks sends the webhooks queued by the router under test when a
+// test calls DeliverDue. Failed deliveries are due again right away. The
+// test receivers listen on loopback.
+var TestWebhooks = handlers.NewWebhookHandler(webhook.Config{Timeout: 5 * time.Second, MaxAttempts: 3, AllowPrivate: true})
+
+// TestSLA estimates arrivals for the shipments of the router under test
+// when a test calls CheckETAs.
+var TestSLA = handlers.NewSLAHandler(roads.Straight{Detour: roads.DefaultDetour, SpeedKmh: roads.DefaultSpeedKmh})
+
 func TestMain(m *testing.M) {
 	// 1. Load Environment
 	_ = godotenv.Load("../.env")
@@ -52,11 +94,35 @@ func TestMain(m *testing.M) {
 
 func setupRouter() *gin.Engine {
 	// Initialize Handlers
-	telemetryHandler := handlers.NewTelemetryHandler()
-	queryHandler := handlers.NewQueryHandler()
-	authHandler := handlers.NewAuthHandler()
-	shipmentHandler := handlers.NewShipmentHandler()
+	roadNetwork := roads.Straight{Detour: roads.DefaultDetour, SpeedKmh: roads.DefaultSpeedKmh}
+	places := gazetteer.Bundled()
+	telemetryHandler := handlers.NewTelemetryHandler(roadNetwork, places)
+	queryHandler := handlers.NewQueryHandler(places)
+	limiterStore := ratelimit.NewMemoryStore()
+	authHandler := handlers.NewAuthHandler(TestSMS, ratelimit.NewLockout(limiterStore, 5, 15*time.Minute, 15*time.Minute),
+		ratelimit.NewLockout(limiterStore, 20, time.Hour, 15*time.Minute))
+	pickupCodes := &pickupcode.Generator{Alphabet: pickupcode.DefaultAlphabet, Length: pickupcode.DefaultLength, TTL: pickupcode.DefaultTTL}
+	dispatchHandler := handlers.NewDispatchHandler(dispatch.DefaultConfig)
+	shipmentHandler := handlers.NewShipmentHandler(ratelimit.NewLockout(limiterStore, 5, 15*time.Minute, 30*time.Minute), pickupCodes, dispatchHandler, roadNetwork, places)
+	routeHandler := handlers.NewRouteHandler(shipmentHandler, roadNetwork)
+	ussdHandler := handlers.NewUSSDHandler(shipmentHandler, "test-ussd-token")
+	smsCommandHandler := handlers.NewSMSCommandHandler(shipmentHandler, telemetryHandler, TestSMS, "test-sms-token")
 	dashboardHandler := handlers.NewDashboardHandler()
+	metricsHandler := handlers.NewMetricsHandler(telemetryHandler, "test-metrics-token")
+	analyticsHandler := handlers.NewAnalyticsHandler()
+	slaHandler := TestSLA
+	reportHandler := handlers.NewReportHandler()
+	adminHandler := handlers.NewAdminHandler()
+	orgHandler := handlers.NewOrgHandler()
+	fleetHandler := handlers.NewFleetHandler()
+	loadBoardHandler := handlers.NewLoadBoardHandler(roadNetwork)
+	bidHandler := handlers.NewBidHandler()
+	notificationHandler := TestNotifications
+	webhookHandler := TestWebhooks
+	TestEvents = events.NewBus(db.Pool)
+	TestEvents.Subscribe("webhooks", webhookHandler.QueueDeliveries, webhook.EventTypes...)
+	TestEvents.Subscribe("notifications", notificationHandler.NotifyShipper, notify.Kinds()...)
+	TestEvents.Subscribe("sla", slaHandler.TrackShipment, events.ShipmentPickedUp, events.ShipmentDelivered)
 
 	// Start Batch Processor (background)
 	// Note: In tests, this might run forever. We can cancel it if we had a context control here.
@@ -65,24 +131,139 @@ func setupRouter() *gin.Engine {
 
 	// Setup Router
 	gin.SetMode(gin.TestMode)
-	r := gin.Default()
+	r := gin.New()
+	r.Use(middleware.Logger("token"), gin.Recovery())
+	r.Use(middleware.Metrics())
 	r.Use(middleware.CORSMiddleware())
 
 	// Public Routes
 	r.POST("/login", authHandler.Login)
 	r.POST("/register", authHandler.Register)
-	r.GET("/status", queryHandler.GetTruckStatus)
-	r.GET("/dashboard/summary", dashboardHandler.GetSummary)
+	r.POST("/otp/request", authHandler.RequestOTP)
+	r.POST("/otp/verify", authHandler.VerifyOTP)
+	r.POST("/ussd", ussdHandler.Callback)
+	r.POST("/sms/inbound", smsCommandHandler.Inbound)
+	r.GET("/metrics", metricsHandler.Serve)
 
 	// Protected Routes
+	// Owners and dispatchers manage the fleet and decide who carries shipments,
+	// everyone in the organization can view
+	fleetRole := middleware.RequireOrgRole(models.OrgRoleOwner, models.OrgRoleDispatcher)
+
 	api := r.Group("/api")
 	api.Use(middleware.AuthMiddleware())
+	api.Use(middleware.OrgMiddleware())
 	{
+		api.GET("/status", queryHandler.GetTruckStatus)
+		api.GET("/dashboard/summary", dashboardHandler.GetSummary)
+		api.GET("/dashboard/late-risk", slaHandler.LateRisk)
+		api.GET("/analytics/deliveries", analyticsHandler.Deliveries)
+		api.GET("/analytics/active-trucks", analyticsHandler.ActiveTrucks)
+		api.GET("/analytics/incidents", analyticsHandler.Incidents)
+		api.GET("/analytics/corridors", analyticsHandler.CorridorSpeeds)
+		api.GET("/reports/fleet", reportHandler.GetFleetReport)
+		api.GET("/shipments/:id/report", reportHandler.GetTripReport)
+		api.GET("/reports/schedules", reportHandler.ListSchedules)
+		api.POST("/reports/schedules", fleetRole, reportHandler.CreateSchedule)
+		api.DELETE("/reports/schedules/:id", fleetRole, reportHandler.DeleteSchedule)
+		api.GET("/reports/archive", reportHandler.ListArchive)
+		api.GET("/reports/archive/:id", reportHandler.GetArchived)
+		api.GET("/sla/policies", slaHandler.ListPolicies)
+		api.POST("/sla/policies", fleetRole, slaHandler.CreatePolicy)
+		api.DELETE("/sla/policies/:id", fleetRole, slaHandler.DeletePolicy)
+		api.GET("/orgs", orgHandler.ListMyOrgs)
+		api.PUT("/org", middleware.RequireOrgRole(models.OrgRoleOwner), orgHandler.UpdateSettings)
+		api.POST("/orgs", orgHandler.CreateOrg)
+		api.GET("/org/members", orgHandler.ListMembers)
+		api.POST("/org/members", middleware.RequireOrgRole(models.OrgRoleOwner), orgHandler.AddMember)
+		api.PUT("/org/members/:user_id", middleware.RequireOrgRole(models.OrgRoleOwner), orgHandler.UpdateMember)
+		api.PUT("/org/members/:user_id/account-role", middleware.RequireOrgRole(models.OrgRoleOwner), orgHandler.UpdateAccountRole)
+		api.DELETE("/org/members/:user_id", middleware.RequireOrgRole(models.OrgRoleOwner), orgHandler.RemoveMember)
+		api.GET("/invitations", orgHandler.ListInvitations)
+		api.POST("/invitations/:id/accept", orgHandler.AcceptInvitation)
+		api.POST("/invitations/:id/decline", orgHandler.DeclineInvitation)
+		api.GET("/locations", orgHandler.ListLocations)
+		api.POST("/locations", orgHandler.CreateLocation)
+		api.GET("/shipments/active", shipmentHandler.GetActiveShipments)
+		api.GET("/fleet/trucks", fleetHandler.ListTrucks)
+		api.GET("/fleet/trucks/:id", fleetHandler.GetTruck)
+		api.GET("/fleet/trucks/:id/assignments", fleetHandler.TruckAssignments)
+		api.GET("/fleet/trucks/:id/capacity", fleetHandler.TruckCapacity)
+		api.POST("/fleet/trucks", fleetRole, fleetHandler.CreateTruck)
+		api.PUT("/fleet/trucks/:id", fleetRole, fleetHandler.UpdateTruck)
+		api.DELETE("/fleet/trucks/:id", fleetRole, fleetHandler.RetireTruck)
+		api.POST("/fleet/trucks/:id/assign", fleetRole, fleetHandler.AssignDriver)
+		api.POST("/fleet/trucks/:id/unassign", fleetRole, fleetHandler.UnassignTruck)
+		api.GET("/fleet/drivers", fleetHandler.ListDrivers)
+		api.GET("/fleet/drivers/:id/assignments", fleetHandler.DriverAssignments)
+		api.POST("/fleet/drivers", fleetRole, fleetHandler.CreateDriver)
+		api.PUT("/fleet/drivers/:id", fleetRole, fleetHandler.UpdateDriver)
+		api.GET("/fleet/me", fleetHandler.MyTruck)
+		api.GET("/loadboard", loadBoardHandler.ListOpenShipments)
+		api.POST("/loadboard/:id/claim", loadBoardHandler.ClaimShipment)
+		api.GET("/loadboard/claims", loadBoardHandler.MyClaims)
+		api.DELETE("/loadboard/claims/:id", loadBoardHandler.WithdrawClaim)
+		api.GET("/shipments/:id/claims", loadBoardHandler.ListClaims)
+		api.POST("/shipments/:id/claims/:claim_id/accept", fleetRole, loadBoardHandler.AcceptClaim)
+		api.POST("/shipments/:id/claims/:claim_id/reject", fleetRole, loadBoardHandler.RejectClaim)
+
+		api.POST("/shipments/:id/bids", bidHandler.PlaceBid)
+		api.GET("/shipments/:id/bids", bidHandler.ListShipmentBids)
+		api.GET("/bids", bidHandler.MyBids)
+		api.POST("/bids/:id/counter", bidHandler.CounterBid)
+		api.POST("/bids/:id/accept", bidHandler.AcceptBid)
+		api.POST("/bids/:id/reject", bidHandler.RejectBid)
+		api.POST("/bids/:id/withdraw", bidHandler.WithdrawBid)
+
+		api.POST("/shipments/:id/dispatch", fleetRole, dispatchHandler.StartDispatch)
+		api.GET("/dispatch/offers", dispatchHandler.MyOffers)
+		api.POST("/dispatch/offers/:id/accept", dispatchHandler.AcceptOffer)
+		api.POST("/dispatch/offers/:id/decline", dispatchHandler.DeclineOffer)
+
+		api.GET("/routes/directions", routeHandler.Directions)
+		api.GET("/geocode/reverse", queryHandler.ReverseGeocode)
+		api.POST("/routes/plan", fleetRole, routeHandler.PlanRoutes)
+		api.POST("/routes/commit", fleetRole, routeHandler.CommitRoutes)
+
+		api.GET("/notifications", notificationHandler.ListNotifications)
+		api.POST("/notifications/read", notificationHandler.MarkRead)
+		api.GET("/notifications/preferences", notificationHandler.GetPreferences)
+		api.PUT("/notifications/preferences", notificationHandler.UpdatePreferences)
+		api.POST("/notifications/:id/read", notificationHandler.MarkRead)
+
+		ownerRole := middleware.RequireOrgRole(models.OrgRoleOwner)
+		api.GET("/webhooks", ownerRole, webhookHandler.ListSubscriptions)
+		api.POST("/webhooks", ownerRole, webhookHandler.CreateSubscription)
+		api.DELETE("/webhooks/:id", ownerRole, webhookHandler.DeleteSubscription)
+		api.GET("/webhooks/:id/deliveries", ownerRole, webhookHandler.ListDeliveries)
+		api.GET("/webhooks/:id/deliveries/:delivery_id", ownerRole, webhookHandler.GetDelivery)
+		api.POST("/webhooks/:id/deliveries/:delivery_id/redeliver", ownerRole, webhookHandler.Redeliver)
+		api.POST("/account/phone", authHandler.AttachPhone)
+		api.POST("/account/email", authHandler.AttachEmail)
 		api.POST("/shipments", shipmentHandler.CreateShipment)
+		api.POST("/shipments/pickup", shipmentHandler.PickupShipment)
 		api.POST("/shipments/start", shipmentHandler.StartShipment)
+		api.POST("/shipments/:id/pickup-code", shipmentHandler.RegeneratePickupCode)
+		api.POST("/shipments/verify", shipmentHandler.VerifyArrival)
+		api.GET("/shipments/:id/stops", shipmentHandler.ListStops)
+		api.POST("/shipments/:id/stops/:seq/complete", shipmentHandler.CompleteStop)
+		api.GET("/shipments/:id/track", telemetryHandler.GetTrack)
+		api.POST("/shipments/:id/track/match", fleetRole, telemetryHandler.MatchTrack)
 		api.POST("/handshake", shipmentHandler.Handshake)
 		api.POST("/telemetry", telemetryHandler.ReceiveTelemetry)
 		api.POST("/telemetry/incident", telemetryHandler.ReportIncident)
+		api.GET("/incidents", telemetryHandler.GetRecentIncidents)
+	}
+
+	admin := api.Group("/admin")
+	admin.Use(middleware.RequireRole(models.RoleAdmin))
+	{
+		admin.GET("/users", adminHandler.ListUsers)
+		admin.POST("/users/:id/suspend", adminHandler.SuspendUser)
+		admin.POST("/users/:id/reactivate", adminHandler.ReactivateUser)
+		admin.PUT("/users/:id/role", adminHandler.ChangeRole)
+		admin.DELETE("/users/:id", adminHandler.DeleteUser)
+		admin.GET("/audit", adminHandler.GetAuditLog)
 	}
 
 	return r
@@ -99,6 +280,11 @@ func ClearDB(t *testing.T) {
 		"TRUNCATE TABLE shipments RESTART IDENTITY CASCADE",
 		"TRUNCATE TABLE trucks RESTART IDENTITY CASCADE",
 		"TRUNCATE TABLE users RESTART IDENTITY CASCADE",
+		"TRUNCATE TABLE otp_codes RESTART IDENTITY CASCADE",
+		"TRUNCATE TABLE audit_log RESTART IDENTITY CASCADE",
+		"TRUNCATE TABLE organizations CASCADE",
+		"TRUNCATE TABLE outbox_events RESTART IDENTITY",
+		"TRUNCATE TABLE inbound_sms",
 	}
 
 	for _, q := range queries {
@@ -138,6 +324,98 @@ func CreateTestUser(t *testing.T, username string) (string, int) {
 	return tokenString, id
 }
 
+// CreateTestAccount inserts an email account with the given role and its
+// personal organization, and returns a valid JWT token and user ID.
+func CreateTestAccount(t *testing.T, email, role string) (string, string) {
+	ctx := context.Background()
+	hashedPassword, _ := utils.HashPassword("testpassword")
+
+	id := uuid.New().String()
+	_, err := db.Pool.Exec(ctx, "INSERT INTO users (id, email, password, role) VALUES ($1, $2, $3, $4)", id, email, hashedPassword, role)
+	if err != nil {
+		t.Fatalf("Failed to create test account: %v", err)
+	}
+
+	orgID := uuid.New().String()
+	_, err = db.Pool.Exec(ctx, "INSERT INTO organizations (id, name, kind) VALUES ($1, $2, 'individual')", orgID, email)
+	if err == nil {
+		_, err = db.Pool.Exec(ctx, "INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, 'owner')", orgID, id)
+	}
+	if err != nil {
+		t.Fatalf("Failed to create test organization: %v", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": id,
+		"role":    role,
+		"exp":     time.Now().Add(24 * time.Hour).Unix(),
+	})
+
+	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	return tokenString, id
+}
+
+// OrgOf returns the personal organization of a test account.
+func OrgOf(t *testing.T, userID string) string {
+	var orgID string
+	err := db.Pool.QueryRow(context.Background(), `
+		SELECT m.org_id FROM org_members m JOIN organizations o ON o.id = m.org_id
+		WHERE m.user_id = $1 AND o.kind = 'individual'
+	`, userID).Scan(&orgID)
+	if err != nil {
+		t.Fatalf("Failed to find organization: %v", err)
+	}
+	return orgID
+}
+
+// Do sends a request to TestRouter as the holder of token, or anonymously
+// when it's empty, with payload as its JSON body unless nil, and returns the
+// status code and response body. An orgID acts in that organization, as the
+// X-Org-ID header does.
+func Do(t *testing.T, method, path, token string, payload interface{}, orgID ...string) (int, []byte) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			t.Fatalf("Failed to encode request: %v", err)
+		}
+	}
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if len(orgID) > 0 && orgID[0] != "" {
+		req.Header.Set("X-Org-ID", orgID[0])
+	}
+	w := httptest.NewRecorder()
+	TestRouter.ServeHTTP(w, req)
+	return w.Code, w.Body.Bytes()
+}
+
+// Decode reads a JSON object from a response body, nil if it isn't one.
+func Decode(body []byte) map[string]interface{} {
+	var resp map[string]interface{}
+	json.Unmarshal(body, &resp)
+	return resp
+}
+
+// AcceptInvitations accepts every invitation waiting for the holder of token.
+func AcceptInvitations(t *testing.T, token string) {
+	_, body := Do(t, "GET", "/api/invitations", token, nil)
+	var invitations []map[string]interface{}
+	json.Unmarshal(body, &invitations)
+	for _, i := range invitations {
+		code, _ := Do(t, "POST", fmt.Sprintf("/api/invitations/%.0f/accept", i["id"]), token, nil)
+		if code != http.StatusOK {
+			t.Fatalf("Failed to accept invitation %v: %d", i["id"], code)
+		}
+	}
+}
+
 // CreateTestTruck creates a truck and returns its ID.
 func CreateTestTruck(t *testing.T) string {
 	ctx := context.Background()
@@ -149,8 +427,32 @@ func CreateTestTruck(t *testing.T) string {
 	return id
 }
 
+// AssignTestTruck gives a driver account a driver profile and a truck of its
+// personal organization, so it can pick up shipments. Returns the truck ID.
+func AssignTestTruck(t *testing.T, driverID string) string {
+	ctx := context.Background()
+	orgID := OrgOf(t, driverID)
+	id := "truck-" + uuid.New().String()[:8]
+	_, err := db.Pool.Exec(ctx, "INSERT INTO trucks (id, plate_number, capacity_kg, org_id) VALUES ($1, $2, 10000, $3)", id, "TEST-"+id[6:], orgID)
+	if err == nil {
+		_, err = db.Pool.Exec(ctx, "INSERT INTO drivers (user_id, org_id, full_name) VALUES ($1, $2, 'Test Driver')", driverID, orgID)
+	}
+	if err == nil {
+		_, err = db.Pool.Exec(ctx, "INSERT INTO truck_assignments (truck_id, driver_id) VALUES ($1, $2)", id, driverID)
+	}
+	if err != nil {
+		t.Fatalf("Failed to assign test truck: %v", err)
+	}
+	return id
+}
+
 // CreateTestShipment creates a shipment for a truck and returns its ID.
 func CreateTestShipment(t *testing.T, truckID string, status string) string {
+	return CreateOrgShipment(t, truckID, status, "")
+}
+
+// CreateOrgShipment creates a shipment owned by an organization and returns its ID.
+func CreateOrgShipment(t *testing.T, truckID string, status string, orgID string) string {
 	ctx := context.Background()
 	id := uuid.New().String()
 	
@@ -161,9 +463,9 @@ func CreateTestShipment(t *testing.T, truckID string, status string) string {
 	}
 
 	_, err := db.Pool.Exec(ctx, `
-		INSERT INTO shipments (id, truck_id, origin_lat, origin_lon, dest_lat, dest_lon, status, completed_at)
-		VALUES ($1, $2, 0, 0, 10, 10, $3, $4)
-	`, id, truckID, status, completedAt)
+		INSERT INTO shipments (id, truck_id, origin_lat, origin_lon, dest_lat, dest_lon, status, completed_at, org_id)
+		VALUES ($1, $2, 0, 0, 10, 10, $3, $4, NULLIF($5, ''))
+	`, id, truckID, status, completedAt, orgID)
 	if err != nil {
 		t.Fatalf("Failed to create test shipment: %v", err)
 	}
@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"agri-track/internal/events"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSLATracking(t *testing.T) {
+	ClearDB(t)
+	ctx := context.Background()
+	farmerToken, farmerID := CreateTestAccount(t, "sla-farmer@test.com", "farmer")
+	orgID := OrgOf(t, farmerID)
+	_, driverID := CreateTestAccount(t, "sla-driver@test.com", "driver")
+	truckID := AssignTestTruck(t, driverID)
+	db.Pool.Exec(ctx, "UPDATE trucks SET plate_number='LAG-049' WHERE id=$1", truckID)
+
+	// onRoad puts a shipment from Kano to Lagos on the road, picked up at startedAt
+	onRoad := func(startedAt time.Time) string {
+		id := CreateOrgShipment(t, truckID, "IN_TRANSIT", orgID)
+		db.Pool.Exec(ctx, `
+			UPDATE shipments SET created_by=$2, started_at=$3, origin_place='Kano', dest_place='Lagos', commodity='maize' WHERE id=$1
+		`, id, farmerID, startedAt)
+		return id
+	}
+	deliver := func(id string, at time.Time) {
+		db.Pool.Exec(ctx, "UPDATE shipments SET status='DELIVERED', completed_at=$2 WHERE id=$1", id, at)
+		assert.NoError(t, TestSLA.TrackShipment(ctx, events.Event{Type: events.ShipmentDelivered, ShipmentID: id}))
+	}
+	slaOf := func(id string) (status, reason *string, delay *float64) {
+		db.Pool.QueryRow(ctx, "SELECT sla_status, delay_reason, delay_minutes FROM shipments WHERE id=$1", id).Scan(&status, &reason, &delay)
+		return
+	}
+
+	t.Run("Policies", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/sla/policies", farmerToken, map[string]interface{}{"name": "Default", "transit_hours": 48})
+		assert.Equal(t, http.StatusCreated, code)
+		code, _ = Do(t, "POST", "/api/sla/policies", farmerToken, map[string]interface{}{
+			"name": "Kano to Lagos", "origin_place": "Kano", "dest_place": "Lagos", "transit_hours": 24, "window_hours": 4,
+		})
+		assert.Equal(t, http.StatusCreated, code)
+
+		code, _ = Do(t, "POST", "/api/sla/policies", farmerToken, map[string]interface{}{"name": "Again", "transit_hours": 12})
+		assert.Equal(t, http.StatusConflict, code)
+		code, _ = Do(t, "POST", "/api/sla/policies", farmerToken, map[string]interface{}{"name": "Wide", "dest_place": "Ibadan", "transit_hours": 2, "window_hours": 3})
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, body := Do(t, "GET", "/api/sla/policies", farmerToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var policies []map[string]interface{}
+		json.Unmarshal(body, &policies)
+		assert.Len(t, policies, 2)
+
+		code, _ = Do(t, "DELETE", "/api/sla/policies/999", farmerToken, nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("Window At Pickup", func(t *testing.T) {
+		pickedUp := time.Now().Add(-time.Hour).Truncate(time.Second)
+		id := onRoad(pickedUp)
+		assert.NoError(t, TestSLA.TrackShipment(ctx, events.Event{Type: events.ShipmentPickedUp, ShipmentID: id}))
+
+		var from, by time.Time
+		db.Pool.QueryRow(ctx, "SELECT deliver_from, deliver_by FROM shipments WHERE id=$1", id).Scan(&from, &by)
+		assert.WithinDuration(t, pickedUp.Add(20*time.Hour), from, time.Second)
+		assert.WithinDuration(t, pickedUp.Add(24*time.Hour), by, time.Second)
+
+		deliver(id, pickedUp.Add(22*time.Hour))
+		status, reason, _ := slaOf(id)
+		assert.Equal(t, "on_time", *status)
+		assert.Nil(t, reason)
+	})
+
+	t.Run("Late With Reason", func(t *testing.T) {
+		start := time.Now().Add(-30 * time.Hour).Truncate(time.Second)
+		id := onRoad(start)
+		assert.NoError(t, TestSLA.TrackShipment(ctx, events.Event{Type: events.ShipmentPickedUp, ShipmentID: id}))
+		// Two hours stood still after a breakdown, twenty minutes in traffic
+		db.Pool.Exec(ctx, `
+			INSERT INTO logistics_events (time, truck_id, shipment_id, latitude, longitude, event_type, speed) VALUES
+				($3::timestamptz + INTERVAL '1 hour', $1, $2, 1, 1, 'moving', 60),
+				($3::timestamptz + INTERVAL '2 hours', $1, $2, 1, 1, 'moving', 0),
+				($3::timestamptz + INTERVAL '2 hours 20 minutes', $1, $2, 1, 1, 'moving', 0),
+				($3::timestamptz + INTERVAL '2 hours 40 minutes', $1, $2, 1, 1, 'moving', 0),
+				($3::timestamptz + INTERVAL '3 hours', $1, $2, 1, 1, 'moving', 0),
+				($3::timestamptz + INTERVAL '3 hours 20 minutes', $1, $2, 1, 1, 'moving', 0),
+				($3::timestamptz + INTERVAL '3 hours 40 minutes', $1, $2, 1, 1, 'moving', 0),
+				($3::timestamptz + INTERVAL '4 hours', $1, $2, 1, 1, 'moving', 0),
+				($3::timestamptz + INTERVAL '5 hours', $1, $2, 1, 1, 'moving', 2),
+				($3::timestamptz + INTERVAL '5 hours 20 minutes', $1, $2, 1, 1, 'moving', 2),
+				($3::timestamptz + INTERVAL '5 hours 30 minutes', $1, $2, 1, 1, 'moving', 50)
+		`, truckID, id, start)
+		db.Pool.Exec(ctx, `
+			INSERT INTO logistics_incidents (time, truck_id, shipment_id, latitude, longitude, incident_type, severity) VALUES
+				($3::timestamptz + INTERVAL '2 hours 5 minutes', $1, $2, 1, 1, 'BREAKDOWN', 4),
+				($3::timestamptz + INTERVAL '5 hours', $1, $2, 1, 1, 'TRAFFIC', 1)
+		`, truckID, id, start)
+
+		deliver(id, start.Add(27*time.Hour))
+		status, reason, delay := slaOf(id)
+		assert.Equal(t, "late", *status)
+		assert.Equal(t, "BREAKDOWN", *reason)
+		assert.InDelta(t, 180, *delay, 0.1)
+	})
+
+	t.Run("ETA Breach Alert", func(t *testing.T) {
+		id := onRoad(time.Now().Add(-time.Hour))
+		// Over 1,500 km still to go, due within the hour
+		db.Pool.Exec(ctx, "UPDATE shipments SET deliver_by=NOW() + INTERVAL '1 hour' WHERE id=$1", id)
+
+		n, err := TestSLA.CheckETAs(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		_, err = TestSLA.CheckETAs(ctx)
+		assert.NoError(t, err)
+		_, err = TestEvents.DispatchDue(ctx)
+		assert.NoError(t, err)
+		_, err = TestNotifications.SendDue(ctx)
+		assert.NoError(t, err)
+
+		var breaches int
+		db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM outbox_events WHERE shipment_id=$1 AND type=$2", id, events.ShipmentETABreach).Scan(&breaches)
+		assert.Equal(t, 1, breaches, "alerted once")
+
+		code, body := Do(t, "GET", "/api/notifications", farmerToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var messages []map[string]interface{}
+		json.Unmarshal(body, &messages)
+		if assert.Len(t, messages, 1) {
+			assert.Equal(t, "Running late: your maize", messages[0]["subject"])
+			assert.Contains(t, messages[0]["body"], "LAG-049 now expects to deliver your maize at ")
+		}
+
+		code, body = Do(t, "GET", "/api/dashboard/late-risk", farmerToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var risky []map[string]interface{}
+		json.Unmarshal(body, &risky)
+		if assert.Len(t, risky, 1) {
+			assert.Equal(t, id, risky[0]["id"])
+			assert.Greater(t, risky[0]["late_minutes"], 0.0)
+		}
+	})
+
+	t.Run("Dashboard", func(t *testing.T) {
+		code, body := Do(t, "GET", "/api/dashboard/summary?range=7d", farmerToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var summary map[string]interface{}
+		json.Unmarshal(body, &summary)
+		assert.Equal(t, 0.5, summary["on_time_rate"])
+		assert.Equal(t, 1.0, summary["late_risk_count"])
+	})
+
+	t.Run("Window Order Checked", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{
+			"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 8.6, "dest_lon": 4.6, "commodity": "yams",
+			"deliver_from": "2026-01-06T12:00:00Z", "deliver_by": "2026-01-06T10:00:00Z",
+		})
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"agri-track/internal/smscommand"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSMSCommands(t *testing.T) {
+	ClearDB(t)
+	router := TestRouter
+	ctx := context.Background()
+	farmerToken, _ := CreateTestAccount(t, "smscmd-farmer@test.com", "farmer")
+	_, driverID := CreateTestAccount(t, "smscmd-driver@test.com", "driver")
+	truckID := AssignTestTruck(t, driverID)
+	phone := "+2348030000045"
+	db.Pool.Exec(ctx, "UPDATE users SET phone=$2 WHERE id=$1", driverID, phone)
+
+	payload, _ := json.Marshal(map[string]interface{}{"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 8.6, "dest_lon": 4.6})
+	req, _ := http.NewRequest("POST", "/api/shipments", bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", "Bearer "+farmerToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var created map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	shipmentID := created["id"].(string)
+
+	text := func(id, from, body string) string {
+		form := url.Values{"id": {id}, "from": {from}, "to": {"12345"}, "text": {body}}
+		req, _ := http.NewRequest("POST", "/sms/inbound?token=test-sms-token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	send := func(body string) string {
+		return text(uuid.New().String(), phone, body)
+	}
+
+	t.Run("Senders", func(t *testing.T) {
+		texts := len(TestSMS.Messages())
+		assert.Equal(t, "Ignored", text(uuid.New().String(), "+2348039999999", "PICKUP AG-123456"))
+		assert.Len(t, TestSMS.Messages(), texts, "strangers get no reply")
+
+		// A number typed into a driver profile isn't proof of who is texting
+		db.Pool.Exec(ctx, "UPDATE drivers SET phone='+2348039999998' WHERE user_id=$1", driverID)
+		assert.Equal(t, "Ignored", text(uuid.New().String(), "+2348039999998", "PICKUP AG-123456"))
+
+		reply := send("hello")
+		assert.True(t, strings.HasPrefix(reply, `Sorry, unknown command "hello". Send INC`), reply)
+		last, _ := TestSMS.Last(phone)
+		assert.Equal(t, reply, last.Body)
+
+		reply = text(uuid.New().String(), "08030000045", "help")
+		assert.Equal(t, smscommand.Usage, reply, "local format of the same number")
+	})
+
+	t.Run("Pickup", func(t *testing.T) {
+		assert.Equal(t, "Invalid pickup code AG-ZZZZZZ.", send("PICKUP AG-ZZZZZZ"))
+
+		code := strings.TrimPrefix(created["pickup_code"].(string), "AG-")
+		id := uuid.New().String()
+		reply := text(id, phone, "pickup "+strings.ToLower(code))
+		assert.Equal(t, "Picked up shipment "+shipmentID[:8]+". Send ARRIVED "+shipmentID[:8]+" at the destination.", reply)
+		assert.Equal(t, "Duplicate", text(id, phone, "pickup "+code), "retried callbacks are dropped")
+
+		var status, carrier string
+		db.Pool.QueryRow(ctx, "SELECT status, truck_id FROM shipments WHERE id=$1", shipmentID).Scan(&status, &carrier)
+		assert.Equal(t, "IN_TRANSIT", status)
+		assert.Equal(t, truckID, carrier)
+	})
+
+	t.Run("Incident", func(t *testing.T) {
+		assert.True(t, strings.HasPrefix(send("INC BREAKDOWN 7"), "Sorry, severity must be 1 to 5. Send INC"))
+
+		reply := send("INC BREAKDOWN 3 flat tyre")
+		assert.Equal(t, "Reported a breakdown (severity 3) on shipment "+shipmentID[:8]+". Stay safe.", reply)
+
+		var incidentType, description string
+		var severity int
+		var lat float64
+		err := db.Pool.QueryRow(ctx, `
+			SELECT incident_type, description, severity, latitude FROM logistics_incidents WHERE shipment_id=$1
+		`, shipmentID).Scan(&incidentType, &description, &severity, &lat)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "BREAKDOWN", incidentType)
+			assert.Equal(t, "flat tyre", description)
+			assert.Equal(t, 3, severity)
+			assert.Equal(t, 8.5, lat, "without a position the pickup point is used")
+		}
+	})
+
+	t.Run("Arrived", func(t *testing.T) {
+		assert.Equal(t, "Your truck's position is unknown, confirm arrival in the app.", send("ARRIVED"))
+		assert.Equal(t, "No shipment ffffffff on your truck.", send("ARRIVED ffffffff"))
+
+		db.Pool.Exec(ctx, `
+			INSERT INTO logistics_events (time, truck_id, shipment_id, latitude, longitude, event_type, speed)
+			VALUES (NOW() - INTERVAL '10 minutes', $1, $2, 8.5, 4.55, 'moving', 40)
+		`, truckID, shipmentID)
+		assert.Contains(t, send("ARRIVED "+shipmentID[:8]), "Your truck was last seen 12.4 km away")
+
+		db.Pool.Exec(ctx, `
+			INSERT INTO logistics_events (time, truck_id, shipment_id, latitude, longitude, event_type, speed)
+			VALUES (NOW(), $1, $2, 8.6, 4.6, 'stopped', 0)
+		`, truckID, shipmentID)
+		assert.Equal(t, "Arrival confirmed for shipment "+shipmentID[:8]+". Hand over the goods and complete the delivery.", send("ARRIVED "+shipmentID[:8]))
+	})
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiStopShipment(t *testing.T) {
+	ClearDB(t)
+	farmerToken, _ := CreateTestAccount(t, "stops-farmer@test.com", "farmer")
+	driverToken, driverID := CreateTestAccount(t, "stops-driver@test.com", "driver")
+	truckID := AssignTestTruck(t, driverID)
+
+	// Two farms outside Ilorin, then two market stalls in town
+	stops := []map[string]interface{}{
+		{"kind": "pickup", "lat": 8.40, "lon": 4.50, "name": "Farm A", "quantity_kg": 800},
+		{"kind": "pickup", "lat": 8.45, "lon": 4.60, "name": "Farm B", "quantity_kg": 1200},
+		{"kind": "dropoff", "lat": 8.49, "lon": 4.55, "name": "Oja Oba stall", "quantity_kg": 1500},
+		{"kind": "dropoff", "lat": 8.50, "lon": 4.57, "name": "Ipata stall", "quantity_kg": 500},
+	}
+
+	t.Run("Invalid Stops Rejected", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{"stops": []map[string]interface{}{stops[2], stops[0]}})
+		assert.Equal(t, http.StatusBadRequest, code, "must start with a pickup")
+
+		code, _ = Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{"stops": []map[string]interface{}{stops[0], stops[2]}})
+		assert.Equal(t, http.StatusBadRequest, code, "drops more than it picked up")
+	})
+
+	code, body := Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{"stops": stops})
+	created := Decode(body)
+	assert.Equal(t, http.StatusCreated, code)
+	shipmentID := created["id"].(string)
+	assert.Equal(t, 1.0, created["current_stop_seq"])
+
+	stopStatus := func() (float64, []string) {
+		_, body := Do(t, "GET", "/api/shipments/"+shipmentID+"/stops", farmerToken, nil)
+		resp := Decode(body)
+		var statuses []string
+		for _, s := range resp["stops"].([]interface{}) {
+			statuses = append(statuses, s.(map[string]interface{})["status"].(string))
+		}
+		return resp["current_stop_seq"].(float64), statuses
+	}
+	ping := func(lat, lon float64) map[string]interface{} {
+		code, body := Do(t, "POST", "/api/telemetry", driverToken, map[string]interface{}{
+			"truck_id": truckID, "shipment_id": shipmentID, "latitude": lat, "longitude": lon, "event_type": "moving", "speed": 30,
+		})
+		assert.Equal(t, http.StatusAccepted, code)
+		return Decode(body)
+	}
+
+	t.Run("Pickup Arrives At First Stop", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": created["pickup_code"].(string)})
+		assert.Equal(t, http.StatusOK, code)
+
+		code, _ = Do(t, "POST", "/api/shipments/"+shipmentID+"/stops/2/complete", driverToken, nil)
+		assert.Equal(t, http.StatusConflict, code, "stops go in order")
+
+		code, body := Do(t, "POST", "/api/shipments/"+shipmentID+"/stops/1/complete", driverToken, nil)
+		resp := Decode(body)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 2.0, resp["current_stop_seq"])
+	})
+
+	t.Run("Geofence Advances Stops", func(t *testing.T) {
+		resp := ping(8.4501, 4.6001)
+		assert.Equal(t, true, resp["at_stop"])
+
+		resp = ping(8.47, 4.58)
+		assert.Equal(t, 3.0, resp["current_stop_seq"])
+		assert.Equal(t, false, resp["at_stop"])
+
+		current, statuses := stopStatus()
+		assert.Equal(t, 3.0, current)
+		assert.Equal(t, []string{"COMPLETED", "COMPLETED", "PENDING", "PENDING"}, statuses)
+	})
+
+	t.Run("Verify Arrival At Stop", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments/"+shipmentID+"/stops/3/complete", driverToken, nil)
+		assert.Equal(t, http.StatusConflict, code, "arrival not verified")
+
+		code, _ = Do(t, "POST", "/api/shipments/verify", driverToken, map[string]interface{}{"shipment_id": shipmentID, "lat": 8.50, "lon": 4.57})
+		assert.Equal(t, http.StatusBadRequest, code, "at the wrong stall")
+		code, _ = Do(t, "POST", "/api/shipments/verify", driverToken, map[string]interface{}{"shipment_id": shipmentID, "lat": 8.4963, "lon": 4.55})
+		assert.Equal(t, http.StatusBadRequest, code, "700m off is outside the stop geofence")
+
+		code, body := Do(t, "POST", "/api/shipments/verify", driverToken, map[string]interface{}{"shipment_id": shipmentID, "lat": 8.4901, "lon": 4.5501})
+		resp := Decode(body)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 3.0, resp["stop_seq"])
+
+		code, _ = Do(t, "POST", "/api/shipments/"+shipmentID+"/stops/3/complete", driverToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("Last Stop Delivers", func(t *testing.T) {
+		code, body := Do(t, "POST", "/api/shipments/"+shipmentID+"/stops/4/complete", driverToken, map[string]interface{}{"skipped": true})
+		resp := Decode(body)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "DELIVERED", resp["status"])
+
+		_, statuses := stopStatus()
+		assert.Equal(t, []string{"COMPLETED", "COMPLETED", "COMPLETED", "SKIPPED"}, statuses)
+	})
+}
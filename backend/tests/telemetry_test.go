@@ -1,8 +1,10 @@
 package tests
 
 import (
+	"agri-track/internal/db"
 	"agri-track/internal/models"
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -89,3 +91,70 @@ func TestTelemetryEndpoint(t *testing.T) {
 		assert.Equal(t, http.StatusUnauthorized, w.Code)
 	})
 }
+
+func TestTelemetryTruckScope(t *testing.T) {
+	ClearDB(t)
+	router := TestRouter
+	driverToken, driverID := CreateTestAccount(t, "scope-driver@test.com", "driver")
+	truckID := AssignTestTruck(t, driverID)
+	shipmentID := CreateOrgShipment(t, truckID, "IN_TRANSIT", OrgOf(t, driverID))
+	otherToken, otherID := CreateTestAccount(t, "scope-other@test.com", "driver")
+	otherTruckID := AssignTestTruck(t, otherID)
+	otherShipmentID := CreateOrgShipment(t, otherTruckID, "IN_TRANSIT", OrgOf(t, otherID))
+
+	fix := func(truck, shipment string) models.LogisticsEvent {
+		return models.LogisticsEvent{TruckID: truck, ShipmentID: shipment, Latitude: 5, Longitude: 5, EventType: "moving", Speed: 40, Time: time.Now()}
+	}
+	incident := func(truck, shipment string) map[string]interface{} {
+		return map[string]interface{}{"truck_id": truck, "shipment_id": shipment, "latitude": 5, "longitude": 5,
+			"incident_type": "TRAFFIC", "description": "Jam", "severity": 1}
+	}
+
+	t.Run("Fixes", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/telemetry", driverToken, fix(truckID, shipmentID))
+		assert.Equal(t, http.StatusAccepted, code)
+		// Another organization's truck on our own shipment
+		code, _ = Do(t, "POST", "/api/telemetry", otherToken, fix(truckID, otherShipmentID))
+		assert.Equal(t, http.StatusForbidden, code)
+		code, _ = Do(t, "POST", "/api/telemetry", otherToken, fix(truckID, shipmentID))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		// The accepted fix is published with the rest of its batch
+		assert.Eventually(t, func() bool {
+			var fixes int
+			db.Pool.QueryRow(context.Background(), `
+				SELECT COALESCE(SUM((data->>'fixes')::int), 0) FROM outbox_events WHERE type='telemetry.accepted' AND shipment_id=$1
+			`, shipmentID).Scan(&fixes)
+			return fixes == 1
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("Incidents", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/telemetry/incident", driverToken, incident(truckID, shipmentID))
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = Do(t, "POST", "/api/telemetry/incident", otherToken, incident(truckID, otherShipmentID))
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("Listed Without A Shipment", func(t *testing.T) {
+		db.Pool.Exec(context.Background(), `
+			INSERT INTO logistics_incidents (time, truck_id, latitude, longitude, incident_type, severity)
+			VALUES (NOW(), $1, 5, 5, 'BREAKDOWN', 3)
+		`, truckID)
+		types := func(token string) []string {
+			req, _ := http.NewRequest("GET", "/api/incidents", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			var incidents []map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &incidents)
+			var list []string
+			for _, i := range incidents {
+				list = append(list, i["incident_type"].(string))
+			}
+			return list
+		}
+		assert.ElementsMatch(t, []string{"TRAFFIC", "BREAKDOWN"}, types(driverToken))
+		assert.Empty(t, types(otherToken))
+	})
+}
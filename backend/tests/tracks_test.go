@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShipmentTrack(t *testing.T) {
+	ClearDB(t)
+	farmerToken, _ := CreateTestAccount(t, "track-farmer@test.com", "farmer")
+	otherToken, _ := CreateTestAccount(t, "track-other@test.com", "farmer")
+	_, driverID := CreateTestAccount(t, "track-driver@test.com", "driver")
+	truckID := AssignTestTruck(t, driverID)
+
+	_, body := Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{
+		"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 9.1333, "dest_lon": 4.8333,
+	})
+	created := Decode(body)
+	shipmentID := created["id"].(string)
+
+	start := time.Now().Add(-10 * time.Minute)
+	for i := 0; i < 3; i++ {
+		_, err := db.Pool.Exec(context.Background(), `
+			INSERT INTO logistics_events (time, truck_id, shipment_id, latitude, longitude, event_type, speed)
+			VALUES ($1, $2, $3, $4, $5, 'moving', 40)
+		`, start.Add(time.Duration(i)*time.Minute), truckID, shipmentID, 8.5+float64(i)*0.01, 4.55+float64(i)*0.005)
+		assert.NoError(t, err)
+	}
+
+	t.Run("Raw Track", func(t *testing.T) {
+		code, body := Do(t, "GET", "/api/shipments/"+shipmentID+"/track", farmerToken, nil)
+		resp := Decode(body)
+		assert.Equal(t, http.StatusOK, code)
+		fixes := resp["fixes"].([]interface{})
+		assert.Len(t, fixes, 3)
+		assert.Equal(t, 8.5, fixes[0].(map[string]interface{})["lat"])
+		assert.Nil(t, fixes[0].(map[string]interface{})["matched_lat"])
+		assert.Nil(t, resp["matched"])
+
+		code, _ = Do(t, "GET", "/api/shipments/"+shipmentID+"/track", otherToken, nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("Matching Needs A Road Network", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments/"+shipmentID+"/track/match", farmerToken, nil)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+	})
+}
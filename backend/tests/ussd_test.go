@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"agri-track/internal/db"
+	"agri-track/internal/middleware"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactQuery(t *testing.T) {
+	assert.Equal(t, "/ussd?token=REDACTED", middleware.RedactQuery("/ussd?token=secret", "token"))
+	assert.Equal(t, "/sms/inbound?a=1&token=REDACTED&tokens=2", middleware.RedactQuery("/sms/inbound?a=1&token=secret&tokens=2", "token"))
+	assert.Equal(t, "/ussd", middleware.RedactQuery("/ussd", "token"))
+}
+
+func TestUSSD(t *testing.T) {
+	ClearDB(t)
+	router := TestRouter
+	ctx := context.Background()
+	_, farmerID := CreateTestAccount(t, "ussd-farmer@test.com", "farmer")
+	phone := "+2348030000044"
+	db.Pool.Exec(ctx, "UPDATE users SET phone=$2 WHERE id=$1", farmerID, phone)
+	orgID := OrgOf(t, farmerID)
+	db.Pool.Exec(ctx, "INSERT INTO locations (id, org_id, name, latitude, longitude) VALUES ($1, $2, 'Farm', 8.5, 4.55)", uuid.New().String(), orgID)
+	db.Pool.Exec(ctx, "INSERT INTO locations (id, org_id, name, latitude, longitude) VALUES ($1, $2, 'Market', 8.6, 4.6)", uuid.New().String(), orgID)
+
+	dial := func(token, from, text string) (int, string) {
+		form := url.Values{"sessionId": {"ATUid_test"}, "serviceCode": {"*384*123#"}, "phoneNumber": {from}, "text": {text}}
+		req, _ := http.NewRequest("POST", "/ussd?token="+token, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	session := func(text string) string {
+		code, body := dial("test-ussd-token", phone, text)
+		assert.Equal(t, http.StatusOK, code)
+		return body
+	}
+
+	t.Run("Callers", func(t *testing.T) {
+		code, _ := dial("wrong", phone, "")
+		assert.Equal(t, http.StatusForbidden, code)
+		_, body := dial("test-ussd-token", "+2348039999999", "")
+		assert.True(t, strings.HasPrefix(body, "END This number is not registered"))
+		assert.True(t, strings.HasPrefix(session(""), "CON Welcome to AgriTrack"))
+		_, body = dial("test-ussd-token", "08030000044", "")
+		assert.True(t, strings.HasPrefix(body, "CON Welcome to AgriTrack"), "local format of the same number")
+		assert.Equal(t, "END Invalid choice. Please dial again.", session("9"))
+	})
+
+	t.Run("Create Shipment", func(t *testing.T) {
+		assert.Equal(t, "CON Pick up from:\n1. Farm\n2. Market", session("1"))
+		assert.Equal(t, "CON Deliver to:\n1. Farm\n2. Market", session("1*1*0*2"), "0 goes back")
+		assert.Equal(t, "CON Send yams from Farm to Market?\n1. Confirm\n2. Cancel", session("1*1*2*yams"))
+		assert.Equal(t, "END Cancelled.", session("1*1*2*yams*2"))
+
+		body := session("1*1*2*yams*1")
+		assert.True(t, strings.HasPrefix(body, "END Shipment created. Pickup code: "), body)
+
+		var commodity, pickupCode string
+		var originLat, destLat float64
+		err := db.Pool.QueryRow(ctx, `
+			SELECT commodity, pickup_code, origin_lat, dest_lat FROM shipments WHERE created_by=$1 AND org_id=$2
+		`, farmerID, orgID).Scan(&commodity, &pickupCode, &originLat, &destLat)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "yams", commodity)
+			assert.Equal(t, 8.5, originLat)
+			assert.Equal(t, 8.6, destLat)
+			assert.Contains(t, body, pickupCode)
+		}
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		assert.Equal(t, "END Your shipments:\n1. yams to Market: waiting for pickup", session("2"))
+	})
+
+	t.Run("Pickup Code", func(t *testing.T) {
+		var pickupCode string
+		db.Pool.QueryRow(ctx, "SELECT pickup_code FROM shipments WHERE created_by=$1", farmerID).Scan(&pickupCode)
+		assert.True(t, strings.HasPrefix(session("3"), "CON Which shipment?\n1. yams to Market, "))
+		assert.True(t, strings.HasPrefix(session("3*1"), "END Pickup code for yams to Market: "+pickupCode+", valid until "))
+
+		// An expired code is replaced rather than read back
+		db.Pool.Exec(ctx, "UPDATE shipments SET pickup_code_expires_at = NOW() - INTERVAL '1 minute' WHERE created_by=$1", farmerID)
+		body := session("3*1")
+		var fresh string
+		db.Pool.QueryRow(ctx, "SELECT pickup_code FROM shipments WHERE created_by=$1", farmerID).Scan(&fresh)
+		assert.NotEqual(t, pickupCode, fresh)
+		assert.Contains(t, body, ": "+fresh+", valid until ")
+	})
+}
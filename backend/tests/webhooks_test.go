@@ -0,0 +1,212 @@
+package tests
+
+import (
+	"agri-track/internal/webhook"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	ClearDB(t)
+	ctx := context.Background()
+	farmerToken, _ := CreateTestAccount(t, "hooks-farmer@test.com", "farmer")
+	otherToken, _ := CreateTestAccount(t, "hooks-other@test.com", "farmer")
+	driverToken, driverID := CreateTestAccount(t, "hooks-driver@test.com", "driver")
+	truckID := AssignTestTruck(t, driverID)
+
+	receiver := webhook.NewReceiver("")
+	defer receiver.Close()
+
+	deliveries := func(subID, query string) []map[string]interface{} {
+		code, body := Do(t, "GET", "/api/webhooks/"+subID+"/deliveries"+query, farmerToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var resp []map[string]interface{}
+		json.Unmarshal(body, &resp)
+		return resp
+	}
+	deliverAll := func() {
+		_, err := TestEvents.DispatchDue(ctx)
+		assert.NoError(t, err)
+		_, err = TestWebhooks.DeliverDue(ctx)
+		assert.NoError(t, err)
+	}
+
+	var subID string
+	t.Run("Subscribe", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/webhooks", farmerToken, map[string]interface{}{
+			"url": "ftp://erp.example.com", "event_types": []string{webhook.ShipmentDelivered},
+		})
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = Do(t, "POST", "/api/webhooks", farmerToken, map[string]interface{}{
+			"url": receiver.URL(), "event_types": []string{"shipment.lost"},
+		})
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, body := Do(t, "POST", "/api/webhooks", farmerToken, map[string]interface{}{
+			"url":         receiver.URL(),
+			"event_types": []string{webhook.ShipmentPickedUp, webhook.ShipmentDelivered, webhook.IncidentReported},
+		})
+		assert.Equal(t, http.StatusCreated, code)
+		var sub map[string]interface{}
+		json.Unmarshal(body, &sub)
+		subID = sub["id"].(string)
+		receiver.SetSecret(sub["secret"].(string))
+
+		code, body = Do(t, "GET", "/api/webhooks", farmerToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var subs []map[string]interface{}
+		json.Unmarshal(body, &subs)
+		if assert.Len(t, subs, 1) {
+			assert.Nil(t, subs[0]["secret"], "secrets are only shown once")
+		}
+	})
+
+	_, body := Do(t, "POST", "/api/shipments", farmerToken, map[string]interface{}{
+		"origin_lat": 8.5, "origin_lon": 4.55, "dest_lat": 8.6, "dest_lon": 4.6,
+	})
+	var created map[string]interface{}
+	json.Unmarshal(body, &created)
+	shipmentID := created["id"].(string)
+
+	t.Run("Signed Delivery", func(t *testing.T) {
+		code, _ := Do(t, "POST", "/api/shipments/pickup", driverToken, map[string]string{"pickup_code": created["pickup_code"].(string)})
+		assert.Equal(t, http.StatusOK, code)
+		deliverAll()
+
+		received := receiver.Received()
+		if assert.Len(t, received, 1) {
+			assert.Equal(t, webhook.ShipmentPickedUp, received[0].Event)
+			assert.True(t, received[0].Valid)
+			var payload map[string]interface{}
+			json.Unmarshal(received[0].Payload, &payload)
+			data := payload["data"].(map[string]interface{})
+			assert.Equal(t, shipmentID, data["shipment_id"])
+			assert.Equal(t, truckID, data["truck_id"])
+		}
+		assert.Equal(t, "delivered", deliveries(subID, "")[0]["status"])
+	})
+
+	t.Run("Retried After A Failure", func(t *testing.T) {
+		receiver.FailNext(1)
+		code, _ := Do(t, "POST", "/api/handshake", driverToken, map[string]string{"shipment_id": shipmentID})
+		assert.Equal(t, http.StatusOK, code)
+
+		deliverAll()
+		failed := deliveries(subID, "?status=pending")
+		if assert.Len(t, failed, 1) {
+			assert.Equal(t, webhook.ShipmentDelivered, failed[0]["event_type"])
+			assert.Equal(t, float64(1), failed[0]["attempts"])
+			assert.Equal(t, float64(500), failed[0]["last_status_code"])
+		}
+
+		deliverAll()
+		code, body := Do(t, "GET", "/api/webhooks/"+subID+"/deliveries/"+failed[0]["id"].(string), farmerToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		var delivery map[string]interface{}
+		json.Unmarshal(body, &delivery)
+		assert.Equal(t, "delivered", delivery["status"])
+		assert.Len(t, delivery["log"], 2)
+
+		received := receiver.Received()
+		assert.Equal(t, received[1].ID, received[2].ID, "retries keep the delivery ID")
+	})
+
+	t.Run("Dead Letter And Redelivery", func(t *testing.T) {
+		receiver.FailNext(3)
+		code, _ := Do(t, "POST", "/api/telemetry/incident", driverToken, map[string]interface{}{
+			"truck_id": truckID, "shipment_id": shipmentID, "latitude": 8.55, "longitude": 4.57,
+			"incident_type": "BREAKDOWN", "description": "Flat tyre", "severity": 2,
+		})
+		assert.Equal(t, http.StatusOK, code)
+		for i := 0; i < 3; i++ {
+			deliverAll()
+		}
+
+		dead := deliveries(subID, "?status=dead")
+		if !assert.Len(t, dead, 1) {
+			return
+		}
+		assert.Equal(t, webhook.IncidentReported, dead[0]["event_type"])
+		deliveryID := dead[0]["id"].(string)
+
+		code, _ = Do(t, "POST", "/api/webhooks/"+subID+"/deliveries/"+deliveryID+"/redeliver", otherToken, nil)
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = Do(t, "POST", "/api/webhooks/"+subID+"/deliveries/"+deliveryID+"/redeliver", farmerToken, nil)
+		assert.Equal(t, http.StatusAccepted, code)
+		deliverAll()
+		assert.Empty(t, deliveries(subID, "?status=dead"))
+		assert.Equal(t, webhook.IncidentReported, receiver.Received()[len(receiver.Received())-1].Event)
+	})
+
+	t.Run("Delivery Log", func(t *testing.T) {
+		assert.Len(t, deliveries(subID, ""), 3)
+
+		code, body := Do(t, "GET", "/api/webhooks/"+subID+"/deliveries", otherToken, nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.JSONEq(t, "[]", string(body))
+	})
+
+	t.Run("Backoff", func(t *testing.T) {
+		cfg := webhook.Config{BaseDelay: 30 * time.Second, MaxDelay: 10 * time.Minute}
+		assert.Equal(t, 30*time.Second, cfg.Backoff(1))
+		assert.Equal(t, 2*time.Minute, cfg.Backoff(3))
+		assert.Equal(t, 10*time.Minute, cfg.Backoff(20))
+	})
+}
+
+func TestWebhookPrivateAddresses(t *testing.T) {
+	receiver := webhook.NewReceiver("whsec_test")
+	defer receiver.Close()
+	cfg := webhook.Config{Timeout: 2 * time.Second}
+	d := webhook.Delivery{ID: "d1", Secret: "whsec_test", Event: webhook.ShipmentDelivered, Payload: []byte(`{}`)}
+
+	t.Run("Subscription URLs", func(t *testing.T) {
+		for _, raw := range []string{
+			"http://127.0.0.1:8080/hook",
+			"http://localhost/hook",
+			"http://10.1.2.3/hook",
+			"http://192.168.0.10/hook",
+			"http://169.254.169.254/latest/meta-data",
+			"http://[::1]/hook",
+			"http://[::ffff:10.0.0.1]/hook",
+			"http://0.0.0.0/hook",
+			"http://100.64.0.1/hook",
+		} {
+			assert.False(t, cfg.ValidURL(raw), raw)
+		}
+		assert.True(t, cfg.ValidURL("https://erp.example.com/hooks"))
+		assert.True(t, cfg.ValidURL("http://203.0.113.10/hooks"))
+		assert.True(t, webhook.Config{AllowPrivate: true}.ValidURL(receiver.URL()))
+	})
+
+	t.Run("Not Dialed", func(t *testing.T) {
+		client := webhook.NewClient(cfg)
+		// Only resolved when dialing, like a name rebound after subscribing
+		byName := strings.Replace(receiver.URL(), "127.0.0.1", "localhost", 1)
+		for _, url := range []string{receiver.URL(), byName} {
+			d.URL = url
+			r := client.Send(context.Background(), d)
+			assert.False(t, r.OK())
+			assert.Equal(t, 0, r.StatusCode)
+			assert.Contains(t, r.Error, webhook.ErrPrivateAddress.Error())
+		}
+		assert.Empty(t, receiver.Received())
+	})
+
+	t.Run("Redirects Not Followed", func(t *testing.T) {
+		redirect := httptest.NewServer(http.RedirectHandler(receiver.URL(), http.StatusTemporaryRedirect))
+		defer redirect.Close()
+		d.URL = redirect.URL
+		r := webhook.NewClient(webhook.Config{Timeout: 2 * time.Second, AllowPrivate: true}).Send(context.Background(), d)
+		assert.False(t, r.OK())
+		assert.Equal(t, http.StatusTemporaryRedirect, r.StatusCode)
+		assert.Empty(t, receiver.Received())
+	})
+}
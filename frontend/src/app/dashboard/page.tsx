@@ -157,14 +157,13 @@ export default function DashboardPage() {
   const handleGenerateReport = async () => {
     setLoadingReport(true);
     try {
-      await new Promise(resolve => setTimeout(resolve, 2000));
       const result = await generateReportAction();
       if (result.success && result.report) {
         setReport(result.report);
         setIsModalOpen(true);
         toast.success("Report Generated!");
       } else {
-        toast.error("Failed to generate report");
+        toast.error(result.error || "Failed to generate report");
       }
     } catch (error) {
       toast.error("An error occurred");
@@ -232,7 +231,7 @@ export default function DashboardPage() {
                 >
                     <div style={{ display: 'flex', alignItems: 'center', gap: '8px', justifyContent: 'center' }}>
                         <Sparkles size={18} />
-                        <span>Generate AI Report</span>
+                        <span>Generate Fleet Report</span>
                     </div>
                 </AIReportButton>
             </div>
@@ -126,7 +126,7 @@ const Select = styled.select`
 export default function AuthCard() {
   const router = useRouter();
   const [isLogin, setIsLogin] = useState(true);
-  const [role, setRole] = useState('DEPOT_MANAGER');
+  const [role, setRole] = useState('FARMER');
   const [loading, setLoading] = useState(false);
   const [showPassword, setShowPassword] = useState(false);
   const [showConfirmPassword, setShowConfirmPassword] = useState(false);
@@ -254,9 +254,10 @@ export default function AuthCard() {
         <InputGroup>
           <Label>I am a...</Label>
           <Select value={role} onChange={(e) => setRole(e.target.value)}>
-            <option value="DEPOT_MANAGER">Depot Manager</option>
-            <option value="DRIVER">Driver</option>
             <option value="FARMER">Farmer</option>
+            <option value="DRIVER">Driver</option>
+            {/* Depot managers are made by their organization's owner */}
+            {isLogin && <option value="DEPOT_MANAGER">Depot Manager</option>}
           </Select>
         </InputGroup>
 